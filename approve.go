@@ -0,0 +1,100 @@
+package mysqlreplace
+
+import (
+	"strings"
+	"time"
+)
+
+// RowChange is a row with replacements, passed to Replacer.Approve before it
+// is written. Key identifies the row as in the audit file.
+type RowChange struct {
+	Table   string
+	Key     string
+	Columns []ColumnChange
+}
+
+// ColumnChange is one changed column of a RowChange. Null is set, and
+// NewValue empty, when the column is to be set to NULL.
+type ColumnChange struct {
+	Column   string
+	OldValue string
+	NewValue string
+	Null     bool
+}
+
+// Excerpts returns the old and new values cut down to the changed region
+// and context characters either side of it.
+func (c ColumnChange) Excerpts(context int) (string, string) {
+	return logChange(c.OldValue, c.NewValue, Config{LogContext: context})
+}
+
+// Diff returns the change as a one-line inline diff, marking removed text
+// [-...-] and added text {+...+}, with context characters around each
+// change. Newlines and tabs are shown escaped.
+func (c ColumnChange) Diff(context int) string {
+	return diffEscaper.Replace(diffValues(c.OldValue, c.NewValue, context))
+}
+
+// MarkedExcerpts is Excerpts with the changed region of each value passed
+// through mark, such as to color it on a terminal. A negative context keeps
+// the whole values.
+func (c ColumnChange) MarkedExcerpts(context int, mark func(string) string) (string, string) {
+	prefix, suffix := commonAffixes(c.OldValue, c.NewValue)
+	if context < 0 {
+		context = len(c.OldValue) + len(c.NewValue)
+	}
+	return markedExcerpt(c.OldValue, prefix, len(c.OldValue)-suffix, context, mark),
+		markedExcerpt(c.NewValue, prefix, len(c.NewValue)-suffix, context, mark)
+}
+
+// MarkedDiff is Diff with removed and added text passed through removed and
+// added rather than bracketed.
+func (c ColumnChange) MarkedDiff(context int, removed, added func(string) string) string {
+	return diffEscaper.Replace(markedDiff(c.OldValue, c.NewValue, context, removed, added))
+}
+
+var diffEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// Approval is Replacer.Approve's answer for a row.
+type Approval int
+
+const (
+	// ApplyRow writes the row's changes.
+	ApplyRow Approval = iota
+	// SkipRow leaves the row as it is.
+	SkipRow
+	// ApplyTable writes the row and the rest of the table without asking.
+	ApplyTable
+	// QuitRun leaves the row as it is and ends the run: the rows of the
+	// table approved so far are still written, later tables are not started.
+	QuitRun
+)
+
+// approveRow asks config.approve about a changed row and reports whether to
+// write it.
+func (j *tableJob) approveRow(columnsList []string, values []interface{}, changes []auditChange) bool {
+	if j.approveAll {
+		return true
+	}
+	row := RowChange{Table: j.table, Key: auditRowKey(columnsList, values, j.primaryKey)}
+	for _, change := range changes {
+		row.Columns = append(row.Columns, ColumnChange{Column: change.Column, OldValue: change.OldValue, NewValue: change.NewValue, Null: change.Null})
+	}
+	// The prompt must not be drawn over by the progress line.
+	stderrStatus.clearStatus()
+	asked := time.Now()
+	answer := j.config.approve(j.ctx, row)
+	j.result.prompted += time.Since(asked)
+	switch answer {
+	case ApplyRow:
+		return true
+	case ApplyTable:
+		j.log.Info("applying the rest of the table without asking")
+		j.approveAll = true
+		return true
+	case QuitRun:
+		j.log.Info("quitting at the approval prompt")
+		j.result.Quit = true
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditWriter appends one CSV record per changed column to the -audit-csv
+// file. Records are flushed after every row so an interrupted run still
+// leaves a usable audit.
+type auditWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *csv.Writer
+	err  error
+}
+
+var auditHeader = []string{"time", "action", "table", "row_key", "column", "old_value", "new_value", "values_changed", "occurrences"}
+
+// auditChange is one changed column. Null is set when the column is set to
+// NULL, which the audit file writes as \N. Values is the number of values
+// the change counts as, more than one for a JSON document, and Occurrences
+// the number of occurrences replaced.
+type auditChange struct {
+	Column      string
+	OldValue    string
+	NewValue    string
+	Null        bool
+	Values      int
+	Occurrences int
+}
+
+func createAuditWriter(path string) (*auditWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	aw := &auditWriter{file: file, w: csv.NewWriter(file)}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		if err := checkAuditHeader(path); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		aw.w.Write(auditHeader)
+		aw.w.Flush()
+		if err := aw.w.Error(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return aw, nil
+}
+
+// checkAuditHeader refuses to append to an audit file whose header is not
+// the current one, such as one written by an older version with fewer
+// columns.
+func checkAuditHeader(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, err := csv.NewReader(file).Read()
+	if err != nil {
+		return fmt.Errorf("%s is not an audit file: %w", path, err)
+	}
+	if strings.Join(header, ",") != strings.Join(auditHeader, ",") {
+		return fmt.Errorf("%s has the columns %s, not %s; write the audit to a new file", path, strings.Join(header, ","), strings.Join(auditHeader, ","))
+	}
+	return nil
+}
+
+// writeRow records the changes made to one row. action is "update",
+// "dry-run" or "sql-file" depending on where the change went.
+func (aw *auditWriter) writeRow(action, table, rowKey string, changes []auditChange) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	now := time.Now().Format(time.RFC3339Nano)
+	for _, change := range changes {
+		newValue := change.NewValue
+		if change.Null {
+			newValue = `\N`
+		}
+		aw.w.Write([]string{now, action, table, rowKey, change.Column, change.OldValue, newValue,
+			strconv.Itoa(change.Values), strconv.Itoa(change.Occurrences)})
+	}
+	aw.flushLocked()
+}
+
+// writeRollback records that the updates audited for table were rolled back.
+func (aw *auditWriter) writeRollback(table string) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.w.Write([]string{time.Now().Format(time.RFC3339Nano), "rollback", table, "", "", "", "", "", ""})
+	aw.flushLocked()
+}
+
+func (aw *auditWriter) flushLocked() {
+	aw.w.Flush()
+	if err := aw.w.Error(); err != nil && aw.err == nil {
+		aw.err = err
+	}
+}
+
+func (aw *auditWriter) Close() error {
+	if aw.err != nil {
+		aw.file.Close()
+		return aw.err
+	}
+	return aw.file.Close()
+}
+
+// auditRowKey identifies a row as a JSON object of its primary key values,
+// or of every non-NULL column when the table has no primary key.
+func auditRowKey(columnsList []string, values []interface{}, primaryKey []string) string {
+	key := make(map[string]interface{})
+	for i, col := range columnsList {
+		if len(primaryKey) > 0 && indexOf(primaryKey, col) < 0 {
+			continue
+		}
+		if values[i] != nil {
+			key[col] = convertToString(values[i])
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(key)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
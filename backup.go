@@ -0,0 +1,99 @@
+package mysqlreplace
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// prepareWrite runs before the first UPDATE of a table. It creates the
+// backup table, if requested, and then opens the per-table transaction;
+// CREATE TABLE commits implicitly, so it cannot run inside the transaction.
+func (j *tableJob) prepareWrite(columnsList []string) error {
+	if j.prepared {
+		return nil
+	}
+	j.prepared = true
+
+	if j.config.BackupSuffix != "" {
+		if err := j.createBackup(columnsList); err != nil {
+			return err
+		}
+	}
+
+	if j.config.TxPerTable {
+		tx, err := j.w.BeginTx(j.ctx, nil)
+		if err != nil {
+			return err
+		}
+		j.tx = tx
+		j.exec = tx
+	}
+	return nil
+}
+
+// createBackup creates the backup table and, unless only changed rows are
+// backed up, copies the whole table into it.
+func (j *tableJob) createBackup(columnsList []string) error {
+	backup := j.table + j.config.BackupSuffix
+	var exists int
+	cond, args := tableCondition(backup)
+	err := j.w.QueryRowContext(j.ctx, "SELECT COUNT(*) FROM information_schema.TABLES WHERE "+cond, args...).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("checking for backup table %s: %v", backup, err)
+	}
+	if exists > 0 {
+		return fmt.Errorf("backup table %s already exists; refusing to overwrite it", backup)
+	}
+
+	_, err = j.w.ExecContext(j.ctx, fmt.Sprintf("CREATE TABLE %s LIKE %s", quoteTable(backup), quoteTable(j.table)))
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1050 {
+			return fmt.Errorf("backup table %s already exists; refusing to overwrite it", backup)
+		}
+		return fmt.Errorf("creating backup table %s: %v", backup, err)
+	}
+	j.result.Backup = backup
+
+	if !j.config.BackupChangedOnly {
+		columns := j.copyColumns(columnsList)
+		query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteTable(backup), columns, columns, quoteTable(j.table))
+		if _, err := j.w.ExecContext(j.ctx, query); err != nil {
+			return fmt.Errorf("copying %s into backup table %s: %v", j.table, backup, err)
+		}
+	}
+	j.log.Info("created backup table", "backup", backup)
+	return nil
+}
+
+// backupRow copies one row into the backup table before it is updated.
+func (j *tableJob) backupRow(columnsList []string, values []interface{}) error {
+	where, args, err := buildRowMatch(columnsList, values, j.primaryKey, j.generated, j.exact, j.temporal)
+	if err != nil {
+		return err
+	}
+	columns := j.copyColumns(columnsList)
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s", quoteTable(j.result.Backup), columns, columns, quoteTable(j.table), where)
+	if len(j.primaryKey) == 0 {
+		query += " LIMIT 1"
+	}
+	defer j.waited(time.Now())
+	if _, err := j.exec.ExecContext(j.writeContext(), query, args...); err != nil {
+		return fmt.Errorf("backing up row: %v", err)
+	}
+	return nil
+}
+
+// copyColumns lists the columns to copy into a backup table. Generated
+// columns are recomputed by the server and cannot be inserted.
+func (j *tableJob) copyColumns(columnsList []string) string {
+	var columns []string
+	for _, col := range columnsList {
+		if indexOf(j.generated, col) < 0 {
+			columns = append(columns, quoteIdent(col))
+		}
+	}
+	return strings.Join(columns, ", ")
+}
@@ -0,0 +1,55 @@
+package mysqlreplace
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+)
+
+// base64Encodings are tried in turn when decoding a value. Each is strict, so
+// a value only counts as base64 if re-encoding gives back exactly the same
+// text.
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding.Strict(),
+	base64.RawStdEncoding.Strict(),
+	base64.URLEncoding.Strict(),
+	base64.RawURLEncoding.Strict(),
+}
+
+// minBase64Length keeps short words that happen to be valid base64 from
+// being decoded.
+const minBase64Length = 8
+
+// decodeBase64 returns the decoded form of s and the encoding it round-trips
+// through, or false when s is not base64.
+func decodeBase64(s string) (string, *base64.Encoding, bool) {
+	if len(s) < minBase64Length {
+		return "", nil, false
+	}
+	for _, enc := range base64Encodings {
+		decoded, err := enc.DecodeString(s)
+		if err == nil && enc.EncodeToString(decoded) == s {
+			return string(decoded), enc, true
+		}
+	}
+	return "", nil, false
+}
+
+// replaceBase64 applies the replacements to the decoded form of a
+// base64-encoded value and re-encodes the result. It reports false, leaving
+// the value alone, when s is not base64 or its decoded form does not match.
+func replaceBase64(s, table, column string, config Config, hits []int) (string, bool) {
+	decoded, enc, ok := decodeBase64(s)
+	if !ok || !config.matches(decoded) {
+		return s, false
+	}
+	newDecoded := replaceValue(decoded, table, column, config, hits)
+	if newDecoded == decoded {
+		return s, false
+	}
+	if config.log().Enabled(context.Background(), slog.LevelDebug) {
+		change := describeChange(decoded, newDecoded, config)
+		config.tableLogger(table).Debug("decoded base64 value "+change.String(), "column", column, change.attr())
+	}
+	return enc.EncodeToString([]byte(newDecoded)), true
+}
@@ -0,0 +1,246 @@
+package mysqlreplace
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// defaultMaxPacket is assumed when the server's max_allowed_packet cannot
+// be read.
+const defaultMaxPacket = 4 << 20
+
+// maxPlaceholders is the most parameters a prepared statement may have.
+const maxPlaceholders = 65535
+
+// updateBatch holds changed rows of a table with a primary key until they
+// are sent as a single UPDATE. It is flushed every maxRows rows, or earlier
+// when the statement would outgrow maxSize bytes or maxPlaceholders.
+type updateBatch struct {
+	rows         []batchRow
+	size         int
+	placeholders int
+	maxRows      int
+	maxSize      int
+}
+
+// batchRow is one queued row: its primary key values, the values written to
+// each changed column, and what updateRow needs to retry it on its own.
+type batchRow struct {
+	columnsList []string
+	values      []interface{}
+	key         []interface{}
+	updates     []string
+	args        []interface{}
+	changed     map[string]interface{}
+	changes     []auditChange
+}
+
+// newUpdateBatch returns the batch for a table. Half of max_allowed_packet
+// leaves room for the statement text and protocol overhead.
+func newUpdateBatch(j *tableJob) *updateBatch {
+	maxPacket := 0
+	if err := j.w.QueryRowContext(j.ctx, "SELECT @@max_allowed_packet").Scan(&maxPacket); err != nil || maxPacket <= 0 {
+		j.log.Warn("could not read max_allowed_packet, assuming 4MB for update batches", "err", err)
+		maxPacket = defaultMaxPacket
+	}
+	j.log.Debug("batching updates", "batch_size", j.config.BatchSize, "max_allowed_packet", maxPacket)
+	return &updateBatch{maxRows: j.config.BatchSize, maxSize: maxPacket / 2}
+}
+
+// changesKey reports whether a row's update writes a primary key column.
+// Such rows are updated on their own: in a batch the later CASE expressions
+// would compare against the key's new value.
+func changesKey(changed map[string]interface{}, primaryKey []string) bool {
+	for _, key := range primaryKey {
+		if _, ok := changed[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// queueUpdate adds a changed row to the batch, flushing it first if the row
+// would not fit and afterwards once it is full.
+func (j *tableJob) queueUpdate(columnsList []string, values []interface{}, updates []string, args []interface{}, changed map[string]interface{}, changes []auditChange) error {
+	row := batchRow{columnsList: columnsList, values: values, updates: updates, args: args, changed: changed, changes: changes}
+	keySize := 0
+	for _, key := range j.primaryKey {
+		i := indexOf(columnsList, key)
+		if i < 0 {
+			return fmt.Errorf("primary key column %s not found in result set", key)
+		}
+		row.key = append(row.key, values[i])
+		keySize += len(convertToString(values[i]))
+	}
+
+	// The key is sent once per changed column and once in the IN list.
+	size := keySize * (len(changed) + 1)
+	for _, value := range changed {
+		size += len(convertToString(value)) + 32
+	}
+	placeholders := (len(j.primaryKey)+1)*len(changed) + len(j.primaryKey)
+
+	b := j.batch
+	if len(b.rows) > 0 && (b.size+size > b.maxSize || b.placeholders+placeholders > maxPlaceholders) {
+		if err := j.flush(); err != nil {
+			return err
+		}
+	}
+	b.rows = append(b.rows, row)
+	b.size += size
+	b.placeholders += placeholders
+	if len(b.rows) >= b.maxRows {
+		return j.flush()
+	}
+	return nil
+}
+
+// flush sends the queued rows as one UPDATE. If it fails the rows are
+// retried one at a time, so the error names the row at fault and the rows
+// before it are still written. Queued rows are only audited once written.
+func (j *tableJob) flush() error {
+	b := j.batch
+	if b == nil || len(b.rows) == 0 {
+		return nil
+	}
+	rows := b.rows
+	b.rows, b.size, b.placeholders = nil, 0, 0
+
+	query, args := buildBatchUpdate(j.table, j.columns, rows, j.primaryKey, j.preserve)
+	if err := j.throttle(len(rows)); err != nil {
+		return err
+	}
+	res, err := j.execRetry(func() (sql.Result, error) {
+		ctx, cancel := j.statementContext(j.writeContext())
+		defer cancel()
+		return j.exec.ExecContext(ctx, query, args...)
+	})
+	if err == nil {
+		if affected, err := res.RowsAffected(); err == nil && affected != int64(len(rows)) {
+			if err := j.unexpectedAffected(affected, int64(len(rows)), ""); err != nil {
+				j.auditRows(rows)
+				return err
+			}
+		}
+		j.log.Debug("flushed update batch", "rows", len(rows))
+		j.auditRows(rows)
+		return nil
+	}
+	// A deadlock has already rolled back the whole transaction, so the rows
+	// must not be retried outside it.
+	if j.ctx.Err() != nil || (j.tx != nil && isDeadlock(err)) {
+		return err
+	}
+
+	j.log.Warn("batch update failed, retrying its rows one at a time", "rows", len(rows), "err", err)
+	for i, row := range rows {
+		affected, err := j.updateRow(row.updates, row.args, row.columnsList, row.values, nil, nil)
+		if err != nil {
+			j.auditRows(rows[:i])
+			return fmt.Errorf("row %s: %w", auditRowKey(row.columnsList, row.values, j.primaryKey), err)
+		}
+		if affected != 1 {
+			if err := j.unexpectedAffected(affected, 1, auditRowKey(row.columnsList, row.values, j.primaryKey)); err != nil {
+				j.auditRows(rows[:i+1])
+				return err
+			}
+		}
+	}
+	j.auditRows(rows)
+	return nil
+}
+
+// auditRows records written rows in the audit file and their keys, or with
+// lockRows once the chunk's transaction commits.
+func (j *tableJob) auditRows(rows []batchRow) {
+	if j.config.audit == nil && j.keys == nil {
+		return
+	}
+	if j.lockRows {
+		j.chunkAudit = append(j.chunkAudit, rows...)
+		return
+	}
+	j.writeAudit(rows)
+}
+
+func (j *tableJob) writeAudit(rows []batchRow) {
+	for _, row := range rows {
+		if j.config.audit != nil {
+			j.config.audit.writeRow("update", j.table, auditRowKey(row.columnsList, row.values, j.primaryKey), row.changes)
+			j.audited = true
+		}
+		j.recordKey(row.columnsList, row.values)
+	}
+}
+
+// recordKey records the key of a written row for ChangedKeys.
+func (j *tableJob) recordKey(columnsList []string, values []interface{}) {
+	if j.keys != nil {
+		j.keys.add(changedKey(columnsList, values, j.primaryKey))
+	}
+}
+
+// buildBatchUpdate returns the UPDATE for a batch of rows, setting each
+// changed column with a CASE on the primary key:
+//
+//	UPDATE t SET c = CASE id WHEN ? THEN ? ... ELSE c END WHERE id IN (?, ...)
+//
+// Composite keys are matched with WHEN (a, b) = (?, ?).
+func buildBatchUpdate(table string, columns []textColumn, rows []batchRow, primaryKey, preserve []string) (string, []interface{}) {
+	keyColumns := make([]string, len(primaryKey))
+	for i, key := range primaryKey {
+		keyColumns[i] = quoteIdent(key)
+	}
+	keyTuple := "(" + strings.Join(keyColumns, ", ") + ")"
+	keyPlaceholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(primaryKey)), ", ") + ")"
+
+	var sets []string
+	var args []interface{}
+	for _, column := range columns {
+		col := quoteIdent(column.Name)
+		var expr strings.Builder
+		if len(primaryKey) == 1 {
+			fmt.Fprintf(&expr, "%s = CASE %s", col, keyColumns[0])
+		} else {
+			fmt.Fprintf(&expr, "%s = CASE", col)
+		}
+		used := false
+		for _, row := range rows {
+			value, ok := row.changed[column.Name]
+			if !ok {
+				continue
+			}
+			if len(primaryKey) == 1 {
+				expr.WriteString(" WHEN ? THEN ?")
+			} else {
+				fmt.Fprintf(&expr, " WHEN %s = %s THEN ?", keyTuple, keyPlaceholders)
+			}
+			args = append(append(args, row.key...), value)
+			used = true
+		}
+		if used {
+			fmt.Fprintf(&expr, " ELSE %s END", col)
+			sets = append(sets, expr.String())
+		}
+	}
+	for _, col := range preserve {
+		sets = append(sets, fmt.Sprintf("%s = %s", quoteIdent(col), quoteIdent(col)))
+	}
+
+	var match []string
+	for _, row := range rows {
+		if len(primaryKey) == 1 {
+			match = append(match, "?")
+		} else {
+			match = append(match, keyPlaceholders)
+		}
+		args = append(args, row.key...)
+	}
+	where := keyColumns[0]
+	if len(primaryKey) > 1 {
+		where = keyTuple
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s IN (%s)", quoteTable(table), strings.Join(sets, ", "), where, strings.Join(match, ", "))
+	return query, args
+}
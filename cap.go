@@ -0,0 +1,78 @@
+package mysqlreplace
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// errReplacementCap stops a table once MaxTotalReplacements is reached.
+var errReplacementCap = errors.New("stopped at the -max-total-replacements cap")
+
+// ReplacementCounter counts the values changed against
+// Config.MaxTotalReplacements, across every worker of a run. Runs given the
+// same counter, such as one per database, share the cap.
+type ReplacementCounter struct {
+	total   atomic.Int64
+	reached atomic.Bool
+}
+
+// NewReplacementCounter returns a counter to share between runs.
+func NewReplacementCounter() *ReplacementCounter {
+	return &ReplacementCounter{}
+}
+
+// Total returns the values counted so far.
+func (c *ReplacementCounter) Total() int {
+	return int(c.total.Load())
+}
+
+// Reached reports whether a row was refused for going over the cap.
+func (c *ReplacementCounter) Reached() bool {
+	return c.reached.Load()
+}
+
+// reserve counts the n values a row is about to change, unless enforce is
+// set and they would take the total over max; it reports whether they
+// were counted. Dry runs count without enforcing, to tell whether the cap
+// would be exceeded.
+func (c *ReplacementCounter) reserve(n, max int, enforce bool) bool {
+	for {
+		total := c.total.Load()
+		if enforce && total+int64(n) > int64(max) {
+			c.reached.Store(true)
+			return false
+		}
+		if c.total.CompareAndSwap(total, total+int64(n)) {
+			return true
+		}
+	}
+}
+
+// release takes back values counted for a row that was not written.
+func (c *ReplacementCounter) release(n int) {
+	c.total.Add(-int64(n))
+}
+
+// reserveRow counts the values of a changed row against the cap, if any.
+func (j *tableJob) reserveRow(row *pendingRow) error {
+	counter := j.config.ReplacementCounter
+	if j.config.MaxTotalReplacements <= 0 || counter == nil {
+		return nil
+	}
+	n := j.result.Replacements - row.before.Replacements
+	if !counter.reserve(n, j.config.MaxTotalReplacements, !j.config.DryRun) {
+		j.log.Warn("stopping: the next row would take the run over -max-total-replacements",
+			"max", j.config.MaxTotalReplacements, "replacements", counter.Total())
+		return errReplacementCap
+	}
+	row.reserved = n
+	return nil
+}
+
+// unreserveRow releases the values counted for a row that is not written.
+func (j *tableJob) unreserveRow(row *pendingRow) {
+	if row.reserved > 0 {
+		j.config.ReplacementCounter.release(row.reserved)
+		row.reserved = 0
+	}
+}
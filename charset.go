@@ -0,0 +1,134 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// supplementaryCharsets can hold characters outside the Basic Multilingual
+// Plane, such as emoji, which utf8mb3 cannot.
+var supplementaryCharsets = map[string]bool{
+	"utf8mb4": true,
+	"utf16":   true,
+	"utf16le": true,
+	"utf32":   true,
+	"gb18030": true,
+}
+
+// charset returns the character set of the column, the part of its
+// collation before the first underscore, or "" for JSON and binary columns.
+func (c textColumn) charset() string {
+	charset, _, _ := strings.Cut(c.Collation, "_")
+	return normalizeCharset(charset)
+}
+
+// normalizeCharset lower-cases a charset name and spells utf8 as the
+// utf8mb3 it stands for.
+func normalizeCharset(charset string) string {
+	charset = strings.ToLower(charset)
+	if charset == "utf8" {
+		return "utf8mb3"
+	}
+	return charset
+}
+
+// charsetCovers reports whether every character of the column charset can
+// pass through the session charset without loss. An empty (NULL) or binary
+// session charset does no conversion.
+func charsetCovers(session, column string) bool {
+	session = normalizeCharset(session)
+	switch {
+	case session == "" || session == "binary" || session == column:
+		return true
+	case column == "" || column == "ascii" || column == "binary":
+		return true
+	case supplementaryCharsets[session]:
+		return true
+	case session == "utf8mb3" || session == "ucs2":
+		return !supplementaryCharsets[column]
+	}
+	return false
+}
+
+// sessionCharset is one of the session variables that values are converted
+// through.
+type sessionCharset struct {
+	variable string
+	charset  string
+}
+
+// readSessionCharsets returns the character sets values are sent in and
+// read back in; character_set_results is NULL when results are not
+// converted.
+func readSessionCharsets(ctx context.Context, db *sql.DB) ([]sessionCharset, error) {
+	var client, connection, results sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT @@character_set_client, @@character_set_connection, @@character_set_results").
+		Scan(&client, &connection, &results); err != nil {
+		return nil, err
+	}
+	return []sessionCharset{
+		{"character_set_client", client.String},
+		{"character_set_connection", connection.String},
+		{"character_set_results", results.String},
+	}, nil
+}
+
+// checkCharsets verifies that the session character sets, on the replica
+// too when rows are read from one, can represent every column about to be
+// processed. Values are read and written back whole, so a lossy session
+// charset would turn the characters it lacks, such as emoji over utf8mb3,
+// into '?' even where nothing matched. A run that writes values fails the
+// check; otherwise each such column is only logged.
+func (r *Replacer) checkCharsets(ctx context.Context, tables []string, config Config) error {
+	lossy := make(map[string]bool)
+	for i, db := range []*sql.DB{r.db, r.ReadFrom} {
+		if db == nil {
+			continue
+		}
+		session := "session"
+		if i > 0 {
+			session = "replica session"
+		}
+		charsets, err := readSessionCharsets(ctx, db)
+		if err != nil {
+			config.log().Warn("could not read the "+session+" character sets, not checking them", "err", err)
+			continue
+		}
+		config.log().Debug(session+" character sets", "client", charsets[0].charset, "connection", charsets[1].charset, "results", charsets[2].charset)
+		for _, table := range tables {
+			tableConfig, _ := config.forTable(table)
+			schema, err := getColumns(ctx, r.db, table, tableConfig)
+			if err != nil {
+				return fmt.Errorf("reading columns of %s: %w", table, err)
+			}
+			for _, column := range selectColumns(table, schema, tableConfig).Columns {
+				for _, cs := range charsets {
+					if charsetCovers(cs.charset, column.charset()) {
+						continue
+					}
+					config.log().Warn(fmt.Sprintf("%s %s is %s, which cannot represent every %s character; values would be corrupted when written back",
+						session, cs.variable, cs.charset, column.charset()), "table", table, "column", column.Name)
+					lossy[table+"."+column.Name] = true
+					break
+				}
+			}
+		}
+	}
+	if len(lossy) == 0 {
+		return nil
+	}
+	// Server-side replacement never reads the values.
+	if config.OutputSQL != "" || (config.WritesDatabase() && !config.ServerSide) {
+		columns := make([]string, 0, len(lossy))
+		for column := range lossy {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		return fmt.Errorf("the session character set cannot represent %d columns (%s); connect with -charset utf8mb4, or pass -ignore-charset-check to start anyway",
+			len(columns), strings.Join(columns, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package mysqlreplace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkpointVersion is bumped when the checkpoint file changes shape;
+// files of another version are refused.
+const checkpointVersion = 1
+
+// checkpointParams are the settings a checkpoint was written for. A run may
+// only resume from a checkpoint with the same parameters.
+type checkpointParams struct {
+	Database       string            `json:"database"`
+	Pairs          []checkpointPair  `json:"pairs"`
+	Regex          bool              `json:"regex,omitempty"`
+	IgnoreCase     bool              `json:"ignore_case,omitempty"`
+	WholeWord      bool              `json:"whole_word,omitempty"`
+	Tables         []string          `json:"tables,omitempty"`
+	ExcludeTables  []string          `json:"exclude_tables,omitempty"`
+	Columns        []string          `json:"columns,omitempty"`
+	ExcludeColumns []string          `json:"exclude_columns,omitempty"`
+	Where          string            `json:"where,omitempty"`
+	TableWhere     map[string]string `json:"table_where,omitempty"`
+	Rules          []checkpointRule  `json:"rules,omitempty"`
+}
+
+// checkpointRule is a rule of Config.Rules as recorded in a checkpoint.
+// Lists keep telling nil (the run's setting) from empty.
+type checkpointRule struct {
+	Name           string           `json:"name"`
+	Tables         []string         `json:"tables"`
+	Skip           bool             `json:"skip,omitempty"`
+	ForColumns     []string         `json:"for_columns"`
+	Pairs          []checkpointPair `json:"pairs"`
+	Columns        []string         `json:"columns"`
+	ExcludeColumns []string         `json:"exclude_columns"`
+	Serialized     *bool            `json:"serialized"`
+	JSONKeys       *bool            `json:"json_keys"`
+}
+
+type checkpointPair struct {
+	Search  string `json:"search"`
+	Replace string `json:"replace"`
+	Variant string `json:"variant,omitempty"`
+}
+
+// checkpointPosition is the key of the last row of the last chunk of a
+// table whose changes are committed. Values are kept as bytes so that
+// binary keys survive the JSON encoding.
+type checkpointPosition struct {
+	Key    []string `json:"key"`
+	Values [][]byte `json:"values"`
+}
+
+type checkpointState struct {
+	Version   int                           `json:"version"`
+	Params    checkpointParams              `json:"params"`
+	Updated   time.Time                     `json:"updated"`
+	Finished  bool                          `json:"finished"`
+	Completed []string                      `json:"completed"`
+	Positions map[string]checkpointPosition `json:"positions,omitempty"`
+}
+
+// checkpoint records the progress of a run in Config.Checkpoint: the
+// tables completed and, for tables scanned in chunks whose changes commit
+// as they go, the position reached. The file is rewritten after every
+// change, through a temporary file so that a crash never leaves it torn.
+type checkpoint struct {
+	mu    sync.Mutex
+	path  string
+	state checkpointState
+	done  map[string]bool
+}
+
+func newCheckpointParams(config Config) checkpointParams {
+	params := checkpointParams{
+		Database:       config.Database,
+		Regex:          config.Regex,
+		IgnoreCase:     config.IgnoreCase,
+		WholeWord:      config.WholeWord,
+		Tables:         nonEmpty(config.Tables),
+		ExcludeTables:  nonEmpty(config.ExcludeTables),
+		Columns:        nonEmpty(config.Columns),
+		ExcludeColumns: nonEmpty(config.ExcludeColumns),
+		Where:          config.Where,
+	}
+	if len(config.TableWhere) > 0 {
+		params.TableWhere = config.TableWhere
+	}
+	runPairs, _ := config.runPairs()
+	params.Pairs = checkpointPairs(runPairs)
+	for _, rule := range config.Rules {
+		params.Rules = append(params.Rules, checkpointRule{
+			Name:           rule.Name,
+			Tables:         rule.Tables,
+			Skip:           rule.Skip,
+			ForColumns:     rule.ForColumns,
+			Pairs:          checkpointPairs(rule.Pairs),
+			Columns:        rule.Columns,
+			ExcludeColumns: rule.ExcludeColumns,
+			Serialized:     rule.Serialized,
+			JSONKeys:       rule.JSONKeys,
+		})
+	}
+	return params
+}
+
+func checkpointPairs(pairs []Pair) []checkpointPair {
+	var recorded []checkpointPair
+	for _, pair := range pairs {
+		recorded = append(recorded, checkpointPair{Search: pair.Search, Replace: pair.Replace, Variant: pair.variant})
+	}
+	return recorded
+}
+
+func nonEmpty(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// differences names the parameters that differ between p and other.
+func (p checkpointParams) differences(other checkpointParams) []string {
+	var names []string
+	a, b := reflect.ValueOf(p), reflect.ValueOf(other)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("json"), ",")
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// openCheckpoint resumes from the checkpoint at path when it exists, and
+// refuses one written for other parameters. Otherwise it starts a new one.
+func openCheckpoint(path string, config Config) (*checkpoint, error) {
+	params := newCheckpointParams(config)
+	c := &checkpoint{path: path, done: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		c.state = checkpointState{Version: checkpointVersion, Params: params, Completed: []string{}}
+		return c, c.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.state); err != nil {
+		return nil, fmt.Errorf("%s is not a checkpoint file: %w", path, err)
+	}
+	if c.state.Version != checkpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has version %d, expected %d", path, c.state.Version, checkpointVersion)
+	}
+	if diff := c.state.Params.differences(params); len(diff) > 0 {
+		return nil, fmt.Errorf("checkpoint %s was written for a run with different parameters (%s); remove it to start over",
+			path, strings.Join(diff, ", "))
+	}
+	for _, table := range c.state.Completed {
+		c.done[table] = true
+	}
+	if c.state.Finished {
+		config.log().Warn("checkpoint records a finished run; its tables are skipped (remove the file to run again)", "path", path, "tables", len(c.state.Completed))
+	} else {
+		config.log().Info("resuming from checkpoint", "path", path, "tables_completed", len(c.state.Completed), "tables_in_progress", len(c.state.Positions))
+	}
+	return c, nil
+}
+
+// pending returns the tables not completed by the checkpointed run.
+func (c *checkpoint) pending(tables []string) []string {
+	var rest []string
+	for _, table := range tables {
+		if !c.done[table] {
+			rest = append(rest, table)
+		}
+	}
+	return rest
+}
+
+// position returns the key values to resume table after, or nil to start
+// from the beginning. A position recorded for another key is an error.
+func (c *checkpoint) position(table string, key []string) ([]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos, ok := c.state.Positions[table]
+	if !ok {
+		return nil, nil
+	}
+	if !reflect.DeepEqual(pos.Key, key) {
+		return nil, fmt.Errorf("checkpoint position for %s is on key (%s), but the table is now keyed by (%s); remove the checkpoint to start over",
+			table, strings.Join(pos.Key, ", "), strings.Join(key, ", "))
+	}
+	values := make([]interface{}, len(pos.Values))
+	for i, value := range pos.Values {
+		values[i] = value
+	}
+	return values, nil
+}
+
+// advance records that table's changes are committed up to the row with
+// the given key values.
+func (c *checkpoint) advance(table string, key []string, values []interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos := checkpointPosition{Key: key}
+	for _, value := range values {
+		pos.Values = append(pos.Values, []byte(convertToString(value)))
+	}
+	if c.state.Positions == nil {
+		c.state.Positions = make(map[string]checkpointPosition)
+	}
+	c.state.Positions[table] = pos
+	return c.save()
+}
+
+// complete records that table is done.
+func (c *checkpoint) complete(table string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done[table] {
+		c.done[table] = true
+		c.state.Completed = append(c.state.Completed, table)
+		sort.Strings(c.state.Completed)
+	}
+	delete(c.state.Positions, table)
+	return c.save()
+}
+
+// finish marks the checkpoint as that of a finished run, so running again
+// with it skips every table instead of repeating the replacements.
+func (c *checkpoint) finish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.Finished = true
+	return c.save()
+}
+
+// save writes the state to a temporary file and renames it over the
+// checkpoint. The caller holds c.mu.
+func (c *checkpoint) save() error {
+	c.state.Updated = time.Now()
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
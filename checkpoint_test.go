@@ -0,0 +1,76 @@
+package mysqlreplace
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointRefusesOtherWhere(t *testing.T) {
+	base := Config{Database: "db", Pairs: []Pair{{Search: "a", Replace: "b"}}, Where: "account_id = 42"}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"where", func(c *Config) { c.Where = "account_id = 43" }, "where"},
+		{"no where", func(c *Config) { c.Where = "" }, "where"},
+		{"table where", func(c *Config) { c.TableWhere = map[string]string{"users": "id < 10"} }, "table_where"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if _, err := openCheckpoint(path, base); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openCheckpoint(path, base); err != nil {
+				t.Fatalf("resuming with the same parameters: %v", err)
+			}
+			config := base
+			tt.change(&config)
+			_, err := openCheckpoint(path, config)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error naming %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckpointRefusesOtherRules(t *testing.T) {
+	yes := true
+	rule := Rule{Name: "posts", Tables: []string{"wp_posts"}, Columns: []string{"post_content"}}
+	base := Config{Database: "db", Pairs: []Pair{{Search: "a", Replace: "b"}}, Rules: []Rule{rule}}
+	tests := []struct {
+		name   string
+		change func(*Rule)
+	}{
+		{"tables", func(r *Rule) { r.Tables = []string{"wp_pages"} }},
+		{"skip", func(r *Rule) { r.Columns, r.Skip = nil, true }},
+		{"for columns", func(r *Rule) { r.Columns, r.ForColumns = nil, []string{"post_content"} }},
+		{"columns", func(r *Rule) { r.Columns = []string{"post_excerpt"} }},
+		{"no columns", func(r *Rule) { r.Columns = nil }},
+		{"exclude columns", func(r *Rule) { r.ExcludeColumns = []string{"guid"} }},
+		{"serialized", func(r *Rule) { r.Serialized = &yes }},
+		{"json keys", func(r *Rule) { r.JSONKeys = &yes }},
+		{"pairs", func(r *Rule) { r.Pairs = []Pair{{Search: "c", Replace: "d"}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if _, err := openCheckpoint(path, base); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openCheckpoint(path, base); err != nil {
+				t.Fatalf("resuming with the same rules: %v", err)
+			}
+			changed := rule
+			tt.change(&changed)
+			config := base
+			config.Rules = []Rule{changed}
+			_, err := openCheckpoint(path, config)
+			if err == nil || !strings.Contains(err.Error(), "rules") {
+				t.Fatalf("got %v, want an error naming rules", err)
+			}
+		})
+	}
+}
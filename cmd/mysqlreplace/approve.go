@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+// rowPrompt asks on the terminal whether to write each changed row, for
+// -confirm-each. One prompt serves every database of a run.
+type rowPrompt struct {
+	context int
+	full    bool
+	diff    bool
+	color   bool
+	// removed and added color the changed text when color is set.
+	removed, added func(string) string
+
+	once  sync.Once
+	lines chan string
+}
+
+func newRowPrompt(config Config) *rowPrompt {
+	color := useColor(config)
+	return &rowPrompt{context: config.LogContext, full: config.LogFullValues, diff: config.ShowDiff, color: color,
+		removed: painter(color, mysqlreplace.ColorRed), added: painter(color, mysqlreplace.ColorGreen)}
+}
+
+// approve is the Replacer.Approve hook. End of input quits the run; an
+// interrupt skips the row, and the run then stops before the next one.
+func (p *rowPrompt) approve(ctx context.Context, row mysqlreplace.RowChange) mysqlreplace.Approval {
+	p.once.Do(func() {
+		p.lines = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				p.lines <- scanner.Text()
+			}
+			close(p.lines)
+		}()
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\nTable %s, row %s:\n", row.Table, row.Key)
+	context := p.context
+	if p.full {
+		context = -1
+	}
+	for _, column := range row.Columns {
+		if column.Null {
+			before, _ := column.MarkedExcerpts(context, p.removed)
+			fmt.Fprintf(&b, "  %s:\n    - %s\n    + NULL\n", column.Column, before)
+			continue
+		}
+		if p.diff {
+			diffContext := p.context
+			if p.full {
+				diffContext = 0
+			}
+			diff := column.Diff(diffContext)
+			if p.color {
+				diff = column.MarkedDiff(diffContext, p.removed, p.added)
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", column.Column, diff)
+			continue
+		}
+		before, _ := column.MarkedExcerpts(context, p.removed)
+		_, after := column.MarkedExcerpts(context, p.added)
+		fmt.Fprintf(&b, "  %s:\n    - %s\n    + %s\n", column.Column, before, after)
+	}
+	fmt.Fprint(os.Stderr, b.String())
+
+	for {
+		fmt.Fprint(os.Stderr, "Apply this row? [y]es, [n]o, [a]ll remaining rows of the table, [q]uit: ")
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				fmt.Fprintln(os.Stderr)
+				return mysqlreplace.QuitRun
+			}
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "y", "yes":
+				return mysqlreplace.ApplyRow
+			case "n", "no":
+				return mysqlreplace.SkipRow
+			case "a", "all":
+				return mysqlreplace.ApplyTable
+			case "q", "quit":
+				return mysqlreplace.QuitRun
+			}
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr)
+			return mysqlreplace.SkipRow
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadConfigFile sets the flags not already given, on the command line or
+// in the environment, from the TOML file of -config. Its keys are the flag
+// names without the dash; a list sets a repeatable flag once per element
+// and is joined with commas for the others, such as tables. Search and
+// replace pairs may instead be given as [[pairs]] tables. Unknown keys are
+// an error so that typos are not silently ignored.
+func loadConfigFile(flags *flag.FlagSet, path string) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	meta, err := toml.Decode(string(data), &values)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if _, ok := values["pairs"]; ok {
+		if _, ok := values["search"]; ok {
+			return fmt.Errorf("%s: give search and replace either as keys or as [[pairs]], not both", path)
+		}
+		if _, ok := values["replace"]; ok {
+			return fmt.Errorf("%s: give search and replace either as keys or as [[pairs]], not both", path)
+		}
+	}
+
+	// Keys come in file order, with [[pairs]] once per table.
+	seen := make(map[string]bool)
+	for _, key := range meta.Keys() {
+		name := key[0]
+		if len(key) != 1 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if name == "pairs" {
+			if given["search"] || given["replace"] {
+				continue
+			}
+			if err := setPairs(flags, values[name]); err != nil {
+				return fmt.Errorf("%s: pairs: %v", path, err)
+			}
+			continue
+		}
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown key %q (keys are flag names without the dash)", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := setFromFile(flags, f, values[name]); err != nil {
+			return fmt.Errorf("%s: invalid %s for -%s: %v", path, name, name, err)
+		}
+	}
+	return nil
+}
+
+// setFromFile sets f from a decoded TOML value.
+func setFromFile(flags *flag.FlagSet, f *flag.Flag, value interface{}) error {
+	list, isList := value.([]interface{})
+	if !isList {
+		text, err := configText(value)
+		if err != nil {
+			return err
+		}
+		return setFlag(flags, f, text)
+	}
+	texts := make([]string, len(list))
+	for i, item := range list {
+		text, err := configText(item)
+		if err != nil {
+			return err
+		}
+		texts[i] = text
+	}
+	if _, repeatable := f.Value.(*stringList); repeatable {
+		for _, text := range texts {
+			if err := setFlag(flags, f, text); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return setFlag(flags, f, strings.Join(texts, ","))
+}
+
+func setFlag(flags *flag.FlagSet, f *flag.Flag, text string) error {
+	if err := flags.Set(f.Name, text); err != nil {
+		return fmt.Errorf("%q: %s", text, valueError(f, err))
+	}
+	return nil
+}
+
+// setPairs sets -search and -replace from the [[pairs]] tables, in order.
+func setPairs(flags *flag.FlagSet, value interface{}) error {
+	pairs, ok := value.([]map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected [[pairs]] tables with search and replace keys")
+	}
+	for i, pair := range pairs {
+		for key := range pair {
+			if key != "search" && key != "replace" {
+				return fmt.Errorf("pair %d: unknown key %q (expected search and replace)", i+1, key)
+			}
+		}
+		search, ok := pair["search"].(string)
+		if !ok {
+			return fmt.Errorf("pair %d: search must be a string", i+1)
+		}
+		replace, ok := pair["replace"].(string)
+		if _, given := pair["replace"]; given && !ok {
+			return fmt.Errorf("pair %d: replace must be a string", i+1)
+		}
+		flags.Set("search", search)
+		flags.Set("replace", replace)
+	}
+	return nil
+}
+
+// configText formats a scalar TOML value as a flag would read it.
+func configText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported value %v (expected a string, number, boolean or a list of them)", value)
+}
+
+// printConfig writes the flags that differ from their defaults as a TOML
+// file that -config can read back, for -print-config, with the passwords
+// masked. It must run after applyOptions: the flags read the fields of the
+// resolved Config, so option-file values are printed with the rest.
+// Defaults are left out since a flag set in the file counts as given,
+// which some settings check for.
+func printConfig(w io.Writer, flags *flag.FlagSet) error {
+	values := make(map[string]interface{})
+	flags.VisitAll(func(f *flag.Flag) {
+		switch {
+		case f.Name == "config" || f.Name == "print-config":
+			return
+		case f.Value.String() == f.DefValue:
+			return
+		}
+		switch v := f.Value.(type) {
+		case *stringList:
+			values[f.Name] = []string(*v)
+			return
+		case flag.Getter:
+			switch value := v.Get().(type) {
+			case time.Duration:
+				values[f.Name] = value.String()
+			case string:
+				if (f.Name == "password" || f.Name == "read-password") && value != "" {
+					value = "****"
+				}
+				values[f.Name] = value
+			default:
+				values[f.Name] = value
+			}
+			return
+		}
+		values[f.Name] = f.Value.String()
+	})
+	fmt.Fprintln(w, "# Effective configuration: every flag that differs from its default, from")
+	fmt.Fprintln(w, "# the command line, the environment, -config or option files.")
+	return toml.NewEncoder(w).Encode(values)
+}
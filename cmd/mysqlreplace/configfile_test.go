@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// exampleFlags defines the flags that examples/mysqlreplace.toml and the
+// tests below set, as parseFlags does.
+type exampleFlags struct {
+	host, user, database, sslMode, sslCA string
+	tables, excludeColumns               string
+	port                                 int
+	searches, replaces, wheres           stringList
+}
+
+func newExampleFlags() (*flag.FlagSet, *exampleFlags) {
+	v := &exampleFlags{}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&v.host, "host", "localhost", "")
+	flags.IntVar(&v.port, "port", 3306, "")
+	flags.StringVar(&v.user, "user", "", "")
+	flags.StringVar(&v.database, "database", "", "")
+	flags.StringVar(&v.sslMode, "ssl-mode", "", "")
+	flags.StringVar(&v.sslCA, "ssl-ca", "", "")
+	flags.StringVar(&v.tables, "tables", "", "")
+	flags.StringVar(&v.excludeColumns, "exclude-columns", "", "")
+	flags.Var(&v.searches, "search", "")
+	flags.Var(&v.replaces, "replace", "")
+	flags.Var(&v.wheres, "where", "")
+	flags.String("config", "", "")
+	return flags, v
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	flags, got := newExampleFlags()
+	if err := flags.Parse([]string{"-user", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(flags, "../../examples/mysqlreplace.toml"); err != nil {
+		t.Fatal(err)
+	}
+	want := &exampleFlags{
+		host:           "db.internal",
+		port:           3306,
+		user:           "admin",
+		database:       "wordpress",
+		sslMode:        "verify-ca",
+		sslCA:          "/etc/ssl/certs/db-ca.pem",
+		tables:         "wp_posts,wp_postmeta,wp_options",
+		excludeColumns: "guid",
+		searches:       stringList{"https://old.example.com", "old.example.com"},
+		replaces:       stringList{"https://new.example.com", "new.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadConfigLists(t *testing.T) {
+	flags, got := newExampleFlags()
+	path := writeFile(t, "config.toml", `
+search = ["a", "b"]
+replace = ["c", "d"]
+where = ["deleted = 0", "wp_posts:post_status = 'publish'"]
+tables = ["wp_posts", "wp_options"]
+`)
+	if err := loadConfigFile(flags, path); err != nil {
+		t.Fatal(err)
+	}
+	if want := (stringList{"a", "b"}); !reflect.DeepEqual(got.searches, want) {
+		t.Errorf("search is %q, want %q", got.searches, want)
+	}
+	if want := (stringList{"c", "d"}); !reflect.DeepEqual(got.replaces, want) {
+		t.Errorf("replace is %q, want %q", got.replaces, want)
+	}
+	if want := (stringList{"deleted = 0", "wp_posts:post_status = 'publish'"}); !reflect.DeepEqual(got.wheres, want) {
+		t.Errorf("where is %q, want %q", got.wheres, want)
+	}
+	if want := "wp_posts,wp_options"; got.tables != want {
+		t.Errorf("tables is %q, want %q", got.tables, want)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown key", "hots = \"db\"\n"},
+		{"pairs and search", "search = \"a\"\n[[pairs]]\nsearch = \"b\"\n"},
+		{"bad pair key", "[[pairs]]\nsearch = \"a\"\nreplce = \"b\"\n"},
+		{"bad port", "port = \"many\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, _ := newExampleFlags()
+			if err := loadConfigFile(flags, writeFile(t, "config.toml", tt.content)); err == nil {
+				t.Error("loaded without error")
+			}
+		})
+	}
+}
+
+func TestPrintConfigIncludesOptionFiles(t *testing.T) {
+	config := Config{}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.StringVar(&config.Host, "host", "localhost", "")
+	flags.IntVar(&config.Port, "port", 3306, "")
+	flags.StringVar(&config.User, "user", "", "")
+	flags.StringVar(&config.Password, "password", "", "")
+	if err := flags.Parse([]string{"-user", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	options := map[string]string{"host": "db.internal", "port": "3307", "user": "backup", "password": "secret"}
+	applyOptions(&config, options, map[string]bool{"user": true})
+
+	var out bytes.Buffer
+	if err := printConfig(&out, flags); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if _, err := toml.Decode(out.String(), &got); err != nil {
+		t.Fatalf("%v in\n%s", err, out.String())
+	}
+	want := map[string]interface{}{"host": "db.internal", "port": int64(3307), "user": "admin", "password": "****"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
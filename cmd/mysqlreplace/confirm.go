@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/wltechblog/mysqlreplace"
+	"golang.org/x/term"
+)
+
+// databasePlan is the confirmation plan for one database.
+type databasePlan struct {
+	Database string
+	Tables   []mysqlreplace.TablePlan
+}
+
+// confirmRun prints what the run is about to change and waits for the user
+// to type "yes". It returns an error if the user declines or cannot be asked.
+// A single database is listed table by table, several with a line each.
+func confirmRun(ctx context.Context, plans []databasePlan, config Config) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("stdin is not a terminal, so the run cannot be confirmed; pass -yes to proceed without confirmation")
+	}
+
+	server := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	if config.Socket != "" {
+		server = "socket " + config.Socket
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "About to modify the database:\n")
+	if len(plans) == 1 {
+		fmt.Fprintf(&b, "  Database: %s on %s\n", plans[0].Database, server)
+	} else {
+		fmt.Fprintf(&b, "  Server: %s\n", server)
+	}
+	for _, pair := range config.Pairs {
+		if config.SetNull {
+			fmt.Fprintf(&b, "  Set to NULL: values containing %q\n", pair.Search)
+			continue
+		}
+		fmt.Fprintf(&b, "  Replace: %q -> %q\n", pair.Search, pair.Replace)
+		if pair.Replace == "" {
+			fmt.Fprintf(&b, "  WARNING: every match of %q will be removed\n", pair.Search)
+		}
+	}
+	if len(plans) == 1 {
+		plan := plans[0].Tables
+		switch config.OrderBy {
+		case "size":
+			fmt.Fprintf(&b, "  Tables (%d, largest first):\n", len(plan))
+		case "name":
+			fmt.Fprintf(&b, "  Tables (%d, by name):\n", len(plan))
+		default:
+			fmt.Fprintf(&b, "  Tables (%d):\n", len(plan))
+		}
+		for _, table := range plan {
+			name := table.Name + planSize(table)
+			switch {
+			case table.TooLarge:
+				fmt.Fprintf(&b, "    %s: skipped (too large)\n", name)
+			case len(table.Columns) == 0:
+				fmt.Fprintf(&b, "    %s: no text columns, skipped\n", name)
+			case len(table.Key) == 0:
+				fmt.Fprintf(&b, "    %s: %s (identified by full row)\n", name, strings.Join(table.Columns, ", "))
+			case table.KeyIndex != "PRIMARY":
+				fmt.Fprintf(&b, "    %s: %s (identified by unique index %s)\n", name, strings.Join(table.Columns, ", "), table.KeyIndex)
+			default:
+				fmt.Fprintf(&b, "    %s: %s\n", name, strings.Join(table.Columns, ", "))
+			}
+		}
+	} else {
+		fmt.Fprintf(&b, "  Databases (%d):\n", len(plans))
+		for _, plan := range plans {
+			withText, fullRow, tooLarge := 0, 0, 0
+			for _, table := range plan.Tables {
+				if table.TooLarge {
+					tooLarge++
+				}
+				if len(table.Columns) > 0 {
+					withText++
+					if len(table.Key) == 0 {
+						fullRow++
+					}
+				}
+			}
+			line := fmt.Sprintf("    %s: %d tables, %d with text columns", plan.Database, len(plan.Tables), withText)
+			if fullRow > 0 {
+				line += fmt.Sprintf(", %d identified by full row", fullRow)
+			}
+			if tooLarge > 0 {
+				line += fmt.Sprintf(", %d skipped (too large)", tooLarge)
+			}
+			fmt.Fprintln(&b, line)
+		}
+	}
+	if flags := riskyFlags(config); len(flags) > 0 {
+		fmt.Fprintf(&b, "  In effect: %s\n", strings.Join(flags, " "))
+	}
+	fmt.Fprintf(&b, "Type \"yes\" to continue: ")
+	fmt.Fprint(os.Stderr, b.String())
+
+	answer := make(chan string, 1)
+	go func() {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			line = ""
+		}
+		answer <- strings.TrimSpace(line)
+	}()
+	select {
+	case line := <-answer:
+		if !strings.EqualFold(line, "yes") {
+			return fmt.Errorf("not confirmed, no changes made")
+		}
+		return nil
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("interrupted, no changes made")
+	}
+}
+
+// planSize describes a table's size estimates, or returns "" when the
+// server gave none.
+func planSize(table mysqlreplace.TablePlan) string {
+	if table.RowEstimate == 0 && table.DataLength == 0 {
+		return ""
+	}
+	size := fmt.Sprintf("%d B", table.DataLength)
+	if table.DataLength >= 1024 {
+		div, exp := int64(1024), 0
+		for m := table.DataLength / 1024; m >= 1024; m /= 1024 {
+			div *= 1024
+			exp++
+		}
+		size = fmt.Sprintf("%.1f %ciB", float64(table.DataLength)/float64(div), "KMGTPE"[exp])
+	}
+	return fmt.Sprintf(" (~%d rows, %s)", table.RowEstimate, size)
+}
+
+// riskyFlags lists the options in effect that widen what the run changes or
+// make it harder to reverse.
+func riskyFlags(config Config) []string {
+	var flags []string
+	if config.SetNull {
+		flags = append(flags, "-set-null")
+	}
+	if config.Regex {
+		flags = append(flags, "-regex")
+	}
+	if config.IgnoreCase {
+		flags = append(flags, "-ignore-case")
+	}
+	if config.ServerSide {
+		flags = append(flags, "-server-side")
+	}
+	if config.URLVariants {
+		flags = append(flags, "-url-variants")
+	}
+	if config.URLEncoded {
+		flags = append(flags, "-url-encoded")
+	}
+	if config.HTMLEntities {
+		flags = append(flags, "-html-entities")
+	}
+	if config.DecodeBase64 {
+		flags = append(flags, "-decode-base64")
+	}
+	if config.Decompress {
+		flags = append(flags, "-decompress")
+	}
+	if !config.TxPerTable {
+		flags = append(flags, "-tx-per-table=false")
+	}
+	if config.IncludeViews {
+		flags = append(flags, "-include-views")
+	}
+	if config.IncludeBinary {
+		flags = append(flags, "-include-binary")
+	}
+	if config.IncludeEnum {
+		flags = append(flags, "-include-enum")
+	}
+	if config.SkipBinlog {
+		flags = append(flags, "-skip-binlog")
+	}
+	if config.DisableFKChecks {
+		flags = append(flags, "-disable-fk-checks")
+	}
+	if config.Concurrency > 1 {
+		flags = append(flags, fmt.Sprintf("-concurrency=%d", config.Concurrency))
+	}
+	if config.BackupSuffix == "" && config.UndoFile == "" {
+		flags = append(flags, "(no -backup-suffix or -undo-file)")
+	}
+	return flags
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/term"
+)
+
+// tlsConfigName prefixes the names custom TLS configurations are registered
+// under with the MySQL driver.
+const tlsConfigName = "mysqlreplace"
+
+var sslModes = []string{"disabled", "preferred", "required", "verify-ca", "verify-full"}
+
+func connectDB(config Config) (*sql.DB, error) {
+	dsn, err := buildDSN(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+
+	ctx := context.Background()
+	if config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+		defer cancel()
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("no answer from %s within -connect-timeout %s", serverAddress(config), config.ConnectTimeout)
+		}
+		return nil, explainConnError(err, config)
+	}
+	checkCharset(db, config)
+	if config.Compress {
+		checkCompression(db, config)
+	}
+	return db, nil
+}
+
+// serverAddress describes where config connects to, for error messages.
+func serverAddress(config Config) string {
+	if config.Socket != "" {
+		return "socket " + config.Socket
+	}
+	return fmt.Sprintf("%s:%d", config.Host, config.Port)
+}
+
+// replicaConfig returns config with the connection settings of the replica
+// given by the -read-* flags.
+func replicaConfig(config Config) Config {
+	config.Host = config.ReadHost
+	config.Port = config.ReadPort
+	config.Socket = config.ReadSocket
+	config.User = config.ReadUser
+	config.Password = config.ReadPassword
+	config.SSLMode = config.ReadSSLMode
+	config.SSLCA = config.ReadSSLCA
+	config.ServerPubKey = config.ReadServerPubKey
+	return config
+}
+
+// connectReplica connects to the replica to scan, or returns nil when no
+// -read-host or -read-socket was given.
+func connectReplica(config Config) (*sql.DB, error) {
+	if config.ReadHost == "" && config.ReadSocket == "" {
+		return nil, nil
+	}
+	replica := replicaConfig(config)
+	db, err := connectDB(replica)
+	if err != nil {
+		return nil, err
+	}
+	if replica.Socket != "" {
+		replica.log().Debug("connected to the replica over Unix socket", "user", replica.User, "socket", replica.Socket)
+	} else {
+		replica.log().Debug("connected to the replica over TCP", "user", replica.User, "host", replica.Host, "port", replica.Port, "ssl_mode", replica.SSLMode)
+	}
+	return db, nil
+}
+
+// checkCharset warns when the server did not accept the requested connection
+// character set, since values would then be converted on the way in and out.
+func checkCharset(db *sql.DB, config Config) {
+	var charset, collation string
+	if err := db.QueryRow("SELECT @@character_set_connection, @@collation_connection").Scan(&charset, &collation); err != nil {
+		config.log().Warn("could not verify the connection character set", "err", err)
+		return
+	}
+	if !strings.EqualFold(charset, config.Charset) {
+		config.log().Warn(fmt.Sprintf("connection character set is %s, not %s; non-ASCII text may be converted or corrupted", charset, config.Charset))
+	}
+	if config.Collation != "" && !strings.EqualFold(collation, config.Collation) {
+		config.log().Warn(fmt.Sprintf("connection collation is %s, not %s", collation, config.Collation))
+	}
+	config.log().Debug("connection character set", "charset", charset, "collation", collation)
+}
+
+// checkCompression logs whether -compress was negotiated: the driver
+// silently leaves it off when the server does not offer it.
+func checkCompression(db *sql.DB, config Config) {
+	var name, value string
+	if err := db.QueryRow("SHOW SESSION STATUS LIKE 'Compression'").Scan(&name, &value); err != nil {
+		config.log().Debug("could not verify protocol compression", "err", err)
+		return
+	}
+	if !strings.EqualFold(value, "ON") {
+		config.log().Warn("the server did not accept -compress; the connection is not compressed")
+		return
+	}
+	config.log().Debug("protocol compression negotiated")
+}
+
+// buildDSN returns the driver DSN for config, registering a TLS configuration
+// with the driver when the SSL mode needs one.
+func buildDSN(config Config) (string, error) {
+	address := fmt.Sprintf("tcp(%s:%d)", config.Host, config.Port)
+	if config.SSHHost != "" {
+		address = fmt.Sprintf("%s(%s:%d)", sshNetwork, config.Host, config.Port)
+	}
+	if config.Socket != "" {
+		address = fmt.Sprintf("unix(%s)", config.Socket)
+	}
+	dsn := fmt.Sprintf("%s:%s@%s/%s", config.User, config.Password, address, config.Database)
+
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return "", err
+	}
+	var params []dsnParam
+	switch {
+	case config.SSLMode == "disabled":
+		params = append(params, dsnParam{"tls", "false"})
+	case tlsConfig == nil:
+		// preferred without client certificates: the driver's built-in mode
+		// uses TLS when the server offers it, without verification.
+		params = append(params, dsnParam{"tls", "preferred"})
+	default:
+		// The primary and a replica may need different configurations.
+		name := fmt.Sprintf("%s-%s-%d", tlsConfigName, config.Host, config.Port)
+		if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+			return "", err
+		}
+		params = append(params, dsnParam{"tls", name})
+		if config.SSLMode == "preferred" {
+			params = append(params, dsnParam{"allowFallbackToPlaintext", "true"})
+		}
+	}
+
+	params = append(params, dsnParam{"charset", config.Charset})
+	if config.Collation != "" {
+		params = append(params, dsnParam{"collation", config.Collation})
+	}
+	for _, param := range []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"timeout", config.ConnectTimeout},
+		{"readTimeout", config.ReadTimeout},
+		{"writeTimeout", config.WriteTimeout},
+	} {
+		if param.timeout > 0 {
+			params = append(params, dsnParam{param.name, param.timeout.String()})
+		}
+	}
+	if config.Compress {
+		params = append(params, dsnParam{"compress", "true"})
+	}
+	if config.ServerPubKey != "" {
+		key, err := readServerPubKey(config.ServerPubKey)
+		if err != nil {
+			return "", err
+		}
+		name := fmt.Sprintf("%s-%s-%d", tlsConfigName, config.Host, config.Port)
+		mysql.RegisterServerPubKey(name, key)
+		params = append(params, dsnParam{"serverPubKey", name})
+	}
+	params = append(params, config.DSNParams...)
+
+	for i, param := range params {
+		sep := "&"
+		if i == 0 {
+			sep = "?"
+		}
+		dsn += sep + param.Key + "=" + url.QueryEscape(param.Value)
+	}
+	return dsn, nil
+}
+
+// dsnParam is a driver DSN parameter, from buildDSN or -dsn-param.
+type dsnParam struct {
+	Key   string
+	Value string
+}
+
+// dsnParamFlags are the DSN parameters buildDSN sets from flags, with the
+// flag to use instead of a -dsn-param for each.
+var dsnParamFlags = map[string]string{
+	"tls":                      "-ssl-mode",
+	"allowFallbackToPlaintext": "-ssl-mode",
+	"charset":                  "-charset",
+	"collation":                "-collation",
+	"timeout":                  "-connect-timeout",
+	"readTimeout":              "-read-timeout",
+	"writeTimeout":             "-write-timeout",
+	"compress":                 "-compress",
+	"serverPubKey":             "-server-pubkey",
+}
+
+// parseDSNParams splits each key=value given with -dsn-param. Parameters
+// that a flag sets are dropped with a warning, so the flag always wins; for
+// a parameter given more than once, the last value is used.
+func parseDSNParams(list []string) ([]dsnParam, error) {
+	var params []dsnParam
+	index := make(map[string]int)
+	for _, item := range list {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || key == "" || strings.ContainsAny(key, "&?/ ") {
+			return nil, fmt.Errorf("invalid -dsn-param %q (expected key=value)", item)
+		}
+		if name, ok := dsnParamFlags[key]; ok {
+			slog.Warn(fmt.Sprintf("ignoring -dsn-param %s, which is set by %s", key, name))
+			continue
+		}
+		if i, ok := index[key]; ok {
+			params[i].Value = value
+			continue
+		}
+		index[key] = len(params)
+		params = append(params, dsnParam{key, value})
+	}
+	return params, nil
+}
+
+// printDSN writes the DSN of each server config connects to, with the
+// passwords masked, for -print-dsn.
+func printDSN(config Config) error {
+	configs := []Config{config}
+	if config.ReadHost != "" || config.ReadSocket != "" {
+		configs = append(configs, replicaConfig(config))
+	}
+	for i, server := range configs {
+		if server.Password != "" {
+			server.Password = "****"
+		}
+		dsn, err := buildDSN(server)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			dsn += " (replica)"
+		}
+		fmt.Println(dsn)
+	}
+	return nil
+}
+
+// readServerPubKey reads the server's RSA public key for -server-pubkey, in
+// the PEM form MySQL writes to public_key.pem.
+func readServerPubKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading -server-pubkey: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("-server-pubkey %s contains no PEM data", path)
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -server-pubkey %s: %v", path, err)
+		}
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -server-pubkey %s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("-server-pubkey %s is not an RSA public key", path)
+	}
+	return key, nil
+}
+
+// buildTLSConfig returns the TLS configuration for the SSL mode, or nil when
+// the driver's built-in handling is sufficient.
+func buildTLSConfig(config Config) (*tls.Config, error) {
+	valid := false
+	for _, mode := range sslModes {
+		if config.SSLMode == mode {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid -ssl-mode %q (expected one of disabled, preferred, required, verify-ca, verify-full)", config.SSLMode)
+	}
+	if (config.SSLCert == "") != (config.SSLKey == "") {
+		return nil, fmt.Errorf("-ssl-cert and -ssl-key must be given together")
+	}
+	if config.SSLMode == "disabled" {
+		if config.SSLCA != "" || config.SSLCert != "" {
+			return nil, fmt.Errorf("-ssl-ca, -ssl-cert and -ssl-key cannot be used with -ssl-mode=disabled")
+		}
+		return nil, nil
+	}
+	if config.SSLMode == "preferred" && config.SSLCert == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.SSLCert, config.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if config.SSLCA != "" {
+		pem, err := os.ReadFile(config.SSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ssl-ca: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-ssl-ca %s contains no PEM certificates", config.SSLCA)
+		}
+	}
+
+	switch config.SSLMode {
+	case "preferred", "required":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// Verify the chain but not the host name, which the standard
+		// verification cannot do on its own.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	case "verify-full":
+		tlsConfig.RootCAs = roots
+		tlsConfig.ServerName = config.Host
+	}
+
+	return tlsConfig, nil
+}
+
+// explainConnError adds a hint to TLS certificate and authentication
+// failures, which the driver otherwise reports as bare handshake errors or
+// in terms of its DSN.
+func explainConnError(err error, config Config) error {
+	var tunnel *tunnelError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &tunnel):
+		return tunnel
+	case errors.As(err, &unknownAuthority):
+		if config.SSLCA == "" {
+			return fmt.Errorf("%v: the server certificate is not signed by a trusted CA; pass its CA certificate with -ssl-ca", err)
+		}
+		return fmt.Errorf("%v: the server certificate is not signed by the CA in %s", err, config.SSLCA)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("%v: the certificate does not match -host %s; connect using a name it covers or use -ssl-mode=verify-ca", err, config.Host)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("%v: the server certificate is invalid or expired", err)
+	case errors.Is(err, mysql.ErrNoTLS):
+		return fmt.Errorf("%v: use -ssl-mode=preferred or -ssl-mode=disabled to connect without TLS", err)
+	case strings.Contains(err.Error(), "caching_sha2_password") || strings.HasPrefix(err.Error(), "no pem data found"):
+		// Full caching_sha2_password authentication without TLS encrypts
+		// the password with the server's RSA key, which it did not send.
+		return fmt.Errorf("%v: the account uses caching_sha2_password and the server did not send its RSA public key over the unencrypted connection; "+
+			"connect with TLS (-ssl-mode=preferred or required), pass the key with -server-pubkey (the server's public_key.pem), "+
+			"or log in once with the mysql client so the server caches the password", err)
+	case strings.HasPrefix(err.Error(), "no Pem data found"):
+		// The driver's sha256_password error, spelled apart from the
+		// caching_sha2_password one above.
+		return fmt.Errorf("%v: the account uses sha256_password and the server did not send a usable RSA public key over the unencrypted connection; "+
+			"connect with TLS (-ssl-mode=preferred or required) or pass the key with -server-pubkey (the server's public_key.pem)", err)
+	case errors.Is(err, mysql.ErrCleartextPassword):
+		return fmt.Errorf("the account requires clear text authentication (such as PAM or LDAP); pass -dsn-param allowCleartextPasswords=true, with TLS so the password is not sent in the clear")
+	case errors.Is(err, mysql.ErrOldPassword):
+		return fmt.Errorf("the account uses the insecure pre-4.1 password hashing; pass -dsn-param allowOldPasswords=true, or better, reset its password")
+	case errors.Is(err, mysql.ErrNativePassword):
+		return fmt.Errorf("the account uses mysql_native_password, which -dsn-param allowNativePasswords=false rejects")
+	case errors.Is(err, mysql.ErrUnknownPlugin):
+		return fmt.Errorf("%v: the account's authentication plugin is not supported; supported are caching_sha2_password, mysql_native_password, sha256_password, client_ed25519 (MariaDB) and, with -dsn-param, mysql_clear_password and mysql_old_password", err)
+	}
+	return err
+}
+
+// promptPassword asks for the password on stderr, reading it without echo
+// when stdin is a terminal and as a plain line otherwise. An empty password
+// is allowed.
+func promptPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Enter password: ")
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
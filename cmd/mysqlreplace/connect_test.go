@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// writeTestCerts writes a self-signed CA and a client certificate and key
+// it signed, returning their paths.
+func writeTestCerts(t *testing.T) (ca, cert, key string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca = writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})))
+	cert = writeFile(t, "client-cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER})))
+	key = writeFile(t, "client-key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return ca, cert, key
+}
+
+// testTLSConfig returns the settings to connect to db.internal with.
+func testTLSConfig(mode, ca, cert, key string) Config {
+	config := Config{User: "app", SSLMode: mode, SSLCA: ca, SSLCert: cert, SSLKey: key}
+	config.Host, config.Port, config.Charset = "db.internal", 3306, "utf8mb4"
+	return config
+}
+
+func TestBuildDSNSSLModes(t *testing.T) {
+	ca, cert, key := writeTestCerts(t)
+	tests := []struct {
+		name           string
+		mode           string
+		ca, cert, key  string
+		tls            string // the tls parameter, "custom" for a registered configuration
+		fallback       bool   // allowFallbackToPlaintext=true
+		verifyChain    bool   // the chain is verified by VerifyConnection
+		verifyHostname bool
+		certificates   int
+	}{
+		{name: "disabled", mode: "disabled", tls: "false"},
+		{name: "preferred", mode: "preferred", tls: "preferred"},
+		{name: "preferred with CA", mode: "preferred", ca: ca, tls: "preferred"},
+		{name: "preferred with client certificate", mode: "preferred", cert: cert, key: key, tls: "custom", fallback: true, certificates: 1},
+		{name: "required", mode: "required", tls: "custom"},
+		{name: "required with client certificate", mode: "required", cert: cert, key: key, tls: "custom", certificates: 1},
+		{name: "verify-ca", mode: "verify-ca", ca: ca, tls: "custom", verifyChain: true},
+		{name: "verify-full", mode: "verify-full", ca: ca, tls: "custom", verifyHostname: true},
+		{name: "verify-full with client certificate", mode: "verify-full", ca: ca, cert: cert, key: key, tls: "custom", verifyHostname: true, certificates: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testTLSConfig(tt.mode, tt.ca, tt.cert, tt.key)
+			dsn, err := buildDSN(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, query, _ := strings.Cut(dsn, "?")
+			params, err := url.ParseQuery(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := params.Get("tls")
+			if tt.tls == "custom" {
+				if !strings.HasPrefix(got, tlsConfigName+"-") {
+					t.Errorf("tls=%s, want a registered configuration", got)
+				}
+			} else if got != tt.tls {
+				t.Errorf("tls=%s, want %s", got, tt.tls)
+			}
+			if fallback := params.Get("allowFallbackToPlaintext") == "true"; fallback != tt.fallback {
+				t.Errorf("allowFallbackToPlaintext is %v, want %v", fallback, tt.fallback)
+			}
+
+			tlsConfig, err := buildTLSConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tls != "custom" {
+				if tlsConfig != nil {
+					t.Errorf("got a TLS configuration, want the driver's %s mode", tt.tls)
+				}
+				return
+			}
+			if verifyChain := tlsConfig.VerifyConnection != nil; verifyChain != tt.verifyChain {
+				t.Errorf("chain verified: %v, want %v", verifyChain, tt.verifyChain)
+			}
+			if tlsConfig.InsecureSkipVerify == tt.verifyHostname {
+				t.Errorf("InsecureSkipVerify is %v with host name verification %v", tlsConfig.InsecureSkipVerify, tt.verifyHostname)
+			}
+			if tt.verifyHostname && (tlsConfig.ServerName != "db.internal" || tlsConfig.RootCAs == nil) {
+				t.Errorf("verify-full checks %q against %v", tlsConfig.ServerName, tlsConfig.RootCAs)
+			}
+			if len(tlsConfig.Certificates) != tt.certificates {
+				t.Errorf("%d client certificates, want %d", len(tlsConfig.Certificates), tt.certificates)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	ca, cert, key := writeTestCerts(t)
+	notPEM := writeFile(t, "ca.txt", "not a certificate")
+	tests := []struct {
+		name          string
+		mode          string
+		ca, cert, key string
+		want          string
+	}{
+		{"unknown mode", "verify", "", "", "", "invalid -ssl-mode"},
+		{"certificate without key", "required", "", cert, "", "given together"},
+		{"key without certificate", "required", "", "", key, "given together"},
+		{"CA when disabled", "disabled", ca, "", "", "cannot be used with -ssl-mode=disabled"},
+		{"CA not PEM", "verify-ca", notPEM, "", "", "contains no PEM certificates"},
+		{"missing CA", "verify-ca", ca + ".missing", "", "", "reading -ssl-ca"},
+		{"key of another certificate", "required", "", ca, key, "loading client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildTLSConfig(testTLSConfig(tt.mode, tt.ca, tt.cert, tt.key))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// throttledProxy forwards connections to target at most bytesPerSecond in
+// each direction, as a slow link would, and returns its address.
+func throttledProxy(b *testing.B, target string, bytesPerSecond int) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	pipe := func(dst, src net.Conn) {
+		defer dst.Close()
+		buf := make([]byte, 16<<10)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				time.Sleep(time.Duration(n) * time.Second / time.Duration(bytesPerSecond))
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go pipe(server, client)
+			go pipe(client, server)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// BenchmarkCompressedScan reads a table of wide, repetitive text rows with
+// and without -compress, over the loopback and over a 32 Mbit/s link. It
+// needs MYSQLREPLACE_TEST_DSN to name a scratch database on a server that
+// supports protocol compression.
+func BenchmarkCompressedScan(b *testing.B) {
+	dsn := os.Getenv("MYSQLREPLACE_TEST_DSN")
+	if dsn == "" {
+		b.Skip("MYSQLREPLACE_TEST_DSN is not set")
+	}
+	dsnConfig, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	setup, err := sql.Open("mysql", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer setup.Close()
+	const rows, rowSize = 500, 4 << 10
+	body := strings.Repeat("Visit https://old.example.com/shop for the latest offers. ", rowSize/58+1)[:rowSize]
+	for _, statement := range []string{"DROP TABLE IF EXISTS test_bench_compress", "CREATE TABLE test_bench_compress (id INT PRIMARY KEY, body TEXT)"} {
+		if _, err := setup.Exec(statement); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer setup.Exec("DROP TABLE test_bench_compress")
+	for i := 0; i < rows; i++ {
+		if _, err := setup.Exec("INSERT INTO test_bench_compress VALUES (?, ?)", i, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, link := range []struct {
+		name           string
+		bytesPerSecond int
+	}{
+		{"loopback", 0},
+		{"32Mbit", 4 << 20},
+	} {
+		for _, compress := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/compress=%v", link.name, compress), func(b *testing.B) {
+				addr := dsnConfig.Addr
+				if link.bytesPerSecond > 0 {
+					addr = throttledProxy(b, addr, link.bytesPerSecond)
+				}
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				config := Config{User: dsnConfig.User, Password: dsnConfig.Passwd, SSLMode: "disabled", Compress: compress}
+				config.Host, config.Database, config.Charset = host, dsnConfig.DBName, "utf8mb4"
+				if config.Port, err = strconv.Atoi(port); err != nil {
+					b.Fatal(err)
+				}
+				config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+				db, err := connectDB(config)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+				db.SetMaxOpenConns(1)
+				if compress {
+					var name, value string
+					if err := db.QueryRow("SHOW SESSION STATUS LIKE 'Compression'").Scan(&name, &value); err != nil || !strings.EqualFold(value, "ON") {
+						b.Skip("the server does not support protocol compression")
+					}
+				}
+				b.SetBytes(rows * rowSize)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					result, err := db.Query("SELECT id, body FROM test_bench_compress")
+					if err != nil {
+						b.Fatal(err)
+					}
+					var id int
+					var text string
+					for result.Next() {
+						if err := result.Scan(&id, &text); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if err := result.Err(); err != nil {
+						b.Fatal(err)
+					}
+					result.Close()
+				}
+			})
+		}
+	}
+}
+
+func TestExplainAuthErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"caching_sha2_password without key", errors.New("no pem data found, data: "), "the account uses caching_sha2_password"},
+		{"caching_sha2_password unexpected response", errors.New("unexpected resp from server for caching_sha2_password, perform full authentication"),
+			"pass the key with -server-pubkey"},
+		{"sha256_password without key", errors.New("no Pem data found, data: \x01"), "the account uses sha256_password"},
+		{"clear text", mysql.ErrCleartextPassword, "allowCleartextPasswords=true"},
+		{"old password", mysql.ErrOldPassword, "allowOldPasswords=true"},
+		{"native password", mysql.ErrNativePassword, "allowNativePasswords=false"},
+		{"unknown plugin", fmt.Errorf("auth: %w", mysql.ErrUnknownPlugin), "authentication plugin is not supported"},
+		{"no TLS", mysql.ErrNoTLS, "-ssl-mode=preferred"},
+		{"other", errors.New("Error 1045 (28000): Access denied"), "Error 1045 (28000): Access denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := explainConnError(tt.err, Config{}).Error()
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
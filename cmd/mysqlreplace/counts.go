@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+// countReport is one database's report for printCounts.
+type countReport struct {
+	Database string
+	Report   *mysqlreplace.Report
+}
+
+// printCounts writes the -count-only results as a table: for each table
+// with matches, the rows with at least one match and the occurrences in
+// each column. The database column is only shown for several databases.
+func printCounts(w io.Writer, reports []countReport) error {
+	multi := len(reports) > 1
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if multi {
+		fmt.Fprint(tw, "DATABASE\t")
+	}
+	fmt.Fprintln(tw, "TABLE\tROWS\tCOLUMN\tOCCURRENCES")
+
+	var totalRows, totalOccurrences int
+	for _, cr := range reports {
+		for _, table := range cr.Report.Tables {
+			if table.MatchedRows == 0 {
+				continue
+			}
+			columns := make([]string, 0, len(table.Occurrences))
+			for col := range table.Occurrences {
+				columns = append(columns, col)
+			}
+			sort.Strings(columns)
+			for i, col := range columns {
+				if multi {
+					fmt.Fprintf(tw, "%s\t", cr.Database)
+				}
+				if i == 0 {
+					fmt.Fprintf(tw, "%s\t%d\t", table.Name, table.MatchedRows)
+				} else {
+					fmt.Fprint(tw, "\t\t")
+				}
+				fmt.Fprintf(tw, "%s\t%d\n", col, table.Occurrences[col])
+			}
+		}
+		totalRows += cr.Report.Totals.MatchedRows
+		totalOccurrences += cr.Report.Totals.Occurrences
+	}
+	if multi {
+		fmt.Fprint(tw, "\t")
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t\t%d\n", totalRows, totalOccurrences)
+	return tw.Flush()
+}
+
+// countsOutput returns where printCounts writes: stdout, unless the JSON
+// report is going there.
+func countsOutput(config Config) io.Writer {
+	if config.ReportJSON == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
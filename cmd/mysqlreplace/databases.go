@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+// serverReport is the JSON report of a run over several databases.
+type serverReport struct {
+	SchemaVersion       int                       `json:"schema_version"`
+	Host                string                    `json:"host"`
+	StartedAt           time.Time                 `json:"started_at"`
+	FinishedAt          time.Time                 `json:"finished_at"`
+	DurationSeconds     float64                   `json:"duration_seconds"`
+	Interrupted         bool                      `json:"interrupted"`
+	Quit                bool                      `json:"quit,omitempty"`
+	CapReached          bool                      `json:"cap_reached,omitempty"`
+	WouldExceedCap      bool                      `json:"would_exceed_cap,omitempty"`
+	DatabasesSelected   int                       `json:"databases_selected"`
+	DatabasesFailed     int                       `json:"databases_failed"`
+	DatabasesNotStarted int                       `json:"databases_not_started"`
+	Totals              mysqlreplace.ReportTotals `json:"totals"`
+	VerifyRemaining     int                       `json:"verify_remaining,omitempty"`
+	VerifyTablesFailed  int                       `json:"verify_tables_failed,omitempty"`
+	Databases           []databaseReport          `json:"databases"`
+}
+
+// databaseReport is one database's entry in the server report. Status is
+// one of "ok", "failed", "interrupted" or "not_started"; failed tables of a
+// database that was processed are reported in its Report, which is missing
+// when the database could not be processed at all.
+type databaseReport struct {
+	Database string               `json:"database"`
+	Status   string               `json:"status"`
+	Error    string               `json:"error,omitempty"`
+	Report   *mysqlreplace.Report `json:"report,omitempty"`
+}
+
+// runDatabases processes each database selected by -all-databases or
+// -databases, over a connection pool of its own, and returns the exit
+// status. A database that fails is reported and the others still run,
+// unless -fail-fast is given. -concurrency is shared out by
+// databaseWorkers.
+func runDatabases(ctx context.Context, config Config) int {
+	startedAt := time.Now()
+
+	db, err := connectDB(config)
+	if err != nil {
+		fatalf("Failed to connect to database server: %v", err)
+	}
+	databases, err := selectDatabases(ctx, db, config)
+	db.Close()
+	if err != nil {
+		fatalf("Invalid database selection: %v", err)
+	}
+	if len(databases) == 0 {
+		fatalf("No databases to process")
+	}
+	if err := checkScopedTables(config, databases); err != nil {
+		fatalf("Invalid table selection: %v", err)
+	}
+	slog.Debug("selected databases", "databases", strings.Join(databases, ","))
+
+	report := serverReport{
+		SchemaVersion:     mysqlreplace.ReportSchemaVersion,
+		Host:              config.Host,
+		StartedAt:         startedAt,
+		DatabasesSelected: len(databases),
+	}
+	failed := make(map[string]error)
+	var prompt *rowPrompt
+	if config.ConfirmEach {
+		prompt = newRowPrompt(config)
+	}
+
+	if config.WritesDatabase() && !config.Yes {
+		var plans []databasePlan
+		for _, name := range databases {
+			tables, err := planDatabase(ctx, config, name)
+			if err != nil {
+				slog.Error("could not plan database", "database", name, "err", err)
+				failed[name] = err
+				continue
+			}
+			plans = append(plans, databasePlan{Database: name, Tables: tables})
+		}
+		if len(plans) == 0 {
+			fatalf("No databases could be read")
+		}
+		if err := confirmRun(ctx, plans, config); err != nil {
+			fatalf("Aborted: %v", err)
+		}
+	}
+
+	workers, perDatabase := databaseWorkers(config, len(databases))
+	if workers > 1 {
+		slog.Debug("processing databases in parallel", "databases", workers, "tables_per_database", perDatabase)
+	}
+	config.Concurrency = perDatabase
+	config.MaxUpdatesPerSecond /= float64(workers)
+	// One counter makes -max-total-replacements a cap on the whole server.
+	if config.MaxTotalReplacements > 0 {
+		config.ReplacementCounter = mysqlreplace.NewReplacementCounter()
+	}
+
+	// Entries are kept in selection order; those left nil never started.
+	entries := make([]*databaseReport, len(databases))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	stop := false
+	slots := make(chan struct{}, workers)
+	for i, name := range databases {
+		slots <- struct{}{}
+		mu.Lock()
+		halt := stop
+		mu.Unlock()
+		if ctx.Err() != nil || halt {
+			break
+		}
+		if err, ok := failed[name]; ok {
+			<-slots
+			entries[i] = &databaseReport{Database: name, Status: "failed", Error: err.Error()}
+			if config.FailFast {
+				slog.Error("stopping after error (-fail-fast)", "database", name)
+				break
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			entry := runDatabase(ctx, config, name, prompt)
+			mu.Lock()
+			defer mu.Unlock()
+			entries[i] = &entry
+			if entry.Report != nil && (entry.Report.Quit || entry.Report.CapReached) {
+				stop = true
+			}
+			if config.FailFast && databaseFailed(entry) && !stop {
+				slog.Error("stopping after error (-fail-fast)", "database", name)
+				stop = true
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, entry := range entries {
+		if entry == nil {
+			report.Databases = append(report.Databases, databaseReport{Database: databases[i], Status: "not_started"})
+			report.DatabasesNotStarted++
+			continue
+		}
+		if entry.Status == "failed" {
+			report.DatabasesFailed++
+		}
+		if entry.Report != nil {
+			addTotals(&report.Totals, entry.Report.Totals)
+			report.Quit = report.Quit || entry.Report.Quit
+			report.CapReached = report.CapReached || entry.Report.CapReached
+			report.WouldExceedCap = report.WouldExceedCap || entry.Report.WouldExceedCap
+			if verify := entry.Report.Verify; verify != nil {
+				report.VerifyRemaining += verify.Remaining
+				report.VerifyTablesFailed += verify.TablesFailed
+			}
+		}
+		report.Databases = append(report.Databases, *entry)
+	}
+	report.Interrupted = ctx.Err() != nil
+	report.FinishedAt = time.Now()
+	report.DurationSeconds = report.FinishedAt.Sub(startedAt).Seconds()
+	if report.DurationSeconds > 0 {
+		report.Totals.RowsPerSecond = float64(report.Totals.RowsScanned) / report.DurationSeconds
+		report.Totals.BytesPerSecond = float64(report.Totals.BytesScanned) / report.DurationSeconds
+		report.Totals.UpdatesPerSecond = float64(report.Totals.RowsUpdated) / report.DurationSeconds
+	}
+
+	for _, entry := range report.Databases {
+		switch {
+		case entry.Report != nil:
+			totals := entry.Report.Totals
+			summaryf("Database %s: %d replacements across %d tables, %d tables failed%s",
+				entry.Database, totals.Replacements, totals.TablesChanged, totals.TablesFailed, statusNote(entry.Status))
+		case entry.Status == "not_started":
+			summaryf("Database %s: not started", entry.Database)
+		default:
+			summaryf("Database %s: %s: %s", entry.Database, entry.Status, entry.Error)
+		}
+	}
+	summaryf("Databases: %d selected, %d failed, %d not started; %d replacements across %d tables",
+		report.DatabasesSelected, report.DatabasesFailed, report.DatabasesNotStarted,
+		report.Totals.Replacements, report.Totals.TablesChanged)
+
+	if config.CountOnly {
+		var counts []countReport
+		for _, entry := range report.Databases {
+			if entry.Report != nil {
+				counts = append(counts, countReport{Database: entry.Database, Report: entry.Report})
+			}
+		}
+		if err := printCounts(countsOutput(config), counts); err != nil {
+			fatalf("Failed to write counts: %v", err)
+		}
+	}
+	if config.ReportJSON != "" {
+		if err := writeServerReport(config.ReportJSON, report); err != nil {
+			fatalf("Failed to write JSON report: %v", err)
+		}
+	}
+
+	switch {
+	case report.Interrupted || report.Quit:
+		return exitInterrupted
+	case report.CapReached || report.WouldExceedCap:
+		return exitCapReached
+	case report.DatabasesFailed > 0 || report.Totals.TablesFailed > 0:
+		return exitTableErrors
+	case report.VerifyRemaining > 0 || report.VerifyTablesFailed > 0:
+		return exitRemaining
+	case report.Totals.Replacements == 0 && report.Totals.Occurrences == 0:
+		return exitNoMatches
+	}
+	return exitOK
+}
+
+// selectDatabases returns the databases to process: every database on the
+// server for -all-databases, or the -databases names, which must all exist.
+func selectDatabases(ctx context.Context, db *sql.DB, config Config) ([]string, error) {
+	available, err := mysqlreplace.ListDatabases(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if config.AllDatabases {
+		return available, nil
+	}
+	var missing []string
+	for _, name := range config.Databases {
+		found := false
+		for _, db := range available {
+			if db == name {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no such database (or a system schema): %s", strings.Join(missing, ", "))
+	}
+	return config.Databases, nil
+}
+
+// databaseWorkers returns how many of count databases to process at once
+// and how many tables of each, so that no more than -concurrency tables are
+// in progress: databases are run side by side first, and any workers left
+// over go to their tables. -confirm-each asks about one row at a time, so it
+// processes one database at a time.
+func databaseWorkers(config Config, count int) (int, int) {
+	total := config.Concurrency
+	if total < 1 {
+		total = 1
+	}
+	workers := min(total, count)
+	if config.ConfirmEach && workers > 1 {
+		slog.Warn("processing databases one at a time so rows can be approved in turn")
+		workers = 1
+	}
+	return workers, max(1, total/workers)
+}
+
+// databaseFailed reports whether a database, or one of its tables, failed,
+// for -fail-fast.
+func databaseFailed(entry databaseReport) bool {
+	return entry.Status == "failed" || (entry.Report != nil && entry.Report.Totals.TablesFailed > 0)
+}
+
+// checkScopedTables checks that the -tables, -exclude-tables and
+// -allow-large-tables entries written as database.table name a database of
+// the run.
+func checkScopedTables(config Config, databases []string) error {
+	selected := make(map[string]bool, len(databases))
+	for _, name := range databases {
+		selected[name] = true
+	}
+	for _, list := range [][]string{config.Tables, config.ExcludeTables, config.AllowLargeTables} {
+		for _, entry := range list {
+			database, _, scoped := strings.Cut(entry, ".")
+			if scoped && !selected[database] {
+				return fmt.Errorf("%s names the database %s, which is not selected", entry, database)
+			}
+		}
+	}
+	return nil
+}
+
+// scopeTables returns the entries of list that apply to database: those
+// without a database, and those written as database.table, without it.
+// Entries for other databases are left out.
+func scopeTables(list []string, database string) []string {
+	var scoped []string
+	for _, entry := range list {
+		name, table, ok := strings.Cut(entry, ".")
+		switch {
+		case !ok:
+			scoped = append(scoped, entry)
+		case name == database:
+			scoped = append(scoped, table)
+		}
+	}
+	return scoped
+}
+
+// databaseConfig returns config for processing one database, logging with
+// its name and with the table filters scoped to it by scopeTables. Each
+// database writes its own -output-sql, -audit-csv, -undo-file,
+// -snapshot-dir and -checkpoint, named by inserting the database name
+// before the file extension.
+func databaseConfig(config Config, name string) Config {
+	config.Database = name
+	config.Logger = slog.With("database", name)
+	config.Tables = scopeTables(config.Tables, name)
+	config.ExcludeTables = scopeTables(config.ExcludeTables, name)
+	config.AllowLargeTables = scopeTables(config.AllowLargeTables, name)
+	config.OutputSQL = databasePath(config.OutputSQL, name)
+	config.AuditCSV = databasePath(config.AuditCSV, name)
+	config.UndoFile = databasePath(config.UndoFile, name)
+	config.SnapshotDir = databasePath(config.SnapshotDir, name)
+	config.ChangedKeysFile = databasePath(config.ChangedKeysFile, name)
+	config.Checkpoint = databasePath(config.Checkpoint, name)
+	return config
+}
+
+// databasePath turns out.sql into out.<database>.sql.
+func databasePath(path, database string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + database + ext
+}
+
+func planDatabase(ctx context.Context, config Config, name string) ([]mysqlreplace.TablePlan, error) {
+	config = databaseConfig(config, name)
+	db, err := connectDB(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer db.Close()
+	if config.WordPress {
+		if err := applyWordPress(ctx, db, &config, true); err != nil {
+			return nil, fmt.Errorf("WordPress preset: %w", err)
+		}
+	}
+	replacer, err := mysqlreplace.New(db, config.Config)
+	if err != nil {
+		return nil, err
+	}
+	return replacer.Plan(ctx)
+}
+
+// runDatabase processes one database. Its own confirmation, if any, has
+// already been given; prompt, if set, asks about each changed row.
+func runDatabase(ctx context.Context, config Config, name string, prompt *rowPrompt) databaseReport {
+	config = databaseConfig(config, name)
+	entry := databaseReport{Database: name, Status: "ok"}
+
+	db, err := connectDB(config)
+	if err != nil {
+		config.log().Error("failed to connect to database", "err", err)
+		entry.Status, entry.Error = "failed", err.Error()
+		return entry
+	}
+	defer db.Close()
+
+	if config.WordPress {
+		// The site was already logged when planning the confirmation.
+		if err := applyWordPress(ctx, db, &config, config.Yes || !config.WritesDatabase()); err != nil {
+			config.log().Error("WordPress preset failed", "err", err)
+			entry.Status, entry.Error = "failed", "WordPress preset: "+err.Error()
+			return entry
+		}
+	}
+
+	replica, err := connectReplica(config)
+	if err != nil {
+		config.log().Error("failed to connect to the replica", "err", err)
+		entry.Status, entry.Error = "failed", "replica: "+err.Error()
+		return entry
+	}
+	if replica != nil {
+		defer replica.Close()
+	}
+
+	replacer, err := mysqlreplace.New(db, config.Config)
+	if err != nil {
+		entry.Status, entry.Error = "failed", err.Error()
+		return entry
+	}
+	replacer.ReadFrom = replica
+	if prompt != nil {
+		replacer.Approve = prompt.approve
+	}
+	report, err := replacer.Run(ctx)
+	entry.Report = report
+	switch {
+	case ctx.Err() != nil:
+		entry.Status = "interrupted"
+	case err != nil:
+		config.log().Error("database failed", "err", err)
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	return entry
+}
+
+func statusNote(status string) string {
+	if status == "interrupted" {
+		return " (interrupted)"
+	}
+	return ""
+}
+
+func addTotals(sum *mysqlreplace.ReportTotals, t mysqlreplace.ReportTotals) {
+	sum.TablesSelected += t.TablesSelected
+	sum.TablesChanged += t.TablesChanged
+	sum.TablesFailed += t.TablesFailed
+	sum.TablesInterrupted += t.TablesInterrupted
+	sum.TablesCapped += t.TablesCapped
+	sum.TablesNotStarted += t.TablesNotStarted
+	sum.TablesCheckpoint += t.TablesCheckpoint
+	sum.TablesExcluded += t.TablesExcluded
+	sum.TablesTooLarge += t.TablesTooLarge
+	sum.TablesNoText += t.TablesNoText
+	sum.TablesWhereSkipped += t.TablesWhereSkipped
+	sum.TablesLimited += t.TablesLimited
+	sum.ViewsSkipped += t.ViewsSkipped
+	sum.RowsScanned += t.RowsScanned
+	sum.RowsUpdated += t.RowsUpdated
+	sum.BytesScanned += t.BytesScanned
+	sum.DBWaitSeconds += t.DBWaitSeconds
+	sum.ProcessingSeconds += t.ProcessingSeconds
+	sum.Replacements += t.Replacements
+	sum.Base64Values += t.Base64Values
+	sum.CompressedValues += t.CompressedValues
+	sum.OccurrencesReplaced += t.OccurrencesReplaced
+	sum.NulledValues += t.NulledValues
+	sum.Occurrences += t.Occurrences
+	sum.MatchedRows += t.MatchedRows
+	sum.LockRetries += t.LockRetries
+	sum.Reconnects += t.Reconnects
+	sum.Timeouts += t.Timeouts
+	sum.RowsSkipped += t.RowsSkipped
+	sum.ChangedSinceRead += t.ChangedSinceRead
+	sum.DuplicateRows += t.DuplicateRows
+	sum.DuplicatesSkipped += t.DuplicatesSkipped
+	sum.UnexpectedAffected += t.UnexpectedAffected
+	sum.ExcludedMatches += t.ExcludedMatches
+	sum.OversizeValues += t.OversizeValues
+	sum.RejectedRows += t.RejectedRows
+}
+
+// writeServerReport writes the report to path, or to stdout for "-".
+func writeServerReport(path string, report serverReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
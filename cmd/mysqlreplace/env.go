@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variable of every flag, see envName.
+const envPrefix = "MYSQLREPLACE_"
+
+// envName returns the environment variable for a flag: -ssl-ca is read
+// from MYSQLREPLACE_SSL_CA.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// addEnvUsage appends each flag's environment variable to its usage, for
+// -help.
+func addEnvUsage(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		f.Usage += " [$" + envName(f.Name) + "]"
+	})
+}
+
+// applyEnvironment sets each flag not given on the command line from its
+// environment variable, if that is set. A flag set this way counts as given
+// for everything that follows, so it overrides option files like a flag
+// does. Repeatable flags take a single value from the environment.
+func applyEnvironment(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s=%q for -%s: %v", name, value, f.Name, valueError(f, setErr))
+		}
+	})
+	return err
+}
+
+// valueError describes what a flag expects, since the flag package reports
+// bad booleans and numbers as bare parse errors.
+func valueError(f *flag.Flag, err error) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return "expected true or false (or 1 or 0)"
+	}
+	if msg := err.Error(); strings.HasSuffix(msg, "parse error") || strings.HasSuffix(msg, "value out of range") {
+		typ, _ := flag.UnquoteUsage(f)
+		if typ == "" {
+			typ = "value"
+		}
+		return "expected a valid " + typ
+	}
+	return err.Error()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/wltechblog/mysqlreplace"
+	"golang.org/x/term"
+)
+
+// logFile is the -log-file, closed by exit.
+var logFile *os.File
+
+// setupLogging sends all logging to stderr at the level selected by -v and
+// -quiet, and also to -log-file if set. stdout is left for machine-readable
+// output. Only stderr is colored.
+func setupLogging(config Config) {
+	level := slog.LevelInfo
+	switch {
+	case config.Quiet:
+		level = slog.LevelError
+	case config.Verbose:
+		level = slog.LevelDebug
+	}
+	handler := mysqlreplace.NewLogHandler(level)
+	if useColor(config) {
+		handler = mysqlreplace.NewColorLogHandler(level)
+	}
+	slog.SetDefault(slog.New(handler))
+	if config.LogFile == "" {
+		return
+	}
+
+	file, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		fatalf("Failed to open log file: %v", err)
+	}
+	logFile = file
+	slog.SetDefault(slog.New(teeHandler{handler, mysqlreplace.NewWriterLogHandler(file, level)}))
+}
+
+// useColor reports whether to color the output on stderr for -color: with
+// auto, when stderr is a terminal and NO_COLOR is not set.
+func useColor(config Config) bool {
+	switch config.Color {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return !noColor && os.Getenv("TERM") != "dumb" && term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// painter returns a function coloring text with the ANSI color code, or
+// leaving it as it is when color is off.
+func painter(color bool, code string) func(string) string {
+	return func(s string) string {
+		if !color {
+			return s
+		}
+		return mysqlreplace.Paint(code, s)
+	}
+}
+
+// teeHandler passes every record to each of its handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, record.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// exit closes the log file and exits with code.
+func exit(code int) {
+	if logFile != nil {
+		logFile.Sync()
+		logFile.Close()
+	}
+	os.Exit(code)
+}
+
+// log returns the logger of config, which carries the database with
+// -all-databases and -databases.
+func (c Config) log() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// fatalf logs an error and exits with exitFatal.
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	exit(exitFatal)
+}
+
+// summaryf logs a line of the end-of-run summary.
+func summaryf(format string, args ...interface{}) {
+	slog.Log(context.Background(), mysqlreplace.LevelSummary, fmt.Sprintf(format, args...))
+}
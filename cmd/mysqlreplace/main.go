@@ -0,0 +1,821 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wltechblog/mysqlreplace"
+	"golang.org/x/term"
+)
+
+// Config is the command-line configuration: the library configuration plus
+// the connection and output settings handled by the command.
+type Config struct {
+	mysqlreplace.Config
+
+	Socket   string
+	User     string
+	Password string
+
+	SSLMode string
+	SSLCA   string
+	SSLCert string
+	SSLKey  string
+
+	// SSHHost carries the MySQL connections through an SSH tunnel to this
+	// host, see openTunnel.
+	SSHHost                  string
+	SSHPort                  int
+	SSHUser                  string
+	SSHKey                   string
+	SSHInsecureIgnoreHostKey bool
+
+	// ServerPubKey is a PEM file of the server's RSA public key, used to
+	// send the password without TLS.
+	ServerPubKey string
+
+	Charset   string
+	Collation string
+	// Compress enables the protocol's zlib compression.
+	Compress bool
+
+	// ConnectTimeout bounds dialing and the initial ping; ReadTimeout and
+	// WriteTimeout are the driver's I/O timeouts. The pool settings are
+	// applied when non-zero.
+	ConnectTimeout  time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// DSNParams are added to the DSN after the parameters the flags set;
+	// PrintDSN prints the resulting DSN and exits.
+	DSNParams []dsnParam
+	PrintDSN  bool
+	// PrintConfig prints the value of every flag and exits.
+	PrintConfig bool
+
+	// ReadHost or ReadSocket selects a replica to scan; the other Read
+	// settings default to those of the primary. See replicaConfig.
+	ReadHost     string
+	ReadPort     int
+	ReadSocket   string
+	ReadUser     string
+	ReadPassword string
+	ReadSSLMode  string
+	ReadSSLCA    string
+	// ReadServerPubKey is not taken from the primary: each server has a key
+	// of its own.
+	ReadServerPubKey string
+
+	PairsFile  string
+	RulesFile  string
+	ReportJSON string
+
+	// WordPress applies the WordPress preset, see applyWordPress.
+	WordPress   bool
+	IncludeGUID bool
+	WPPrefix    string
+
+	// AllDatabases and Databases process several databases in turn instead
+	// of Database.
+	AllDatabases bool
+	Databases    []string
+
+	Verbose bool
+	// Quiet limits logging to errors and the final summary.
+	Quiet bool
+	// LogFile also appends all logging to this file.
+	LogFile string
+	// Color is auto, always or never: whether to color the output on stderr.
+	Color string
+	Yes   bool
+
+	// AllowEmptyReplace permits pairs that delete their matches, and Force
+	// pairs that change nothing or multiply their matches. See
+	// checkReplacements.
+	AllowEmptyReplace bool
+	Force             bool
+
+	// ConfirmEach asks on the terminal before writing each changed row.
+	ConfirmEach bool
+}
+
+// Exit statuses. fatalf exits with exitFatal.
+const (
+	// exitOK: the run completed and made (or would make) replacements.
+	exitOK = 0
+	// exitFatal: a usage, connection or other fatal error stopped the run.
+	exitFatal = 1
+	// exitNoMatches: the run completed but nothing matched.
+	exitNoMatches = 2
+	// exitTableErrors: one or more tables (or databases) failed but the run
+	// continued.
+	exitTableErrors = 3
+	// exitRemaining: -verify found matches left after the run, or tables it
+	// could not scan.
+	exitRemaining = 4
+	// exitCapReached: the run stopped at -max-total-replacements, or a dry
+	// run would have gone over it.
+	exitCapReached = 5
+	// exitInterrupted: SIGINT or SIGTERM, following the shell convention
+	// of 128 + SIGINT, or quitting at the -confirm-each prompt.
+	exitInterrupted = 130
+)
+
+const exitStatusHelp = `
+Exit status:
+  0    the run completed and replacements were made (or would be, with -dry-run)
+  1    fatal error: invalid usage, connection failure or similar
+  2    the run completed but no matches were found
+  3    one or more tables or databases failed; the remaining ones were processed
+  4    -verify found matches left after the run, or tables it could not scan
+  5    the run stopped at -max-total-replacements, or a dry run would exceed it
+  130  interrupted by SIGINT or SIGTERM, or quit at the -confirm-each prompt
+
+Environment:
+  Each flag not given on the command line is read from the variable shown
+  in brackets after it, e.g. MYSQLREPLACE_PASSWORD for -password. Repeatable
+  flags such as -search take a single value this way.
+`
+
+func main() {
+	config := parseFlags()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	if config.PrintConfig {
+		if err := printConfig(os.Stdout, flag.CommandLine); err != nil {
+			fatalf("Failed to print the configuration: %v", err)
+		}
+	}
+	if config.PrintDSN {
+		if err := printDSN(config); err != nil {
+			fatalf("Failed to build the DSN: %v", err)
+		}
+	}
+	if config.PrintConfig || config.PrintDSN {
+		os.Exit(exitOK)
+	}
+
+	if config.SSHHost != "" {
+		closeTunnel, err := openTunnel(config)
+		if err != nil {
+			fatalf("Failed to open the SSH tunnel: %v", err)
+		}
+		defer closeTunnel()
+	}
+
+	if config.AllDatabases || len(config.Databases) > 0 {
+		exit(runDatabases(ctx, config))
+	}
+
+	db, err := connectDB(config)
+	if err != nil {
+		fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if config.Socket != "" {
+		slog.Debug("connected over Unix socket", "database", config.Database, "user", config.User, "socket", config.Socket)
+	} else {
+		slog.Debug("connected over TCP", "database", config.Database, "user", config.User, "host", config.Host, "port", config.Port, "ssl_mode", config.SSLMode)
+	}
+
+	if config.WordPress {
+		if err := applyWordPress(ctx, db, &config, true); err != nil {
+			fatalf("WordPress preset: %v", err)
+		}
+	}
+
+	replica, err := connectReplica(config)
+	if err != nil {
+		fatalf("Failed to connect to the replica: %v", err)
+	}
+	if replica != nil {
+		defer replica.Close()
+	}
+
+	replacer, err := mysqlreplace.New(db, config.Config)
+	if err != nil {
+		fatalf("Invalid configuration: %v", err)
+	}
+	replacer.ReadFrom = replica
+	if config.ConfirmEach {
+		replacer.Approve = newRowPrompt(config).approve
+	}
+	if !config.Yes {
+		replacer.Confirm = func(ctx context.Context, plan []mysqlreplace.TablePlan) error {
+			return confirmRun(ctx, []databasePlan{{Database: config.Database, Tables: plan}}, config)
+		}
+	}
+
+	report, err := replacer.Run(ctx)
+	if report == nil {
+		fatalf("Run failed: %v", err)
+	}
+
+	if config.CountOnly {
+		if err := printCounts(countsOutput(config), []countReport{{Database: config.Database, Report: report}}); err != nil {
+			fatalf("Failed to write counts: %v", err)
+		}
+	}
+	if config.ReportJSON != "" {
+		if err := writeReport(config.ReportJSON, report); err != nil {
+			fatalf("Failed to write JSON report: %v", err)
+		}
+	}
+
+	switch {
+	case report.Interrupted || report.Quit:
+		exit(exitInterrupted)
+	case report.CapReached || report.WouldExceedCap:
+		exit(exitCapReached)
+	case report.Totals.TablesFailed > 0:
+		exit(exitTableErrors)
+	case verifyFailed(report.Verify):
+		exit(exitRemaining)
+	case report.Totals.Replacements == 0 && report.Totals.Occurrences == 0:
+		exit(exitNoMatches)
+	}
+	exit(exitOK)
+}
+
+// verifyFailed reports whether -verify found matches left or could not
+// scan some tables.
+func verifyFailed(verify *mysqlreplace.VerifyReport) bool {
+	return verify != nil && (verify.Remaining > 0 || verify.TablesFailed > 0)
+}
+
+// writeReport writes the JSON report to path, or to stdout for "-".
+func writeReport(path string, report *mysqlreplace.Report) error {
+	if path == "-" {
+		return report.WriteJSON(os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteJSON(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// handleSignals cancels the run on the first SIGINT or SIGTERM so the
+// current table can stop cleanly, and exits immediately on the second.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Warn(fmt.Sprintf("received %s, stopping after the current statement (send again to exit immediately)", sig))
+		cancel()
+		<-signals
+		slog.Error("received second signal, exiting immediately")
+		exit(exitInterrupted)
+	}()
+}
+
+func parseFlags() Config {
+	config := Config{}
+	// Exit with exitFatal on flag errors rather than the flag package's
+	// default of 2, which means "no matches" here.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitStatusHelp)
+	}
+	configFile := flag.String("config", "", "Read flags not given on the command line from this TOML file, keyed by flag name")
+	flag.BoolVar(&config.PrintConfig, "print-config", false, "Print the effective value of every flag, as a -config file with the passwords masked, and exit")
+	defaultsFile := flag.String("defaults-file", "", "Read connection settings only from this option file instead of the standard my.cnf locations")
+	flag.StringVar(&config.Host, "host", "localhost", "MySQL host")
+	flag.IntVar(&config.Port, "port", 3306, "MySQL port")
+	flag.StringVar(&config.Socket, "socket", "", "Connect through this Unix socket instead of TCP")
+	flag.StringVar(&config.User, "user", "", "MySQL user")
+	flag.StringVar(&config.Password, "password", "", "MySQL password")
+	askPass := flag.Bool("ask-pass", false, "Prompt for the password on the terminal (MYSQL_PWD is used when no password is given)")
+	flag.StringVar(&config.Database, "database", "", "Database name")
+	flag.BoolVar(&config.AllDatabases, "all-databases", false, "Process every database on the server except the system schemas")
+	databases := flag.String("databases", "", "Comma-separated databases to process in turn, instead of -database")
+	flag.StringVar(&config.SSLMode, "ssl-mode", "", "TLS mode: disabled, preferred, required, verify-ca or verify-full (default preferred, or verify-ca with -ssl-ca)")
+	flag.StringVar(&config.SSLCA, "ssl-ca", "", "PEM file of CA certificates used to verify the server")
+	flag.StringVar(&config.SSLCert, "ssl-cert", "", "PEM client certificate file")
+	flag.StringVar(&config.SSLKey, "ssl-key", "", "PEM client private key file")
+	flag.StringVar(&config.SSHHost, "ssh-host", "", "Connect to MySQL through an SSH tunnel to this bastion host; -host is then resolved by the bastion")
+	flag.IntVar(&config.SSHPort, "ssh-port", 22, "SSH port of -ssh-host")
+	flag.StringVar(&config.SSHUser, "ssh-user", "", "SSH user (default: the OS login name)")
+	flag.StringVar(&config.SSHKey, "ssh-key", "", "Private key file to log in to -ssh-host with (keys of a running ssh-agent are also tried)")
+	flag.BoolVar(&config.SSHInsecureIgnoreHostKey, "ssh-insecure-ignore-hostkey", false, "Do not verify the host key of -ssh-host against ~/.ssh/known_hosts")
+	flag.StringVar(&config.ServerPubKey, "server-pubkey", "", "PEM file of the server's RSA public key, to authenticate caching_sha2_password and sha256_password accounts without TLS")
+	flag.StringVar(&config.ReadHost, "read-host", "", "Scan rows on this replica and only send the updates to -host; updates skip rows that changed since they were read")
+	flag.IntVar(&config.ReadPort, "read-port", 0, "Replica port (default: -port)")
+	flag.StringVar(&config.ReadSocket, "read-socket", "", "Scan rows on the replica at this Unix socket, instead of -read-host")
+	flag.StringVar(&config.ReadUser, "read-user", "", "Replica user (default: -user)")
+	flag.StringVar(&config.ReadPassword, "read-password", "", "Replica password (default: the primary's password)")
+	flag.StringVar(&config.ReadSSLMode, "read-ssl-mode", "", "TLS mode for the replica (default: as for the primary)")
+	flag.StringVar(&config.ReadSSLCA, "read-ssl-ca", "", "PEM file of CA certificates used to verify the replica (default: -ssl-ca)")
+	flag.StringVar(&config.ReadServerPubKey, "read-server-pubkey", "", "PEM file of the replica's RSA public key (not taken from -server-pubkey)")
+	flag.StringVar(&config.Charset, "charset", "utf8mb4", "Connection character set")
+	flag.StringVar(&config.Collation, "collation", "utf8mb4_unicode_ci", "Connection collation (empty for the character set's default)")
+	flag.DurationVar(&config.ConnectTimeout, "connect-timeout", 10*time.Second, "Give up connecting to a server after this long (0 for no limit)")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", 0, "Fail a connection that waits this long for data from the server (0 for no limit)")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", 0, "Fail a connection that waits this long to send data to the server (0 for no limit)")
+	flag.IntVar(&config.MaxOpenConns, "max-open-conns", 0, "Maximum open connections per server (0: twice -concurrency)")
+	flag.IntVar(&config.MaxIdleConns, "max-idle-conns", 0, "Maximum idle connections kept per server (0: the driver's default, or twice -concurrency)")
+	flag.DurationVar(&config.ConnMaxLifetime, "conn-max-lifetime", 0, "Close pooled connections once they are this old (0 for no limit)")
+	flag.BoolVar(&config.Compress, "compress", false, "Compress the traffic to and from the server, for runs over slow links")
+	var dsnParams stringList
+	flag.Var(&dsnParams, "dsn-param", "Add a go-sql-driver DSN parameter as key=value, e.g. interpolateParams=true (repeatable; parameters set by other flags are ignored)")
+	flag.BoolVar(&config.PrintDSN, "print-dsn", false, "Print the DSN used to connect, with the password masked, and exit")
+	var searches, replaces stringList
+	flag.Var(&searches, "search", "String to search for (repeat with -replace for multiple pairs)")
+	flag.Var(&replaces, "replace", "String to replace with (one per -search, in the same order)")
+	flag.BoolVar(&config.AllowEmptyReplace, "allow-empty-replace", false, "Allow an empty or missing -replace, which deletes every match")
+	flag.BoolVar(&config.Force, "force", false, "Run even when a -search is the same as its -replace, or its -replace contains it more than once")
+	flag.StringVar(&config.PairsFile, "pairs-file", "", "File of tab-separated search/replace pairs, one per line, applied after any -search flags")
+	flag.BoolVar(&config.Verbose, "v", false, "Enable verbose (debug) output")
+	flag.BoolVar(&config.Quiet, "quiet", false, "Only log errors and the final summary")
+	flag.StringVar(&config.LogFile, "log-file", "", "Also append all log output to this file")
+	flag.StringVar(&config.Color, "color", "auto", "Color the output on stderr: auto (when it is a terminal), always, or never")
+	flag.IntVar(&config.LogNoMatch, "log-no-match", 3, "With -v, log unmatched values for the first N rows of each table (0 disables)")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Report replacements without updating the database")
+	flag.BoolVar(&config.CountOnly, "count-only", false, "Only count the occurrences of each -search per table and column (no -replace needed)")
+	flag.BoolVar(&config.SetNull, "set-null", false, "Set values containing a -search string to NULL instead of replacing in them (no -replace); NOT NULL columns are skipped")
+	flag.BoolVar(&config.ServerSide, "server-side", false, "Replace with one UPDATE ... SET col = REPLACE(col, ...) per text column instead of reading rows; only for literal pairs on columns without serialized data (needs -serialized=false)")
+	flag.BoolVar(&config.Serialized, "serialized", true, "Rewrite PHP-serialized values with corrected string lengths")
+	flag.BoolVar(&config.Regex, "regex", false, "Treat -search as a Go regular expression; -replace may use $1-style group references")
+	flag.BoolVar(&config.IgnoreCase, "ignore-case", false, "Match -search case-insensitively (Unicode-aware); -replace is inserted exactly as given")
+	flag.BoolVar(&config.IgnoreCase, "i", false, "Shorthand for -ignore-case")
+	flag.BoolVar(&config.WholeWord, "whole-word", false, "Only replace matches that are not part of a longer word (Unicode-aware)")
+	flag.BoolVar(&config.URLVariants, "url-variants", false, "For a -search and -replace that are bare hosts (old.example.com), also replace their https://, http:// and // forms and the same with slashes escaped as \\/, each counted separately")
+	flag.BoolVar(&config.URLEncoded, "url-encoded", false, "Also replace the percent-encoded form of each -search with the percent-encoded -replace")
+	flag.BoolVar(&config.HTMLEntities, "html-entities", false, "Also replace forms of each -search written with HTML entities (&amp;, &#8217; ...) with the entity-encoded -replace")
+	flag.BoolVar(&config.JSONKeys, "json-keys", false, "Also replace inside object keys of JSON column values")
+	flag.BoolVar(&config.DecodeBase64, "decode-base64", false, "Also replace inside base64-encoded values whose decoded form contains a search string")
+	flag.StringVar(&config.OutputSQL, "output-sql", "", "Write UPDATE statements to this .sql file instead of executing them")
+	flag.StringVar(&config.ReportJSON, "report-json", "", "Write a JSON summary of the run to this file (- for stdout)")
+	flag.StringVar(&config.AuditCSV, "audit-csv", "", "Append a CSV record of every changed column (old and new values) to this file")
+	flag.BoolVar(&config.IncludeBinary, "include-binary", false, "Also scan BLOB, BINARY and VARBINARY columns, replacing -search/-replace as raw bytes")
+	flag.BoolVar(&config.Decompress, "decompress", false, "Also replace inside gzip- and zlib-compressed values of binary columns, recompressing them (needs -include-binary)")
+	flag.BoolVar(&config.IncludeEnum, "include-enum", false, "Also replace in ENUM and SET columns when the result is still an allowed member")
+	flag.BoolVar(&config.IncludeViews, "include-views", false, "Also scan and update views (only updatable views can be written)")
+	flag.BoolVar(&config.TxPerTable, "tx-per-table", true, "Apply each table's updates in a single transaction (set to false to autocommit each row)")
+	flag.IntVar(&config.ProgressRows, "progress-rows", 10000, "Report progress every N rows scanned (0 to disable)")
+	flag.DurationVar(&config.ProgressInterval, "progress-interval", 5*time.Second, "Report progress at least this often while scanning a table (0 to disable)")
+	flag.IntVar(&config.ChunkSize, "chunk-size", 1000, "Scan tables with a primary key in chunks of N rows using keyset pagination (0 to scan with a single SELECT)")
+	flag.IntVar(&config.LockRetries, "lock-retries", 3, "Retry an UPDATE that fails with a lock wait timeout or deadlock up to N times, with exponential backoff")
+	flag.IntVar(&config.ReconnectRetries, "reconnect-retries", 3, "After the connection to the server is lost, retry the statement, chunk or table up to N times, with backoff from 1s to 30s")
+	flag.DurationVar(&config.StatementTimeout, "statement-timeout", 0, "Abort any SELECT or UPDATE that runs longer than this (e.g. 30s; 0 for no limit); retried up to -lock-retries times in chunked scans")
+	flag.BoolVar(&config.LockRows, "lock-rows", false, "Read each chunk with SELECT ... FOR UPDATE in its own transaction so rows cannot change before they are updated; slower, and blocks application writes to the chunk's rows until it commits")
+	flag.IntVar(&config.BatchSize, "batch-size", 1, "Send the updates of up to N rows of a table with a primary key as a single UPDATE (1 updates row by row)")
+	flag.Int64Var(&config.PendingLimit, "pending-limit", 64<<20, "In tables scanned with a single SELECT, hold up to N bytes of changed rows to write after the scan, writing them during it beyond that")
+	flag.IntVar(&config.MaxTotalReplacements, "max-total-replacements", 0, "Stop before the run changes more than N values in all (0 = no cap); a dry run only reports whether it would")
+	flag.Float64Var(&config.MaxUpdatesPerSecond, "max-updates-per-second", 0, "Update at most N rows per second across all workers; scans run at full speed (0 = unlimited)")
+	flag.DurationVar(&config.SleepBetweenChunks, "sleep-between-chunks", 0, "Pause this long after each chunk that updated rows, e.g. 500ms, so replicas can catch up (0 to disable)")
+	flag.IntVar(&config.SleepEvery, "sleep-every", 1000, "In tables not scanned in chunks, pause for -sleep-between-chunks after every N rows updated")
+	flag.BoolVar(&config.Prefilter, "prefilter", false, "Only fetch rows whose text columns contain a search string (server-side LIKE)")
+	flag.BoolVar(&config.SkipBinlog, "skip-binlog", false, "Disable binary logging for the update sessions (SET sql_log_bin=0) so changes do not replicate")
+	flag.BoolVar(&config.DisableFKChecks, "disable-fk-checks", false, "Disable foreign key checks for the update sessions (SET foreign_key_checks=0)")
+	flag.BoolVar(&config.PreserveTimestamps, "preserve-timestamps", false, "Keep ON UPDATE CURRENT_TIMESTAMP columns unchanged on updated rows")
+	flag.BoolVar(&config.AllowDuplicateRows, "allow-duplicate-rows", false, "Update rows that have an identical copy in tables without a primary key or unique index, one copy at a time")
+	flag.BoolVar(&config.IgnorePrivilegeCheck, "ignore-privilege-check", false, "Start even if SHOW GRANTS shows the account lacks SELECT or UPDATE on some tables")
+	flag.BoolVar(&config.IgnoreCharsetCheck, "ignore-charset-check", false, "Start even if the session character set cannot represent some columns, such as utf8mb3 for utf8mb4 columns")
+	flag.BoolVar(&config.Strict, "strict", false, "Fail a table when an UPDATE affects a number of rows other than expected, instead of logging it")
+	flag.StringVar(&config.BackupSuffix, "backup-suffix", "", "Before changing a table, copy it to a new table named <table><suffix>")
+	flag.BoolVar(&config.BackupChangedOnly, "backup-changed-only", false, "With -backup-suffix, copy only the rows about to change")
+	flag.IntVar(&config.LogContext, "log-context", 40, "Characters of context shown around each change in verbose logging")
+	flag.BoolVar(&config.LogFullValues, "log-full-values", false, "Log complete old and new values in verbose logging")
+	flag.BoolVar(&config.ShowDiff, "show-diff", false, "Log each change in verbose output (and show it at -confirm-each) as an inline diff marking [-removed-] and {+added+} text")
+	flag.BoolVar(&config.Yes, "yes", false, "Modify the database without asking for confirmation")
+	flag.BoolVar(&config.ConfirmEach, "confirm-each", false, "Show each changed row and ask whether to apply it: y(es), n(o), a(ll) for the rest of the table, q(uit); needs a terminal")
+	flag.StringVar(&config.UndoFile, "undo-file", "", "Write UPDATE statements that restore every changed row to this file")
+	flag.StringVar(&config.SnapshotDir, "snapshot-dir", "", "Write every row about to change, all columns with their original values, to a file per table in this new or empty directory (dry runs included)")
+	flag.StringVar(&config.SnapshotFormat, "snapshot-format", "jsonl", "Format of the -snapshot-dir files: jsonl or csv")
+	flag.BoolVar(&config.Verify, "verify", false, "After the run, scan the same tables and columns again, read-only, and report the matches left in each column with the reason where known")
+	flag.BoolVar(&config.ChangedKeys, "changed-keys", false, "List the primary keys of the rows changed, per table: in the summary for tables with up to 20, and the first 1000 per table in the JSON report")
+	flag.StringVar(&config.ChangedKeysFile, "changed-keys-file", "", "Write the primary keys of all the rows changed to this file, grouped by table")
+	flag.StringVar(&config.Checkpoint, "checkpoint", "", "Record progress in this file and, when it exists, resume the interrupted run it describes")
+	flag.IntVar(&config.Limit, "limit", 0, "Scan at most N rows per table (0 for no limit)")
+	flag.Int64Var(&config.MaxValueSize, "max-value-size", 0, "Leave values larger than N bytes alone, logging their row for manual handling (0 for no limit)")
+	flag.IntVar(&config.Samples, "samples", 0, "With -dry-run or -count-only, show up to N example matches per table")
+	flag.IntVar(&config.TopValues, "top-values", 0, "Show the N most common matching values of each table, with their counts")
+	flag.IntVar(&config.Concurrency, "concurrency", 1, "Number of tables to process in parallel")
+	flag.BoolVar(&config.FailFast, "fail-fast", false, "Stop starting new tables after the first table fails")
+	flag.StringVar(&config.OrderBy, "order-by", "size", "Order tables are processed in: size (largest first, by estimated data length), name, or none (as the server lists them)")
+	tables := flag.String("tables", "", "Comma-separated tables to process (supports % and * wildcards)")
+	excludeTables := flag.String("exclude-tables", "", "Comma-separated tables to skip (supports % and * wildcards)")
+	flag.Int64Var(&config.MaxTableRows, "max-table-rows", 0, "Skip tables with more than N estimated rows (0 for no limit)")
+	allowLargeTables := flag.String("allow-large-tables", "", "Comma-separated tables to process despite -max-table-rows (supports % and * wildcards)")
+	columns := flag.String("columns", "", "Comma-separated columns to process, as column (any table) or table.column")
+	var wheres stringList
+	flag.Var(&wheres, "where", "Only scan rows matching this SQL condition, in every table or, as table:condition, in the tables matching table (% * ? wildcards); repeat to combine them with AND")
+	flag.StringVar(&config.RulesFile, "rules", "", "YAML file of per-table rules, each overriding the pairs, columns, -serialized and -json-keys of the tables it matches, or skipping them")
+	flag.BoolVar(&config.StrictWhere, "strict-where", false, "Fail a table that lacks a column -where refers to, instead of skipping it with a warning")
+	excludeColumns := flag.String("exclude-columns", "", "Comma-separated columns to skip, as column (any table) or table.column; % * ? wildcards, case-insensitive (e.g. *_hash,*_token)")
+	flag.BoolVar(&config.WordPress, "wordpress", false, "WordPress preset: detect the table prefix, process only its tables and skip the posts guid column")
+	flag.BoolVar(&config.IncludeGUID, "include-guid", false, "With -wordpress, also replace in the posts guid column")
+	flag.StringVar(&config.WPPrefix, "wp-prefix", "", "With -wordpress, use this table prefix instead of detecting it")
+	addEnvUsage(flag.CommandLine)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitFatal)
+	}
+	if err := applyEnvironment(flag.CommandLine); err != nil {
+		fatalf("%v", err)
+	}
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile); err != nil {
+			fatalf("Failed to read -config: %v", err)
+		}
+	}
+	if config.Quiet && config.Verbose {
+		fatalf("-quiet and -v cannot be used together")
+	}
+	switch config.Color {
+	case "auto", "always", "never":
+	default:
+		fatalf("-color must be auto, always or never, not %q", config.Color)
+	}
+	setupLogging(config)
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if config.Socket != "" && explicit["host"] && config.Host != "localhost" {
+		fatalf("-socket and -host cannot be used together")
+	}
+	params, err := parseDSNParams(dsnParams)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	config.DSNParams = params
+
+	optionFiles := defaultOptionFiles()
+	if *defaultsFile != "" {
+		optionFiles = []string{*defaultsFile}
+	}
+	options, err := readOptionFiles(optionFiles, *defaultsFile != "")
+	if err != nil {
+		fatalf("Failed to read option file: %v", err)
+	}
+	applyOptions(&config, options, explicit)
+
+	// Password precedence: -password, then -ask-pass, then option files,
+	// then MYSQL_PWD.
+	if *askPass && !explicit["password"] {
+		config.Password, err = promptPassword()
+		if err != nil {
+			fatalf("Failed to read password: %v", err)
+		}
+	} else if _, ok := options["password"]; !ok && !explicit["password"] {
+		config.Password = os.Getenv("MYSQL_PWD")
+	}
+
+	if config.SSHHost != "" {
+		if config.Socket != "" || config.ReadSocket != "" {
+			fatalf("-ssh-host cannot be used with -socket or -read-socket: the tunnel carries TCP connections")
+		}
+		if config.SSHUser == "" {
+			if u, err := user.Current(); err == nil {
+				config.SSHUser = u.Username
+			}
+		}
+	} else if explicit["ssh-port"] || explicit["ssh-user"] || explicit["ssh-key"] || explicit["ssh-insecure-ignore-hostkey"] {
+		fatalf("the -ssh-* settings require -ssh-host")
+	}
+
+	if config.Socket != "" {
+		// Like the mysql client, default to the login name so auth_socket
+		// accounts work without extra flags.
+		if config.User == "" {
+			if u, err := user.Current(); err == nil {
+				config.User = u.Username
+			}
+		}
+	}
+
+	config.Tables = splitList(*tables)
+	config.ExcludeTables = splitList(*excludeTables)
+	config.AllowLargeTables = splitList(*allowLargeTables)
+	config.Columns = splitList(*columns)
+	config.ExcludeColumns = splitList(*excludeColumns)
+	config.Where, config.TableWhere = parseWhere(wheres)
+	if (config.IncludeGUID || config.WPPrefix != "") && !config.WordPress {
+		fatalf("-include-guid and -wp-prefix require -wordpress")
+	}
+	config.Databases = splitList(*databases)
+
+	multiDatabase := config.AllDatabases || len(config.Databases) > 0
+	if config.AllDatabases && len(config.Databases) > 0 {
+		fatalf("-all-databases and -databases cannot be used together")
+	}
+	if multiDatabase && config.Database != "" {
+		fatalf("-database cannot be used with -all-databases or -databases")
+	}
+	if config.User == "" || (config.Database == "" && !multiDatabase) || (len(searches) == 0 && config.PairsFile == "") {
+		fatalf("-user, -database (or -all-databases or -databases), and -search (or -pairs-file) are required")
+	}
+
+	if config.ConfirmEach && (config.DryRun || config.CountOnly) {
+		fatalf("-confirm-each cannot be used with -dry-run or -count-only, which write nothing")
+	}
+	if config.PendingLimit < 1 {
+		fatalf("-pending-limit must be at least 1")
+	}
+	if config.ConfirmEach && !term.IsTerminal(int(os.Stdin.Fd())) {
+		fatalf("-confirm-each needs a terminal on stdin to ask about each row")
+	}
+	if config.ServerSide && (config.ConfirmEach || config.ReadHost != "" || config.ReadSocket != "") {
+		fatalf("-server-side cannot be used with -confirm-each, -read-host or -read-socket, which need each row to be read here")
+	}
+	pairs, err := buildPairs(searches, replaces, config.PairsFile, config.CountOnly || config.SetNull)
+	if err != nil {
+		fatalf("Invalid search/replace pairs: %v", err)
+	}
+	config.Pairs = pairs
+	if config.SetNull {
+		for _, pair := range pairs {
+			if pair.Replace != "" {
+				fatalf("-set-null cannot be used with -replace, or with replacements in -pairs-file")
+			}
+		}
+	} else if !config.CountOnly {
+		if err := checkReplacements(pairs, config, slog.Default()); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if config.RulesFile != "" {
+		rules, err := loadRules(config.RulesFile)
+		if err != nil {
+			fatalf("Failed to read -rules: %v", err)
+		}
+		for i, rule := range rules {
+			for _, pair := range rule.Pairs {
+				if config.SetNull && pair.Replace != "" {
+					fatalf("-set-null cannot be used with replacements in -rules (%s)", ruleName(rule, i))
+				}
+			}
+			if !config.CountOnly && !config.SetNull {
+				if err := checkReplacements(rule.Pairs, config, slog.With("rule", ruleName(rule, i))); err != nil {
+					fatalf("%s: %v", ruleName(rule, i), err)
+				}
+			}
+		}
+		config.Rules = rules
+	}
+	if err := config.Config.Validate(); err != nil {
+		fatalf("Invalid configuration: %v", err)
+	}
+
+	if config.SSLMode == "" {
+		switch {
+		case config.SSLCA != "":
+			config.SSLMode = "verify-ca"
+		case config.Socket != "":
+			// TLS adds nothing on a local socket.
+			config.SSLMode = "disabled"
+		default:
+			config.SSLMode = "preferred"
+		}
+	}
+
+	if config.ReadHost != "" || config.ReadSocket != "" {
+		if config.ReadHost != "" && config.ReadSocket != "" {
+			fatalf("-read-host and -read-socket cannot be used together")
+		}
+		if config.LockRows {
+			fatalf("-lock-rows cannot be used with a replica: the rows it reads cannot be locked on the primary")
+		}
+		if !explicit["read-port"] {
+			config.ReadPort = config.Port
+		}
+		if !explicit["read-user"] {
+			config.ReadUser = config.User
+		}
+		if !explicit["read-password"] {
+			config.ReadPassword = config.Password
+		}
+		if !explicit["read-ssl-ca"] {
+			config.ReadSSLCA = config.SSLCA
+		}
+		if config.ReadSSLMode == "" {
+			switch {
+			case config.ReadSocket != "":
+				config.ReadSSLMode = "disabled"
+			case explicit["read-ssl-ca"]:
+				config.ReadSSLMode = "verify-ca"
+			default:
+				config.ReadSSLMode = config.SSLMode
+			}
+		}
+	} else if explicit["read-port"] || explicit["read-user"] || explicit["read-password"] || explicit["read-ssl-mode"] || explicit["read-ssl-ca"] || explicit["read-server-pubkey"] {
+		fatalf("the -read-* settings require -read-host or -read-socket")
+	}
+
+	if config.LogContext < 1 {
+		fatalf("-log-context must be at least 1 (use -log-full-values to log complete values)")
+	}
+
+	if config.Concurrency < 1 {
+		fatalf("-concurrency must be at least 1")
+	}
+	if config.ConnectTimeout < 0 || config.ReadTimeout < 0 || config.WriteTimeout < 0 || config.ConnMaxLifetime < 0 {
+		fatalf("-connect-timeout, -read-timeout, -write-timeout and -conn-max-lifetime must not be negative")
+	}
+	// A table may hold a write connection, in a transaction or with session
+	// settings, while its rows are read through another.
+	if config.MaxOpenConns != 0 && config.MaxOpenConns < 2*config.Concurrency {
+		fatalf("-max-open-conns must be at least %d, twice -concurrency, as each table may hold one connection for its updates while reading through another", 2*config.Concurrency)
+	}
+	if config.MaxIdleConns < 0 {
+		fatalf("-max-idle-conns must not be negative")
+	}
+
+	return config
+}
+
+// tableCondition matches the table: prefix of a per-table -where. A
+// condition such as created < '2024-01-01 00:00' has no such prefix, since
+// what comes before its first colon is not a name.
+var tableCondition = regexp.MustCompile(`^\s*([\w$.%*?]+)\s*:(.*)$`)
+
+// parseWhere splits the -where flags into the condition for every table and
+// the conditions for tables matching a pattern, each ANDed together when
+// given more than once.
+func parseWhere(wheres []string) (string, map[string]string) {
+	var all []string
+	var tables map[string]string
+	for _, where := range wheres {
+		if strings.TrimSpace(where) == "" {
+			fatalf("-where must not be empty")
+		}
+		m := tableCondition.FindStringSubmatch(where)
+		if m == nil {
+			all = append(all, where)
+			continue
+		}
+		condition := strings.TrimSpace(m[2])
+		if condition == "" {
+			fatalf("-where %s has no condition after the table", where)
+		}
+		if tables == nil {
+			tables = make(map[string]string)
+		}
+		if previous, ok := tables[m[1]]; ok {
+			condition = "(" + previous + ") AND (" + condition + ")"
+		}
+		tables[m[1]] = condition
+	}
+	if len(all) == 1 {
+		return all[0], tables
+	}
+	for i := range all {
+		all[i] = "(" + all[i] + ")"
+	}
+	return strings.Join(all, " AND "), tables
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringList is a flag.Value that collects every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// buildPairs combines repeated -search/-replace flags and the optional pairs
+// file into the ordered list of pairs to apply. With searchOnly, for
+// -count-only and -set-null, the -replace flags may be left out.
+func buildPairs(searches, replaces []string, pairsFile string, searchOnly bool) ([]mysqlreplace.Pair, error) {
+	if len(replaces) > 0 && len(replaces) != len(searches) {
+		return nil, fmt.Errorf("got %d -search flags but %d -replace flags; each -search needs a matching -replace", len(searches), len(replaces))
+	}
+	if len(searches) > 1 && len(replaces) == 0 && !searchOnly {
+		return nil, fmt.Errorf("multiple -search flags need a matching -replace for each")
+	}
+
+	var pairs []mysqlreplace.Pair
+	for i, search := range searches {
+		pair := mysqlreplace.Pair{Search: search}
+		if i < len(replaces) {
+			pair.Replace = replaces[i]
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if pairsFile != "" {
+		filePairs, err := mysqlreplace.ReadPairsFile(pairsFile)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, filePairs...)
+	}
+	return pairs, nil
+}
+
+// checkReplacements refuses a pair with an empty replacement, which deletes
+// every match of its search string, unless -allow-empty-replace is given,
+// and a pair whose replacement is its search string, which changes nothing,
+// unless -force is given. With -regex or -ignore-case such a pair can still
+// change the text matched, so it is allowed. It then checks with
+// checkRematches that the pairs do not match their own output.
+func checkReplacements(pairs []mysqlreplace.Pair, config Config, logger *slog.Logger) error {
+	for _, pair := range pairs {
+		switch {
+		case pair.Replace == "" && !config.AllowEmptyReplace:
+			return fmt.Errorf("the replacement for '%s' is empty, which deletes every match; pass -allow-empty-replace to do that, or give -replace", pair.Search)
+		case pair.Replace == "":
+			logger.Warn("empty replacement: every match will be removed", "search", pair.Search)
+		case pair.Search == pair.Replace && !config.Regex && !config.IgnoreCase && !config.Force:
+			return fmt.Errorf("'%s' would be replaced with itself, which changes nothing; pass -force to scan anyway", pair.Search)
+		}
+	}
+	if config.Regex {
+		return nil
+	}
+	rematches := findRematches(pairs, config.IgnoreCase)
+	for _, m := range rematches {
+		from, to := pairs[m.from], pairs[m.to]
+		switch {
+		case m.from == m.to && m.count > 1 && !config.Force:
+			return fmt.Errorf("the replacement '%s' contains '%s' %d times, so every run multiplies its matches by %d and values grow without bound when the run is repeated; pass -force to run anyway",
+				from.Replace, from.Search, m.count, m.count)
+		case m.from == m.to:
+			logger.Warn("the replacement contains the search string, so running again replaces it again and grows the value each time: the run is not idempotent",
+				"search", from.Search, "replace", from.Replace)
+		case m.to > m.from:
+			logger.Warn(fmt.Sprintf("the replacement of pair %d contains the search string of pair %d, which rewrites it again in the same run", m.from+1, m.to+1),
+				"replace", from.Replace, "search", to.Search)
+		default:
+			logger.Warn(fmt.Sprintf("the replacement of pair %d contains the search string of pair %d, so running again rewrites it: the run is not idempotent", m.from+1, m.to+1),
+				"replace", from.Replace, "search", to.Search)
+		}
+	}
+	return nil
+}
+
+// rematch is a pair whose replacement contains the search string of
+// another pair, or its own when from and to are equal, count times.
+type rematch struct {
+	from, to int
+	count    int
+}
+
+// findRematches returns, for literal pairs applied in order, each pair
+// whose output another pair (or itself) would match again: later pairs in
+// the same run, earlier ones and the pair itself when the run is repeated.
+// A pair whose replacement is its search string changes nothing and is not
+// reported against itself.
+func findRematches(pairs []mysqlreplace.Pair, ignoreCase bool) []rematch {
+	fold := func(s string) string {
+		if ignoreCase {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	var found []rematch
+	for i, from := range pairs {
+		replace := fold(from.Replace)
+		for j, to := range pairs {
+			search := fold(to.Search)
+			if search == "" || (i == j && search == replace) {
+				continue
+			}
+			if count := strings.Count(replace, search); count > 0 {
+				found = append(found, rematch{from: i, to: j, count: count})
+			}
+		}
+	}
+	return found
+}
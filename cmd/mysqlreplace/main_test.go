@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+func TestFindRematches(t *testing.T) {
+	tests := []struct {
+		name       string
+		pairs      []mysqlreplace.Pair
+		ignoreCase bool
+		want       []rematch
+	}{
+		{"independent", []mysqlreplace.Pair{{Search: "a", Replace: "b"}, {Search: "c", Replace: "d"}}, false, nil},
+		{"own search contained", []mysqlreplace.Pair{{Search: "example.com", Replace: "www.example.com"}}, false,
+			[]rematch{{from: 0, to: 0, count: 1}}},
+		{"chained", []mysqlreplace.Pair{{Search: "A", Replace: "B"}, {Search: "B", Replace: "C"}}, false,
+			[]rematch{{from: 0, to: 1, count: 1}}},
+		{"chained backwards", []mysqlreplace.Pair{{Search: "B", Replace: "C"}, {Search: "A", Replace: "B"}}, false,
+			[]rematch{{from: 1, to: 0, count: 1}}},
+		{"multiplying", []mysqlreplace.Pair{{Search: "ab", Replace: "abab"}}, false,
+			[]rematch{{from: 0, to: 0, count: 2}}},
+		{"identity", []mysqlreplace.Pair{{Search: "a", Replace: "a"}}, false, nil},
+		{"case folded", []mysqlreplace.Pair{{Search: "Old", Replace: "old-new"}}, true,
+			[]rematch{{from: 0, to: 0, count: 1}}},
+		{"case kept", []mysqlreplace.Pair{{Search: "Old", Replace: "old-new"}}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findRematches(tt.pairs, tt.ignoreCase); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReplacementsRematches(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []mysqlreplace.Pair
+		force bool
+		// err is part of the error wanted, or empty for none; warn is part
+		// of the warning wanted, or empty for none.
+		err, warn string
+	}{
+		{"own search contained", []mysqlreplace.Pair{{Search: "example.com", Replace: "www.example.com"}}, false,
+			"", "not idempotent"},
+		{"chained", []mysqlreplace.Pair{{Search: "A", Replace: "B"}, {Search: "B", Replace: "C"}}, false,
+			"", "rewrites it again in the same run"},
+		{"chained backwards", []mysqlreplace.Pair{{Search: "B", Replace: "C"}, {Search: "A", Replace: "B"}}, false,
+			"", "running again rewrites it"},
+		{"multiplying", []mysqlreplace.Pair{{Search: "ab", Replace: "abab"}}, false,
+			"multiplies its matches by 2", ""},
+		{"multiplying with -force", []mysqlreplace.Pair{{Search: "ab", Replace: "abab"}}, true,
+			"", "not idempotent"},
+		{"independent", []mysqlreplace.Pair{{Search: "a", Replace: "b"}}, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			config := Config{Force: tt.force}
+			err := checkReplacements(tt.pairs, config, slog.New(slog.NewTextHandler(&logged, nil)))
+			checkResult(t, err, tt.err, logged.String(), tt.warn)
+		})
+	}
+}
+
+// checkResult fails t unless err and the log output match the parts
+// wanted, empty for none.
+func checkResult(t *testing.T, err error, wantErr, logged, wantWarn string) {
+	t.Helper()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Errorf("unexpected error: %v", err)
+	case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+		t.Errorf("got error %v, want one containing %q", err, wantErr)
+	}
+	switch {
+	case wantWarn == "" && logged != "":
+		t.Errorf("unexpected log output: %s", logged)
+	case wantWarn != "" && !strings.Contains(logged, wantWarn):
+		t.Errorf("log output %q lacks %q", logged, wantWarn)
+	}
+}
+
+func TestCheckReplacementsEmptyAndIdentical(t *testing.T) {
+	tests := []struct {
+		name   string
+		pair   mysqlreplace.Pair
+		config Config
+		err    string
+		warn   string
+	}{
+		{"empty", mysqlreplace.Pair{Search: "tracking-pixel"}, Config{}, "-allow-empty-replace", ""},
+		{"empty allowed", mysqlreplace.Pair{Search: "tracking-pixel"}, Config{AllowEmptyReplace: true}, "", "every match will be removed"},
+		{"identical", mysqlreplace.Pair{Search: "same", Replace: "same"}, Config{}, "replaced with itself", ""},
+		{"identical with -force", mysqlreplace.Pair{Search: "same", Replace: "same"}, Config{Force: true}, "", ""},
+		{"identical with -ignore-case", mysqlreplace.Pair{Search: "same", Replace: "same"},
+			Config{Config: mysqlreplace.Config{IgnoreCase: true}}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			err := checkReplacements([]mysqlreplace.Pair{tt.pair}, tt.config, slog.New(slog.NewTextHandler(&logged, nil)))
+			checkResult(t, err, tt.err, logged.String(), tt.warn)
+		})
+	}
+}
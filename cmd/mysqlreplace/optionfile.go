@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// optionGroups are the option-file sections read for connection settings.
+var optionGroups = map[string]bool{"client": true, "mysqlreplace": true}
+
+// defaultOptionFiles returns the standard MySQL option-file search path, in
+// the order later files override earlier ones.
+func defaultOptionFiles() []string {
+	files := []string{"/etc/my.cnf", "/etc/mysql/my.cnf"}
+	if home := os.Getenv("MYSQL_HOME"); home != "" {
+		files = append(files, filepath.Join(home, "my.cnf"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".my.cnf"))
+	}
+	return files
+}
+
+// readOptionFiles reads the [client] and [mysqlreplace] groups of the given
+// option files. Missing or unreadable files are skipped, except that an error
+// is returned when required is set and the single file cannot be read.
+func readOptionFiles(files []string, required bool) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, path := range files {
+		if err := readOptionFile(path, options, 0); err != nil {
+			if required {
+				return nil, err
+			}
+			if !os.IsNotExist(err) {
+				slog.Warn("skipping option file", "path", path, "err", err)
+			}
+		}
+	}
+	return options, nil
+}
+
+func readOptionFile(path string, options map[string]string, depth int) error {
+	if depth > 10 {
+		return fmt.Errorf("!include nested too deeply")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	slog.Debug("reading option file", "path", path)
+
+	inGroup := false
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case strings.HasPrefix(line, "!includedir"):
+			dir := strings.TrimSpace(strings.TrimPrefix(line, "!includedir"))
+			matches, _ := filepath.Glob(filepath.Join(dir, "*.cnf"))
+			sort.Strings(matches)
+			for _, match := range matches {
+				if err := readOptionFile(match, options, depth+1); err != nil {
+					slog.Warn("skipping option file", "path", match, "err", err)
+				}
+			}
+			continue
+		case strings.HasPrefix(line, "!include"):
+			include := strings.TrimSpace(strings.TrimPrefix(line, "!include"))
+			if err := readOptionFile(include, options, depth+1); err != nil {
+				slog.Warn("skipping option file", "path", include, "err", err)
+			}
+			continue
+		case line[0] == '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return fmt.Errorf("%s:%d: malformed group header", path, lineNo)
+			}
+			inGroup = optionGroups[strings.ToLower(strings.TrimSpace(line[1:end]))]
+			continue
+		}
+		if !inGroup {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		key = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(key)), "_", "-")
+		value, err := optionValue(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		options[key] = value
+	}
+	return scanner.Err()
+}
+
+// optionValue unquotes an option value and strips a trailing comment.
+func optionValue(value string) (string, error) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return unescapeOption(value), nil
+	}
+
+	quote := value[0]
+	var b strings.Builder
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && i+1 < len(value):
+			i++
+			b.WriteString(unescapeOption(`\` + string(value[i])))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
+
+// unescapeOption expands the escape sequences MySQL accepts in option values.
+func unescapeOption(s string) string {
+	return strings.NewReplacer(`\b`, "\b", `\t`, "\t", `\n`, "\n", `\r`, "\r", `\\`, `\`, `\s`, " ", `\"`, `"`, `\'`, `'`).Replace(s)
+}
+
+// applyOptions fills in connection settings from option files. Flags given
+// on the command line always take precedence.
+func applyOptions(config *Config, options map[string]string, explicit map[string]bool) {
+	if value, ok := options["host"]; ok && !explicit["host"] && !explicit["socket"] {
+		config.Host = value
+	}
+	if value, ok := options["port"]; ok && !explicit["port"] {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			slog.Warn("ignoring invalid port in option file", "port", value)
+		} else {
+			config.Port = port
+		}
+	}
+	if value, ok := options["user"]; ok && !explicit["user"] {
+		config.User = value
+	}
+	if value, ok := options["password"]; ok && !explicit["password"] {
+		config.Password = value
+	}
+	// As with the mysql client, the socket is only used for localhost.
+	if value, ok := options["socket"]; ok && !explicit["socket"] && config.Host == "localhost" {
+		config.Socket = value
+	}
+}
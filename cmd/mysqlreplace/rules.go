@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+// rawRule is the YAML layout of a rule of -rules: the file is a list of
+// them, with their pairs as lists of search and replace.
+type rawRule struct {
+	Name           string    `yaml:"name"`
+	Tables         []string  `yaml:"tables"`
+	Skip           bool      `yaml:"skip"`
+	ForColumns     []string  `yaml:"for-columns"`
+	Pairs          []rawPair `yaml:"pairs"`
+	Columns        []string  `yaml:"columns"`
+	ExcludeColumns []string  `yaml:"exclude-columns"`
+	Serialized     *bool     `yaml:"serialized"`
+	JSONKeys       *bool     `yaml:"json-keys"`
+}
+
+type rawPair struct {
+	Search  string `yaml:"search"`
+	Replace string `yaml:"replace"`
+}
+
+// loadRules reads the rules of -rules, in the order they are declared.
+// Unknown keys are an error so that typos are not silently ignored.
+func loadRules(path string) ([]mysqlreplace.Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file []rawRule
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v (expected a list of rules with name, tables, skip, for-columns, pairs, columns, exclude-columns, serialized and json-keys)", path, err)
+	}
+	if len(file) == 0 {
+		return nil, fmt.Errorf("%s: no rules", path)
+	}
+	rules := make([]mysqlreplace.Rule, len(file))
+	for i, raw := range file {
+		rule := mysqlreplace.Rule{
+			Name:           raw.Name,
+			Tables:         raw.Tables,
+			Skip:           raw.Skip,
+			ForColumns:     raw.ForColumns,
+			Columns:        raw.Columns,
+			ExcludeColumns: raw.ExcludeColumns,
+			Serialized:     raw.Serialized,
+			JSONKeys:       raw.JSONKeys,
+		}
+		if raw.Pairs != nil {
+			rule.Pairs = make([]mysqlreplace.Pair, len(raw.Pairs))
+		}
+		for j, pair := range raw.Pairs {
+			if pair.Search == "" {
+				return nil, fmt.Errorf("%s: %s: pair %d has no search string", path, ruleName(rule, i), j+1)
+			}
+			rule.Pairs[j] = mysqlreplace.Pair{Search: pair.Search, Replace: pair.Replace}
+		}
+		for _, list := range [][]string{rule.Tables, rule.ForColumns, rule.Columns, rule.ExcludeColumns} {
+			for k := range list {
+				list[k] = strings.TrimSpace(list[k])
+			}
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+// ruleName names a rule in errors, by its position when it has no name.
+func ruleName(rule mysqlreplace.Rule, i int) string {
+	if rule.Name != "" {
+		return fmt.Sprintf("rule %q", rule.Name)
+	}
+	return fmt.Sprintf("rule %d", i+1)
+}
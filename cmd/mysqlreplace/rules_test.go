@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRules(t *testing.T) {
+	path := writeFile(t, "rules.yaml", `
+- name: options
+  tables: [wp_options]
+  serialized: true
+- tables: [" logs ", "audit_*"]
+  skip: true
+- name: email
+  tables: [users]
+  for-columns: [email]
+  pairs:
+    - search: old.example.com
+      replace: new.example.com
+`)
+	rules, err := loadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yes := true
+	want := []mysqlreplace.Rule{
+		{Name: "options", Tables: []string{"wp_options"}, Serialized: &yes},
+		{Tables: []string{"logs", "audit_*"}, Skip: true},
+		{Name: "email", Tables: []string{"users"}, ForColumns: []string{"email"},
+			Pairs: []mysqlreplace.Pair{{Search: "old.example.com", Replace: "new.example.com"}}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %+v, want %+v", rules, want)
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "- tables: [x]\n  skp: true\n", "skp"},
+		{"empty", "", "no rules"},
+		{"pair without search", "- tables: [x]\n  pairs:\n    - replace: y\n", "no search string"},
+		{"not a list", "tables: [x]\n", "expected a list of rules"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadRules(writeFile(t, "rules.yaml", tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshNetwork is the network name the tunnel's dialer is registered under
+// with the MySQL driver, used in place of tcp in the DSN.
+const sshNetwork = "mysqlreplace-ssh"
+
+// sshKeepAlive is how often the tunnel is checked while a run is idle on it,
+// so that NAT and firewall state along the way does not expire.
+const sshKeepAlive = 30 * time.Second
+
+// tunnelError is a failure of the SSH connection or of the bastion to reach
+// the MySQL server, as opposed to an error from the server itself.
+type tunnelError struct {
+	err error
+}
+
+func (e *tunnelError) Error() string { return "SSH tunnel: " + e.err.Error() }
+
+func (e *tunnelError) Unwrap() error { return e.err }
+
+// openTunnel connects to -ssh-host and registers a dialer with the driver
+// that opens the MySQL connections, to the primary and any replica, through
+// it. The returned function closes the tunnel.
+func openTunnel(config Config) (func(), error) {
+	auths, closeAgent, err := sshAuthMethods(config)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	hostKeys, err := sshHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort(config.SSHHost, strconv.Itoa(config.SSHPort))
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            config.SSHUser,
+		Auth:            auths,
+		HostKeyCallback: hostKeys,
+		Timeout:         config.ConnectTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s as %s: %w", address, config.SSHUser, err)
+	}
+	slog.Debug("SSH tunnel open", "host", address, "user", config.SSHUser)
+
+	mysql.RegisterDialContext(sshNetwork, func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := client.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, &tunnelError{fmt.Errorf("%s could not reach %s: %w", address, addr, err)}
+		}
+		return conn, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sshKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+					slog.Warn("SSH tunnel keepalive failed", "err", err)
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		client.Close()
+	}, nil
+}
+
+// sshAuthMethods returns the key from -ssh-key, if given, then the keys of
+// the running ssh-agent, if any. The returned function closes the agent
+// connection once the handshake is done.
+func sshAuthMethods(config Config) ([]ssh.AuthMethod, func(), error) {
+	var auths []ssh.AuthMethod
+	if config.SSHKey != "" {
+		pem, err := os.ReadFile(config.SSHKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading -ssh-key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, nil, fmt.Errorf("-ssh-key %s is protected by a passphrase; add it to ssh-agent and leave -ssh-key out", config.SSHKey)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing -ssh-key %s: %v", config.SSHKey, err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+
+	closeAgent := func() {}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			slog.Warn("could not connect to ssh-agent", "err", err)
+		} else {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+	if len(auths) == 0 {
+		return nil, nil, fmt.Errorf("no SSH key to log in with: pass -ssh-key or start ssh-agent (SSH_AUTH_SOCK is not set)")
+	}
+	return auths, closeAgent, nil
+}
+
+// sshHostKeyCallback verifies the bastion's host key against
+// ~/.ssh/known_hosts, unless -ssh-insecure-ignore-hostkey is given.
+func sshHostKeyCallback(config Config) (ssh.HostKeyCallback, error) {
+	if config.SSHInsecureIgnoreHostKey {
+		slog.Warn("not verifying the SSH host key of " + config.SSHHost + " (-ssh-insecure-ignore-hostkey)")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("finding known_hosts: %v", err)
+	}
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v (connect once with ssh to add the host key, or pass -ssh-insecure-ignore-hostkey)", path, err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%s is not in %s; connect once with ssh to verify and add its host key", hostname, path)
+			}
+			return fmt.Errorf("the host key of %s does not match %s: %v", hostname, path, err)
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/wltechblog/mysqlreplace"
+)
+
+// applyWordPress sets the options of the -wordpress preset for the
+// installation in db: only the tables with its prefix, unless -tables is
+// given, and no GUID columns, unless -include-guid is. With announce set the
+// site URLs are logged so the search strings can be checked against them.
+func applyWordPress(ctx context.Context, db *sql.DB, config *Config, announce bool) error {
+	wp, err := mysqlreplace.DetectWordPress(ctx, db, config.WPPrefix)
+	if err != nil {
+		return err
+	}
+
+	if announce {
+		config.log().Info("WordPress site", "prefix", wp.Prefix, "siteurl", wp.SiteURL, "home", wp.Home)
+		found := false
+		for _, pair := range config.Pairs {
+			if strings.Contains(wp.SiteURL, pair.Search) || strings.Contains(wp.Home, pair.Search) {
+				found = true
+			}
+		}
+		if !found {
+			config.log().Warn("no search string appears in siteurl or home; check it matches the site's current URL")
+		}
+	}
+
+	if len(config.Tables) == 0 {
+		config.Tables = []string{wp.Prefix + "*"}
+	}
+	if !config.IncludeGUID {
+		exclude := append([]string{}, config.ExcludeColumns...)
+		for _, table := range wp.PostsTables {
+			exclude = append(exclude, table+".guid")
+		}
+		config.ExcludeColumns = exclude
+	}
+	return nil
+}
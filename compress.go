@@ -0,0 +1,144 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// maxDecompressedSize bounds the memory a compressed value may expand to.
+// Larger values are left alone.
+const maxDecompressedSize = 64 << 20
+
+// compression returns "gzip" or "zlib" when value starts with the header of
+// that format, and "" otherwise.
+func compression(value string) string {
+	if len(value) < 3 {
+		return ""
+	}
+	if value[0] == 0x1f && value[1] == 0x8b && value[2] == 8 {
+		return "gzip"
+	}
+	// A zlib header is deflate with a window of at most 32 KiB, and a
+	// multiple of 31 when read as a big-endian number.
+	cmf, flg := value[0], value[1]
+	if cmf&0x0f == 8 && cmf>>4 <= 7 && (uint16(cmf)<<8|uint16(flg))%31 == 0 {
+		return "zlib"
+	}
+	return ""
+}
+
+// replaceCompressed applies the replacements to the decompressed form of a
+// gzip or zlib value and compresses the result with the same format and
+// level. It reports false, leaving the value alone, when the decompressed
+// form does not match or the value cannot be decompressed, which is logged.
+func replaceCompressed(s, algorithm, table, column string, config Config, hits []int) (string, bool) {
+	tlog := config.tableLogger(table)
+	plain, level, err := decompress(s, algorithm)
+	if err != nil {
+		tlog.Warn("could not decompress value, left alone", "column", column, "format", algorithm, "bytes", len(s), "err", err)
+		return s, false
+	}
+	if !config.matches(plain) {
+		return s, false
+	}
+	newPlain := replaceValue(plain, table, column, config, hits)
+	if newPlain == plain {
+		return s, false
+	}
+	compressed, err := recompress(newPlain, algorithm, level, s)
+	if err != nil {
+		tlog.Warn("could not recompress value, left alone", "column", column, "format", algorithm, "err", err)
+		return s, false
+	}
+	if config.log().Enabled(context.Background(), slog.LevelDebug) {
+		change := describeChange(plain, newPlain, config)
+		tlog.Debug(algorithm+" value "+change.String(), "column", column, change.attr())
+	}
+	return compressed, true
+}
+
+// decompress returns the decompressed form of s and the compression level
+// its header records. Trailing bytes after the compressed data are an error,
+// since they would be lost in recompressing.
+func decompress(s, algorithm string) (string, int, error) {
+	input := bytes.NewReader([]byte(s))
+	var r io.ReadCloser
+	level := gzip.DefaultCompression
+	switch algorithm {
+	case "gzip":
+		zr, err := gzip.NewReader(input)
+		if err != nil {
+			return "", 0, err
+		}
+		// The XFL header byte marks the best and fastest levels.
+		switch s[8] {
+		case 2:
+			level = gzip.BestCompression
+		case 4:
+			level = gzip.BestSpeed
+		}
+		r = zr
+	case "zlib":
+		zr, err := zlib.NewReader(input)
+		if err != nil {
+			return "", 0, err
+		}
+		// FLEVEL, the top two bits of the second byte.
+		level = []int{zlib.BestSpeed, 5, zlib.DefaultCompression, zlib.BestCompression}[s[1]>>6]
+		r = zr
+	default:
+		return "", 0, fmt.Errorf("unknown compression %s", algorithm)
+	}
+	defer r.Close()
+
+	var out bytes.Buffer
+	n, err := io.Copy(&out, io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if n > maxDecompressedSize {
+		return "", 0, fmt.Errorf("decompresses to more than %d MiB", maxDecompressedSize>>20)
+	}
+	if input.Len() > 0 {
+		return "", 0, fmt.Errorf("%d bytes follow the compressed data", input.Len())
+	}
+	return out.String(), level, nil
+}
+
+// recompress compresses s in the format and at the level of the original
+// value, keeping a gzip header's name, comment and time.
+func recompress(s, algorithm string, level int, original string) (string, error) {
+	var out bytes.Buffer
+	var w io.WriteCloser
+	switch algorithm {
+	case "gzip":
+		zw, err := gzip.NewWriterLevel(&out, level)
+		if err != nil {
+			return "", err
+		}
+		if zr, err := gzip.NewReader(bytes.NewReader([]byte(original))); err == nil {
+			zw.Header = zr.Header
+		}
+		w = zw
+	case "zlib":
+		zw, err := zlib.NewWriterLevel(&out, level)
+		if err != nil {
+			return "", err
+		}
+		w = zw
+	default:
+		return "", fmt.Errorf("unknown compression %s", algorithm)
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
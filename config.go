@@ -0,0 +1,613 @@
+// Package mysqlreplace rewrites text across the tables of a MySQL database,
+// keeping PHP-serialized and JSON values valid. The mysqlreplace command in
+// cmd/mysqlreplace is a thin wrapper around this package.
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Config configures a Replacer. The zero value scans every table, applies
+// updates with autocommit and writes no files.
+type Config struct {
+	// Database, Host and Port describe the server the database handle is
+	// connected to. They appear in generated files and the report; Database
+	// is also the schema named in USE statements of generated SQL.
+	Database string
+	Host     string
+	Port     int
+
+	// Logger receives the log output and the summary, with attributes such
+	// as the database added by the caller; nil logs to slog.Default().
+	Logger *slog.Logger
+
+	// Pairs are applied to each value in order.
+	Pairs []Pair
+	// Regex treats each Pair's Search as a regular expression and allows
+	// $1-style references in Replace. IgnoreCase matches case-insensitively,
+	// except in columns with a _bin collation.
+	Regex      bool
+	IgnoreCase bool
+	// exactPairs are Pairs compiled case-sensitively, used with IgnoreCase
+	// for the columns with a _bin collation. pairOffset is the index of the
+	// first of Pairs in runPairs, and columnRules are the rules with
+	// ForColumns matching the table, set by forTable.
+	exactPairs  []Pair
+	pairOffset  int
+	columnRules []*Rule
+	// WholeWord only replaces matches that are not part of a longer word.
+	WholeWord bool
+	// URLVariants precedes each pair of bare hosts with its https://, http://
+	// and // forms, plain and with slashes escaped as \/, each counted as a
+	// pair of its own.
+	URLVariants bool
+	// URLEncoded also replaces the percent-encoded form of each Search with
+	// the percent-encoded form of its Replace, counted as a pair of its own.
+	URLEncoded bool
+	// HTMLEntities also replaces forms of each Search with & < > " ' and
+	// non-ASCII characters written as HTML entities, with Replace encoded
+	// like htmlspecialchars. They are counted as a pair of their own.
+	HTMLEntities bool
+
+	// DryRun reports replacements without writing anything.
+	DryRun bool
+	// CountOnly counts the occurrences of each Search per column instead of
+	// replacing them; Replace is not used.
+	CountOnly bool
+	// SetNull sets the values that contain a search string to NULL instead
+	// of replacing in them; Replace is not used. NOT NULL columns are left
+	// alone and listed in TableResult.NotNullColumns.
+	SetNull bool
+	// Serialized rewrites PHP-serialized values with corrected lengths.
+	Serialized bool
+	// JSONKeys also replaces inside the object keys of JSON values.
+	JSONKeys bool
+	// DecodeBase64 also replaces inside values that are base64-encoded and
+	// whose decoded form matches, re-encoding the result.
+	DecodeBase64 bool
+	// Decompress also replaces inside gzip- and zlib-compressed values of
+	// binary columns, recompressing the result. It needs IncludeBinary.
+	Decompress bool
+	// TxPerTable applies each table's updates in a single transaction.
+	TxPerTable bool
+	// ServerSide replaces with one UPDATE ... SET col = REPLACE(col, ...)
+	// per text column instead of reading rows, for literal pairs on columns
+	// that hold no serialized data. JSON columns are skipped, and settings
+	// that need the values in Go cannot be used with it.
+	ServerSide bool
+
+	// Tables and ExcludeTables select tables by name, with % and * matching
+	// any sequence of characters and ? a single character. Columns limits
+	// the scan to the named columns, given as column or table.column, and
+	// ExcludeColumns leaves out the columns matching its entries, given the
+	// same way with the wildcards of Tables and ignoring case.
+	Tables         []string
+	ExcludeTables  []string
+	Columns        []string
+	ExcludeColumns []string
+
+	// Where restricts the rows of every table to those matching this SQL
+	// condition, and TableWhere the rows of the tables matching each
+	// pattern, with the wildcards of Tables; all that apply must hold. A
+	// table lacking a column they refer to is skipped, or fails with
+	// StrictWhere.
+	Where       string
+	TableWhere  map[string]string
+	StrictWhere bool
+
+	// Rules override the pairs, column selection and value handling for
+	// the tables they match, or skip them; a table follows the first rule
+	// that matches it.
+	Rules []Rule
+
+	IncludeViews  bool
+	IncludeBinary bool
+	IncludeEnum   bool
+
+	// OutputSQL writes the UPDATE statements to this file instead of
+	// executing them.
+	OutputSQL string
+	sqlOut    *sqlWriter
+
+	// readDB is Replacer.ReadFrom, the handle rows are scanned through.
+	readDB *sql.DB
+
+	// approve is Replacer.Approve.
+	approve func(ctx context.Context, row RowChange) Approval
+
+	// AuditCSV appends a record of every changed column to this file.
+	AuditCSV string
+	audit    *auditWriter
+
+	// UndoFile writes statements restoring every changed row to this file.
+	UndoFile string
+	undo     *undoWriter
+
+	// SnapshotDir receives a file per table with every row about to be
+	// changed, all columns with their original values, in dry runs too.
+	// SnapshotFormat is "jsonl" (the default) or "csv".
+	SnapshotDir    string
+	SnapshotFormat string
+	snapshot       *snapshotWriter
+
+	// Verify scans the tables again once the run has finished, read-only,
+	// and reports the matches left in them in Report.Verify.
+	Verify bool
+
+	// ChangedKeys records the primary key of every row changed, or a
+	// fingerprint of the row as read in tables without one, in
+	// TableResult.ChangedKeys, up to 1000 per table. ChangedKeysFile
+	// writes all of them to this file, grouped by table.
+	ChangedKeys     bool
+	ChangedKeysFile string
+	keys            *keysWriter
+
+	// Checkpoint records the run's progress in this file, and resumes from
+	// it when it exists: completed tables are skipped, and tables scanned in
+	// chunks whose changes commit as they go (LockRows, or TxPerTable off)
+	// continue after the last chunk recorded.
+	Checkpoint string
+	checkpoint *checkpoint
+
+	// ProgressRows and ProgressInterval control per-table progress lines;
+	// zero disables each.
+	ProgressRows     int
+	ProgressInterval time.Duration
+	tableSizes       map[string]tableSize
+
+	// schemaColumns caches the columns of the tables Run may process, read
+	// in one query before the first table.
+	schemaColumns map[string][]columnInfo
+
+	// Concurrency is the number of tables processed in parallel. FailFast
+	// stops starting new tables after one fails.
+	Concurrency int
+	FailFast    bool
+
+	// OrderBy is the order tables are processed in: "size" for the largest
+	// first by estimated data length, "name", or "none" (or empty) for the
+	// order the server lists them in.
+	OrderBy string
+
+	// MaxTableRows, if set, skips tables whose estimated row count is
+	// larger, except those matching AllowLargeTables (with the wildcards of
+	// ExcludeTables). The estimates are only used for this decision.
+	MaxTableRows     int64
+	AllowLargeTables []string
+
+	// ChunkSize scans tables with a primary key in chunks of this many rows
+	// (0 scans with a single SELECT). Prefilter only fetches rows containing
+	// a search string. Limit caps the rows scanned per table (0 for no cap).
+	ChunkSize int
+	Prefilter bool
+	Limit     int
+	// MaxValueSize leaves values longer than this many bytes, as read from
+	// the server, alone (0 for no limit).
+	MaxValueSize int64
+	// Samples collects up to this many example matches per table in DryRun
+	// and CountOnly runs, for TableResult.Samples.
+	Samples int
+
+	// TopValues counts the values matched in each table, or the text
+	// around the match in long values, and keeps the N most common in
+	// TableResult.TopValues.
+	TopValues int
+
+	// LockRows reads each chunk of a table with a primary key using SELECT
+	// ... FOR UPDATE in a transaction of its own, committed once the chunk's
+	// updates are made, so rows cannot change between being read and
+	// written. A chunk hitting a lock conflict is retried up to LockRetries
+	// times. It replaces TxPerTable for those tables and needs ChunkSize.
+	LockRows bool
+
+	// LockRetries is the number of times an UPDATE that failed with a lock
+	// wait timeout, or a deadlock outside a transaction, is retried. In
+	// chunked scans it also bounds the retries of statements that exceeded
+	// StatementTimeout.
+	LockRetries int
+	// ReconnectRetries is the number of times an operation that failed
+	// because the connection to the server was lost is run again, after a
+	// backoff of 1s, 2s, 4s ... up to 30s: a statement or chunk outside a
+	// transaction, or a chunk of LockRows, on a new connection with the
+	// session settings applied again. A table whose TxPerTable transaction
+	// was lost is processed again from the start.
+	ReconnectRetries int
+	// StatementTimeout, if set, limits every SELECT (with a
+	// MAX_EXECUTION_TIME hint) and UPDATE (with a context deadline).
+	StatementTimeout time.Duration
+
+	// BatchSize sends the updates of up to this many rows of a table with a
+	// primary key as one statement, kept under max_allowed_packet; 0 or 1
+	// updates one row at a time.
+	BatchSize int
+
+	// PendingLimit bounds, in bytes, the changed rows a full-table scan
+	// holds in memory to write once it ends; beyond it they are written
+	// during the scan. 0 uses 64 MiB.
+	PendingLimit int64
+
+	// MaxUpdatesPerSecond, if set, caps the rows updated per second across
+	// all workers; scans are not slowed.
+	MaxUpdatesPerSecond float64
+	limiter             *updateLimiter
+
+	// MaxTotalReplacements stops the run before the row that would take
+	// the values changed in all tables over this many: no further updates
+	// are made, and the tables in progress stop as when interrupted, rolled
+	// back with TxPerTable. Dry runs are not stopped, and only report
+	// whether the cap would have been exceeded. ReplacementCounter counts
+	// against it; Run creates one unless it is set, so that several runs
+	// can share a cap.
+	MaxTotalReplacements int
+	ReplacementCounter   *ReplacementCounter
+
+	// SleepBetweenChunks pauses after each chunk that updated rows, or in
+	// tables not scanned in chunks after every SleepEvery rows updated, so
+	// replicas can catch up.
+	SleepBetweenChunks time.Duration
+	SleepEvery         int
+
+	SkipBinlog      bool
+	DisableFKChecks bool
+
+	PreserveTimestamps bool
+
+	// AllowDuplicateRows updates rows that have a byte-identical copy in a
+	// table identified by full row, one copy at a time; such rows are left
+	// alone otherwise.
+	AllowDuplicateRows bool
+
+	// IgnorePrivilegeCheck skips the check, before any table is processed,
+	// that the account can SELECT, and unless nothing is written UPDATE,
+	// every selected table.
+	IgnorePrivilegeCheck bool
+	// IgnoreCharsetCheck skips the check that the session character sets
+	// can represent every column to be processed.
+	IgnoreCharsetCheck bool
+
+	// Strict fails a table when an UPDATE affects a number of rows other
+	// than expected, instead of logging it.
+	Strict bool
+
+	// BackupSuffix copies each table to <table><suffix> before its first
+	// change, or only the rows about to change with BackupChangedOnly.
+	BackupSuffix      string
+	BackupChangedOnly bool
+
+	// LogContext is the number of characters shown either side of a change
+	// in debug value logging, unless LogFullValues is set. ShowDiff logs
+	// changes as inline diffs rather than old and new values. LogNoMatch is
+	// the number of rows per table whose unmatched values are logged at
+	// debug level.
+	LogContext    int
+	LogFullValues bool
+	ShowDiff      bool
+	LogNoMatch    int
+}
+
+// Validate checks the configuration for errors, such as an invalid regular
+// expression, without connecting to the database.
+func (c Config) Validate() error {
+	if len(c.Pairs) == 0 {
+		return fmt.Errorf("no search/replace pairs given")
+	}
+	if _, err := compilePairs(c.Pairs, c.Regex, c.IgnoreCase); err != nil {
+		return err
+	}
+	if c.URLVariants && c.Regex {
+		return fmt.Errorf("URLVariants cannot be used with Regex")
+	}
+	if (c.URLEncoded || c.HTMLEntities) && c.Regex {
+		return fmt.Errorf("URLEncoded and HTMLEntities cannot be used with Regex")
+	}
+	if conflicts := c.serverSideConflicts(); c.ServerSide && len(conflicts) > 0 {
+		return fmt.Errorf("ServerSide cannot be used with %s", strings.Join(conflicts, ", "))
+	}
+	if c.CountOnly && c.OutputSQL != "" {
+		return fmt.Errorf("CountOnly cannot be used with OutputSQL")
+	}
+	if c.SetNull && c.CountOnly {
+		return fmt.Errorf("SetNull cannot be used with CountOnly")
+	}
+	if c.Limit < 0 {
+		return fmt.Errorf("Limit must not be negative")
+	}
+	if c.Decompress && !c.IncludeBinary {
+		return fmt.Errorf("Decompress requires IncludeBinary")
+	}
+	if c.MaxValueSize < 0 {
+		return fmt.Errorf("MaxValueSize must not be negative")
+	}
+	if c.Samples < 0 {
+		return fmt.Errorf("Samples must not be negative")
+	}
+	if (c.ChangedKeys || c.ChangedKeysFile != "") && c.CountOnly {
+		return fmt.Errorf("ChangedKeys cannot be used with CountOnly, which changes no rows")
+	}
+	if c.MaxTotalReplacements < 0 {
+		return fmt.Errorf("MaxTotalReplacements must not be negative")
+	}
+	if c.MaxTotalReplacements > 0 && c.CountOnly {
+		return fmt.Errorf("MaxTotalReplacements cannot be used with CountOnly, which replaces nothing")
+	}
+	if c.TopValues < 0 {
+		return fmt.Errorf("TopValues must not be negative")
+	}
+	if c.Samples > 0 && !c.DryRun && !c.CountOnly {
+		return fmt.Errorf("Samples requires DryRun or CountOnly")
+	}
+	if c.StatementTimeout < 0 || (c.StatementTimeout > 0 && c.StatementTimeout < time.Millisecond) {
+		return fmt.Errorf("StatementTimeout must be 0 or at least 1ms")
+	}
+	if c.LockRetries < 0 {
+		return fmt.Errorf("LockRetries must not be negative")
+	}
+	if c.ReconnectRetries < 0 {
+		return fmt.Errorf("ReconnectRetries must not be negative")
+	}
+	if c.LockRows && c.ChunkSize <= 0 {
+		return fmt.Errorf("LockRows requires ChunkSize")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("BatchSize must not be negative")
+	}
+	if c.PendingLimit < 0 {
+		return fmt.Errorf("PendingLimit must not be negative")
+	}
+	if c.MaxTableRows < 0 {
+		return fmt.Errorf("MaxTableRows must not be negative")
+	}
+	switch c.OrderBy {
+	case "", "none", "name", "size":
+	default:
+		return fmt.Errorf("OrderBy must be size, name or none, not %q", c.OrderBy)
+	}
+	if c.MaxUpdatesPerSecond < 0 {
+		return fmt.Errorf("MaxUpdatesPerSecond must not be negative")
+	}
+	if c.SleepBetweenChunks < 0 {
+		return fmt.Errorf("SleepBetweenChunks must not be negative")
+	}
+	if c.SleepBetweenChunks > 0 && c.SleepEvery < 1 {
+		return fmt.Errorf("SleepEvery must be at least 1")
+	}
+	if c.LogContext < 0 {
+		return fmt.Errorf("LogContext must not be negative")
+	}
+	if c.BackupChangedOnly && c.BackupSuffix == "" {
+		return fmt.Errorf("BackupChangedOnly requires BackupSuffix")
+	}
+	if c.Checkpoint != "" && !c.WritesDatabase() {
+		return fmt.Errorf("Checkpoint cannot be used with DryRun, CountOnly or OutputSQL")
+	}
+	if c.Verify && !c.WritesDatabase() {
+		return fmt.Errorf("Verify requires a run that writes the database, not DryRun, CountOnly or OutputSQL")
+	}
+	switch c.SnapshotFormat {
+	case "", "jsonl", "csv":
+	default:
+		return fmt.Errorf("SnapshotFormat must be jsonl or csv, not %q", c.SnapshotFormat)
+	}
+	if c.SnapshotDir != "" && c.CountOnly {
+		return fmt.Errorf("SnapshotDir cannot be used with CountOnly, which changes no rows")
+	}
+	return c.validateRules()
+}
+
+// WritesDatabase reports whether changes are applied to the live database
+// rather than only reported or written to a file.
+func (c Config) WritesDatabase() bool {
+	return !c.DryRun && !c.CountOnly && c.OutputSQL == ""
+}
+
+func (c Config) matches(s string) bool {
+	for _, pair := range c.Pairs {
+		if pair.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceString applies every pair to s in order, adding to hits[i] the
+// number of occurrences pair i replaced.
+func (c Config) replaceString(s string, hits []int) string {
+	for i, pair := range c.Pairs {
+		newValue := pair.apply(s)
+		if newValue != s {
+			accepted, _ := pair.find(s)
+			hits[i] += len(accepted)
+			s = newValue
+		}
+	}
+	return s
+}
+
+func (c Config) searchTerms() string {
+	terms := make([]string, len(c.Pairs))
+	for i, pair := range c.Pairs {
+		terms[i] = pair.Search
+	}
+	return strings.Join(terms, "', '")
+}
+
+type textColumn struct {
+	Name string
+	JSON bool
+	// Binary columns (BLOB, BINARY, VARBINARY) are replaced byte for byte.
+	Binary bool
+	// Members lists the allowed values of an ENUM or SET column and is nil
+	// for other columns.
+	Members []string
+	Set     bool
+	// Generated columns are computed by the server and never written.
+	Generated bool
+	// Collation is the collation of a column holding characters, and empty
+	// for JSON and binary columns.
+	Collation string
+	Nullable  bool
+}
+
+// byteExact reports whether the column's collation tells apart the letter
+// case, as the _bin collations do.
+func (c textColumn) byteExact() bool {
+	return strings.HasSuffix(c.Collation, "_bin")
+}
+
+// forColumn returns the configuration to match the values of col with:
+// that of the first column rule matching it, if any, and for a column with
+// a _bin collation, IgnoreCase does not apply.
+func (c Config) forColumn(col textColumn) Config {
+	if c.columnRules != nil {
+		c = c.withColumnRule(col.Name)
+	}
+	if c.exactPairs != nil && col.byteExact() {
+		c.Pairs = c.exactPairs
+	}
+	return c
+}
+
+// allows reports whether value can be stored in an ENUM or SET column: one
+// member for ENUM, a comma-separated list of members (or empty) for SET.
+func (c textColumn) allows(value string) bool {
+	if c.Set {
+		if value == "" {
+			return true
+		}
+		for _, item := range strings.Split(value, ",") {
+			if indexOf(c.Members, item) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return indexOf(c.Members, value) >= 0
+}
+
+// TableResult is the outcome of processing one table.
+type TableResult struct {
+	// Replacements counts changed values; Columns and Pairs break it down
+	// by column name and by pair, indexed like Config.Pairs followed by the
+	// Pairs of each of Config.Rules. OccurrencesReplaced counts the
+	// occurrences of the search strings replaced in them.
+	Replacements        int
+	Columns             map[string]int
+	Pairs               []int
+	OccurrencesReplaced int
+	// Rule names the rule of Config.Rules the table followed, if any, and
+	// ColumnRules the rule with ForColumns each column followed.
+	Rule        string
+	ColumnRules map[string]string
+	// NoTextColumns is set when the table had no columns to scan, and
+	// WhereSkipped when it lacked a column of its Where condition.
+	NoTextColumns bool
+	WhereSkipped  bool
+	// Committed is set when the table's transaction was committed, or with
+	// LockRows when at least one chunk was.
+	Committed   bool
+	RowsScanned int
+	RowsUpdated int
+	// BytesScanned is the size of the values read from the columns
+	// scanned. Elapsed leaves out the time spent waiting at the approval
+	// prompt, which prompted counts, and sleeping for SleepBetweenChunks,
+	// which Slept counts.
+	BytesScanned int64
+	Elapsed      time.Duration
+	Slept        time.Duration
+	prompted     time.Duration
+	// DBWait is the part of Elapsed spent waiting on the server: running
+	// the SELECTs and reading their rows, and the writes and commits.
+	// Processing is the part spent matching and replacing in the rows read,
+	// decoding and serializing included. The rest goes to writing files,
+	// building statements and bookkeeping.
+	DBWait     time.Duration
+	Processing time.Duration
+	// Limited is set when Limit stopped the scan before the end of the
+	// table.
+	Limited bool
+	// Backup is the backup table created for this table, if any.
+	Backup string
+	// Base64Values counts the changed values that were base64-encoded, and
+	// CompressedValues those that were compressed.
+	Base64Values     int
+	CompressedValues int
+	// NulledValues counts the values set to NULL by SetNull, and
+	// NotNullColumns lists the columns it left alone for being NOT NULL.
+	NulledValues   int
+	NotNullColumns []string
+	// LockRetries counts the statements run again after a lock conflict.
+	LockRetries int
+	// Reconnects counts the operations run again after a lost connection,
+	// the table itself included when it was processed again.
+	Reconnects int
+	// Timeouts counts the statements that exceeded StatementTimeout,
+	// retried or not.
+	Timeouts int
+	// ChangedSinceRead counts the rows, read from a replica, that no longer
+	// held the values read when they were to be updated and were left alone.
+	ChangedSinceRead int
+	// RowsSkipped counts the rows Replacer.Approve declined, and Quit is set
+	// when it ended the run at this table.
+	RowsSkipped int
+	Quit        bool
+	// DuplicateRows counts the rows with a byte-identical copy in a table
+	// identified by full row, and DuplicatesSkipped those of them with
+	// replacements left alone because AllowDuplicateRows was not set.
+	DuplicateRows     int
+	DuplicatesSkipped int
+	// UnexpectedAffected counts the UPDATEs that affected a number of rows
+	// other than expected.
+	UnexpectedAffected int
+	// OversizeValues counts the values left alone for being larger than
+	// MaxValueSize.
+	OversizeValues int
+	// RejectedRows counts the rows left alone because the server rejected
+	// one of their values in the UPDATE, such as an invalid date.
+	RejectedRows int
+	// ExcludedMatches counts, per column left out by ExcludeColumns, the
+	// values that contain a search string and were left alone.
+	ExcludedMatches map[string]int
+	// Occurrences counts the matches per column and MatchedRows the rows
+	// with at least one, in CountOnly mode.
+	Occurrences map[string]int
+	MatchedRows int
+	// Samples holds the example matches collected for Config.Samples, in
+	// scan order.
+	Samples []Sample
+	// TopValues holds the most common matching values for
+	// Config.TopValues, and OtherValues counts the matching values not
+	// among them.
+	TopValues   []ValueCount
+	OtherValues int
+	// ChangedKeys holds the keys of the rows changed for Config.ChangedKeys,
+	// in the order they were written, and ChangedKeysOmitted counts those
+	// beyond the first 1000. ChangedKeysColumns names the key columns.
+	ChangedKeys        []string
+	ChangedKeysOmitted int
+	ChangedKeysColumns string
+}
+
+// Sample is an example match: the column, the row as identified in the
+// audit file, and an excerpt around the first match in the value. Matches
+// in columns left out by ExcludeColumns are Redacted and have no excerpt.
+type Sample struct {
+	Column   string `json:"column"`
+	Row      string `json:"row"`
+	Excerpt  string `json:"excerpt,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// preparer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type preparer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
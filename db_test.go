@@ -0,0 +1,101 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// testDB connects to the scratch database of MYSQLREPLACE_TEST_DSN, a
+// go-sql-driver DSN such as root@tcp(127.0.0.1:3306)/test, and skips the
+// test when it is not set.
+func testDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+	dsn := os.Getenv("MYSQLREPLACE_TEST_DSN")
+	if dsn == "" {
+		tb.Skip("MYSQLREPLACE_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// createTestTable creates table with the given column definitions and
+// rows, and drops it when the test ends.
+func createTestTable(tb testing.TB, db *sql.DB, table, definition string, inserts ...string) {
+	tb.Helper()
+	statements := []string{
+		"DROP TABLE IF EXISTS " + quoteIdent(table),
+		fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(table), definition),
+	}
+	for _, values := range inserts {
+		statements = append(statements, fmt.Sprintf("INSERT INTO %s VALUES %s", quoteIdent(table), values))
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			tb.Fatalf("%s: %v", statement, err)
+		}
+	}
+	tb.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS " + quoteIdent(table)) })
+}
+
+// testReplacer returns a Replacer for db with config, in the connected
+// database, logging nowhere unless config has a Logger.
+func testReplacer(tb testing.TB, db *sql.DB, config Config) *Replacer {
+	tb.Helper()
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if err := db.QueryRow("SELECT DATABASE()").Scan(&config.Database); err != nil {
+		tb.Fatal(err)
+	}
+	r, err := New(db, config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+// processTestTable runs config over table, failing the test on error.
+func processTestTable(tb testing.TB, db *sql.DB, table string, config Config) TableResult {
+	tb.Helper()
+	result, err := testReplacer(tb, db, config).ProcessTable(context.Background(), table)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return result
+}
+
+// columnValues returns the values of column in table, ordered by order.
+func columnValues(tb testing.TB, db *sql.DB, table, column, order string) []sql.NullString {
+	tb.Helper()
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", quoteIdent(column), quoteIdent(table), order))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rows.Close()
+	var values []sql.NullString
+	for rows.Next() {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil {
+			tb.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return values
+}
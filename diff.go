@@ -0,0 +1,259 @@
+package mysqlreplace
+
+import "fmt"
+
+// maxDiffEdits bounds the work of diffValues: values that differ in more
+// characters are shown as a single changed region.
+const maxDiffEdits = 500
+
+// minDiffEqual is the shortest unchanged run kept between two changes;
+// shorter runs are folded into the changes so that, for example, "com" to
+// "org" reads as one change rather than three around a shared "o".
+const minDiffEqual = 3
+
+// diffOp is a run of characters kept ('='), removed ('-') or added ('+').
+type diffOp struct {
+	kind byte
+	text []rune
+}
+
+// diffValues renders the change from a to b on one line, marking removed
+// text as [-...-] and added text as {+...+}. Unchanged runs keep context
+// characters next to each change and are otherwise elided with a marker
+// giving their length; changed runs longer than 2*context characters are
+// shortened in the middle the same way. A context of 0 elides nothing.
+func diffValues(a, b string, context int) string {
+	return markedDiff(a, b, context, func(s string) string { return "[-" + s + "-]" }, func(s string) string { return "{+" + s + "+}" })
+}
+
+// markedDiff is diffValues with removed and added text passed through
+// removed and added instead.
+func markedDiff(a, b string, context int, removed, added func(string) string) string {
+	return diffParts(a, b, context).join(func(kind byte, s string) string {
+		switch kind {
+		case '-':
+			return removed(s)
+		case '+':
+			return added(s)
+		}
+		return s
+	})
+}
+
+// diffParts is the change from a to b as rendered by diffValues, in parts
+// marked as removed, added or unchanged.
+func diffParts(a, b string, context int) highlight {
+	ops := cleanupDiff(diffRunes([]rune(a), []rune(b)))
+	var parts highlight
+	for i, op := range ops {
+		text := op.text
+		if context > 0 {
+			switch {
+			case op.kind != '=':
+				text = elideMiddle(text, context)
+			case i == 0 && len(ops) > 1:
+				text = elideStart(text, context)
+			case i == len(ops)-1 && len(ops) > 1:
+				text = elideEnd(text, context)
+			case len(ops) > 1:
+				text = elideMiddle(text, context)
+			}
+		}
+		kind := op.kind
+		if kind == '=' {
+			kind = 0
+		}
+		parts = append(parts, markedPart{string(text), kind})
+	}
+	return parts
+}
+
+func elideStart(text []rune, keep int) []rune {
+	cut := len(text) - keep
+	if !worthEliding(cut) {
+		return text
+	}
+	return append(elision(cut), text[cut:]...)
+}
+
+func elideEnd(text []rune, keep int) []rune {
+	cut := len(text) - keep
+	if !worthEliding(cut) {
+		return text
+	}
+	return append(append([]rune(nil), text[:keep]...), elision(cut)...)
+}
+
+func elideMiddle(text []rune, keep int) []rune {
+	cut := len(text) - 2*keep
+	if !worthEliding(cut) {
+		return text
+	}
+	out := append(append([]rune(nil), text[:keep]...), elision(cut)...)
+	return append(out, text[len(text)-keep:]...)
+}
+
+func elision(cut int) []rune {
+	return []rune(fmt.Sprintf("…[%d chars]…", cut))
+}
+
+// worthEliding reports whether cutting cut characters saves more than the
+// marker costs.
+func worthEliding(cut int) bool {
+	return cut > len(elision(cut))
+}
+
+// diffRunes returns the edits turning a into b. The common prefix and
+// suffix are split off first; the rest is diffed with Myers' algorithm, or
+// replaced as a whole when it needs more than maxDiffEdits edits.
+func diffRunes(a, b []rune) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	if prefix > 0 {
+		ops = append(ops, diffOp{'=', a[:prefix]})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle, ok := myersDiff(midA, midB, maxDiffEdits)
+	if !ok {
+		middle = nil
+		if len(midA) > 0 {
+			middle = append(middle, diffOp{'-', midA})
+		}
+		if len(midB) > 0 {
+			middle = append(middle, diffOp{'+', midB})
+		}
+	}
+	ops = append(ops, middle...)
+	if suffix > 0 {
+		ops = append(ops, diffOp{'=', a[len(a)-suffix:]})
+	}
+	return ops
+}
+
+// myersDiff finds the shortest edit script from a to b, giving up when it
+// needs more than maxEdits edits.
+func myersDiff(a, b []rune, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	if n+m < maxEdits {
+		maxEdits = n + m
+	}
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	var trace [][]int
+	for d := 0; d <= maxEdits; d++ {
+		// Step d only reads the diagonals -d..d of the previous frontier.
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(trace, a, b), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// backtrackDiff walks the saved frontiers of myersDiff back from the end,
+// trace[d] holding diagonals -d..d of the frontier before step d.
+func backtrackDiff(trace [][]int, a, b []rune) []diffOp {
+	var reversed []diffOp
+	add := func(kind byte, r rune) {
+		if n := len(reversed); n > 0 && reversed[n-1].kind == kind {
+			reversed[n-1].text = append(reversed[n-1].text, r)
+			return
+		}
+		reversed = append(reversed, diffOp{kind, []rune{r}})
+	}
+
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			add('=', a[x-1])
+			x--
+			y--
+		}
+		if x == prevX {
+			add('+', b[y-1])
+			y--
+		} else {
+			add('-', a[x-1])
+			x--
+		}
+	}
+	for x > 0 {
+		add('=', a[x-1])
+		x--
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		for l, r := 0, len(op.text)-1; l < r; l, r = l+1, r-1 {
+			op.text[l], op.text[r] = op.text[r], op.text[l]
+		}
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// cleanupDiff folds unchanged runs shorter than minDiffEqual between two
+// changes into them and merges each group of changes into one removal
+// followed by one addition.
+func cleanupDiff(ops []diffOp) []diffOp {
+	var out []diffOp
+	var removed, added []rune
+	changed := false
+	flush := func() {
+		if len(removed) > 0 {
+			out = append(out, diffOp{'-', removed})
+		}
+		if len(added) > 0 {
+			out = append(out, diffOp{'+', added})
+		}
+		removed, added, changed = nil, nil, false
+	}
+	for i, op := range ops {
+		switch {
+		case op.kind == '-':
+			removed = append(removed, op.text...)
+			changed = true
+		case op.kind == '+':
+			added = append(added, op.text...)
+			changed = true
+		case changed && i < len(ops)-1 && len(op.text) < minDiffEqual:
+			removed = append(removed, op.text...)
+			added = append(added, op.text...)
+		default:
+			flush()
+			out = append(out, op)
+		}
+	}
+	flush()
+	return out
+}
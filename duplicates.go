@@ -0,0 +1,87 @@
+package mysqlreplace
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rowFingerprint hashes a row's values, NULLs included, so byte-identical
+// rows share a fingerprint.
+func rowFingerprint(values []interface{}) [sha256.Size]byte {
+	h := sha256.New()
+	var length [8]byte
+	for _, value := range values {
+		if value == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		s := convertToString(value)
+		binary.BigEndian.PutUint64(length[:], uint64(len(s)))
+		h.Write([]byte{1})
+		h.Write(length[:])
+		h.Write([]byte(s))
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// findDuplicates looks for rows with a byte-identical copy in a table
+// identified by full row, where the copies cannot be told apart. Each
+// UPDATE is limited to one row, so the copies are changed one at a time,
+// but the audit, undo and backup records of one copy then stand for any of
+// them. Unless AllowDuplicateRows is set, such rows are left alone.
+func (j *tableJob) findDuplicates() error {
+	defer j.waited(time.Now())
+	columnsList, _, err := queryRows(j.ctx, j.db, fmt.Sprintf("SELECT * FROM %s LIMIT 0", quoteTable(j.table)))
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(columnsList))
+	for i, col := range columnsList {
+		quoted[i] = quoteIdent(col)
+	}
+	list := strings.Join(quoted, ", ")
+	// Only rows the scan will read matter, so the probe shares its filter.
+	query := fmt.Sprintf("SELECT %s%s, COUNT(*) FROM %s", j.config.selectHint(), list, quoteTable(j.table))
+	if j.filter != "" {
+		query += " WHERE " + j.filter
+	}
+	query += fmt.Sprintf(" GROUP BY %s HAVING COUNT(*) > 1", list)
+	_, groups, err := queryRows(j.ctx, j.db, query, j.filterArgs...)
+	if err != nil {
+		j.timedOut(err)
+		return fmt.Errorf("looking for duplicate rows: %w", err)
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	j.duplicates = make(map[[sha256.Size]byte]bool, len(groups))
+	for _, group := range groups {
+		values := group[:len(columnsList)]
+		j.duplicates[rowFingerprint(values)] = true
+		var copies int
+		if _, err := fmt.Sscan(convertToString(group[len(columnsList)]), &copies); err != nil {
+			return fmt.Errorf("invalid duplicate count %v", group[len(columnsList)])
+		}
+		j.result.DuplicateRows += copies
+	}
+	if j.config.AllowDuplicateRows {
+		j.log.Warn("table has rows that are exact duplicates of another row; updating each copy on its own",
+			"rows", j.result.DuplicateRows, "groups", len(groups))
+	} else {
+		j.log.Warn("table has rows that are exact duplicates of another row; leaving them alone (use -allow-duplicate-rows to update each copy on its own)",
+			"rows", j.result.DuplicateRows, "groups", len(groups))
+	}
+	return nil
+}
+
+// skipDuplicate reports whether a changed row is one of several identical
+// copies to be left alone.
+func (j *tableJob) skipDuplicate(values []interface{}) bool {
+	return j.duplicates != nil && !j.config.AllowDuplicateRows && j.duplicates[rowFingerprint(values)]
+}
@@ -2,6 +2,15 @@ module github.com/wltechblog/mysqlreplace
 
 go 1.24.1
 
-require github.com/go-sql-driver/mysql v1.9.3
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/go-sql-driver/mysql v1.9.3
+	golang.org/x/crypto v0.39.0
+	golang.org/x/term v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+)
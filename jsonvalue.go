@@ -0,0 +1,80 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// replaceJSON applies fn to every string value inside a JSON document (and to
+// object keys when keys is true) and re-encodes it. It returns the new
+// document and the number of strings that were modified.
+func replaceJSON(value string, fn func(string) string, keys bool) (string, int, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", 0, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return "", 0, fmt.Errorf("unexpected data after JSON document")
+	}
+
+	modified := 0
+	doc, err := replaceJSONNode(doc, fn, keys, &modified)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", 0, err
+	}
+
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), modified, nil
+}
+
+func replaceJSONNode(node interface{}, fn func(string) string, keys bool, modified *int) (interface{}, error) {
+	switch v := node.(type) {
+	case string:
+		newValue := fn(v)
+		if newValue != v {
+			*modified++
+		}
+		return newValue, nil
+	case []interface{}:
+		for i, elem := range v {
+			newElem, err := replaceJSONNode(elem, fn, keys, modified)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = newElem
+		}
+		return v, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			newElem, err := replaceJSONNode(elem, fn, keys, modified)
+			if err != nil {
+				return nil, err
+			}
+			if keys {
+				if newKey := fn(key); newKey != key {
+					*modified++
+					key = newKey
+				}
+			}
+			if _, exists := out[key]; exists {
+				return nil, fmt.Errorf("key replacement produces duplicate key %q", key)
+			}
+			out[key] = newElem
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,188 @@
+package mysqlreplace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// changedKeysKept caps the keys of a table held in TableResult.ChangedKeys;
+// ChangedKeysFile has all of them.
+const changedKeysKept = 1000
+
+// changedKeysInline is the most keys of a table listed in the summary.
+const changedKeysInline = 20
+
+// keysWriter writes the keys of the changed rows to ChangedKeysFile, a
+// section per table. Each table's keys go to a temporary file next to it
+// while the table is processed, and are appended to the file once the
+// table ends with its changes kept, so that memory does not grow with the
+// number of rows and tables processed at once are not interleaved.
+type keysWriter struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	err    error
+	rows   int
+	tables int
+}
+
+func createKeysWriter(path string) (*keysWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &keysWriter{path: path, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (kw *keysWriter) Close() error {
+	if err := kw.w.Flush(); err != nil && kw.err == nil {
+		kw.err = err
+	}
+	if err := kw.file.Close(); err != nil && kw.err == nil {
+		kw.err = err
+	}
+	return kw.err
+}
+
+// tableKeys collects the keys of one table's changed rows, in the result
+// when collect is set and in the file when kw is.
+type tableKeys struct {
+	kw      *keysWriter
+	collect bool
+	table   string
+	header  string
+	result  *TableResult
+	tmp     *os.File
+	w       *bufio.Writer
+	rows    int
+	err     error
+}
+
+// newTableKeys returns the collector for table, whose key columns are
+// described by header in the file, the summary and the report.
+func newTableKeys(kw *keysWriter, collect bool, table string, primaryKey []string, result *TableResult) *tableKeys {
+	header := "(" + strings.Join(primaryKey, ", ") + ")"
+	if len(primaryKey) == 0 {
+		header = "(no primary key: sha256 of the original row)"
+	}
+	return &tableKeys{kw: kw, collect: collect, table: table, header: header, result: result}
+}
+
+// add records the key of a changed row.
+func (tk *tableKeys) add(key string) {
+	if tk.collect {
+		tk.result.ChangedKeysColumns = tk.header
+		if len(tk.result.ChangedKeys) < changedKeysKept {
+			tk.result.ChangedKeys = append(tk.result.ChangedKeys, key)
+		} else {
+			tk.result.ChangedKeysOmitted++
+		}
+	}
+	if tk.kw == nil || tk.err != nil {
+		return
+	}
+	if tk.tmp == nil {
+		tk.tmp, tk.err = os.CreateTemp(filepath.Dir(tk.kw.path), ".changed-keys-*")
+		if tk.err != nil {
+			return
+		}
+		tk.w = bufio.NewWriter(tk.tmp)
+	}
+	tk.w.WriteString(key + "\n")
+	tk.rows++
+}
+
+// end appends the table's keys to the file when its changes were kept, and
+// otherwise forgets them.
+func (tk *tableKeys) end(kept bool) {
+	if !kept {
+		tk.result.ChangedKeys, tk.result.ChangedKeysOmitted, tk.result.ChangedKeysColumns = nil, 0, ""
+	}
+	if tk.tmp == nil {
+		if tk.err != nil {
+			tk.kw.fail(tk.err)
+		}
+		return
+	}
+	defer os.Remove(tk.tmp.Name())
+	defer tk.tmp.Close()
+	if !kept {
+		return
+	}
+	if tk.err == nil {
+		tk.err = tk.w.Flush()
+	}
+	if tk.err == nil {
+		_, tk.err = tk.tmp.Seek(0, io.SeekStart)
+	}
+	if tk.err != nil {
+		tk.kw.fail(tk.err)
+		return
+	}
+
+	kw := tk.kw
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	fmt.Fprintf(kw.w, "# %s %s: %d rows\n", tk.table, tk.header, tk.rows)
+	if _, err := io.Copy(kw.w, tk.tmp); err != nil && kw.err == nil {
+		kw.err = err
+	}
+	kw.rows += tk.rows
+	kw.tables++
+}
+
+func (kw *keysWriter) fail(err error) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	if kw.err == nil {
+		kw.err = err
+	}
+}
+
+// changedKey renders the key of a row: its value, or for a composite
+// key a tuple such as (1, 'en'), with strings quoted as in SQL. Rows of a
+// table without one are identified by a fingerprint of all their values.
+func changedKey(columnsList []string, values []interface{}, primaryKey []string) string {
+	if len(primaryKey) == 0 {
+		sum := rowFingerprint(values)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	parts := make([]string, 0, len(primaryKey))
+	for _, key := range primaryKey {
+		i := indexOf(columnsList, key)
+		if i < 0 {
+			continue
+		}
+		parts = append(parts, keyLiteral(values[i]))
+	}
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func keyLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int32, int, uint32:
+		return fmt.Sprint(v)
+	}
+	s := convertToString(value)
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,124 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// querier is satisfied by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// lockedChunk runs one chunk for LockRows in a transaction of its own: run
+// reads the chunk with SELECT ... FOR UPDATE through the transaction, so
+// the rows cannot change until their updates are committed. After a lock
+// wait timeout, deadlock or statement timeout the chunk is rolled back and
+// retried, up to LockRetries more times, and after a lost connection up to
+// ReconnectRetries more times.
+func (j *tableJob) lockedChunk(run func(q querier) error) error {
+	delay := retryBaseDelay
+	lost := 0
+	for attempt := 1; ; attempt++ {
+		saved := j.result.snapshot()
+		err := j.runLockedChunk(run)
+		if err == nil {
+			return nil
+		}
+		// The rolled-back chunk's rows are counted again when retried.
+		j.result.restore(saved)
+
+		if isConnectionLost(err) && j.ctx.Err() == nil && lost < j.config.ReconnectRetries {
+			lost++
+			if !j.reconnect(err, lost) {
+				return err
+			}
+			attempt--
+			continue
+		}
+
+		n := mysqlErrorNumber(err)
+		if j.ctx.Err() != nil || attempt > j.config.LockRetries || (n != errLockWaitTimeout && n != errLockDeadlock && !isTimeout(err)) {
+			return fmt.Errorf("%w (chunk rolled back, earlier chunks are committed)", err)
+		}
+		if isTimeout(err) {
+			j.log.Warn(fmt.Sprintf("statement timed out, retrying chunk in %s", delay), "attempt", attempt, "err", err)
+		} else {
+			j.result.LockRetries++
+			j.log.Warn(fmt.Sprintf("lock conflict, retrying chunk in %s", delay), "attempt", attempt, "err", err)
+		}
+		if !j.wait(delay) {
+			return err
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+func (j *tableJob) runLockedChunk(run func(q querier) error) (err error) {
+	tx, err := j.w.BeginTx(j.ctx, nil)
+	if err != nil {
+		return err
+	}
+	j.tx, j.exec = tx, tx
+	defer func() {
+		// Statements prepared in the transaction end with it.
+		j.closeStatements()
+		j.tx, j.exec = nil, j.w
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				err = fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+			}
+			if j.batch != nil {
+				j.batch.rows, j.batch.size, j.batch.placeholders = nil, 0, 0
+			}
+		}
+		j.chunkAudit = nil
+	}()
+
+	if err := run(tx); err != nil {
+		return err
+	}
+	if err := j.flush(); err != nil {
+		return err
+	}
+	committing := time.Now()
+	err = tx.Commit()
+	j.waited(committing)
+	if err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	j.result.Committed = true
+	j.writeAudit(j.chunkAudit)
+	return nil
+}
+
+// snapshot copies the counts of r so a rolled-back chunk can be undone.
+func (r *TableResult) snapshot() TableResult {
+	s := *r
+	s.Columns = make(map[string]int, len(r.Columns))
+	for col, n := range r.Columns {
+		s.Columns[col] = n
+	}
+	s.Pairs = append([]int(nil), r.Pairs...)
+	if r.ExcludedMatches != nil {
+		s.ExcludedMatches = make(map[string]int, len(r.ExcludedMatches))
+		for col, n := range r.ExcludedMatches {
+			s.ExcludedMatches[col] = n
+		}
+	}
+	return s
+}
+
+// restore puts back a snapshot, keeping the retries, reconnections and
+// timeouts counted since, a quit at and the time spent waiting at the
+// approval prompt, and the time slept, waited on the server and spent
+// processing.
+func (r *TableResult) restore(s TableResult) {
+	retries, reconnects, timeouts, quit, prompted, slept := r.LockRetries, r.Reconnects, r.Timeouts, r.Quit, r.prompted, r.Slept
+	dbWait, processing := r.DBWait, r.Processing
+	*r = s
+	r.LockRetries, r.Reconnects, r.Timeouts, r.Quit, r.prompted, r.Slept = retries, reconnects, timeouts, quit, prompted, slept
+	r.DBWait, r.Processing = dbWait, processing
+}
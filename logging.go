@@ -0,0 +1,152 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// LevelSummary is the level of the end-of-run summary logged by Run. It is
+// above slog.LevelError so the summary is printed even when only errors are.
+const LevelSummary = slog.LevelError + 4
+
+// LevelChanged is the level of the lines logging the replacements made in a
+// table, so that they can be told apart from those of tables left
+// unchanged. The handlers of this package name it "INFO".
+const LevelChanged = slog.LevelInfo + 1
+
+// NewLogHandler returns a text handler writing to stderr at the given level.
+// It shares stderr with the progress status line shown on terminals, and
+// names LevelSummary "SUMMARY".
+func NewLogHandler(level slog.Leveler) slog.Handler {
+	return NewWriterLogHandler(stderrStatus, level)
+}
+
+// NewWriterLogHandler returns a text handler like NewLogHandler's that
+// writes to w, such as a log file.
+func NewWriterLogHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewTextHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey {
+				switch a.Value.Any() {
+				case LevelSummary:
+					a.Value = slog.StringValue("SUMMARY")
+				case LevelChanged:
+					a.Value = slog.StringValue("INFO")
+				}
+			}
+			return a
+		},
+	})
+}
+
+// ANSI escape codes of the colors used on terminals, for Paint.
+const (
+	ColorRed    = "\x1b[31m"
+	ColorYellow = "\x1b[33m"
+	ColorGreen  = "\x1b[32m"
+	colorReset  = "\x1b[0m"
+)
+
+// Paint returns s in color for a terminal. An empty s is left as it is.
+func Paint(color, s string) string {
+	if s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// NewColorLogHandler returns a handler like NewLogHandler's that colors the
+// lines for a terminal: errors red, warnings yellow and LevelChanged lines
+// green. In the verbose lines logging a change, the removed text is red and
+// the added text green.
+func NewColorLogHandler(level slog.Leveler) slog.Handler {
+	out := &colorOutput{w: stderrStatus}
+	return colorHandler{out: out, inner: NewWriterLogHandler(&out.buf, level)}
+}
+
+// colorOutput is shared by a colorHandler and those derived from it, whose
+// text handlers format each record into buf.
+type colorOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+type colorHandler struct {
+	out   *colorOutput
+	inner slog.Handler
+}
+
+func (h colorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h colorHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.inner.Handle(ctx, record); err != nil {
+		return err
+	}
+	line := h.out.buf.Bytes()
+	color := levelColor(record.Level)
+	record.Attrs(func(a slog.Attr) bool {
+		if change, ok := a.Value.Any().(highlight); ok {
+			line = change.paint(line, color)
+			return false
+		}
+		return true
+	})
+	if color == "" {
+		_, err := h.out.w.Write(line)
+		return err
+	}
+	_, err := fmt.Fprintf(h.out.w, "%s%s%s\n", color, bytes.TrimSuffix(line, []byte("\n")), colorReset)
+	return err
+}
+
+func (h colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return colorHandler{out: h.out, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h colorHandler) WithGroup(name string) slog.Handler {
+	return colorHandler{out: h.out, inner: h.inner.WithGroup(name)}
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level == LevelSummary:
+		return ""
+	case level >= slog.LevelError:
+		return ColorRed
+	case level >= slog.LevelWarn:
+		return ColorYellow
+	case level == LevelChanged:
+		return ColorGreen
+	}
+	return ""
+}
+
+// log returns the logger of the run, see Config.Logger.
+func (c Config) log() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// summaryf logs a line of the end-of-run summary.
+func (c Config) summaryf(format string, args ...interface{}) {
+	c.log().Log(context.Background(), LevelSummary, fmt.Sprintf(format, args...))
+}
+
+// tableLogger returns the logger for per-table output, which carries the
+// table name as an attribute.
+func (c Config) tableLogger(table string) *slog.Logger {
+	return c.log().With("table", table)
+}
@@ -0,0 +1,34 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestHighlightOnlyOnTerminal checks that the color handler marks the
+// changed parts of a logged change while the plain handler, as used for
+// -log-file, writes no escape codes.
+func TestHighlightOnlyOnTerminal(t *testing.T) {
+	change := describeChange(`see old.example.com "now"`, `see new.example.com "now"`, Config{LogContext: 40})
+	var colored, plain bytes.Buffer
+	out := &colorOutput{w: &colored}
+	handlers := []slog.Handler{
+		colorHandler{out: out, inner: NewWriterLogHandler(&out.buf, slog.LevelDebug)},
+		NewWriterLogHandler(&plain, slog.LevelDebug),
+	}
+	for _, handler := range handlers {
+		slog.New(handler).Debug("would replace "+change.String(), "column", "post_content", change.attr())
+	}
+
+	want := `msg="would replace 'see ` + ColorRed + `old` + colorReset + `.example.com \"now\"' -> 'see ` +
+		ColorGreen + `new` + colorReset + `.example.com \"now\"'" column=post_content`
+	if !strings.Contains(colored.String(), want) {
+		t.Errorf("colored line %q lacks %q", colored.String(), want)
+	}
+	want = `msg="would replace 'see old.example.com \"now\"' -> 'see new.example.com \"now\"'" column=post_content` + "\n"
+	if !strings.HasSuffix(plain.String(), want) {
+		t.Errorf("plain line is %q, want it to end with %q", plain.String(), want)
+	}
+}
@@ -0,0 +1,247 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// logChange returns the old and new values of a replaced column for verbose
+// logging, each cut down to the changed region and config.LogContext
+// characters either side of it.
+func logChange(oldValue, newValue string, config Config) (string, string) {
+	if config.LogFullValues {
+		return oldValue, newValue
+	}
+	prefix, suffix := commonAffixes(oldValue, newValue)
+	return excerpt(oldValue, prefix, len(oldValue)-suffix, config.LogContext),
+		excerpt(newValue, prefix, len(newValue)-suffix, config.LogContext)
+}
+
+// describeChange formats a change for verbose logging as 'old' -> 'new', or
+// with config.ShowDiff as an inline diff, marking the changed parts.
+func describeChange(oldValue, newValue string, config Config) highlight {
+	if config.ShowDiff {
+		context := config.LogContext
+		if config.LogFullValues {
+			context = 0
+		}
+		var change highlight
+		for _, part := range diffParts(oldValue, newValue, context) {
+			switch part.kind {
+			case '-':
+				part.text = "[-" + part.text + "-]"
+			case '+':
+				part.text = "{+" + part.text + "+}"
+			}
+			change = append(change, part)
+		}
+		return change
+	}
+	context := config.LogContext
+	if config.LogFullValues {
+		context = len(oldValue) + len(newValue)
+	}
+	prefix, suffix := commonAffixes(oldValue, newValue)
+	change := highlight{{text: "'"}}
+	change = append(change, excerptParts(oldValue, prefix, len(oldValue)-suffix, context, '-')...)
+	change = append(change, markedPart{text: "' -> '"})
+	change = append(change, excerptParts(newValue, prefix, len(newValue)-suffix, context, '+')...)
+	return append(change, markedPart{text: "'"})
+}
+
+// markedPart is a part of a logged message, removed ('-'), added ('+') or
+// neither (0).
+type markedPart struct {
+	text string
+	kind byte
+}
+
+// highlight is a logged change as its parts, passed as a log attribute so
+// that NewColorLogHandler can color what was removed and added. It logs as
+// an empty group, which other handlers leave out.
+type highlight []markedPart
+
+func (h highlight) LogValue() slog.Value {
+	return slog.GroupValue()
+}
+
+// String returns the change as logged, without colors.
+func (h highlight) String() string {
+	return h.join(func(_ byte, s string) string { return s })
+}
+
+// attr returns h as the log attribute NewColorLogHandler looks for.
+func (h highlight) attr() slog.Attr {
+	return slog.Any("highlight", h)
+}
+
+func (h highlight) join(mark func(kind byte, s string) string) string {
+	var sb strings.Builder
+	for _, part := range h {
+		sb.WriteString(mark(part.kind, part.text))
+	}
+	return sb.String()
+}
+
+// paint colors the removed and added parts of h in line, a record formatted
+// by a text handler, resuming lineColor after each. A line in which the
+// change is not found is returned as it is.
+func (h highlight) paint(line []byte, lineColor string) []byte {
+	start := bytes.Index(line, []byte("msg="))
+	if start < 0 {
+		return line
+	}
+	// The message is quoted unless it has no spaces or special characters.
+	for _, quote := range []func(string) string{quotedText, func(s string) string { return s }} {
+		plain := h.join(func(_ byte, s string) string { return quote(s) })
+		i := bytes.Index(line[start:], []byte(plain))
+		if plain == "" || i < 0 {
+			continue
+		}
+		marked := h.join(func(kind byte, s string) string {
+			s = quote(s)
+			switch {
+			case s == "":
+				return s
+			case kind == '-':
+				return ColorRed + s + colorReset + lineColor
+			case kind == '+':
+				return ColorGreen + s + colorReset + lineColor
+			}
+			return s
+		})
+		i += start
+		out := append([]byte(nil), line[:i]...)
+		out = append(out, marked...)
+		return append(out, line[i+len(plain):]...)
+	}
+	return line
+}
+
+// quotedText returns s escaped as inside a string quoted by strconv.Quote,
+// which the text handler uses.
+func quotedText(s string) string {
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+// logValue returns a value for verbose logging, cut down to its first
+// config.LogContext characters.
+func logValue(s string, config Config) string {
+	if config.LogFullValues {
+		return s
+	}
+	return excerpt(s, 0, 0, config.LogContext)
+}
+
+// sampleExcerpt returns the part of a value around its first match, with
+// LogContext characters either side. A match inside an encoded value is not
+// shown.
+func sampleExcerpt(value string, config Config, encoding string) string {
+	if encoding != "" {
+		return fmt.Sprintf("(inside a %s value)", encoding)
+	}
+	var first []int
+	for _, pair := range config.Pairs {
+		accepted, _ := pair.find(value)
+		if len(accepted) > 0 && (first == nil || accepted[0][0] < first[0]) {
+			first = accepted[0]
+		}
+	}
+	if first == nil {
+		return excerpt(value, 0, 0, config.LogContext)
+	}
+	return excerpt(value, first[0], first[1], config.LogContext)
+}
+
+// excerpt returns s[start:end] with up to context characters either side,
+// marking cuts with an ellipsis and adding the total length when anything
+// was cut. A changed region longer than 2*context characters is shortened in
+// the middle. Cuts never split a multi-byte character.
+func excerpt(s string, start, end, context int) string {
+	return markedExcerpt(s, start, end, context, nil)
+}
+
+// markedExcerpt is excerpt with the part of s[start:end] shown passed
+// through mark, if set.
+func markedExcerpt(s string, start, end, context int, mark func(string) string) string {
+	if mark == nil {
+		mark = func(s string) string { return s }
+	}
+	return highlight(excerptParts(s, start, end, context, '-')).join(func(kind byte, s string) string {
+		if kind == 0 {
+			return s
+		}
+		return mark(s)
+	})
+}
+
+// excerptParts is the excerpt of s as its parts, with the part of
+// s[start:end] shown marked as kind.
+func excerptParts(s string, start, end, context int, kind byte) highlight {
+	from := backRunes(s, start, context)
+	to := forwardRunes(s, end, context)
+	if end-start > 0 && utf8.RuneCountInString(s[start:end]) > 2*context {
+		head := forwardRunes(s, start, context)
+		tail := backRunes(s, end, context)
+		if from == 0 && to == len(s) && head >= tail {
+			return highlight{{text: s[:start]}, {s[start:end], kind}, {text: s[end:]}}
+		}
+		return highlight{{text: ellipsisIf(from > 0) + s[from:start]}, {s[start:head], kind}, {text: "…"}, {s[tail:end], kind},
+			{text: fmt.Sprintf("%s%s (%d chars)", s[end:to], ellipsisIf(to < len(s)), utf8.RuneCountInString(s))}}
+	}
+	parts := highlight{{text: s[from:start]}, {s[start:end], kind}, {text: s[end:to]}}
+	if from == 0 && to == len(s) {
+		return parts
+	}
+	parts[0].text = ellipsisIf(from > 0) + parts[0].text
+	parts[2].text += fmt.Sprintf("%s (%d chars)", ellipsisIf(to < len(s)), utf8.RuneCountInString(s))
+	return parts
+}
+
+func ellipsisIf(cut bool) string {
+	if cut {
+		return "…"
+	}
+	return ""
+}
+
+// backRunes returns the offset n characters before i in s.
+func backRunes(s string, i, n int) int {
+	for ; n > 0 && i > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	return i
+}
+
+// forwardRunes returns the offset n characters after i in s.
+func forwardRunes(s string, i, n int) int {
+	for ; n > 0 && i < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return i
+}
+
+// commonAffixes returns the byte lengths of the longest common prefix and
+// suffix of a and b that end on character boundaries and do not overlap.
+func commonAffixes(a, b string) (prefix, suffix int) {
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(a) && !utf8.RuneStart(a[prefix]) {
+		prefix--
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(a[len(a)-suffix]) {
+		suffix--
+	}
+	return prefix, suffix
+}
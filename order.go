@@ -0,0 +1,71 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// tableSize is a table's estimated row count and data length from
+// information_schema.TABLES. For InnoDB both can be far off; they are used
+// for progress reporting and to order the tables.
+type tableSize struct {
+	Rows       int64
+	DataLength int64
+}
+
+// getTableSizes returns the size estimates of every table in the current
+// database and of the schema-qualified ones among tables.
+func getTableSizes(ctx context.Context, db *sql.DB, tables []string) (map[string]tableSize, error) {
+	query := "SELECT TABLE_SCHEMA, TABLE_NAME, TABLE_ROWS, DATA_LENGTH, TABLE_SCHEMA = DATABASE() FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()"
+	var args []interface{}
+	for _, table := range tables {
+		if schema, name := splitTable(table); schema != "" {
+			query += " OR (TABLE_SCHEMA = ? AND TABLE_NAME = ?)"
+			args = append(args, schema, name)
+		}
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]tableSize)
+	for rows.Next() {
+		var schema, table string
+		var estimate, length sql.NullInt64
+		var local bool
+		if err := rows.Scan(&schema, &table, &estimate, &length, &local); err != nil {
+			return nil, err
+		}
+		if local {
+			table = localTableName(schema, table)
+		} else {
+			table = schema + "." + table
+		}
+		sizes[table] = tableSize{Rows: estimate.Int64, DataLength: length.Int64}
+	}
+	return sizes, rows.Err()
+}
+
+// orderTables sorts tables in place for Config.OrderBy: "size" puts the
+// largest data length first, then the most rows, and "name" sorts by name.
+// Ties are broken by name, so the order only depends on the estimates.
+func orderTables(tables []string, sizes map[string]tableSize, orderBy string) {
+	switch orderBy {
+	case "size":
+		sort.SliceStable(tables, func(i, j int) bool {
+			a, b := sizes[tables[i]], sizes[tables[j]]
+			if a.DataLength != b.DataLength {
+				return a.DataLength > b.DataLength
+			}
+			if a.Rows != b.Rows {
+				return a.Rows > b.Rows
+			}
+			return tables[i] < tables[j]
+		})
+	case "name":
+		sort.Strings(tables)
+	}
+}
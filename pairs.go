@@ -0,0 +1,261 @@
+package mysqlreplace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pair is a single search/replace rewrite. Pairs are applied to each
+// value in the order they were given.
+type Pair struct {
+	Search  string
+	Replace string
+
+	// pattern is set in regex and case-insensitive modes.
+	pattern *regexp.Regexp
+	// expand reports whether Replace may reference regex groups.
+	expand bool
+	// variant names the encoding of a pair added by URLEncoded or
+	// HTMLEntities, whose matches are found by variantExpr rather than
+	// Search.
+	variant     string
+	variantExpr string
+	// wholeWord rejects matches that are part of a longer word.
+	wholeWord bool
+}
+
+func (p Pair) String() string {
+	if p.variant != "" {
+		return fmt.Sprintf("'%s' -> '%s' (%s)", p.Search, p.Replace, p.variant)
+	}
+	return fmt.Sprintf("'%s' -> '%s'", p.Search, p.Replace)
+}
+
+func (p Pair) matches(s string) bool {
+	if p.wholeWord {
+		accepted, _ := p.find(s)
+		return len(accepted) > 0
+	}
+	if p.pattern != nil {
+		return p.pattern.MatchString(s)
+	}
+	return strings.Contains(s, p.Search)
+}
+
+func (p Pair) apply(s string) string {
+	switch {
+	case p.wholeWord:
+		return p.applyWholeWord(s)
+	case p.pattern != nil && p.expand:
+		return p.pattern.ReplaceAllString(s, p.Replace)
+	case p.pattern != nil:
+		return p.pattern.ReplaceAllLiteralString(s, p.Replace)
+	default:
+		return strings.ReplaceAll(s, p.Search, p.Replace)
+	}
+}
+
+// applyWholeWord replaces the matches accepted by find.
+func (p Pair) applyWholeWord(s string) string {
+	accepted, _ := p.find(s)
+	if len(accepted) == 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range accepted {
+		b.WriteString(s[last:m[0]])
+		if p.pattern != nil && p.expand {
+			b.Write(p.pattern.ExpandString(nil, p.Replace, s, m))
+		} else {
+			b.WriteString(p.Replace)
+		}
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// find returns the offsets of the pair's matches in s, in the form returned
+// by FindAllStringSubmatchIndex. With whole-word matching the matches that
+// are part of a longer word are returned separately as rejected.
+func (p Pair) find(s string) (accepted, rejected [][]int) {
+	var all [][]int
+	if p.pattern != nil {
+		all = p.pattern.FindAllStringSubmatchIndex(s, -1)
+	} else {
+		for i := 0; i <= len(s)-len(p.Search); {
+			j := strings.Index(s[i:], p.Search)
+			if j < 0 {
+				break
+			}
+			all = append(all, []int{i + j, i + j + len(p.Search)})
+			i += j + len(p.Search)
+		}
+	}
+	if !p.wholeWord {
+		return all, nil
+	}
+	for _, m := range all {
+		if atWordBoundaries(s, m[0], m[1]) {
+			accepted = append(accepted, m)
+		} else {
+			rejected = append(rejected, m)
+		}
+	}
+	return accepted, rejected
+}
+
+// findAll returns the text of every match of the pair in s.
+func (p Pair) findAll(s string) []string {
+	if p.pattern != nil {
+		accepted, _ := p.find(s)
+		texts := make([]string, len(accepted))
+		for i, m := range accepted {
+			texts[i] = s[m[0]:m[1]]
+		}
+		return texts
+	}
+	return nil
+}
+
+// skippedWords returns, for every match of the pair that whole-word
+// matching rejected, the word it is part of.
+func (p Pair) skippedWords(s string) []string {
+	_, rejected := p.find(s)
+	words := make([]string, len(rejected))
+	for i, m := range rejected {
+		words[i] = s[wordStart(s, m[0]):wordEnd(s, m[1])]
+	}
+	return words
+}
+
+// atWordBoundaries reports whether s[start:end] is not part of a longer word.
+// An edge of the match that is itself punctuation or space needs no boundary,
+// so a search for ".com" or "v1.2" behaves as expected.
+func atWordBoundaries(s string, start, end int) bool {
+	if start == end {
+		return true
+	}
+	first, _ := utf8.DecodeRuneInString(s[start:end])
+	last, _ := utf8.DecodeLastRuneInString(s[start:end])
+	if isWordRune(first) && wordStart(s, start) != start {
+		return false
+	}
+	if isWordRune(last) && wordEnd(s, end) != end {
+		return false
+	}
+	return true
+}
+
+// wordStart returns the offset of the first character of the word around i,
+// or i when the character before i is not a word character.
+func wordStart(s string, i int) int {
+	for i > 0 {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+		if !isWordRune(r) {
+			break
+		}
+		i -= size
+	}
+	return i
+}
+
+// wordEnd returns the offset after the last character of the word around i.
+func wordEnd(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !isWordRune(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// isWordRune reports whether r is a word character in the Unicode sense of
+// \w: a letter, combining mark, decimal digit or connector such as '_'.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r) || unicode.Is(unicode.Pc, r)
+}
+
+// compilePairs checks pairs for empty and duplicate search strings and
+// returns a copy with the patterns used in regex and case-insensitive modes.
+func compilePairs(pairs []Pair, regex, ignoreCase bool) ([]Pair, error) {
+	compiled := make([]Pair, len(pairs))
+	seen := make(map[string]bool, len(pairs))
+	for i, pair := range pairs {
+		if pair.Search == "" {
+			return nil, fmt.Errorf("search string %d is empty", i+1)
+		}
+		if seen[pair.Search] {
+			return nil, fmt.Errorf("duplicate search string '%s'", pair.Search)
+		}
+		seen[pair.Search] = true
+
+		pair.pattern, pair.expand = nil, false
+		if pair.variantExpr != "" {
+			expr := pair.variantExpr
+			if ignoreCase {
+				expr = "(?i)" + expr
+			}
+			pair.pattern = regexp.MustCompile(expr)
+		} else if regex || ignoreCase {
+			expr := pair.Search
+			if !regex {
+				expr = regexp.QuoteMeta(expr)
+			}
+			if ignoreCase {
+				expr = "(?i)" + expr
+			}
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression '%s': %v", pair.Search, err)
+			}
+			pair.pattern = pattern
+			pair.expand = regex
+		}
+		compiled[i] = pair
+	}
+	return compiled, nil
+}
+
+// ReadPairsFile reads one tab-separated search/replace pair per line. Blank
+// lines are ignored.
+func ReadPairsFile(path string) ([]Pair, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pairs []Pair
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		search, replace, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected a tab between search and replace strings", path, lineNo)
+		}
+		pairs = append(pairs, Pair{Search: search, Replace: replace})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("%s contains no search/replace pairs", path)
+	}
+
+	return pairs, nil
+}
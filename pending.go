@@ -0,0 +1,112 @@
+package mysqlreplace
+
+// defaultPendingLimit is the PendingLimit used when none is set.
+const defaultPendingLimit = 64 << 20
+
+// pendingRow is a changed row found by processRow and not yet written, with
+// the counts it added (after less before) so they can be taken back if it
+// never is.
+type pendingRow struct {
+	columnsList []string
+	values      []interface{}
+	updates     []string
+	args        []interface{}
+	changed     map[string]interface{}
+	changes     []auditChange
+	guards      []string
+	guardArgs   []interface{}
+	before      TableResult
+	counts      TableResult
+	size        int64
+	// reserved is the number of values counted for the row against
+	// MaxTotalReplacements.
+	reserved int
+}
+
+// deferRow queues a changed row found by a full-table scan, to be written
+// by writePending once the scan's result set is closed. When the queue
+// outgrows PendingLimit it is written straight away, with the scan still
+// open.
+func (j *tableJob) deferRow(row *pendingRow) error {
+	row.counts = j.result.snapshot()
+	for _, value := range row.values {
+		row.size += valueSize(value)
+	}
+	for _, arg := range row.args {
+		row.size += valueSize(arg)
+	}
+	j.pending = append(j.pending, row)
+	j.pendingSize += row.size
+	if j.pendingSize < j.pendingLimit() {
+		return nil
+	}
+	j.log.Debug("pending updates reached -pending-limit, writing them before the scan ends", "rows", len(j.pending), "bytes", j.pendingSize)
+	return j.writePending()
+}
+
+// writePending writes the queued rows in scan order, stopping between rows
+// once the run is interrupted.
+func (j *tableJob) writePending() error {
+	for len(j.pending) > 0 {
+		if err := j.ctx.Err(); err != nil {
+			return err
+		}
+		row := j.pending[0]
+		j.pending = j.pending[1:]
+		j.pendingSize -= row.size
+		if err := j.writeRow(row); err != nil {
+			return err
+		}
+	}
+	j.pending = nil
+	return nil
+}
+
+// dropPending discards the rows still queued when a table stops early,
+// taking back their counts, as they were never written.
+func (j *tableJob) dropPending() {
+	if len(j.pending) == 0 {
+		return
+	}
+	j.log.Warn("changed rows found by the scan were not written", "rows", len(j.pending))
+	for _, row := range j.pending {
+		j.result.uncount(row.before, row.counts)
+		j.unreserveRow(row)
+	}
+	j.pending, j.pendingSize = nil, 0
+}
+
+func (j *tableJob) pendingLimit() int64 {
+	if j.config.PendingLimit > 0 {
+		return j.config.PendingLimit
+	}
+	return defaultPendingLimit
+}
+
+// takeBack takes back the counts of a row that is not updated after all.
+func (j *tableJob) takeBack(row *pendingRow) {
+	j.unreserveRow(row)
+	if row.counts.Pairs != nil {
+		j.result.uncount(row.before, row.counts)
+		return
+	}
+	j.result.restore(row.before)
+}
+
+// uncount takes back the counts a row added between the before and after
+// snapshots.
+func (r *TableResult) uncount(before, after TableResult) {
+	r.Replacements -= after.Replacements - before.Replacements
+	r.OccurrencesReplaced -= after.OccurrencesReplaced - before.OccurrencesReplaced
+	r.NulledValues -= after.NulledValues - before.NulledValues
+	r.Base64Values -= after.Base64Values - before.Base64Values
+	r.CompressedValues -= after.CompressedValues - before.CompressedValues
+	for col, n := range after.Columns {
+		if r.Columns[col] -= n - before.Columns[col]; r.Columns[col] == 0 {
+			delete(r.Columns, col)
+		}
+	}
+	for i := range r.Pairs {
+		r.Pairs[i] -= after.Pairs[i] - before.Pairs[i]
+	}
+}
@@ -0,0 +1,348 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// grants holds the privileges of the connected account, parsed from SHOW
+// GRANTS: global ones, per database (whose name may hold LIKE wildcards),
+// per table and per column. Privileges are upper case; ALL stands for ALL
+// PRIVILEGES.
+type grants struct {
+	global    map[string]bool
+	databases []databaseGrant
+	tables    map[string]map[string]bool
+	columns   map[string]map[string][]string
+}
+
+type databaseGrant struct {
+	pattern string
+	privs   map[string]bool
+}
+
+// readGrants returns the privileges of the connected account, including
+// those of its active roles on MySQL 8 (MariaDB lists the current role's
+// privileges on its own).
+func readGrants(ctx context.Context, db *sql.DB) (*grants, error) {
+	query := "SHOW GRANTS"
+	var roles sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT CURRENT_ROLE()").Scan(&roles); err == nil &&
+		roles.Valid && roles.String != "NONE" && strings.Contains(roles.String, "@") {
+		query = "SHOW GRANTS FOR CURRENT_USER() USING " + roles.String
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	g := &grants{global: map[string]bool{}, tables: map[string]map[string]bool{}, columns: map[string]map[string][]string{}}
+	parsed := 0
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if g.add(line) {
+			parsed++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if parsed == 0 {
+		return nil, fmt.Errorf("SHOW GRANTS returned no privileges that could be parsed")
+	}
+	return g, nil
+}
+
+// add records the privileges of a "GRANT ... ON ... TO ..." line and reports
+// whether it was one. Role grants and grants on routines are ignored.
+func (g *grants) add(line string) bool {
+	if !strings.HasPrefix(line, "GRANT ") {
+		return false
+	}
+	rest := line[len("GRANT "):]
+	on := strings.Index(rest, " ON ")
+	if on < 0 {
+		return false
+	}
+	privList, target := rest[:on], rest[on+len(" ON "):]
+	to := strings.LastIndex(target, " TO ")
+	if to < 0 {
+		return false
+	}
+	target = target[:to]
+	if strings.HasPrefix(target, "FUNCTION ") || strings.HasPrefix(target, "PROCEDURE ") {
+		return false
+	}
+	database, table, ok := parseGrantTarget(target)
+	if !ok {
+		return false
+	}
+
+	privs := map[string]bool{}
+	columnPrivs := map[string][]string{}
+	for _, item := range splitGrantList(privList) {
+		name, columns := item, ""
+		if open := strings.IndexByte(item, '('); open >= 0 && strings.HasSuffix(item, ")") {
+			name, columns = strings.TrimSpace(item[:open]), item[open+1:len(item)-1]
+		}
+		name = strings.ToUpper(name)
+		if name == "ALL PRIVILEGES" {
+			name = "ALL"
+		}
+		if columns == "" {
+			privs[name] = true
+			continue
+		}
+		for _, col := range splitGrantList(columns) {
+			columnPrivs[name] = append(columnPrivs[name], unquoteGrantIdent(col))
+		}
+	}
+
+	switch {
+	case database == "*":
+		for priv := range privs {
+			g.global[priv] = true
+		}
+	case table == "*":
+		g.databases = append(g.databases, databaseGrant{pattern: database, privs: privs})
+	default:
+		key := database + "." + table
+		if g.tables[key] == nil {
+			g.tables[key] = map[string]bool{}
+		}
+		for priv := range privs {
+			g.tables[key][priv] = true
+		}
+		if len(columnPrivs) > 0 && g.columns[key] == nil {
+			g.columns[key] = map[string][]string{}
+		}
+		for priv, cols := range columnPrivs {
+			g.columns[key][priv] = append(g.columns[key][priv], cols...)
+		}
+	}
+	return true
+}
+
+// has reports whether priv is granted on the whole of database.table.
+func (g *grants) has(priv, database, table string) bool {
+	if g.global[priv] || g.global["ALL"] {
+		return true
+	}
+	for _, grant := range g.databases {
+		if (grant.privs[priv] || grant.privs["ALL"]) && matchGrantPattern(grant.pattern, database) {
+			return true
+		}
+	}
+	privs := g.tables[database+"."+table]
+	return privs[priv] || privs["ALL"]
+}
+
+// columnsWith returns the columns of database.table priv is granted on by
+// column-level grants.
+func (g *grants) columnsWith(priv, database, table string) []string {
+	return g.columns[database+"."+table][priv]
+}
+
+// parseGrantTarget splits `db`.`table`, `db`.* or *.* into its parts.
+func parseGrantTarget(target string) (string, string, bool) {
+	database, rest, ok := cutGrantIdent(strings.TrimSpace(target))
+	if !ok || !strings.HasPrefix(rest, ".") {
+		return "", "", false
+	}
+	table, rest, ok := cutGrantIdent(rest[1:])
+	if !ok || rest != "" {
+		return "", "", false
+	}
+	return database, table, true
+}
+
+// cutGrantIdent reads a backquoted or single-quoted identifier, or *, from
+// the start of s.
+func cutGrantIdent(s string) (string, string, bool) {
+	if strings.HasPrefix(s, "*") {
+		return "*", s[1:], true
+	}
+	if s == "" || (s[0] != '`' && s[0] != '\'') {
+		// An unquoted name runs up to the dot.
+		end := strings.IndexByte(s, '.')
+		if end < 0 {
+			end = len(s)
+		}
+		return s[:end], s[end:], end > 0
+	}
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			b.WriteByte(quote)
+			i++
+			continue
+		}
+		return b.String(), s[i+1:], true
+	}
+	return "", "", false
+}
+
+func unquoteGrantIdent(s string) string {
+	s = strings.TrimSpace(s)
+	if name, rest, ok := cutGrantIdent(s); ok && rest == "" {
+		return name
+	}
+	return s
+}
+
+// splitGrantList splits a comma-separated list, leaving the commas inside
+// parentheses and quotes alone.
+func splitGrantList(s string) []string {
+	var items []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '`' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if item := strings.TrimSpace(s[start:]); item != "" {
+		items = append(items, item)
+	}
+	return items
+}
+
+// matchGrantPattern matches a database name against the database of a
+// grant, where % and _ are wildcards unless escaped with a backslash.
+func matchGrantPattern(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '%':
+		for i := 0; i <= len(name); i++ {
+			if matchGrantPattern(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case '_':
+		return name != "" && matchGrantPattern(pattern[1:], name[1:])
+	case '\\':
+		if len(pattern) > 1 {
+			return name != "" && name[0] == pattern[1] && matchGrantPattern(pattern[2:], name[1:])
+		}
+	}
+	return name != "" && name[0] == pattern[0] && matchGrantPattern(pattern[1:], name[1:])
+}
+
+// checkPrivileges verifies that the account has SELECT on every table, and
+// UPDATE too when the run writes to the database, before any is processed.
+// Tables missing a privilege are logged and fail the check. When the
+// grants cannot be read, the check is skipped with a warning.
+func (r *Replacer) checkPrivileges(ctx context.Context, tables []string, config Config) error {
+	database := config.Database
+	if database == "" {
+		if err := r.db.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&database); err != nil {
+			config.log().Warn("could not determine the database, privileges not checked", "err", err)
+			return nil
+		}
+	}
+	primary, err := readGrants(ctx, r.db)
+	if err != nil {
+		config.log().Warn("could not read the account's privileges, not checking them", "err", err)
+		return nil
+	}
+	// Rows are read from the replica with its own account's grants.
+	reader := primary
+	if r.ReadFrom != nil {
+		if reader, err = readGrants(ctx, r.ReadFrom); err != nil {
+			config.log().Warn("could not read the replica account's privileges, not checking them", "err", err)
+			reader = nil
+		}
+	}
+
+	failed := 0
+	for _, table := range tables {
+		schema, name := splitTable(table)
+		if schema == "" {
+			schema = database
+		}
+		var missing []string
+		if reader != nil && !reader.has("SELECT", schema, name) {
+			missing = append(missing, "SELECT")
+		}
+		if config.WritesDatabase() && !primary.has("UPDATE", schema, name) {
+			granted := primary.columnsWith("UPDATE", schema, name)
+			uncovered, err := r.uncoveredColumns(ctx, table, granted, config)
+			if err != nil {
+				return err
+			}
+			switch {
+			case len(granted) == 0:
+				missing = append(missing, "UPDATE")
+			case len(uncovered) > 0:
+				missing = append(missing, fmt.Sprintf("UPDATE on %s", strings.Join(uncovered, ", ")))
+			}
+		}
+		if len(missing) > 0 {
+			config.log().Error("missing privileges", "table", table, "missing", strings.Join(missing, "; "))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("the account lacks privileges on %d of %d tables; grant them, or pass -ignore-privilege-check to start anyway", failed, len(tables))
+	}
+	config.log().Debug("privileges checked", "tables", len(tables))
+	return nil
+}
+
+// uncoveredColumns returns the columns of table the run would update that
+// are not among granted.
+func (r *Replacer) uncoveredColumns(ctx context.Context, table string, granted []string, config Config) ([]string, error) {
+	if len(granted) == 0 {
+		return nil, nil
+	}
+	config, _ = config.forTable(table)
+	schema, err := getColumns(ctx, r.db, table, config)
+	if err != nil {
+		return nil, fmt.Errorf("reading columns of %s: %w", table, err)
+	}
+	needed := columnNames(selectColumns(table, schema, config).Columns)
+	if config.PreserveTimestamps {
+		needed = append(needed, schema.OnUpdate...)
+	}
+	var uncovered []string
+	for _, col := range needed {
+		covered := false
+		for _, g := range granted {
+			if strings.EqualFold(g, col) {
+				covered = true
+			}
+		}
+		if !covered {
+			uncovered = append(uncovered, col)
+		}
+	}
+	return uncovered, nil
+}
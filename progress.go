@@ -0,0 +1,191 @@
+package mysqlreplace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// statusWriter is the log output. On a terminal it owns a single status line
+// that is redrawn in place and cleared before any regular log output.
+type statusWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	tty    bool
+	status bool
+}
+
+var stderrStatus = &statusWriter{out: os.Stderr, tty: isTerminal(os.Stderr)}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clearLocked()
+	return w.out.Write(p)
+}
+
+func (w *statusWriter) setStatus(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.out, "\r\x1b[K%s", line)
+	w.status = true
+}
+
+func (w *statusWriter) clearStatus() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clearLocked()
+}
+
+func (w *statusWriter) clearLocked() {
+	if w.status {
+		fmt.Fprint(w.out, "\r\x1b[K")
+		w.status = false
+	}
+}
+
+// activeProgress counts the tables being scanned across every run of the
+// process. The status line is only drawn while there is one; otherwise
+// progress is logged.
+var activeProgress atomic.Int32
+
+// progress emits periodic progress lines for a single table.
+type progress struct {
+	log      *slog.Logger
+	tty      bool
+	table    string
+	estimate int64
+	every    int
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	reported bool
+}
+
+func newProgress(table string, config Config) *progress {
+	activeProgress.Add(1)
+	now := time.Now()
+	return &progress{
+		log:      config.tableLogger(table),
+		tty:      stderrStatus.tty,
+		table:    table,
+		estimate: config.tableSizes[table].Rows,
+		every:    config.ProgressRows,
+		interval: config.ProgressInterval,
+		start:    now,
+		last:     now,
+	}
+}
+
+// update is called once per scanned row.
+func (p *progress) update(scanned, updated int) {
+	if (p.every <= 0 && p.interval <= 0) || !p.log.Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+	now := time.Now()
+	due := (p.every > 0 && scanned%p.every == 0) || (p.interval > 0 && now.Sub(p.last) >= p.interval)
+	if !due {
+		return
+	}
+	p.last = now
+	p.reported = true
+
+	elapsed := now.Sub(p.start)
+	line := fmt.Sprintf("%d rows scanned, %d rows updated", scanned, updated)
+	if p.estimate > 0 {
+		percent := float64(scanned) / float64(p.estimate) * 100
+		if percent > 100 {
+			percent = 100
+		}
+		line += fmt.Sprintf(" (~%.1f%% of ~%d)", percent, p.estimate)
+		if remaining := p.estimate - int64(scanned); remaining > 0 && scanned > 0 {
+			eta := time.Duration(float64(elapsed) / float64(scanned) * float64(remaining))
+			line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+		}
+	}
+
+	if p.tty && activeProgress.Load() == 1 {
+		stderrStatus.setStatus(fmt.Sprintf("Table %s: %s", p.table, line))
+	} else {
+		p.log.Info(line)
+	}
+}
+
+func (p *progress) finish() {
+	activeProgress.Add(-1)
+	if p.tty && p.reported {
+		stderrStatus.clearStatus()
+	}
+}
+
+// waited adds the time since start to the table's DBWait.
+func (j *tableJob) waited(start time.Time) {
+	j.result.DBWait += time.Since(start)
+}
+
+// processed adds the time since start to the table's Processing.
+func (j *tableJob) processed(start time.Time) {
+	j.result.Processing += time.Since(start)
+}
+
+// rowsPerSecond formats a throughput figure for the per-table summary line.
+func rowsPerSecond(rows int, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.0f rows/s", float64(rows)/elapsed.Seconds())
+}
+
+// bytesPerSecond formats the text read per second, as in "1.5 MiB/s".
+func bytesPerSecond(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	return formatBytes(int64(float64(n)/elapsed.Seconds())) + "/s"
+}
+
+// updatesPerSecond formats the rows updated per second.
+func updatesPerSecond(rows int, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.0f updates/s", float64(rows)/elapsed.Seconds())
+}
+
+// timeSplit formats the time of elapsed spent waiting on the server and
+// processing values, for the summary.
+func timeSplit(dbWait, processing, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return fmt.Sprintf("database %s, processing %s", dbWait.Round(time.Millisecond), processing.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("database %s (%.0f%%), processing %s (%.0f%%)", dbWait.Round(time.Millisecond), float64(dbWait)/float64(elapsed)*100,
+		processing.Round(time.Millisecond), float64(processing)/float64(elapsed)*100)
+}
+
+// formatBytes formats a byte count with a binary unit, as in "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
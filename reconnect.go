@@ -0,0 +1,112 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers for a connection the server closed: shutdown, KILL,
+// wait_timeout, and the client errors for a server gone away or lost that
+// proxies pass on.
+const (
+	errServerShutdown     = 1053
+	errConnectionKilled   = 1927
+	errInteractionTimeout = 4031
+	errServerGone         = 2006
+	errServerLost         = 2013
+)
+
+// reconnectBaseDelay and reconnectMaxDelay bound the backoff before an
+// operation is run again after a lost connection.
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// isConnectionLost reports whether err means the connection to the server
+// was lost, rather than the statement failing: the driver's invalid
+// connection, a broken pipe or reset, or the server closing the connection.
+func isConnectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	switch mysqlErrorNumber(err) {
+	case errServerShutdown, errConnectionKilled, errInteractionTimeout, errServerGone, errServerLost:
+		return true
+	}
+	return false
+}
+
+// reconnectDelay returns the wait before attempt n to run an operation
+// again after a lost connection: 1s, 2s, 4s ... up to 30s.
+func reconnectDelay(n int) time.Duration {
+	delay := reconnectBaseDelay
+	for i := 1; i < n && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		return reconnectMaxDelay
+	}
+	return delay
+}
+
+// reconnect waits before attempt n to run an operation again after err lost
+// the connection, then reopens the table's dedicated connection, if it
+// uses one, with its session settings. Statements prepared on the old
+// connection are closed. It reports false if the run was interrupted first.
+// A connection that cannot be reopened yet fails the next attempt, which
+// comes back here while attempts remain.
+func (j *tableJob) reconnect(err error, n int) bool {
+	delay := reconnectDelay(n)
+	j.result.Reconnects++
+	j.log.Warn(fmt.Sprintf("connection lost, retrying in %s", delay), "attempt", n, "of", j.config.ReconnectRetries, "err", err)
+	if !j.wait(delay) {
+		return false
+	}
+	j.closeStatements()
+	if conn, ok := j.w.(*sessionConn); ok {
+		if err := conn.reopen(j.ctx); err != nil {
+			j.log.Warn("could not reopen the connection for updates", "err", err)
+		}
+	}
+	return true
+}
+
+// restartable reports whether a table that failed with a lost connection
+// can be processed again from the start: its changes were all in the
+// per-table transaction the server rolled back, no backup table was
+// created for it, and no row was approved at the prompt.
+func restartable(result TableResult, config Config) bool {
+	return config.TxPerTable && config.WritesDatabase() && !result.Committed && config.BackupSuffix == "" &&
+		config.approve == nil && !result.Quit
+}
+
+// waitContext sleeps for delay and reports false if ctx was done first.
+func waitContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,852 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replacer applies search/replace pairs to the text columns of the database
+// its handle is connected to.
+type Replacer struct {
+	db     *sql.DB
+	config Config
+
+	// ReadFrom, if set, is a handle on a replica of the database that Run
+	// scans instead, sending only the updates to the handle given to New.
+	// Each update then also requires the changed columns to still hold the
+	// values read; rows that no longer do, because the replica was behind or
+	// the row changed since, are left alone and counted in ChangedSinceRead.
+	ReadFrom *sql.DB
+
+	// Confirm, if set, is called by Run with the tables and columns about to
+	// be scanned, before anything is written to the database. Returning an
+	// error aborts the run. It is not called when the run writes nothing.
+	Confirm func(ctx context.Context, plan []TablePlan) error
+
+	// Approve, if set, is called with every row that has replacements before
+	// it is written, to the database or OutputSQL; its answer decides whether
+	// the row is written. It is not called in dry runs. Tables are then
+	// processed one at a time.
+	Approve func(ctx context.Context, row RowChange) Approval
+}
+
+// TablePlan lists the text columns Run will scan in one table. Columns is
+// empty for tables with nothing to scan. Key lists the columns rows are
+// identified by, of the primary key or of the unique index KeyIndex; it is
+// empty for tables identified by full row, and for tables with no columns
+// to scan. RowEstimate and DataLength are the server's size estimates, zero
+// when unknown. Tables are listed in the order Run processes them, followed
+// by those skipped for Config.MaxTableRows, which are TooLarge. Rule names
+// the rule of Config.Rules the table follows, if any.
+type TablePlan struct {
+	Name        string
+	Columns     []string
+	Key         []string
+	KeyIndex    string
+	RowEstimate int64
+	DataLength  int64
+	TooLarge    bool
+	Rule        string
+}
+
+// tableSelection is the outcome of applying the table filters.
+type tableSelection struct {
+	tables       []string
+	excluded     int
+	skippedViews int
+	// columns are the columns of every table of the database and of the
+	// selected schema-qualified ones.
+	columns map[string][]columnInfo
+	// sizes are the size estimates of the same tables, nil if they could
+	// not be read. tooLarge are the tables left out for MaxTableRows.
+	sizes    map[string]tableSize
+	tooLarge []string
+}
+
+// New returns a Replacer for db. It validates config and compiles its
+// search patterns.
+func New(db *sql.DB, config Config) (*Replacer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	pairs, exact, err := config.compile(config.Pairs)
+	if err != nil {
+		return nil, err
+	}
+	config.Pairs, config.exactPairs = pairs, exact
+	if err := config.compileRules(); err != nil {
+		return nil, err
+	}
+
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.LogContext == 0 {
+		config.LogContext = 40
+	}
+	if config.Prefilter && (config.Regex || config.IgnoreCase) {
+		config.log().Warn("prefilter is disabled because LIKE cannot reproduce regex or case-insensitive matching")
+		config.Prefilter = false
+	}
+	if config.Prefilter && (config.URLEncoded || config.HTMLEntities) {
+		config.log().Warn("prefilter is disabled because LIKE cannot match every encoded form of the search strings")
+		config.Prefilter = false
+	}
+	if config.Prefilter && config.DecodeBase64 {
+		config.log().Warn("prefilter is disabled because base64-encoded values do not contain the search strings literally")
+		config.Prefilter = false
+	}
+	if config.Prefilter && config.Decompress {
+		config.log().Warn("prefilter is disabled because compressed values do not contain the search strings literally")
+		config.Prefilter = false
+	}
+	if config.BackupSuffix != "" && !config.WritesDatabase() {
+		config.log().Warn("backup tables are not created for dry runs or SQL output")
+		config.BackupSuffix = ""
+		config.BackupChangedOnly = false
+	}
+	if config.LockRows && !config.WritesDatabase() {
+		config.log().Warn("rows are not locked for dry runs or SQL output")
+		config.LockRows = false
+	}
+	if config.UndoFile != "" && !config.WritesDatabase() {
+		config.log().Warn("no undo file is written for dry runs or SQL output")
+		config.UndoFile = ""
+	}
+	if config.MaxUpdatesPerSecond > 0 && !config.WritesDatabase() {
+		config.log().Warn("updates are not throttled for dry runs or SQL output")
+		config.MaxUpdatesPerSecond = 0
+	}
+	if config.SleepBetweenChunks > 0 && !config.WritesDatabase() {
+		config.log().Warn("no sleeping between chunks for dry runs or SQL output")
+		config.SleepBetweenChunks = 0
+	}
+	if config.SleepBetweenChunks > 0 && config.TxPerTable && !config.LockRows {
+		config.log().Warn("sleeping between chunks inside a per-table transaction keeps its locks while asleep, and replicas only see the table's changes once it commits; consider -tx-per-table=false or -lock-rows")
+	}
+
+	return &Replacer{db: db, config: config}, nil
+}
+
+// selectTables lists the database's tables and applies the table and column
+// filters.
+func (r *Replacer) selectTables(ctx context.Context) (tableSelection, error) {
+	config := r.config
+	var sel tableSelection
+
+	allTables, views, err := getTables(ctx, r.db)
+	if err != nil {
+		return sel, fmt.Errorf("failed to get tables: %w", err)
+	}
+
+	if config.IncludeViews {
+		allTables = append(allTables, views...)
+	} else {
+		for _, view := range views {
+			for _, name := range config.Tables {
+				if name == view {
+					return sel, fmt.Errorf("invalid table selection: %s is a view, pass -include-views to process it", view)
+				}
+			}
+			config.log().Debug("skipping view", "table", view)
+		}
+		sel.skippedViews = len(views)
+	}
+
+	var database sql.NullString
+	if err := r.db.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&database); err != nil {
+		return sel, fmt.Errorf("failed to get the current database: %w", err)
+	}
+	include, qualified := splitTableSelection(config.Tables, append(append([]string(nil), allTables...), views...))
+
+	// Naming only tables of other schemas selects none of this one's.
+	if len(include) > 0 || len(qualified) == 0 {
+		sel.tables, sel.excluded, err = filterTables(allTables, include, config.ExcludeTables)
+		if err != nil {
+			return sel, fmt.Errorf("invalid table selection: %w", err)
+		}
+	}
+	for i, table := range sel.tables {
+		sel.tables[i] = localTableName(database.String, table)
+	}
+	for _, name := range qualified {
+		table, err := resolveQualifiedTable(ctx, r.db, name, database.String, config.IncludeViews)
+		if err != nil {
+			return sel, fmt.Errorf("invalid table selection: %w", err)
+		}
+		if indexOf(sel.tables, table) >= 0 {
+			continue
+		}
+		if matchesAny(config.ExcludeTables, table) {
+			sel.excluded++
+			continue
+		}
+		sel.tables = append(sel.tables, table)
+	}
+
+	var skipped int
+	sel.tables, skipped = config.applyRules(sel.tables)
+	sel.excluded += skipped
+
+	sel.columns, err = readColumns(ctx, r.db, sel.tables)
+	if err != nil {
+		return sel, fmt.Errorf("failed to read columns: %w", err)
+	}
+	if len(config.Columns) > 0 {
+		if err := checkColumns(config.Columns, sel.columns); err != nil {
+			return sel, fmt.Errorf("invalid column selection: %w", err)
+		}
+	}
+
+	sel.sizes, err = getTableSizes(ctx, r.db, sel.tables)
+	if err != nil && config.MaxTableRows > 0 {
+		return sel, fmt.Errorf("failed to read table size estimates for MaxTableRows: %w", err)
+	}
+	if config.MaxTableRows > 0 {
+		kept := sel.tables[:0]
+		for _, table := range sel.tables {
+			if rows := sel.sizes[table].Rows; rows > config.MaxTableRows && !matchesAny(config.AllowLargeTables, table) {
+				config.log().Info("skipping table, too large", "table", table, "estimated_rows", rows, "max_table_rows", config.MaxTableRows)
+				sel.tooLarge = append(sel.tooLarge, table)
+				continue
+			}
+			kept = append(kept, table)
+		}
+		sel.tables = kept
+	}
+	if err != nil {
+		config.log().Warn("could not read table size estimates; progress will not show percentages, and tables keep the order they are listed in", "err", err)
+	} else if config.OrderBy == "size" || config.OrderBy == "name" {
+		orderTables(sel.tables, sel.sizes, config.OrderBy)
+		config.log().Debug("ordered tables", "by", config.OrderBy, "tables", sel.tables)
+	}
+
+	config.log().Debug("found tables", "tables", len(allTables), "selected", len(sel.tables))
+	return sel, nil
+}
+
+// compile adds the enabled variants to pairs and compiles them, returning
+// them case-sensitively too with IgnoreCase, for byte-exact columns.
+func (c Config) compile(pairs []Pair) ([]Pair, []Pair, error) {
+	if c.URLVariants {
+		pairs = withURLVariants(pairs, c)
+	}
+	if c.URLEncoded || c.HTMLEntities {
+		pairs = withVariantPairs(pairs, c.URLEncoded, c.HTMLEntities)
+	}
+	pairs, err := compilePairs(pairs, c.Regex, c.IgnoreCase)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range pairs {
+		pairs[i].wholeWord = c.WholeWord
+	}
+	if !c.IgnoreCase {
+		return pairs, nil, nil
+	}
+	exact, err := compilePairs(pairs, c.Regex, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range exact {
+		exact[i].wholeWord = c.WholeWord
+	}
+	return pairs, exact, nil
+}
+
+// Plan returns the tables Run would process and the text columns it would
+// scan in each.
+func (r *Replacer) Plan(ctx context.Context) ([]TablePlan, error) {
+	sel, err := r.selectTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config := r.config
+	config.schemaColumns = sel.columns
+	config.tableSizes = sel.sizes
+	return r.plan(ctx, sel.tables, sel.tooLarge, config)
+}
+
+func (r *Replacer) plan(ctx context.Context, tables, tooLarge []string, config Config) ([]TablePlan, error) {
+	var plan []TablePlan
+	for _, table := range tables {
+		tableConfig, rule := config.forTable(table)
+		schema, err := getColumns(ctx, r.db, table, tableConfig)
+		if err != nil {
+			return nil, fmt.Errorf("reading columns of %s: %w", table, err)
+		}
+		size := config.tableSizes[table]
+		tablePlan := TablePlan{Name: table, Columns: columnNames(selectColumns(table, schema, tableConfig).Columns),
+			RowEstimate: size.Rows, DataLength: size.DataLength}
+		if rule != nil {
+			tablePlan.Rule = rule.Name
+		}
+		if len(tablePlan.Columns) > 0 {
+			key, err := getRowKey(ctx, r.db, table)
+			if err != nil {
+				return nil, fmt.Errorf("reading keys of %s: %w", table, err)
+			}
+			tablePlan.Key, tablePlan.KeyIndex = key.Columns, key.Index
+		}
+		plan = append(plan, tablePlan)
+	}
+	for _, table := range tooLarge {
+		size := config.tableSizes[table]
+		plan = append(plan, TablePlan{Name: table, RowEstimate: size.Rows, DataLength: size.DataLength, TooLarge: true})
+	}
+	return plan, nil
+}
+
+// Run processes every selected table and logs a summary. Table failures are
+// recorded in the report rather than returned. When ctx is canceled the
+// table in progress is stopped and the partial report is returned along
+// with ctx.Err(). Run raises the handle's connection limits when processing
+// tables concurrently.
+func (r *Replacer) Run(ctx context.Context) (*Report, error) {
+	config := r.config
+	startedAt := time.Now()
+
+	for i, pair := range config.Pairs {
+		if pair.pattern != nil {
+			config.log().Debug("using pattern", "pair", i+1, "pattern", pair.pattern.String())
+		}
+	}
+
+	sel, err := r.selectTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tables := sel.tables
+	config.schemaColumns = sel.columns
+	config.tableSizes = sel.sizes
+
+	if !config.IgnorePrivilegeCheck {
+		if err := r.checkPrivileges(ctx, tables, config); err != nil {
+			return nil, err
+		}
+	}
+	if !config.IgnoreCharsetCheck {
+		if err := r.checkCharsets(ctx, tables, config); err != nil {
+			return nil, err
+		}
+	}
+
+	// Time spent waiting for the user is left out of the run's duration.
+	var waited time.Duration
+	if r.Confirm != nil && config.WritesDatabase() {
+		plan, err := r.plan(ctx, tables, sel.tooLarge, config)
+		if err != nil {
+			return nil, err
+		}
+		asked := time.Now()
+		if err := r.Confirm(ctx, plan); err != nil {
+			return nil, err
+		}
+		waited = time.Since(asked)
+	}
+
+	if r.ReadFrom != nil {
+		if config, err = r.replicaConfig(); err != nil {
+			return nil, err
+		}
+		config.schemaColumns = sel.columns
+		config.tableSizes = sel.sizes
+		config.log().Info("scanning the replica; rows changed since they were read are left alone")
+	}
+	if config.ServerSide && r.Approve != nil {
+		return nil, fmt.Errorf("ServerSide cannot ask about each row, as rows are never read")
+	}
+
+	if r.Approve != nil && !config.DryRun {
+		config.approve = r.Approve
+		if config.Concurrency > 1 {
+			config.log().Warn("processing tables one at a time so rows can be approved in turn")
+			config.Concurrency = 1
+		}
+	}
+
+	if config.CountOnly {
+		config.log().Info("count only: matches are counted, nothing is replaced")
+	} else if config.DryRun {
+		config.log().Info("dry run: no changes will be written to the database")
+	} else if config.OutputSQL != "" {
+		config.sqlOut, err = createSQLWriter(config.OutputSQL, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SQL output file: %w", err)
+		}
+		config.log().Info("writing UPDATE statements to a file; the database will not be modified", "path", config.OutputSQL)
+	}
+
+	if config.AuditCSV != "" {
+		config.audit, err = createAuditWriter(config.AuditCSV)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %w", err)
+		}
+	}
+
+	if config.UndoFile != "" {
+		config.undo, err = createUndoWriter(config.UndoFile, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create undo file: %w", err)
+		}
+	}
+
+	if config.ChangedKeysFile != "" {
+		config.keys, err = createKeysWriter(config.ChangedKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create changed keys file: %w", err)
+		}
+	}
+
+	if config.SnapshotDir != "" {
+		config.snapshot, err = createSnapshotWriter(config.SnapshotDir, config.SnapshotFormat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+	}
+
+	pending := tables
+	if config.Checkpoint != "" {
+		config.checkpoint, err = openCheckpoint(config.Checkpoint, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+		}
+		pending = config.checkpoint.pending(tables)
+		if skipped := len(tables) - len(pending); skipped > 0 {
+			config.log().Info("skipping tables completed before the checkpoint", "tables", skipped)
+		}
+	}
+
+	// A limit the caller set high enough is kept.
+	if max := r.db.Stats().MaxOpenConnections; config.Concurrency > 1 && (max == 0 || max < 2*config.Concurrency) {
+		r.db.SetMaxOpenConns(2 * config.Concurrency)
+		r.db.SetMaxIdleConns(2 * config.Concurrency)
+	}
+
+	if err := checkSessionSettings(ctx, r.db, config); err != nil {
+		return nil, fmt.Errorf("failed to prepare the update session: %w", err)
+	}
+	if config.DisableFKChecks {
+		reportForeignKeys(ctx, r.db, tables, config)
+	}
+
+	if config.MaxUpdatesPerSecond > 0 {
+		config.limiter = newUpdateLimiter(config.MaxUpdatesPerSecond)
+	}
+	if config.MaxTotalReplacements > 0 && config.ReplacementCounter == nil {
+		config.ReplacementCounter = NewReplacementCounter()
+	}
+
+	processingStarted := time.Now()
+	summary := runTables(ctx, r.db, pending, config)
+	processing := time.Since(processingStarted) - summary.prompted
+
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		config.summaryf("Run interrupted: %d tables cut short, %d tables not started; the summary below is partial",
+			summary.interruptedTables, summary.notStarted)
+	} else if summary.quit {
+		config.summaryf("Quit at the approval prompt: %d tables not started; the summary below is partial", summary.notStarted)
+	}
+	capReached := config.ReplacementCounter != nil && config.ReplacementCounter.Reached()
+	wouldExceed := config.DryRun && config.ReplacementCounter != nil && config.ReplacementCounter.Total() > config.MaxTotalReplacements
+	if capReached {
+		cut := "kept"
+		if config.TxPerTable {
+			cut = "rolled back"
+		}
+		config.summaryf("Stopped at -max-total-replacements %d: %d values changed before the cap; %d tables cut short (%s), %d tables not started",
+			config.MaxTotalReplacements, summary.replacements, summary.cappedTables, cut, summary.notStarted)
+	} else if wouldExceed {
+		config.summaryf("Dry run would exceed -max-total-replacements %d: %d values would be changed", config.MaxTotalReplacements, config.ReplacementCounter.Total())
+	}
+
+	if config.audit != nil {
+		if err := config.audit.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write audit file: %w", err)
+		}
+	}
+	if config.undo != nil {
+		if err := config.undo.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write undo file: %w", err)
+		}
+		config.summaryf("Wrote %d undo statements to %s", config.undo.statements, config.UndoFile)
+	}
+	if config.snapshot != nil {
+		if err := config.snapshot.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write snapshot: %w", err)
+		}
+		config.summaryf("Wrote snapshots of %d rows of %d tables to %s", config.snapshot.rows, config.snapshot.tables, config.SnapshotDir)
+	}
+	if config.keys != nil {
+		if err := config.keys.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write changed keys file: %w", err)
+		}
+		config.summaryf("Wrote the keys of %d changed rows of %d tables to %s", config.keys.rows, config.keys.tables, config.ChangedKeysFile)
+	}
+
+	config.summaryf("Tables: %d selected, %d skipped by exclusion, %d skipped for having no text columns, %d views skipped, %d failed",
+		len(tables), sel.excluded, summary.noTextTables, sel.skippedViews, summary.failedTables)
+	if len(sel.tooLarge) > 0 {
+		config.summaryf("Tables skipped (too large, over %d estimated rows): %d", config.MaxTableRows, len(sel.tooLarge))
+		for _, table := range sel.tooLarge {
+			config.summaryf("  %s: ~%d rows", table, config.tableSizes[table].Rows)
+		}
+	}
+	if summary.whereSkippedTables > 0 {
+		config.summaryf("Tables skipped for lacking a column -where refers to: %d", summary.whereSkippedTables)
+	}
+	if config.checkpoint != nil {
+		config.summaryf("Tables completed before resuming from the checkpoint: %d", len(tables)-len(pending))
+	}
+	if config.Limit > 0 {
+		config.summaryf("Tables truncated by -limit %d: %d", config.Limit, summary.limitedTables)
+	}
+	if config.sqlOut != nil {
+		if err := config.sqlOut.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write SQL output file: %w", err)
+		}
+		config.summaryf("Wrote %d UPDATE statements (%d replacements across %d tables) to %s",
+			config.sqlOut.statements, summary.replacements, summary.changedTables, config.OutputSQL)
+	} else if config.CountOnly {
+		config.summaryf("Count only: %d occurrences in %d rows across %d tables", summary.occurrences, summary.matchedRows, summary.changedTables)
+	} else if config.ServerSide && config.DryRun {
+		config.summaryf("Dry run (server-side): %d values would change across %d tables", summary.replacements, summary.changedTables)
+	} else if config.ServerSide {
+		config.summaryf("Values changed server-side: %d across %d tables", summary.replacements, summary.changedTables)
+	} else if config.SetNull && config.DryRun {
+		config.summaryf("Dry run: %d values would be set to NULL across %d tables", summary.nulledValues, summary.changedTables)
+	} else if config.SetNull {
+		config.summaryf("Values set to NULL: %d", summary.nulledValues)
+	} else if config.DryRun {
+		config.summaryf("Dry run: %d replacements would be made across %d tables (%d occurrences)", summary.replacements, summary.changedTables, summary.occurrencesReplaced)
+	} else {
+		config.summaryf("Total replacements: %d values changed, %d occurrences replaced", summary.replacements, summary.occurrencesReplaced)
+	}
+	if config.limiter != nil {
+		if updates, rate := config.limiter.average(); rate > 0 {
+			config.summaryf("Updates throttled to %g per second: %d rows updated at an average of %.2f per second", config.MaxUpdatesPerSecond, updates, rate)
+		} else {
+			config.summaryf("Updates throttled to %g per second: %d rows updated", config.MaxUpdatesPerSecond, updates)
+		}
+	}
+	if config.DecodeBase64 {
+		config.summaryf("Base64-encoded values changed: %d", summary.base64Values)
+	}
+	if config.Decompress {
+		config.summaryf("Compressed values changed: %d", summary.compressedValues)
+	}
+	if config.readDB != nil {
+		config.summaryf("Rows changed since they were read from the replica (not updated): %d", summary.changedSinceRead)
+	}
+	if config.approve != nil {
+		config.summaryf("Rows skipped at the approval prompt: %d", summary.rowsSkipped)
+	}
+	if summary.duplicateRows > 0 {
+		config.summaryf("Rows with an identical copy in tables identified by full row: %d", summary.duplicateRows)
+		for _, table := range summary.tables {
+			if table.DuplicateRows == 0 {
+				continue
+			}
+			if config.AllowDuplicateRows {
+				config.summaryf("  %s: %d duplicate rows, updated one copy at a time", table.Name, table.DuplicateRows)
+			} else {
+				config.summaryf("  %s: %d duplicate rows, %d with matches skipped (use -allow-duplicate-rows)", table.Name, table.DuplicateRows, table.DuplicatesSkipped)
+			}
+		}
+	}
+	if summary.notNullColumns > 0 {
+		config.summaryf("NOT NULL columns left alone by -set-null: %d", summary.notNullColumns)
+		for _, table := range summary.tables {
+			if len(table.NotNullColumns) > 0 {
+				config.summaryf("  %s: %s", table.Name, strings.Join(table.NotNullColumns, ", "))
+			}
+		}
+	}
+	if summary.oversizeValues > 0 {
+		config.summaryf("Values larger than -max-value-size left alone: %d (their rows are logged)", summary.oversizeValues)
+		for _, table := range summary.tables {
+			if table.OversizeValues > 0 {
+				config.summaryf("  %s: %d", table.Name, table.OversizeValues)
+			}
+		}
+	}
+	if summary.rejectedRows > 0 {
+		config.summaryf("Rows not updated because the server rejected one of their values: %d (their rows are logged)", summary.rejectedRows)
+		for _, table := range summary.tables {
+			if table.RejectedRows > 0 {
+				config.summaryf("  %s: %d", table.Name, table.RejectedRows)
+			}
+		}
+	}
+	if summary.excludedMatches > 0 {
+		config.summaryf("Matches skipped by exclusion: %d values in -exclude-columns columns contain a search string and were left alone", summary.excludedMatches)
+		for _, table := range summary.tables {
+			for _, col := range sortedKeys(table.ExcludedMatches) {
+				config.summaryf("  %s.%s: %d", table.Name, col, table.ExcludedMatches[col])
+			}
+		}
+	}
+	if config.Samples > 0 {
+		for _, table := range summary.tables {
+			if len(table.Samples) == 0 {
+				continue
+			}
+			config.summaryf("Sample matches in %s:", table.Name)
+			for _, sample := range table.Samples {
+				if sample.Redacted {
+					config.summaryf("  %s %s: [excluded column, redacted]", sample.Column, sample.Row)
+				} else {
+					config.summaryf("  %s %s: '%s'", sample.Column, sample.Row, sample.Excerpt)
+				}
+			}
+		}
+	}
+	if config.ChangedKeys {
+		for _, table := range summary.tables {
+			switch n := len(table.ChangedKeys) + table.ChangedKeysOmitted; {
+			case n == 0:
+			case n <= changedKeysInline:
+				config.summaryf("Changed rows in %s %s: %s", table.Name, table.ChangedKeysColumns, strings.Join(table.ChangedKeys, ", "))
+			case table.ChangedKeysOmitted == 0:
+				config.summaryf("Changed rows in %s %s: %d rows, listed in the JSON report", table.Name, table.ChangedKeysColumns, n)
+			default:
+				config.summaryf("Changed rows in %s %s: %d rows, the first %d listed in the JSON report; -changed-keys-file lists all", table.Name, table.ChangedKeysColumns, n, changedKeysKept)
+			}
+		}
+	}
+	if config.TopValues > 0 {
+		for _, table := range summary.tables {
+			if len(table.TopValues) == 0 {
+				continue
+			}
+			total := table.OtherValues
+			for _, value := range table.TopValues {
+				total += value.Count
+			}
+			config.summaryf("Most common matching values in %s:", table.Name)
+			for _, value := range table.TopValues {
+				config.summaryf("  %d (%.0f%%): '%s'", value.Count, float64(value.Count)/float64(total)*100, value.Value)
+			}
+			if table.OtherValues > 0 {
+				config.summaryf("  %d (%.0f%%): others", table.OtherValues, float64(table.OtherValues)/float64(total)*100)
+			}
+		}
+	}
+	if summary.lockRetries > 0 {
+		config.summaryf("Statements retried after a lock conflict: %d", summary.lockRetries)
+	}
+	if summary.reconnects > 0 {
+		config.summaryf("Operations retried after a lost connection: %d", summary.reconnects)
+	}
+	if summary.timeouts > 0 {
+		config.summaryf("Statements that exceeded -statement-timeout: %d", summary.timeouts)
+		for _, table := range summary.tables {
+			if table.Timeouts > 0 {
+				config.summaryf("  %s: %d (%s)", table.Name, table.Timeouts, table.Status)
+			}
+		}
+	}
+	if summary.unexpectedAffected > 0 {
+		config.summaryf("Unexpected affected rows: %d UPDATEs affected a number of rows other than expected", summary.unexpectedAffected)
+		for _, table := range summary.tables {
+			if table.UnexpectedAffected > 0 {
+				config.summaryf("  %s: %d (%s)", table.Name, table.UnexpectedAffected, table.Status)
+			}
+		}
+	}
+	// Server-side replacement does not tell the pairs apart.
+	if runPairs, rules := config.runPairs(); len(runPairs) > 1 && !config.ServerSide {
+		for i, count := range summary.pairs {
+			from := ""
+			if rules[i] != "" {
+				from = " (" + rules[i] + ")"
+			}
+			if config.CountOnly {
+				config.summaryf("Pair %d '%s'%s: %d values matched", i+1, runPairs[i].Search, from, count)
+			} else {
+				config.summaryf("Pair %d %s%s: %d values changed", i+1, runPairs[i], from, count)
+			}
+		}
+	}
+	logTimings(summary.tables, processing, config)
+	if config.checkpoint != nil {
+		if interrupted || summary.quit || summary.failedTables > 0 {
+			config.summaryf("Progress saved to checkpoint %s; run again with the same options to resume", config.Checkpoint)
+		} else if err := config.checkpoint.finish(); err != nil {
+			config.log().Error("could not mark the checkpoint finished", "path", config.Checkpoint, "err", err)
+		} else {
+			config.summaryf("Run finished; checkpoint %s is marked finished, so running again with it skips every table", config.Checkpoint)
+		}
+	}
+	if len(summary.backups) > 0 {
+		sort.Strings(summary.backups)
+		config.summaryf("Created %d backup tables; to drop them once the changes are verified:", len(summary.backups))
+		for _, backup := range summary.backups {
+			config.summaryf("  DROP TABLE %s;", quoteTable(backup))
+		}
+	}
+
+	var verified *VerifyReport
+	if config.Verify && !interrupted && !summary.quit {
+		verified = r.verify(ctx, tables, summary.tables, config)
+		if verified.Remaining == 0 && verified.TablesFailed == 0 {
+			config.summaryf("Verify: no matches remain")
+		} else if verified.TablesFailed > 0 {
+			config.summaryf("Verify: %d matches remain, %d tables could not be scanned", verified.Remaining, verified.TablesFailed)
+		} else {
+			config.summaryf("Verify: %d matches remain", verified.Remaining)
+		}
+		for _, match := range verified.Matches {
+			reason := ""
+			if match.Reason != "" {
+				reason = " (" + match.Reason + ")"
+			}
+			if match.Values > 0 {
+				config.summaryf("  %s.%s: %d values%s", match.Table, match.Column, match.Values, reason)
+			} else {
+				config.summaryf("  %s.%s: %d occurrences%s", match.Table, match.Column, match.Occurrences, reason)
+			}
+		}
+	}
+
+	report := &Report{
+		SchemaVersion:  ReportSchemaVersion,
+		Host:           config.Host,
+		Database:       config.Database,
+		Regex:          config.Regex,
+		IgnoreCase:     config.IgnoreCase,
+		DryRun:         config.DryRun,
+		CountOnly:      config.CountOnly,
+		OutputSQL:      config.OutputSQL,
+		StartedAt:      startedAt,
+		FinishedAt:     time.Now(),
+		Interrupted:    interrupted,
+		Quit:           summary.quit,
+		CapReached:     capReached,
+		WouldExceedCap: wouldExceed,
+		Totals: ReportTotals{
+			TablesSelected:      len(tables),
+			TablesChanged:       summary.changedTables,
+			TablesFailed:        summary.failedTables,
+			TablesInterrupted:   summary.interruptedTables,
+			TablesCapped:        summary.cappedTables,
+			TablesNotStarted:    summary.notStarted,
+			TablesCheckpoint:    len(tables) - len(pending),
+			TablesExcluded:      sel.excluded,
+			TablesTooLarge:      len(sel.tooLarge),
+			TablesNoText:        summary.noTextTables,
+			TablesWhereSkipped:  summary.whereSkippedTables,
+			TablesLimited:       summary.limitedTables,
+			ViewsSkipped:        sel.skippedViews,
+			RowsScanned:         summary.rowsScanned,
+			RowsUpdated:         summary.rowsUpdated,
+			BytesScanned:        summary.bytesScanned,
+			DBWaitSeconds:       summary.dbWait.Seconds(),
+			ProcessingSeconds:   summary.processing.Seconds(),
+			Replacements:        summary.replacements,
+			OccurrencesReplaced: summary.occurrencesReplaced,
+			Base64Values:        summary.base64Values,
+			CompressedValues:    summary.compressedValues,
+			NulledValues:        summary.nulledValues,
+			Occurrences:         summary.occurrences,
+			MatchedRows:         summary.matchedRows,
+			LockRetries:         summary.lockRetries,
+			Reconnects:          summary.reconnects,
+			Timeouts:            summary.timeouts,
+			RowsSkipped:         summary.rowsSkipped,
+			ChangedSinceRead:    summary.changedSinceRead,
+			DuplicateRows:       summary.duplicateRows,
+			DuplicatesSkipped:   summary.duplicatesSkipped,
+			UnexpectedAffected:  summary.unexpectedAffected,
+			ExcludedMatches:     summary.excludedMatches,
+			OversizeValues:      summary.oversizeValues,
+			RejectedRows:        summary.rejectedRows,
+		},
+		Tables: summary.tables,
+		Verify: verified,
+	}
+	report.DurationSeconds = (report.FinishedAt.Sub(startedAt) - waited - summary.prompted).Seconds()
+	if processing > 0 {
+		report.Totals.RowsPerSecond = float64(summary.rowsScanned) / processing.Seconds()
+		report.Totals.BytesPerSecond = float64(summary.bytesScanned) / processing.Seconds()
+		report.Totals.UpdatesPerSecond = float64(summary.rowsUpdated) / processing.Seconds()
+	}
+	runPairs, rules := config.runPairs()
+	for i, pair := range runPairs {
+		report.Pairs = append(report.Pairs, ReportPair{Search: pair.Search, Replace: pair.Replace, Variant: pair.variant, Rule: rules[i], ValuesChanged: summary.pairs[i]})
+	}
+	for _, table := range sel.tooLarge {
+		report.Tables = append(report.Tables, TableReport{Name: table, Status: "too_large", RowEstimate: config.tableSizes[table].Rows,
+			Columns: map[string]int{}, Pairs: make([]int, len(runPairs))})
+	}
+	sort.Slice(report.Tables, func(i, j int) bool {
+		return report.Tables[i].Name < report.Tables[j].Name
+	})
+	if report.Tables == nil {
+		report.Tables = []TableReport{}
+	}
+
+	return report, ctx.Err()
+}
+
+// ProcessTable processes a single table, applying the session settings of
+// the configuration. Output files are only written by Run, so it returns an
+// error when OutputSQL, AuditCSV, UndoFile or SnapshotDir is set. The table
+// may be in another schema of the server, named as schema.table.
+func (r *Replacer) ProcessTable(ctx context.Context, name string) (TableResult, error) {
+	config := r.config
+	if config.OutputSQL != "" || config.AuditCSV != "" || config.UndoFile != "" || config.SnapshotDir != "" || config.ChangedKeysFile != "" || config.Checkpoint != "" {
+		return TableResult{}, fmt.Errorf("output files are only written by Run")
+	}
+
+	read := r.db
+	if r.ReadFrom != nil {
+		var err error
+		if config, err = r.replicaConfig(); err != nil {
+			return TableResult{}, err
+		}
+		read = r.ReadFrom
+	}
+	if config.MaxTotalReplacements > 0 && config.ReplacementCounter == nil {
+		return TableResult{}, fmt.Errorf("MaxTotalReplacements needs a ReplacementCounter shared by the calls to ProcessTable")
+	}
+	if r.Approve != nil && !config.DryRun {
+		if config.ServerSide {
+			return TableResult{}, fmt.Errorf("ServerSide cannot ask about each row, as rows are never read")
+		}
+		config.approve = r.Approve
+	}
+
+	var w writer = r.db
+	conn, err := openWriteConn(ctx, r.db, config)
+	if err != nil {
+		return TableResult{}, err
+	}
+	if conn != nil {
+		w = conn
+		defer releaseWriteConn(conn, config)
+	}
+	return processTable(ctx, read, w, name, config)
+}
+
+// replicaConfig returns the configuration for scanning ReadFrom.
+func (r *Replacer) replicaConfig() (Config, error) {
+	config := r.config
+	if config.LockRows {
+		return config, fmt.Errorf("LockRows cannot be used when reading from a replica")
+	}
+	if config.ServerSide {
+		return config, fmt.Errorf("ServerSide cannot be used when reading from a replica, as it reads no rows")
+	}
+	if config.BatchSize > 1 {
+		config.log().Warn("updates are not batched when reading from a replica, since each checks its row's old values")
+		config.BatchSize = 1
+	}
+	config.readDB = r.ReadFrom
+	return config, nil
+}
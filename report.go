@@ -0,0 +1,233 @@
+package mysqlreplace
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// ReportSchemaVersion is bumped whenever a field of the JSON report changes
+// meaning or is removed. New fields may be added without a bump.
+const ReportSchemaVersion = 1
+
+// Report summarizes a run. It is returned by Replacer.Run and is the JSON
+// document written by the -report-json flag. Tables are sorted by name.
+// CapReached is set when the run stopped at Config.MaxTotalReplacements,
+// and WouldExceedCap when a dry run went over it.
+type Report struct {
+	SchemaVersion   int           `json:"schema_version"`
+	Host            string        `json:"host"`
+	Database        string        `json:"database"`
+	Pairs           []ReportPair  `json:"pairs"`
+	Regex           bool          `json:"regex"`
+	IgnoreCase      bool          `json:"ignore_case"`
+	DryRun          bool          `json:"dry_run"`
+	CountOnly       bool          `json:"count_only,omitempty"`
+	OutputSQL       string        `json:"output_sql,omitempty"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Interrupted     bool          `json:"interrupted"`
+	Quit            bool          `json:"quit,omitempty"`
+	CapReached      bool          `json:"cap_reached,omitempty"`
+	WouldExceedCap  bool          `json:"would_exceed_cap,omitempty"`
+	Totals          ReportTotals  `json:"totals"`
+	Tables          []TableReport `json:"tables"`
+	Verify          *VerifyReport `json:"verify,omitempty"`
+}
+
+// ReportPair gives the number of values each search/replace pair changed.
+// Variant is "url-encoded" or "html-entities" for the pairs added by
+// Config.URLEncoded and Config.HTMLEntities, and "https", "http",
+// "protocol-relative" or one of those with "-escaped" for the pairs added by
+// Config.URLVariants. Rule names the rule of Config.Rules a pair belongs
+// to, empty for those of Config.Pairs.
+type ReportPair struct {
+	Search        string `json:"search"`
+	Replace       string `json:"replace"`
+	Variant       string `json:"variant,omitempty"`
+	Rule          string `json:"rule,omitempty"`
+	ValuesChanged int    `json:"values_changed"`
+}
+
+// ReportTotals holds the run-wide counts. The rates are over the time spent
+// processing the tables, and DBWaitSeconds and ProcessingSeconds total the
+// tables' db_wait_seconds and processing_seconds.
+type ReportTotals struct {
+	TablesSelected      int     `json:"tables_selected"`
+	TablesChanged       int     `json:"tables_changed"`
+	TablesFailed        int     `json:"tables_failed"`
+	TablesInterrupted   int     `json:"tables_interrupted"`
+	TablesCapped        int     `json:"tables_capped"`
+	TablesNotStarted    int     `json:"tables_not_started"`
+	TablesCheckpoint    int     `json:"tables_completed_before"`
+	TablesExcluded      int     `json:"tables_excluded"`
+	TablesTooLarge      int     `json:"tables_too_large"`
+	TablesNoText        int     `json:"tables_no_text_columns"`
+	TablesWhereSkipped  int     `json:"tables_where_skipped"`
+	TablesLimited       int     `json:"tables_limited"`
+	ViewsSkipped        int     `json:"views_skipped"`
+	RowsScanned         int     `json:"rows_scanned"`
+	RowsUpdated         int     `json:"rows_updated"`
+	BytesScanned        int64   `json:"bytes_scanned"`
+	RowsPerSecond       float64 `json:"rows_per_second"`
+	BytesPerSecond      float64 `json:"bytes_per_second"`
+	UpdatesPerSecond    float64 `json:"updates_per_second"`
+	DBWaitSeconds       float64 `json:"db_wait_seconds"`
+	ProcessingSeconds   float64 `json:"processing_seconds"`
+	Replacements        int     `json:"replacements"`
+	OccurrencesReplaced int     `json:"occurrences_replaced"`
+	Base64Values        int     `json:"base64_values"`
+	CompressedValues    int     `json:"compressed_values"`
+	NulledValues        int     `json:"nulled_values"`
+	Occurrences         int     `json:"occurrences"`
+	MatchedRows         int     `json:"matched_rows"`
+	LockRetries         int     `json:"lock_retries"`
+	Reconnects          int     `json:"reconnects"`
+	Timeouts            int     `json:"timeouts"`
+	RowsSkipped         int     `json:"rows_skipped"`
+	ChangedSinceRead    int     `json:"changed_since_read"`
+	DuplicateRows       int     `json:"duplicate_rows"`
+	DuplicatesSkipped   int     `json:"duplicates_skipped"`
+	UnexpectedAffected  int     `json:"unexpected_affected_rows"`
+	ExcludedMatches     int     `json:"excluded_matches"`
+	OversizeValues      int     `json:"oversize_values"`
+	RejectedRows        int     `json:"rejected_rows"`
+}
+
+// TableReport is one table's entry in the JSON report. Status is one of
+// "ok", "no_text_columns", "where_skipped", "failed", "interrupted",
+// "capped" (stopped by Config.MaxTotalReplacements) or, for
+// tables skipped for Config.MaxTableRows with their RowEstimate,
+// "too_large". Replacements counts the values changed and
+// OccurrencesReplaced the occurrences replaced in them. Occurrences is only
+// set in count-only runs, where Pairs counts the values each pair matched.
+// Pairs is indexed like the report's, Rule names the rule of Config.Rules
+// the table followed, if any, and ColumnRules the rule with ForColumns
+// each column followed. Samples holds the example
+// matches collected for Config.Samples.
+type TableReport struct {
+	Name                string            `json:"name"`
+	Status              string            `json:"status"`
+	Rule                string            `json:"rule,omitempty"`
+	ColumnRules         map[string]string `json:"column_rules,omitempty"`
+	RowEstimate         int64             `json:"row_estimate,omitempty"`
+	RowsScanned         int               `json:"rows_scanned"`
+	RowsUpdated         int               `json:"rows_updated"`
+	BytesScanned        int64             `json:"bytes_scanned"`
+	RowsPerSecond       float64           `json:"rows_per_second"`
+	BytesPerSecond      float64           `json:"bytes_per_second"`
+	UpdatesPerSecond    float64           `json:"updates_per_second"`
+	SleepSeconds        float64           `json:"sleep_seconds"`
+	DBWaitSeconds       float64           `json:"db_wait_seconds"`
+	ProcessingSeconds   float64           `json:"processing_seconds"`
+	Replacements        int               `json:"replacements"`
+	OccurrencesReplaced int               `json:"occurrences_replaced"`
+	Columns             map[string]int    `json:"columns"`
+	Pairs               []int             `json:"pairs"`
+	Committed           bool              `json:"committed"`
+	Limited             bool              `json:"limited"`
+	Backup              string            `json:"backup,omitempty"`
+	Base64Values        int               `json:"base64_values"`
+	CompressedValues    int               `json:"compressed_values"`
+	NulledValues        int               `json:"nulled_values"`
+	NotNullColumns      []string          `json:"not_null_columns,omitempty"`
+	Occurrences         map[string]int    `json:"occurrences,omitempty"`
+	MatchedRows         int               `json:"matched_rows"`
+	LockRetries         int               `json:"lock_retries"`
+	Reconnects          int               `json:"reconnects"`
+	Timeouts            int               `json:"timeouts"`
+	RowsSkipped         int               `json:"rows_skipped"`
+	ChangedSinceRead    int               `json:"changed_since_read"`
+	DuplicateRows       int               `json:"duplicate_rows"`
+	DuplicatesSkipped   int               `json:"duplicates_skipped"`
+	UnexpectedAffected  int               `json:"unexpected_affected_rows"`
+	ExcludedMatches     map[string]int    `json:"excluded_matches,omitempty"`
+	OversizeValues      int               `json:"oversize_values"`
+	RejectedRows        int               `json:"rejected_rows"`
+	Samples             []Sample          `json:"samples,omitempty"`
+	TopValues           []ValueCount      `json:"top_values,omitempty"`
+	OtherValues         int               `json:"other_values,omitempty"`
+	ChangedKeysColumns  string            `json:"changed_keys_columns,omitempty"`
+	ChangedKeys         []string          `json:"changed_keys,omitempty"`
+	ChangedKeysOmitted  int               `json:"changed_keys_omitted,omitempty"`
+	Error               string            `json:"error,omitempty"`
+	DurationSeconds     float64           `json:"duration_seconds"`
+}
+
+// record adds a table's entry for the report. The caller holds s.mu.
+func (s *runSummary) record(table string, result TableResult, status string, err error) {
+	entry := TableReport{
+		Name:                table,
+		Status:              status,
+		Rule:                result.Rule,
+		ColumnRules:         result.ColumnRules,
+		RowsScanned:         result.RowsScanned,
+		RowsUpdated:         result.RowsUpdated,
+		BytesScanned:        result.BytesScanned,
+		Replacements:        result.Replacements,
+		OccurrencesReplaced: result.OccurrencesReplaced,
+		Columns:             result.Columns,
+		Pairs:               result.Pairs,
+		Committed:           result.Committed,
+		Limited:             result.Limited,
+		Backup:              result.Backup,
+		Base64Values:        result.Base64Values,
+		CompressedValues:    result.CompressedValues,
+		NulledValues:        result.NulledValues,
+		NotNullColumns:      result.NotNullColumns,
+		Occurrences:         result.Occurrences,
+		MatchedRows:         result.MatchedRows,
+		LockRetries:         result.LockRetries,
+		Reconnects:          result.Reconnects,
+		Timeouts:            result.Timeouts,
+		RowsSkipped:         result.RowsSkipped,
+		ChangedSinceRead:    result.ChangedSinceRead,
+		DuplicateRows:       result.DuplicateRows,
+		DuplicatesSkipped:   result.DuplicatesSkipped,
+		UnexpectedAffected:  result.UnexpectedAffected,
+		ExcludedMatches:     result.ExcludedMatches,
+		OversizeValues:      result.OversizeValues,
+		RejectedRows:        result.RejectedRows,
+		Samples:             result.Samples,
+		TopValues:           result.TopValues,
+		OtherValues:         result.OtherValues,
+		ChangedKeysColumns:  result.ChangedKeysColumns,
+		ChangedKeys:         result.ChangedKeys,
+		ChangedKeysOmitted:  result.ChangedKeysOmitted,
+		DurationSeconds:     result.Elapsed.Seconds(),
+		SleepSeconds:        result.Slept.Seconds(),
+		DBWaitSeconds:       result.DBWait.Seconds(),
+		ProcessingSeconds:   result.Processing.Seconds(),
+	}
+	if entry.Columns == nil {
+		entry.Columns = map[string]int{}
+	}
+	if result.Elapsed > 0 {
+		entry.RowsPerSecond = float64(result.RowsScanned) / result.Elapsed.Seconds()
+		entry.BytesPerSecond = float64(result.BytesScanned) / result.Elapsed.Seconds()
+		entry.UpdatesPerSecond = float64(result.RowsUpdated) / result.Elapsed.Seconds()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.tables = append(s.tables, entry)
+	s.timeouts += result.Timeouts
+	s.prompted += result.prompted
+	s.unexpectedAffected += result.UnexpectedAffected
+	// A backup made before the table failed is still listed, since it
+	// holds the rows as they were.
+	if result.Backup != "" {
+		s.backups = append(s.backups, result.Backup)
+	}
+}
+
+// WriteJSON writes the report to w as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,85 @@
+package mysqlreplace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestReportSchema pins the field names of the JSON report, which scripts
+// read: renaming or removing one needs a ReportSchemaVersion bump.
+func TestReportSchema(t *testing.T) {
+	summary := &runSummary{pairs: make([]int, 2)}
+	summary.add("wp_posts", TableResult{
+		Replacements: 2, OccurrencesReplaced: 3, RowsScanned: 10, RowsUpdated: 2, Committed: true,
+		Columns: map[string]int{"post_content": 2}, Pairs: []int{2, 0}, Elapsed: time.Second,
+	})
+	summary.fail("wp_options", TableResult{}, errors.New("lock wait timeout"), Config{})
+	report := &Report{
+		SchemaVersion: ReportSchemaVersion,
+		Database:      "wordpress",
+		Pairs: []ReportPair{
+			{Search: "old.example.com", Replace: "new.example.com", ValuesChanged: summary.pairs[0]},
+			{Search: "@old.example.com", Replace: "@new.example.com", Rule: "emails", ValuesChanged: summary.pairs[1]},
+		},
+		Totals: ReportTotals{TablesSelected: 2, TablesFailed: summary.failedTables, Replacements: summary.replacements},
+		Tables: summary.tables,
+	}
+	var buf bytes.Buffer
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := decoded["schema_version"].(float64); version != 1 {
+		t.Errorf("schema_version is %v, want 1", decoded["schema_version"])
+	}
+	requireKeys(t, "report", decoded, "schema_version", "host", "database", "pairs", "regex", "ignore_case", "dry_run",
+		"started_at", "finished_at", "duration_seconds", "interrupted", "totals", "tables")
+	requireKeys(t, "totals", decoded["totals"], "tables_selected", "tables_changed", "tables_failed", "rows_scanned",
+		"rows_updated", "replacements", "occurrences_replaced")
+
+	pairs := decoded["pairs"].([]interface{})
+	if len(pairs) != 2 {
+		t.Fatalf("got %d pairs, want 2", len(pairs))
+	}
+	requireKeys(t, "pair", pairs[0], "search", "replace", "values_changed")
+	requireKeys(t, "rule pair", pairs[1], "search", "replace", "rule", "values_changed")
+	if changed := pairs[0].(map[string]interface{})["values_changed"]; changed != float64(2) {
+		t.Errorf("values_changed of pair 1 is %v, want 2", changed)
+	}
+
+	tables := decoded["tables"].([]interface{})
+	if len(tables) != 2 {
+		t.Fatalf("got %d tables, want 2", len(tables))
+	}
+	ok, failed := tables[0].(map[string]interface{}), tables[1].(map[string]interface{})
+	requireKeys(t, "table", ok, "name", "status", "rows_scanned", "rows_updated", "bytes_scanned", "replacements",
+		"occurrences_replaced", "columns", "pairs", "committed", "limited", "duration_seconds")
+	if ok["name"] != "wp_posts" || ok["status"] != "ok" {
+		t.Errorf("first table is %v with status %v, want wp_posts ok", ok["name"], ok["status"])
+	}
+	if failed["status"] != "failed" || failed["error"] != "lock wait timeout" {
+		t.Errorf("failed table has status %v and error %v", failed["status"], failed["error"])
+	}
+}
+
+// requireKeys fails t unless value is a JSON object with every key.
+func requireKeys(t *testing.T, name string, value interface{}, keys ...string) {
+	t.Helper()
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		t.Errorf("%s is %T, want an object", name, value)
+		return
+	}
+	for _, key := range keys {
+		if _, ok := object[key]; !ok {
+			t.Errorf("%s lacks %q", name, key)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers for lock conflicts and MAX_EXECUTION_TIME.
+const (
+	errLockWaitTimeout = 1205
+	errLockDeadlock    = 1213
+	errQueryTimeout    = 3024
+)
+
+// MySQL error numbers for a value a strict SQL mode rejects, such as the
+// zero date 0000-00-00.
+const (
+	errTruncatedWrongValue = 1292
+	errWrongValue          = 1525
+)
+
+// retryBaseDelay and retryMaxDelay bound the exponential backoff between
+// attempts of a statement that hit a lock conflict.
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+func mysqlErrorNumber(err error) uint16 {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number
+	}
+	return 0
+}
+
+// isInvalidValue reports whether err is the server rejecting a date or
+// other value of the statement as incorrect.
+func isInvalidValue(err error) bool {
+	n := mysqlErrorNumber(err)
+	return n == errTruncatedWrongValue || n == errWrongValue
+}
+
+// isDeadlock reports whether err is MySQL's ER_LOCK_DEADLOCK.
+func isDeadlock(err error) bool {
+	return mysqlErrorNumber(err) == errLockDeadlock
+}
+
+// isTimeout reports whether err comes from StatementTimeout: the server's
+// MAX_EXECUTION_TIME error for a SELECT, or the deadline of an UPDATE's
+// context. j.ctx itself has no deadline.
+func isTimeout(err error) bool {
+	return mysqlErrorNumber(err) == errQueryTimeout || errors.Is(err, context.DeadlineExceeded)
+}
+
+// timedOut counts err in the table's Timeouts if it is a statement timeout.
+func (j *tableJob) timedOut(err error) bool {
+	if !isTimeout(err) {
+		return false
+	}
+	j.result.Timeouts++
+	return true
+}
+
+// retryable reports whether a statement that failed with err can simply be
+// run again. A lock wait timeout only rolls back the statement; a deadlock
+// rolls back the whole transaction, so it is only retried outside one. A
+// timed-out UPDATE leaves its connection unusable, so it is only retried in
+// chunked scans that write through the pool rather than a transaction or a
+// connection holding session settings.
+func (j *tableJob) retryable(err error) bool {
+	switch mysqlErrorNumber(err) {
+	case errLockWaitTimeout:
+		return true
+	case errLockDeadlock:
+		return j.tx == nil
+	}
+	_, pooled := j.exec.(*sql.DB)
+	return isTimeout(err) && j.chunked && pooled
+}
+
+// statementContext returns ctx limited to StatementTimeout, if set.
+func (j *tableJob) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if j.config.StatementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, j.config.StatementTimeout)
+}
+
+// selectHint returns the optimizer hint limiting a SELECT to
+// StatementTimeout, to follow the SELECT keyword.
+func (c Config) selectHint() string {
+	if c.StatementTimeout <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("/*+ MAX_EXECUTION_TIME(%d) */ ", c.StatementTimeout.Milliseconds())
+}
+
+// execRetry runs an UPDATE through exec, retrying it with exponential
+// backoff after a retryable lock conflict, up to LockRetries more times,
+// and outside a transaction after a lost connection, up to
+// ReconnectRetries more times. The wait ends early when the run is
+// interrupted. An UPDATE that reached the server before the connection was
+// lost sets the same values again.
+func (j *tableJob) execRetry(exec func() (sql.Result, error)) (sql.Result, error) {
+	delay := retryBaseDelay
+	lost := 0
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		res, err := exec()
+		j.waited(started)
+		if err == nil {
+			return res, nil
+		}
+		if isConnectionLost(err) && j.tx == nil && lost < j.config.ReconnectRetries {
+			lost++
+			if !j.reconnect(err, lost) {
+				return nil, err
+			}
+			attempt--
+			continue
+		}
+		timedOut := j.timedOut(err)
+		if attempt > j.config.LockRetries || !j.retryable(err) {
+			return res, err
+		}
+		if timedOut {
+			j.log.Warn(fmt.Sprintf("statement timed out, retrying in %s", delay), "attempt", attempt, "err", err)
+		} else {
+			j.result.LockRetries++
+			j.log.Warn(fmt.Sprintf("lock conflict, retrying in %s", delay), "attempt", attempt, "err", err)
+		}
+		if !j.wait(delay) {
+			return nil, err
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+// readRetry runs a chunk's SELECT, retrying it after a statement timeout,
+// and after a lost connection up to ReconnectRetries more times.
+func (j *tableJob) readRetry(read func() error) error {
+	delay := retryBaseDelay
+	lost := 0
+	for attempt := 1; ; attempt++ {
+		err := read()
+		if isConnectionLost(err) && lost < j.config.ReconnectRetries {
+			lost++
+			if !j.reconnect(err, lost) {
+				return err
+			}
+			attempt--
+			continue
+		}
+		if err == nil || !isTimeout(err) || attempt > j.config.LockRetries {
+			return err
+		}
+		j.log.Warn(fmt.Sprintf("chunk read timed out, retrying in %s", delay), "attempt", attempt, "err", err)
+		if !j.wait(delay) {
+			return err
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+// wait sleeps for delay and reports false if the run was interrupted first.
+func (j *tableJob) wait(delay time.Duration) bool {
+	return waitContext(j.ctx, delay)
+}
+
+func nextDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
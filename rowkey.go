@@ -0,0 +1,206 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rowKey is the set of columns that identifies a row of a table: its
+// primary key or, failing that, a unique index on NOT NULL columns. Index is
+// the key's name, "PRIMARY" for a primary key; a table with neither has an
+// empty rowKey and its rows are matched on all of their values.
+type rowKey struct {
+	Index   string
+	Columns []string
+}
+
+// uniqueIndex is one index of SHOW INDEX as read by getRowKey.
+type uniqueIndex struct {
+	name     string
+	columns  map[int]string
+	unique   bool
+	nullable bool
+}
+
+// getRowKey returns the primary key of table or, if it has none, the unique
+// index with the fewest and then the smallest NOT NULL columns. Indexes on
+// expressions or on nullable columns do not identify rows and are ignored.
+func getRowKey(ctx context.Context, db *sql.DB, table string) (rowKey, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SHOW INDEX FROM %s", quoteTable(table)))
+	if err != nil {
+		return rowKey{}, err
+	}
+	defer rows.Close()
+
+	// The number of columns returned by SHOW INDEX differs between MySQL and
+	// MariaDB versions, so look the ones we need up by name.
+	names, err := rows.Columns()
+	if err != nil {
+		return rowKey{}, err
+	}
+	nonUniqueIdx, keyIdx, seqIdx, colIdx, nullIdx := -1, -1, -1, -1, -1
+	for i, name := range names {
+		switch name {
+		case "Non_unique":
+			nonUniqueIdx = i
+		case "Key_name":
+			keyIdx = i
+		case "Seq_in_index":
+			seqIdx = i
+		case "Column_name":
+			colIdx = i
+		case "Null":
+			nullIdx = i
+		}
+	}
+	if nonUniqueIdx < 0 || keyIdx < 0 || seqIdx < 0 || colIdx < 0 {
+		return rowKey{}, fmt.Errorf("unexpected SHOW INDEX output for table %s", table)
+	}
+
+	indexes := make(map[string]*uniqueIndex)
+	var order []string
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(names))
+		valuePtrs := make([]interface{}, len(names))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return rowKey{}, err
+		}
+		name := string(values[keyIdx])
+		index, ok := indexes[name]
+		if !ok {
+			index = &uniqueIndex{name: name, columns: make(map[int]string), unique: string(values[nonUniqueIdx]) == "0"}
+			indexes[name] = index
+			order = append(order, name)
+		}
+		var seq int
+		if _, err := fmt.Sscan(string(values[seqIdx]), &seq); err != nil {
+			return rowKey{}, fmt.Errorf("invalid Seq_in_index %q for table %s", values[seqIdx], table)
+		}
+		// Functional key parts have no column name.
+		if values[colIdx] == nil {
+			index.nullable = true
+			continue
+		}
+		index.columns[seq] = string(values[colIdx])
+		if nullIdx >= 0 && strings.EqualFold(string(values[nullIdx]), "YES") {
+			index.nullable = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return rowKey{}, err
+	}
+
+	if primary, ok := indexes["PRIMARY"]; ok {
+		columns, err := primary.orderedColumns()
+		if err != nil {
+			return rowKey{}, fmt.Errorf("incomplete primary key definition for table %s", table)
+		}
+		return rowKey{Index: "PRIMARY", Columns: columns}, nil
+	}
+
+	var candidates []rowKey
+	for _, name := range order {
+		index := indexes[name]
+		if !index.unique || index.nullable {
+			continue
+		}
+		columns, err := index.orderedColumns()
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, rowKey{Index: name, Columns: columns})
+	}
+	if len(candidates) <= 1 {
+		if len(candidates) == 0 {
+			return rowKey{}, nil
+		}
+		return candidates[0], nil
+	}
+
+	sizes, err := getColumnSizes(ctx, db, table)
+	if err != nil {
+		return rowKey{}, err
+	}
+	keySize := func(key rowKey) int64 {
+		var total int64
+		for _, col := range key.Columns {
+			total += sizes[col]
+		}
+		return total
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if len(candidates[i].Columns) != len(candidates[j].Columns) {
+			return len(candidates[i].Columns) < len(candidates[j].Columns)
+		}
+		return keySize(candidates[i]) < keySize(candidates[j])
+	})
+	return candidates[0], nil
+}
+
+// orderedColumns returns the index's columns in key order, or an error if a
+// key part is missing.
+func (index *uniqueIndex) orderedColumns() ([]string, error) {
+	columns := make([]string, 0, len(index.columns))
+	for seq := 1; seq <= len(index.columns); seq++ {
+		col, ok := index.columns[seq]
+		if !ok {
+			return nil, fmt.Errorf("index %s has no key part %d", index.name, seq)
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// fixedColumnSizes is the storage size in bytes of the fixed-width types.
+var fixedColumnSizes = map[string]int64{
+	"tinyint":   1,
+	"smallint":  2,
+	"mediumint": 3,
+	"int":       4,
+	"integer":   4,
+	"bigint":    8,
+	"float":     4,
+	"double":    8,
+	"year":      1,
+	"date":      3,
+	"time":      3,
+	"timestamp": 4,
+	"datetime":  8,
+}
+
+// getColumnSizes returns the size in bytes of each column of table, used to
+// prefer the smallest of several unique indexes: the maximum byte length for
+// string types, the storage size of fixed-width types, and 8 otherwise.
+func getColumnSizes(ctx context.Context, db *sql.DB, table string) (map[string]int64, error) {
+	cond, args := tableCondition(table)
+	rows, err := db.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE, CHARACTER_OCTET_LENGTH FROM information_schema.COLUMNS
+		WHERE `+cond, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var column, dataType string
+		var octets sql.NullInt64
+		if err := rows.Scan(&column, &dataType, &octets); err != nil {
+			return nil, err
+		}
+		size, ok := fixedColumnSizes[strings.ToLower(dataType)]
+		switch {
+		case octets.Valid:
+			size = octets.Int64
+		case !ok:
+			size = 8
+		}
+		sizes[column] = size
+	}
+	return sizes, rows.Err()
+}
@@ -0,0 +1,226 @@
+package mysqlreplace
+
+import (
+	"fmt"
+)
+
+// Rule overrides settings for the tables it matches, for Config.Rules.
+// Settings left unset keep the run's.
+type Rule struct {
+	// Name identifies the rule in logs and the report; it defaults to
+	// "rule N", counting from 1.
+	Name string
+	// Tables are the tables the rule applies to, with the wildcards of
+	// Config.Tables.
+	Tables []string
+	// Skip leaves the tables out, as ExcludeTables would.
+	Skip bool
+	// ForColumns limits the rule to the columns it names, with the
+	// wildcards of Config.Columns: their values are matched with the
+	// rule's Pairs, Serialized and JSONKeys, and the other columns of the
+	// tables keep the settings they would have without it. Such a rule
+	// cannot set Skip, Columns or ExcludeColumns.
+	ForColumns []string
+
+	// Pairs, Columns and ExcludeColumns replace those of the run when not
+	// nil; Serialized and JSONKeys when set.
+	Pairs          []Pair
+	Columns        []string
+	ExcludeColumns []string
+	Serialized     *bool
+	JSONKeys       *bool
+
+	// exactPairs are Pairs compiled case-sensitively, as for Config, and
+	// pairOffset is the index of the first of them in runPairs.
+	exactPairs []Pair
+	pairOffset int
+}
+
+func (r Rule) String() string {
+	return r.Name
+}
+
+// validateRules checks each rule and its pairs.
+func (c Config) validateRules() error {
+	for i, rule := range c.Rules {
+		name := fmt.Sprintf("rule %d", i+1)
+		if rule.Name != "" {
+			name = fmt.Sprintf("rule %q", rule.Name)
+		}
+		if len(rule.Tables) == 0 {
+			return fmt.Errorf("%s matches no tables; give it a list of tables", name)
+		}
+		if rule.ForColumns != nil && len(rule.ForColumns) == 0 {
+			return fmt.Errorf("%s has an empty list of columns to apply to", name)
+		}
+		if rule.ForColumns != nil && (rule.Skip || rule.Columns != nil || rule.ExcludeColumns != nil) {
+			return fmt.Errorf("%s applies to some columns only, so it can only set pairs, serialized and json-keys", name)
+		}
+		if rule.Skip && (rule.Pairs != nil || rule.Columns != nil || rule.ExcludeColumns != nil || rule.Serialized != nil || rule.JSONKeys != nil) {
+			return fmt.Errorf("%s skips its tables, so it cannot set anything else", name)
+		}
+		if rule.Pairs != nil && len(rule.Pairs) == 0 {
+			return fmt.Errorf("%s has an empty list of pairs", name)
+		}
+		if _, err := compilePairs(rule.Pairs, c.Regex, c.IgnoreCase); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if c.ServerSide && ((rule.Serialized != nil && *rule.Serialized) || (rule.JSONKeys != nil && *rule.JSONKeys)) {
+			return fmt.Errorf("%s enables serialized or JSON key handling, which -server-side cannot do", name)
+		}
+	}
+	return nil
+}
+
+// compileRules names the rules and compiles their pairs like those of the
+// run, numbering them after the run's pairs for runPairs.
+func (c *Config) compileRules() error {
+	c.Rules = append([]Rule(nil), c.Rules...)
+	offset := len(c.Pairs)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.Pairs == nil {
+			continue
+		}
+		pairs, exact, err := c.compile(rule.Pairs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		rule.Pairs, rule.exactPairs = pairs, exact
+		rule.pairOffset = offset
+		offset += len(pairs)
+	}
+	return nil
+}
+
+// matchingRules returns the rules that match table, in declaration order.
+func (c Config) matchingRules(table string) []*Rule {
+	var rules []*Rule
+	for i := range c.Rules {
+		if matchesAny(c.Rules[i].Tables, table) {
+			rules = append(rules, &c.Rules[i])
+		}
+	}
+	return rules
+}
+
+// tableRules splits rules into those for whole tables and those limited to
+// some columns by ForColumns.
+func tableRules(rules []*Rule) (tables, columns []*Rule) {
+	for _, rule := range rules {
+		if rule.ForColumns != nil {
+			columns = append(columns, rule)
+		} else {
+			tables = append(tables, rule)
+		}
+	}
+	return tables, columns
+}
+
+// forTable returns c with the settings of the first whole-table rule
+// matching table, and that rule, or nil when none does. The column rules
+// matching table are kept for forColumn.
+func (c Config) forTable(table string) (Config, *Rule) {
+	rules, columnRules := tableRules(c.matchingRules(table))
+	c.columnRules = columnRules
+	if len(rules) == 0 {
+		return c, nil
+	}
+	rule := rules[0]
+	if rule.Pairs != nil {
+		c.Pairs, c.exactPairs = rule.Pairs, rule.exactPairs
+		c.pairOffset = rule.pairOffset
+	}
+	if rule.Columns != nil {
+		c.Columns = rule.Columns
+	}
+	if rule.ExcludeColumns != nil {
+		c.ExcludeColumns = rule.ExcludeColumns
+	}
+	if rule.Serialized != nil {
+		c.Serialized = *rule.Serialized
+	}
+	if rule.JSONKeys != nil {
+		c.JSONKeys = *rule.JSONKeys
+	}
+	return c, rule
+}
+
+// matchingColumnRules returns the column rules kept by forTable that match
+// column, in declaration order.
+func (c Config) matchingColumnRules(column string) []*Rule {
+	var rules []*Rule
+	for _, rule := range c.columnRules {
+		if matchesAny(rule.ForColumns, column) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// withColumnRule returns c with the settings of the first column rule
+// matching column.
+func (c Config) withColumnRule(column string) Config {
+	for _, rule := range c.columnRules {
+		if !matchesAny(rule.ForColumns, column) {
+			continue
+		}
+		if rule.Pairs != nil {
+			c.Pairs, c.exactPairs = rule.Pairs, rule.exactPairs
+			c.pairOffset = rule.pairOffset
+		}
+		if rule.Serialized != nil {
+			c.Serialized = *rule.Serialized
+		}
+		if rule.JSONKeys != nil {
+			c.JSONKeys = *rule.JSONKeys
+		}
+		break
+	}
+	return c
+}
+
+// applyRules removes the tables that a Skip rule matches first, counting
+// them as excluded, and warns about tables more than one whole-table rule
+// matches, which only the first applies to.
+func (c Config) applyRules(tables []string) ([]string, int) {
+	if len(c.Rules) == 0 {
+		return tables, 0
+	}
+	kept := tables[:0]
+	skipped := 0
+	for _, table := range tables {
+		rules, _ := tableRules(c.matchingRules(table))
+		if len(rules) > 1 {
+			c.log().Warn("table matches several rules; only the first applies", "table", table, "rules", rules)
+		}
+		switch {
+		case len(rules) == 0:
+		case rules[0].Skip:
+			c.log().Info("skipping table by rule", "table", table, "rule", rules[0].Name)
+			skipped++
+			continue
+		default:
+			c.log().Debug("table follows rule", "table", table, "rule", rules[0].Name)
+		}
+		kept = append(kept, table)
+	}
+	return kept, skipped
+}
+
+// runPairs returns every pair of the run, those of Config.Pairs followed
+// by those of each rule, with the name of the rule each belongs to.
+func (c Config) runPairs() ([]Pair, []string) {
+	pairs := append([]Pair(nil), c.Pairs...)
+	rules := make([]string, len(pairs))
+	for _, rule := range c.Rules {
+		for _, pair := range rule.Pairs {
+			pairs = append(pairs, pair)
+			rules = append(rules, rule.Name)
+		}
+	}
+	return pairs, rules
+}
@@ -0,0 +1,129 @@
+package mysqlreplace
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compiledConfig validates config and compiles its pairs and rules as New
+// does.
+func compiledConfig(t *testing.T, config Config) Config {
+	t.Helper()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	pairs, exact, err := config.compile(config.Pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Pairs, config.exactPairs = pairs, exact
+	if err := config.compileRules(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestColumnRuleOverridesOnlyItsColumns(t *testing.T) {
+	config := compiledConfig(t, Config{
+		Database: "db",
+		Pairs:    []Pair{{Search: "old.example.com", Replace: "example.org"}},
+		Rules: []Rule{{
+			Name:       "emails",
+			Tables:     []string{"users"},
+			ForColumns: []string{"email"},
+			Pairs:      []Pair{{Search: "@old.example.com", Replace: "@new.example.com"}},
+		}},
+	})
+	runPairs, _ := config.runPairs()
+
+	tests := []struct {
+		table, column, value string
+		want                 string
+		pair                 int
+	}{
+		{"users", "email", "bob@old.example.com", "bob@new.example.com", 1},
+		{"users", "bio", "see http://old.example.com", "see http://example.org", 0},
+		{"customers", "email", "bob@old.example.com", "bob@example.org", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table+"."+tt.column, func(t *testing.T) {
+			tableConfig, rule := config.forTable(tt.table)
+			if rule != nil {
+				t.Errorf("table follows rule %q, want none", rule.Name)
+			}
+			col := textColumn{Name: tt.column}
+			colConfig := tableConfig.forColumn(col)
+			hits := make([]int, len(colConfig.Pairs))
+			got, replacements, _ := replaceColumnValue(tt.value, tt.table, col, colConfig, hits)
+			if got != tt.want || replacements != 1 {
+				t.Errorf("replaced %q with %q (%d replacements), want %q", tt.value, got, replacements, tt.want)
+			}
+			counts := make([]int, len(runPairs))
+			for i, hit := range hits {
+				counts[colConfig.pairOffset+i] += hit
+			}
+			want := make([]int, len(runPairs))
+			want[tt.pair] = 1
+			if !reflect.DeepEqual(counts, want) {
+				t.Errorf("pair counts %v, want %v", counts, want)
+			}
+		})
+	}
+
+	tableConfig, _ := config.forTable("users")
+	if rules := tableConfig.matchingColumnRules("bio"); len(rules) != 0 {
+		t.Errorf("bio follows %v, want no rule", rules)
+	}
+	_, args := buildPrefilter([]textColumn{{Name: "email"}, {Name: "bio"}}, tableConfig)
+	if want := []interface{}{"@old.example.com", "old.example.com"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("prefilter arguments %v, want %v", args, want)
+	}
+}
+
+func TestColumnRuleAfterTableRule(t *testing.T) {
+	config := compiledConfig(t, Config{
+		Database: "db",
+		Pairs:    []Pair{{Search: "a", Replace: "b"}},
+		Rules: []Rule{
+			{Name: "email", Tables: []string{"users"}, ForColumns: []string{"email"}, Pairs: []Pair{{Search: "c", Replace: "d"}}},
+			{Name: "users", Tables: []string{"users"}, Pairs: []Pair{{Search: "e", Replace: "f"}}},
+		},
+	})
+	tableConfig, rule := config.forTable("users")
+	if rule == nil || rule.Name != "users" {
+		t.Fatalf("table follows %v, want rule users", rule)
+	}
+	for column, want := range map[string]string{"email": "c", "name": "e"} {
+		colConfig := tableConfig.forColumn(textColumn{Name: column})
+		if len(colConfig.Pairs) != 1 || colConfig.Pairs[0].Search != want {
+			t.Errorf("%s is matched with %v, want %q", column, colConfig.Pairs, want)
+		}
+	}
+	if kept, skipped := config.applyRules([]string{"users"}); len(kept) != 1 || skipped != 0 {
+		t.Errorf("applyRules kept %v and skipped %d, want users kept", kept, skipped)
+	}
+}
+
+func TestValidateColumnRules(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name string
+		rule Rule
+		want string
+	}{
+		{"skip", Rule{Tables: []string{"users"}, ForColumns: []string{"email"}, Skip: true}, "only set pairs"},
+		{"columns", Rule{Tables: []string{"users"}, ForColumns: []string{"email"}, Columns: []string{"email"}}, "only set pairs"},
+		{"exclude columns", Rule{Tables: []string{"users"}, ForColumns: []string{"email"}, ExcludeColumns: []string{"bio"}}, "only set pairs"},
+		{"empty", Rule{Tables: []string{"users"}, ForColumns: []string{}, Serialized: &yes}, "empty list of columns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Database: "db", Pairs: []Pair{{Search: "a", Replace: "b"}}, Rules: []Rule{tt.rule}}
+			err := config.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
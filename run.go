@@ -0,0 +1,465 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runSummary accumulates per-table results. Workers update it concurrently.
+type runSummary struct {
+	mu            sync.Mutex
+	replacements  int
+	pairs         []int
+	changedTables int
+	noTextTables  int
+	failedTables  int
+	limitedTables int
+	// whereSkippedTables counts the tables that lacked a column of their
+	// Where condition.
+	whereSkippedTables int
+
+	// interruptedTables and notStarted count tables cut short or never
+	// started because the run was interrupted.
+	interruptedTables int
+	notStarted        int
+	// cappedTables counts the tables stopped by MaxTotalReplacements.
+	cappedTables int
+
+	occurrencesReplaced int
+	rowsScanned         int
+	rowsUpdated         int
+	bytesScanned        int64
+	base64Values        int
+	compressedValues    int
+	occurrences         int
+	matchedRows         int
+	lockRetries         int
+	reconnects          int
+	changedSinceRead    int
+	tables              []TableReport
+	backups             []string
+
+	// timeouts counts the statements that exceeded StatementTimeout in
+	// every table, including failed ones, and prompted the time spent
+	// waiting at the approval prompt.
+	timeouts int
+	prompted time.Duration
+	// dbWait and processing total the tables' DBWait and Processing.
+	dbWait     time.Duration
+	processing time.Duration
+	// unexpectedAffected counts the UPDATEs that affected an unexpected
+	// number of rows, also in every table.
+	unexpectedAffected int
+
+	// rowsSkipped counts the rows declined at the approval prompt; quit is
+	// set once the user quit there.
+	rowsSkipped int
+	quit        bool
+
+	// duplicateRows and duplicatesSkipped total the tables' DuplicateRows
+	// and DuplicatesSkipped.
+	duplicateRows     int
+	duplicatesSkipped int
+
+	// excludedMatches and oversizeValues total the tables' ExcludedMatches
+	// and OversizeValues.
+	excludedMatches int
+	oversizeValues  int
+	// rejectedRows totals the tables' RejectedRows.
+	rejectedRows int
+
+	// nulledValues totals the tables' NulledValues, and notNullColumns
+	// counts their NotNullColumns.
+	nulledValues   int
+	notNullColumns int
+}
+
+func (s *runSummary) add(table string, result TableResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := "ok"
+	if result.NoTextColumns {
+		status = "no_text_columns"
+	}
+	if result.WhereSkipped {
+		status = "where_skipped"
+	}
+	s.record(table, result, status, nil)
+	s.count(result)
+	if result.Quit {
+		s.quit = true
+	}
+}
+
+// count adds a table's figures to the totals. The caller holds s.mu.
+func (s *runSummary) count(result TableResult) {
+	s.replacements += result.Replacements
+	s.occurrencesReplaced += result.OccurrencesReplaced
+	s.rowsScanned += result.RowsScanned
+	s.rowsUpdated += result.RowsUpdated
+	s.bytesScanned += result.BytesScanned
+	s.dbWait += result.DBWait
+	s.processing += result.Processing
+	s.base64Values += result.Base64Values
+	s.compressedValues += result.CompressedValues
+	s.matchedRows += result.MatchedRows
+	s.lockRetries += result.LockRetries
+	s.reconnects += result.Reconnects
+	s.changedSinceRead += result.ChangedSinceRead
+	s.rowsSkipped += result.RowsSkipped
+	s.duplicateRows += result.DuplicateRows
+	s.duplicatesSkipped += result.DuplicatesSkipped
+	s.excludedMatches += sumCounts(result.ExcludedMatches)
+	s.oversizeValues += result.OversizeValues
+	s.rejectedRows += result.RejectedRows
+	s.nulledValues += result.NulledValues
+	s.notNullColumns += len(result.NotNullColumns)
+	s.occurrences += sumCounts(result.Occurrences)
+	if result.Replacements > 0 || result.MatchedRows > 0 {
+		s.changedTables++
+	}
+	if result.NoTextColumns {
+		s.noTextTables++
+	}
+	if result.WhereSkipped {
+		s.whereSkippedTables++
+	}
+	if result.Limited {
+		s.limitedTables++
+	}
+	for i, count := range result.Pairs {
+		s.pairs[i] += count
+	}
+}
+
+// fail records a failed table and reports whether processing should stop.
+func (s *runSummary) fail(table string, result TableResult, err error, config Config) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(table, result, "failed", err)
+	s.failedTables++
+	return config.FailFast
+}
+
+// interrupt records a table cut short by an interrupt. When its changes were
+// kept, because there was no transaction to roll back, they are counted.
+func (s *runSummary) interrupt(table string, result TableResult, err error, kept bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(table, result, "interrupted", err)
+	s.interruptedTables++
+	if kept {
+		s.count(result)
+	}
+}
+
+// capTable records a table stopped by MaxTotalReplacements, counting its
+// changes when they were kept, like interrupt.
+func (s *runSummary) capTable(table string, result TableResult, err error, kept bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(table, result, "capped", err)
+	s.cappedTables++
+	if kept {
+		s.count(result)
+	}
+}
+
+func (s *runSummary) stopped(config Config) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quit || (config.FailFast && s.failedTables > 0)
+}
+
+// quitting reports whether the user quit at the approval prompt, or
+// MaxTotalReplacements was reached, so that no further table starts.
+func (s *runSummary) quitting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quit || s.cappedTables > 0
+}
+
+// skip counts a table left unstarted after the user quit or the cap was
+// reached. The dispatcher may already have handed it to a worker.
+func (s *runSummary) skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notStarted++
+}
+
+// runTables processes tables with up to config.Concurrency workers.
+func runTables(ctx context.Context, db *sql.DB, tables []string, config Config) *runSummary {
+	runPairs, _ := config.runPairs()
+	summary := &runSummary{pairs: make([]int, len(runPairs))}
+
+	reader := db
+	if config.readDB != nil {
+		reader = config.readDB
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var w writer = db
+			conn, err := openWriteConn(ctx, db, config)
+			if err != nil {
+				config.log().Error("could not open connection for updates", "err", err)
+				for table := range work {
+					summary.fail(table, TableResult{}, err, config)
+				}
+				return
+			}
+			if conn != nil {
+				w = conn
+				defer releaseWriteConn(conn, config)
+			}
+			for table := range work {
+				if summary.quitting() {
+					summary.skip()
+					continue
+				}
+				result, err := processTable(ctx, reader, w, table, config)
+				for lost := 1; isConnectionLost(err) && ctx.Err() == nil && lost <= config.ReconnectRetries && restartable(result, config); lost++ {
+					delay := reconnectDelay(lost)
+					config.tableLogger(table).Warn(fmt.Sprintf("connection lost and the table rolled back; processing it again in %s", delay),
+						"attempt", lost, "of", config.ReconnectRetries, "err", err)
+					if !waitContext(ctx, delay) {
+						break
+					}
+					if conn != nil {
+						if err := conn.reopen(ctx); err != nil {
+							config.log().Warn("could not reopen the connection for updates", "err", err)
+						}
+					}
+					if config.snapshot != nil {
+						config.snapshot.discardTable(table)
+					}
+					reconnects := result.Reconnects + 1
+					result, err = processTable(ctx, reader, w, table, config)
+					result.Reconnects += reconnects
+				}
+				if err != nil && ctx.Err() != nil {
+					config.log().Warn("table interrupted", "table", table, "err", err)
+					// Without a per-table transaction the rows updated so
+					// far stay written and belong in the summary, as do the
+					// chunks committed with -lock-rows.
+					kept := !config.TxPerTable || !config.WritesDatabase() || result.Committed
+					summary.interrupt(table, result, err, kept)
+					if kept {
+						logTableResult(table, result, config)
+					}
+					continue
+				}
+				if errors.Is(err, errReplacementCap) {
+					kept := !config.TxPerTable || !config.WritesDatabase() || result.Committed
+					summary.capTable(table, result, err, kept)
+					if kept {
+						logTableResult(table, result, config)
+					}
+					continue
+				}
+				if err != nil {
+					config.log().Error("table failed", "table", table, "err", err)
+					if summary.fail(table, result, err, config) {
+						config.log().Error("stopping after error (-fail-fast)", "table", table)
+					}
+					continue
+				}
+				summary.add(table, result)
+				logTableResult(table, result, config)
+				if config.checkpoint != nil {
+					if err := config.checkpoint.complete(table); err != nil {
+						config.log().Error("could not record the table in the checkpoint", "table", table, "err", err)
+					}
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i, table := range tables {
+		if summary.quitting() {
+			summary.mu.Lock()
+			summary.notStarted += len(tables) - i
+			summary.mu.Unlock()
+			break
+		}
+		if summary.stopped(config) {
+			break
+		}
+		select {
+		case work <- table:
+		case <-ctx.Done():
+			summary.mu.Lock()
+			summary.notStarted += len(tables) - i
+			summary.mu.Unlock()
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return summary
+}
+
+func logTableResult(table string, result TableResult, config Config) {
+	level := slog.LevelInfo
+	if result.Replacements > 0 {
+		level = LevelChanged
+	} else if !result.Limited && result.Timeouts == 0 {
+		level = slog.LevelDebug
+	}
+	tlog := config.tableLogger(table)
+
+	stats := fmt.Sprintf("%d rows scanned, %d updated, %s in %s, %s", result.RowsScanned, result.RowsUpdated,
+		formatBytes(result.BytesScanned), result.Elapsed.Round(time.Millisecond), rowsPerSecond(result.RowsScanned, result.Elapsed))
+	if result.Slept > 0 {
+		stats += fmt.Sprintf("; slept %s between chunks, %s in total", result.Slept.Round(time.Millisecond),
+			(result.Elapsed + result.Slept).Round(time.Millisecond))
+	}
+	if result.Limited {
+		stats += "; truncated by -limit"
+	}
+	if result.Base64Values > 0 {
+		stats += fmt.Sprintf("; %d base64-encoded values", result.Base64Values)
+	}
+	if result.CompressedValues > 0 {
+		stats += fmt.Sprintf("; %d compressed values", result.CompressedValues)
+	}
+	if result.NulledValues > 0 {
+		stats += fmt.Sprintf("; %d values set to NULL", result.NulledValues)
+	}
+	if result.Timeouts > 0 {
+		stats += fmt.Sprintf("; %d statements timed out", result.Timeouts)
+	}
+	if result.UnexpectedAffected > 0 {
+		stats += fmt.Sprintf("; %d updates affected an unexpected number of rows", result.UnexpectedAffected)
+	}
+	if result.OversizeValues > 0 {
+		stats += fmt.Sprintf("; %d values larger than -max-value-size left alone", result.OversizeValues)
+	}
+	if result.RejectedRows > 0 {
+		stats += fmt.Sprintf("; %d rows rejected by the server", result.RejectedRows)
+	}
+	if n := sumCounts(result.ExcludedMatches); n > 0 {
+		stats += fmt.Sprintf("; %d matches skipped by exclusion", n)
+	}
+	var msg string
+	if config.ServerSide {
+		// No rows were read, so there is no throughput to report.
+		elapsed := result.Elapsed.Round(time.Millisecond)
+		if config.DryRun {
+			msg = fmt.Sprintf("%d values would change server-side (%s)", result.Replacements, elapsed)
+		} else {
+			msg = fmt.Sprintf("%d values changed server-side (%s)", result.Replacements, elapsed)
+		}
+		tlog.Log(context.Background(), level, msg)
+		for _, col := range sortedKeys(result.Columns) {
+			tlog.Log(context.Background(), level, "column values changed", "column", col, "values", result.Columns[col])
+		}
+		return
+	}
+	if config.CountOnly {
+		if result.MatchedRows == 0 && !result.Limited && result.Timeouts == 0 {
+			level = slog.LevelDebug
+		}
+		msg = fmt.Sprintf("%d occurrences in %d rows (%s)", sumCounts(result.Occurrences), result.MatchedRows, stats)
+		tlog.Log(context.Background(), level, msg)
+		for _, col := range sortedKeys(result.Occurrences) {
+			tlog.Log(context.Background(), level, "column occurrences", "column", col, "occurrences", result.Occurrences[col])
+		}
+		return
+	}
+	occurrences := fmt.Sprintf("%d occurrences", result.OccurrencesReplaced)
+	if config.DryRun {
+		msg = fmt.Sprintf("%d replacements would be made (%s; %s)", result.Replacements, occurrences, stats)
+	} else if config.sqlOut != nil {
+		msg = fmt.Sprintf("%d replacements written to %s (%s; %s)", result.Replacements, config.OutputSQL, occurrences, stats)
+	} else if result.Committed {
+		msg = fmt.Sprintf("%d replacements (%s; committed; %s)", result.Replacements, occurrences, stats)
+	} else {
+		msg = fmt.Sprintf("%d replacements (%s; %s)", result.Replacements, occurrences, stats)
+	}
+	tlog.Log(context.Background(), level, msg)
+	for _, col := range sortedKeys(result.Columns) {
+		tlog.Log(context.Background(), level, "column replacements", "column", col, "replacements", result.Columns[col])
+	}
+	if runPairs, _ := config.runPairs(); len(runPairs) > 1 {
+		// The pairs of other tables' rules are only listed when they
+		// replaced something, as a column rule's may have.
+		tableConfig, _ := config.forTable(table)
+		first, last := tableConfig.pairOffset, tableConfig.pairOffset+len(tableConfig.Pairs)
+		for i, count := range result.Pairs {
+			if count == 0 && (i < first || i >= last) {
+				continue
+			}
+			tlog.Log(context.Background(), level, "pair replacements", "pair", i+1, "search", runPairs[i].Search, "replacements", count)
+		}
+	}
+}
+
+// logTimings lists the tables scanned in the summary, slowest first, with
+// their rows, bytes, throughput and the time they spent waiting on the
+// server and processing values, followed by their totals over the time
+// spent processing them. The total split is of the tables' time added up,
+// which exceeds the run's with Concurrency.
+func logTimings(tables []TableReport, processing time.Duration, config Config) {
+	var scanned []TableReport
+	for _, table := range tables {
+		if table.Status != "no_text_columns" {
+			scanned = append(scanned, table)
+		}
+	}
+	if len(scanned) == 0 {
+		return
+	}
+	sort.SliceStable(scanned, func(i, j int) bool {
+		return scanned[i].DurationSeconds > scanned[j].DurationSeconds
+	})
+	config.summaryf("Table timings, slowest first:")
+	var rows, updated int
+	var bytes int64
+	var elapsedSum, dbWait, processed time.Duration
+	for _, table := range scanned {
+		rows += table.RowsScanned
+		updated += table.RowsUpdated
+		bytes += table.BytesScanned
+		elapsed := seconds(table.DurationSeconds)
+		elapsedSum += elapsed
+		dbWait += seconds(table.DBWaitSeconds)
+		processed += seconds(table.ProcessingSeconds)
+		line := fmt.Sprintf("  %s: %s, %d rows scanned, %d updated, %s, %s, %s, %s; %s", table.Name, elapsed.Round(time.Millisecond),
+			table.RowsScanned, table.RowsUpdated, formatBytes(table.BytesScanned), rowsPerSecond(table.RowsScanned, elapsed),
+			bytesPerSecond(table.BytesScanned, elapsed), updatesPerSecond(table.RowsUpdated, elapsed),
+			timeSplit(seconds(table.DBWaitSeconds), seconds(table.ProcessingSeconds), elapsed))
+		if table.SleepSeconds > 0 {
+			line += fmt.Sprintf(" (plus %s asleep)", seconds(table.SleepSeconds).Round(time.Millisecond))
+		}
+		config.summaryf("%s", line)
+	}
+	config.summaryf("  total: %s, %d rows scanned, %d updated, %s, %s, %s, %s; %s", processing.Round(time.Millisecond),
+		rows, updated, formatBytes(bytes), rowsPerSecond(rows, processing), bytesPerSecond(bytes, processing),
+		updatesPerSecond(updated, processing), timeSplit(dbWait, processed, elapsedSum))
+}
+
+// seconds converts a duration of the report back to a time.Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,241 @@
+package mysqlreplace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// isSerialized reports whether value looks like PHP serialize() output. It is
+// a cheap check used to decide whether to attempt a full parse.
+func isSerialized(value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "N;" {
+		return true
+	}
+	if len(value) < 4 || value[1] != ':' {
+		return false
+	}
+	if !strings.ContainsRune("aOsbidE", rune(value[0])) {
+		return false
+	}
+	last := value[len(value)-1]
+	return last == ';' || last == '}'
+}
+
+// replaceSerialized applies fn to every string element of a PHP-serialized
+// value and re-serializes it with corrected length prefixes. String elements
+// that themselves contain serialized data are rewritten recursively.
+func replaceSerialized(value string, fn func(string) string) (string, error) {
+	p := &serializedParser{data: value, fn: fn}
+	if err := p.value(); err != nil {
+		return "", err
+	}
+	if p.pos != len(p.data) {
+		return "", fmt.Errorf("unexpected trailing data at offset %d", p.pos)
+	}
+	return p.out.String(), nil
+}
+
+type serializedParser struct {
+	data string
+	pos  int
+	fn   func(string) string
+	out  strings.Builder
+}
+
+func (p *serializedParser) value() error {
+	if p.pos >= len(p.data) {
+		return fmt.Errorf("unexpected end of data")
+	}
+	typ := p.data[p.pos]
+	switch typ {
+	case 'N':
+		return p.copyLiteral("N;")
+	case 'b', 'i', 'd', 'r', 'R':
+		return p.scalar(typ)
+	case 's':
+		return p.str()
+	case 'a':
+		if err := p.expect("a:"); err != nil {
+			return err
+		}
+		count, err := p.integer(':')
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&p.out, "a:%d:", count)
+		return p.members(count, false)
+	case 'O':
+		if err := p.expect("O:"); err != nil {
+			return err
+		}
+		class, err := p.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		count, err := p.integer(':')
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&p.out, "O:%d:\"%s\":%d:", len(class), class, count)
+		return p.members(count, true)
+	case 'E':
+		if err := p.expect("E:"); err != nil {
+			return err
+		}
+		name, err := p.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(";"); err != nil {
+			return err
+		}
+		fmt.Fprintf(&p.out, "E:%d:\"%s\";", len(name), name)
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %q at offset %d", typ, p.pos)
+	}
+}
+
+// members parses the {key;value;...} body of an array or object. Keys are
+// copied unchanged; only values are rewritten.
+func (p *serializedParser) members(count int, object bool) error {
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	p.out.WriteByte('{')
+	for i := 0; i < count; i++ {
+		if p.pos >= len(p.data) {
+			return fmt.Errorf("unexpected end of data")
+		}
+		switch p.data[p.pos] {
+		case 'i':
+			if err := p.scalar('i'); err != nil {
+				return err
+			}
+		case 's':
+			if err := p.expect("s:"); err != nil {
+				return err
+			}
+			key, err := p.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+			fmt.Fprintf(&p.out, "s:%d:\"%s\";", len(key), key)
+		default:
+			kind := "array"
+			if object {
+				kind = "object"
+			}
+			return fmt.Errorf("invalid %s key at offset %d", kind, p.pos)
+		}
+		if err := p.value(); err != nil {
+			return err
+		}
+	}
+	if err := p.expect("}"); err != nil {
+		return err
+	}
+	p.out.WriteByte('}')
+	return nil
+}
+
+func (p *serializedParser) str() error {
+	if err := p.expect("s:"); err != nil {
+		return err
+	}
+	content, err := p.lengthPrefixed()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+
+	// Serialized data stored inside a serialized string is rewritten
+	// structurally so the inner length prefixes stay correct too.
+	replaced, nested := "", false
+	if isSerialized(content) {
+		if out, err := replaceSerialized(content, p.fn); err == nil {
+			replaced, nested = out, true
+		}
+	}
+	if !nested {
+		replaced = p.fn(content)
+	}
+	fmt.Fprintf(&p.out, "s:%d:\"%s\";", len(replaced), replaced)
+	return nil
+}
+
+// scalar copies a b:, i:, d:, r: or R: value through unchanged.
+func (p *serializedParser) scalar(typ byte) error {
+	end := strings.IndexByte(p.data[p.pos:], ';')
+	if end < 0 {
+		return fmt.Errorf("unterminated %c value at offset %d", typ, p.pos)
+	}
+	token := p.data[p.pos : p.pos+end+1]
+	if len(token) < 3 || token[1] != ':' {
+		return fmt.Errorf("invalid %c value at offset %d", typ, p.pos)
+	}
+	p.out.WriteString(token)
+	p.pos += end + 1
+	return nil
+}
+
+// lengthPrefixed parses N:"..." where N is the byte length of the quoted
+// content, and returns the content.
+func (p *serializedParser) lengthPrefixed() (string, error) {
+	length, err := p.integer(':')
+	if err != nil {
+		return "", err
+	}
+	if err := p.expect("\""); err != nil {
+		return "", err
+	}
+	if length < 0 || p.pos+length > len(p.data) {
+		return "", fmt.Errorf("string length %d exceeds data at offset %d", length, p.pos)
+	}
+	content := p.data[p.pos : p.pos+length]
+	p.pos += length
+	if err := p.expect("\""); err != nil {
+		return "", fmt.Errorf("string length prefix does not match content: %v", err)
+	}
+	return content, nil
+}
+
+// integer parses a decimal integer terminated by sep, consuming the separator.
+func (p *serializedParser) integer(sep byte) (int, error) {
+	end := strings.IndexByte(p.data[p.pos:], sep)
+	if end < 0 {
+		return 0, fmt.Errorf("expected %q after offset %d", sep, p.pos)
+	}
+	n, err := strconv.Atoi(p.data[p.pos : p.pos+end])
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer at offset %d", p.pos)
+	}
+	p.pos += end + 1
+	return n, nil
+}
+
+func (p *serializedParser) expect(token string) error {
+	if !strings.HasPrefix(p.data[p.pos:], token) {
+		return fmt.Errorf("expected %q at offset %d", token, p.pos)
+	}
+	p.pos += len(token)
+	return nil
+}
+
+func (p *serializedParser) copyLiteral(token string) error {
+	if err := p.expect(token); err != nil {
+		return err
+	}
+	p.out.WriteString(token)
+	return nil
+}
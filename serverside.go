@@ -0,0 +1,193 @@
+package mysqlreplace
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// serverSideConflicts lists the settings ServerSide cannot be combined with,
+// because they need each value in Go or a record of each changed row.
+func (c Config) serverSideConflicts() []string {
+	var conflicts []string
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{
+		{"Regex", c.Regex},
+		{"IgnoreCase", c.IgnoreCase},
+		{"WholeWord", c.WholeWord},
+		{"URLEncoded", c.URLEncoded},
+		{"HTMLEntities", c.HTMLEntities},
+		{"Serialized", c.Serialized},
+		{"JSONKeys", c.JSONKeys},
+		{"DecodeBase64", c.DecodeBase64},
+		{"Decompress", c.Decompress},
+		{"IncludeEnum", c.IncludeEnum},
+		{"CountOnly", c.CountOnly},
+		{"SetNull", c.SetNull},
+		{"OutputSQL", c.OutputSQL != ""},
+		{"AuditCSV", c.AuditCSV != ""},
+		{"UndoFile", c.UndoFile != ""},
+		{"SnapshotDir", c.SnapshotDir != ""},
+		{"ChangedKeys", c.ChangedKeys || c.ChangedKeysFile != ""},
+		{"BackupChangedOnly", c.BackupChangedOnly},
+		{"LockRows", c.LockRows},
+		{"Limit", c.Limit > 0},
+		{"MaxValueSize", c.MaxValueSize > 0},
+		{"Samples", c.Samples > 0},
+		{"TopValues", c.TopValues > 0},
+		{"MaxUpdatesPerSecond", c.MaxUpdatesPerSecond > 0},
+		{"MaxTotalReplacements", c.MaxTotalReplacements > 0},
+		{"SleepBetweenChunks", c.SleepBetweenChunks > 0},
+	} {
+		if setting.set {
+			conflicts = append(conflicts, setting.name)
+		}
+	}
+	return conflicts
+}
+
+// serverSideColumn is the replacement of one column for replaceServerSide:
+// expr nests a REPLACE() per pair around the column, and match finds the
+// values containing a search string.
+type serverSideColumn struct {
+	column      textColumn
+	expr        string
+	replaceArgs []interface{}
+	match       string
+	matchArgs   []interface{}
+}
+
+// replaceServerSide replaces in each text column with a single UPDATE of
+// nested REPLACE() calls, for Config.ServerSide, counting the values the
+// server reports as changed. A dry run counts the values that would change
+// instead. JSON columns are left out: REPLACE() does not keep them valid.
+func (j *tableJob) replaceServerSide() error {
+	var columns []serverSideColumn
+	var skipped []string
+	for _, column := range j.columns {
+		if column.JSON {
+			skipped = append(skipped, column.Name)
+			continue
+		}
+		col := quoteIdent(column.Name)
+		c := serverSideColumn{column: column, expr: col}
+		var likes []string
+		for _, pair := range j.config.forColumn(column).Pairs {
+			c.expr = fmt.Sprintf("REPLACE(%s, ?, ?)", c.expr)
+			c.replaceArgs = append(c.replaceArgs, pair.Search, pair.Replace)
+			likes = append(likes, fmt.Sprintf("%s LIKE ?", col))
+			c.matchArgs = append(c.matchArgs, "%"+escapeLike(pair.Search)+"%")
+		}
+		c.match = "(" + strings.Join(likes, " OR ") + ")"
+		columns = append(columns, c)
+	}
+	if len(skipped) > 0 {
+		j.log.Info("skipping JSON columns, which -server-side cannot replace in", "columns", skipped)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	// Each column is updated on its own, so the rows changed are counted
+	// first, as the rows with a value REPLACE() changes in any column.
+	rows, err := j.countServerSideRows(columns)
+	if err != nil {
+		return err
+	}
+	j.result.RowsUpdated = int(rows)
+
+	for _, c := range columns {
+		if err := j.ctx.Err(); err != nil {
+			return err
+		}
+		col := quoteIdent(c.column.Name)
+		// LIKE follows the column's collation and may match more rows than
+		// the case-sensitive REPLACE() changes; those rows are not counted.
+		where := c.match
+		if j.where != "" {
+			where += " AND " + j.where
+		}
+
+		var changed int64
+		if j.config.DryRun {
+			query := fmt.Sprintf("SELECT %sCOUNT(*) FROM %s WHERE %s AND CAST(%s AS BINARY) <> CAST(%s AS BINARY)",
+				j.config.selectHint(), quoteTable(j.table), where, c.expr, col)
+			counting := time.Now()
+			err := j.db.QueryRowContext(j.ctx, query, append(c.matchArgs, c.replaceArgs...)...).Scan(&changed)
+			j.waited(counting)
+			if err != nil {
+				j.timedOut(err)
+				return fmt.Errorf("column %s: %w", c.column.Name, err)
+			}
+		} else {
+			if err := j.prepareServerSideWrite(); err != nil {
+				return err
+			}
+			sets := []string{fmt.Sprintf("%s = %s", col, c.expr)}
+			for _, preserved := range j.preserve {
+				sets = append(sets, fmt.Sprintf("%s = %s", quoteIdent(preserved), quoteIdent(preserved)))
+			}
+			query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteTable(j.table), strings.Join(sets, ", "), where)
+			args := append(append([]interface{}{}, c.replaceArgs...), c.matchArgs...)
+			res, err := j.execRetry(func() (sql.Result, error) {
+				ctx, cancel := j.statementContext(j.writeContext())
+				defer cancel()
+				return j.exec.ExecContext(ctx, query, args...)
+			})
+			if err != nil {
+				return fmt.Errorf("column %s: %w", c.column.Name, err)
+			}
+			if changed, err = res.RowsAffected(); err != nil {
+				return fmt.Errorf("column %s: %w", c.column.Name, err)
+			}
+		}
+		if changed > 0 {
+			j.log.Debug("replaced server-side", "column", c.column.Name, "values", changed)
+			j.result.Columns[c.column.Name] += int(changed)
+			j.result.Replacements += int(changed)
+		}
+	}
+	return nil
+}
+
+// countServerSideRows counts the rows in which REPLACE() changes the value
+// of at least one of columns.
+func (j *tableJob) countServerSideRows(columns []serverSideColumn) (int64, error) {
+	var changes []string
+	var args []interface{}
+	for _, c := range columns {
+		col := quoteIdent(c.column.Name)
+		changes = append(changes, fmt.Sprintf("(%s AND CAST(%s AS BINARY) <> CAST(%s AS BINARY))", c.match, c.expr, col))
+		args = append(append(args, c.matchArgs...), c.replaceArgs...)
+	}
+	where := "(" + strings.Join(changes, " OR ") + ")"
+	if j.where != "" {
+		where += " AND " + j.where
+	}
+	query := fmt.Sprintf("SELECT %sCOUNT(*) FROM %s WHERE %s", j.config.selectHint(), quoteTable(j.table), where)
+	var rows int64
+	counting := time.Now()
+	err := j.db.QueryRowContext(j.ctx, query, args...).Scan(&rows)
+	j.waited(counting)
+	if err != nil {
+		j.timedOut(err)
+		return 0, fmt.Errorf("counting the rows to change: %w", err)
+	}
+	return rows, nil
+}
+
+// prepareServerSideWrite runs prepareWrite before the first UPDATE, so the
+// backup and the per-table transaction are made as for a client-side scan.
+func (j *tableJob) prepareServerSideWrite() error {
+	if j.prepared {
+		return nil
+	}
+	columnsList, _, err := queryRows(j.ctx, j.db, fmt.Sprintf("SELECT * FROM %s LIMIT 0", quoteTable(j.table)))
+	if err != nil {
+		return err
+	}
+	return j.prepareWrite(columnsList)
+}
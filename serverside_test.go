@@ -0,0 +1,22 @@
+package mysqlreplace
+
+import "testing"
+
+// TestServerSideCountsRows checks that a row changed in two columns is
+// counted once as a row updated and twice as values changed.
+func TestServerSideCountsRows(t *testing.T) {
+	db := testDB(t)
+	for _, dryRun := range []bool{true, false} {
+		createTestTable(t, db, "test_serverside_rows", "id INT PRIMARY KEY, title VARCHAR(50), body TEXT",
+			"(1, 'old title', 'old body'), (2, 'kept', 'old body'), (3, 'kept', 'kept')")
+		result := processTestTable(t, db, "test_serverside_rows", Config{
+			Pairs: []Pair{{Search: "old", Replace: "new"}}, ServerSide: true, DryRun: dryRun,
+		})
+		if result.RowsUpdated != 2 || result.Replacements != 3 {
+			t.Errorf("dry run %v: %d rows updated and %d values changed, want 2 and 3", dryRun, result.RowsUpdated, result.Replacements)
+		}
+	}
+	if got := columnValues(t, db, "test_serverside_rows", "body", "id"); got[0].String != "new body" || got[1].String != "new body" {
+		t.Errorf("got bodies %v", got)
+	}
+}
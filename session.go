@@ -0,0 +1,167 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// writer is where a table's UPDATEs go: the pool itself, or a dedicated
+// connection carrying session settings.
+type writer interface {
+	execer
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sessionSettings returns the SET statements that must run on every
+// connection used for updates, and the statements that undo them.
+func sessionSettings(config Config) (apply, restore []string) {
+	if config.SkipBinlog {
+		apply = append(apply, "SET SESSION sql_log_bin = 0")
+		restore = append(restore, "SET SESSION sql_log_bin = 1")
+	}
+	if config.DisableFKChecks {
+		apply = append(apply, "SET SESSION foreign_key_checks = 0")
+		restore = append(restore, "SET SESSION foreign_key_checks = 1")
+	}
+	return apply, restore
+}
+
+// sessionConn is a dedicated connection carrying the session settings,
+// which reopen replaces after the connection is lost.
+type sessionConn struct {
+	*sql.Conn
+	db    *sql.DB
+	apply []string
+}
+
+// openWriteConn returns a dedicated connection with the session settings
+// applied, or nil when no settings are needed and the pool can be used.
+func openWriteConn(ctx context.Context, db *sql.DB, config Config) (*sessionConn, error) {
+	apply, _ := sessionSettings(config)
+	if len(apply) == 0 || !config.WritesDatabase() {
+		return nil, nil
+	}
+	conn := &sessionConn{db: db, apply: apply}
+	if err := conn.open(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *sessionConn) open(ctx context.Context) error {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range c.apply {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			conn.Close()
+			return explainSessionError(stmt, err)
+		}
+	}
+	c.Conn = conn
+	return nil
+}
+
+// reopen discards the lost connection and opens another, applying the
+// session settings again. Until it succeeds, the old connection stays in
+// place and fails every statement.
+func (c *sessionConn) reopen(ctx context.Context) error {
+	c.Conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	c.Conn.Close()
+	return c.open(ctx)
+}
+
+// releaseWriteConn undoes the session settings before returning the
+// connection to the pool, where it may be reused for reads.
+func releaseWriteConn(conn *sessionConn, config Config) {
+	if conn == nil {
+		return
+	}
+	_, restore := sessionSettings(config)
+	for _, stmt := range restore {
+		if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+			// Discard the connection rather than pool it with the
+			// setting still in effect.
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			break
+		}
+	}
+	conn.Close()
+}
+
+// checkSessionSettings applies and undoes the session settings once before
+// any table is processed, so missing privileges fail the run up front.
+func checkSessionSettings(ctx context.Context, db *sql.DB, config Config) error {
+	conn, err := openWriteConn(ctx, db, config)
+	if err != nil {
+		return err
+	}
+	releaseWriteConn(conn, config)
+	return nil
+}
+
+func explainSessionError(stmt string, err error) error {
+	if strings.Contains(stmt, "sql_log_bin") {
+		return fmt.Errorf("%s failed: %v (this needs the SUPER, SYSTEM_VARIABLES_ADMIN or SESSION_VARIABLES_ADMIN privilege)", stmt, err)
+	}
+	return fmt.Errorf("%s failed: %v", stmt, err)
+}
+
+// foreignKeyColumn is one text column taking part in a foreign key.
+type foreignKeyColumn struct {
+	Table, Column, RefTable, RefColumn, Constraint string
+}
+
+// getTextForeignKeys returns the foreign keys of the current database whose
+// referencing column is a text column, for the -disable-fk-checks report.
+func getTextForeignKeys(ctx context.Context, db *sql.DB) ([]foreignKeyColumn, error) {
+	rows, err := db.QueryContext(ctx, `SELECT k.TABLE_NAME, k.COLUMN_NAME, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME, k.CONSTRAINT_NAME
+		FROM information_schema.KEY_COLUMN_USAGE k
+		JOIN information_schema.COLUMNS c
+			ON c.TABLE_SCHEMA = k.TABLE_SCHEMA AND c.TABLE_NAME = k.TABLE_NAME AND c.COLUMN_NAME = k.COLUMN_NAME
+		WHERE k.TABLE_SCHEMA = DATABASE() AND k.REFERENCED_TABLE_NAME IS NOT NULL
+			AND (c.DATA_TYPE LIKE '%char' OR c.DATA_TYPE LIKE '%text')
+		ORDER BY k.TABLE_NAME, k.CONSTRAINT_NAME, k.ORDINAL_POSITION`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []foreignKeyColumn
+	for rows.Next() {
+		var fk foreignKeyColumn
+		if err := rows.Scan(&fk.Table, &fk.Column, &fk.RefTable, &fk.RefColumn, &fk.Constraint); err != nil {
+			return nil, err
+		}
+		keys = append(keys, fk)
+	}
+	return keys, rows.Err()
+}
+
+// reportForeignKeys logs the text foreign keys touching the selected tables.
+func reportForeignKeys(ctx context.Context, db *sql.DB, tables []string, config Config) {
+	keys, err := getTextForeignKeys(ctx, db)
+	if err != nil {
+		config.log().Warn("could not list foreign keys", "err", err)
+		return
+	}
+	var relevant []foreignKeyColumn
+	for _, fk := range keys {
+		if indexOf(tables, fk.Table) >= 0 || indexOf(tables, fk.RefTable) >= 0 {
+			relevant = append(relevant, fk)
+		}
+	}
+	if len(relevant) == 0 {
+		config.log().Info("foreign key checks disabled; no text columns in the selected tables take part in foreign keys")
+		return
+	}
+	config.log().Warn("foreign key checks disabled; these text columns take part in foreign keys and will not be checked")
+	for _, fk := range relevant {
+		config.log().Warn("unchecked foreign key", "column", fk.Table+"."+fk.Column, "references", fk.RefTable+"."+fk.RefColumn, "constraint", fk.Constraint)
+	}
+}
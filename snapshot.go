@@ -0,0 +1,172 @@
+package mysqlreplace
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// snapshotWriter writes every row about to be changed, with all its columns
+// as read, to a file per table in SnapshotDir. Rows are flushed as they are
+// written, before their update, so an interrupted run still leaves the
+// original values of every row it may have changed.
+type snapshotWriter struct {
+	mu     sync.Mutex
+	dir    string
+	format string
+	files  map[string]*snapshotFile
+	err    error
+	rows   int
+	tables int
+}
+
+type snapshotFile struct {
+	file *os.File
+	w    *bufio.Writer
+	csv  *csv.Writer
+	rows int
+}
+
+// snapshotLine is one row of a JSON-lines snapshot. Key holds the primary
+// key columns, and is null for tables without one. Binary lists the columns
+// whose values are not valid UTF-8, which are written base64-encoded.
+type snapshotLine struct {
+	Key    map[string]interface{} `json:"key"`
+	Row    map[string]interface{} `json:"row"`
+	Binary []string               `json:"binary,omitempty"`
+}
+
+// createSnapshotWriter creates dir, which must be empty if it exists so
+// that an earlier run's snapshot is never mixed with or overwritten by this
+// one.
+func createSnapshotWriter(dir, format string) (*snapshotWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty; give a new directory so earlier snapshots are kept", dir)
+	}
+	if format == "" {
+		format = "jsonl"
+	}
+	return &snapshotWriter{dir: dir, format: format, files: make(map[string]*snapshotFile)}, nil
+}
+
+// snapshotFileName returns the file of table's snapshot, with path
+// separators in the name replaced.
+func snapshotFileName(table, format string) string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(table) + "." + format
+}
+
+// writeRow records the original values of one row of table, creating the
+// table's file with the first row. After an error every row fails, so that
+// no row is changed without its snapshot.
+func (sw *snapshotWriter) writeRow(table string, columnsList []string, values []interface{}, primaryKey []string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err != nil {
+		return sw.err
+	}
+	f, ok := sw.files[table]
+	if !ok {
+		file, err := os.OpenFile(filepath.Join(sw.dir, snapshotFileName(table, sw.format)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			sw.err = err
+			return err
+		}
+		f = &snapshotFile{file: file, w: bufio.NewWriter(file)}
+		if sw.format == "csv" {
+			f.csv = csv.NewWriter(f.w)
+			f.csv.Write(columnsList)
+		}
+		sw.files[table] = f
+		sw.tables++
+	}
+
+	if f.csv != nil {
+		record := make([]string, len(values))
+		for i, value := range values {
+			if value == nil {
+				record[i] = `\N`
+			} else {
+				record[i] = convertToString(value)
+			}
+		}
+		f.csv.Write(record)
+		f.csv.Flush()
+		if err := f.csv.Error(); err != nil {
+			sw.err = err
+			return err
+		}
+	} else {
+		line := snapshotLine{Row: make(map[string]interface{}, len(values))}
+		if len(primaryKey) > 0 {
+			line.Key = make(map[string]interface{}, len(primaryKey))
+		}
+		for i, col := range columnsList {
+			var value interface{}
+			if values[i] != nil {
+				s := convertToString(values[i])
+				if !utf8.ValidString(s) {
+					s = base64.StdEncoding.EncodeToString([]byte(s))
+					line.Binary = append(line.Binary, col)
+				}
+				value = s
+			}
+			line.Row[col] = value
+			if indexOf(primaryKey, col) >= 0 {
+				line.Key[col] = value
+			}
+		}
+		enc := json.NewEncoder(f.w)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(line); err != nil {
+			sw.err = err
+			return err
+		}
+	}
+	if err := f.w.Flush(); err != nil {
+		sw.err = err
+		return err
+	}
+	f.rows++
+	sw.rows++
+	return nil
+}
+
+// discardTable removes the snapshot of a table that is processed again
+// from the start, after its transaction was lost.
+func (sw *snapshotWriter) discardTable(table string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	f, ok := sw.files[table]
+	if !ok {
+		return
+	}
+	f.file.Close()
+	os.Remove(f.file.Name())
+	delete(sw.files, table)
+	sw.rows -= f.rows
+	sw.tables--
+}
+
+func (sw *snapshotWriter) Close() error {
+	err := sw.err
+	for _, f := range sw.files {
+		if closeErr := f.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
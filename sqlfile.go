@@ -0,0 +1,196 @@
+package mysqlreplace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sqlWriter writes UPDATE statements to a file that can be replayed with the
+// mysql client instead of executing them against the database.
+type sqlWriter struct {
+	// mu is held by the table currently writing its transaction block, so
+	// blocks from concurrently processed tables never interleave.
+	mu         sync.Mutex
+	file       *os.File
+	w          *bufio.Writer
+	err        error
+	statements int
+}
+
+func createSQLWriter(path string, config Config) (*sqlWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	sw := &sqlWriter{file: file, w: bufio.NewWriter(file)}
+
+	fmt.Fprintf(sw.w, "-- Generated by mysqlreplace\n")
+	fmt.Fprintf(sw.w, "-- Started: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(sw.w, "-- Host: %s:%d\n", config.Host, config.Port)
+	fmt.Fprintf(sw.w, "-- Database: %s\n", config.Database)
+	for _, pair := range config.Pairs {
+		fmt.Fprintf(sw.w, "-- Search: %q Replace: %q\n", pair.Search, pair.Replace)
+	}
+	if config.Regex {
+		fmt.Fprintf(sw.w, "-- Regex: true\n")
+	}
+	if config.IgnoreCase {
+		fmt.Fprintf(sw.w, "-- Ignore case: true\n")
+	}
+	if len(config.Tables) > 0 {
+		fmt.Fprintf(sw.w, "-- Tables: %s\n", strings.Join(config.Tables, ","))
+	}
+	if len(config.ExcludeTables) > 0 {
+		fmt.Fprintf(sw.w, "-- Exclude tables: %s\n", strings.Join(config.ExcludeTables, ","))
+	}
+	fmt.Fprintf(sw.w, "\nSET NAMES utf8mb4;\nUSE %s;\n", quoteIdent(config.Database))
+	apply, _ := sessionSettings(config)
+	for _, stmt := range apply {
+		fmt.Fprintf(sw.w, "%s;\n", stmt)
+	}
+
+	return sw, sw.w.Flush()
+}
+
+// beginTable opens a START TRANSACTION block for table. It blocks while
+// another table's block is open; every beginTable must be paired with
+// endTable.
+func (sw *sqlWriter) beginTable(table string) {
+	sw.mu.Lock()
+	fmt.Fprintf(sw.w, "\n-- Table %s\nSTART TRANSACTION;\n", table)
+}
+
+// writeUpdate writes one statement into the open table block.
+func (sw *sqlWriter) writeUpdate(query string, args []interface{}) error {
+	stmt, err := interpolateQuery(query, args)
+	if err != nil {
+		return err
+	}
+	sw.statements++
+	_, err = fmt.Fprintf(sw.w, "%s;\n", stmt)
+	return err
+}
+
+// endTable closes the open table block, with ROLLBACK instead of COMMIT when
+// the table did not complete. Write errors are reported by Close.
+func (sw *sqlWriter) endTable(commit bool) {
+	defer sw.mu.Unlock()
+	if commit {
+		fmt.Fprintf(sw.w, "COMMIT;\n")
+	} else {
+		fmt.Fprintf(sw.w, "ROLLBACK;\n")
+	}
+	if err := sw.w.Flush(); err != nil && sw.err == nil {
+		sw.err = err
+	}
+}
+
+func (sw *sqlWriter) Close() error {
+	if sw.err != nil {
+		sw.file.Close()
+		return sw.err
+	}
+	fmt.Fprintf(sw.w, "\n-- Completed: %s (%d statements)\n", time.Now().Format(time.RFC3339), sw.statements)
+	if err := sw.w.Flush(); err != nil {
+		sw.file.Close()
+		return err
+	}
+	return sw.file.Close()
+}
+
+// interpolateQuery substitutes literal values for the ? placeholders in
+// query. Placeholders inside backtick-quoted identifiers are left alone.
+func interpolateQuery(query string, args []interface{}) (string, error) {
+	var b strings.Builder
+	argIdx := 0
+	inIdent := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '`':
+			inIdent = !inIdent
+			b.WriteByte(c)
+		case c == '?' && !inIdent:
+			if argIdx >= len(args) {
+				return "", fmt.Errorf("not enough arguments for query")
+			}
+			b.WriteString(sqlLiteral(args[argIdx]))
+			argIdx++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if argIdx != len(args) {
+		return "", fmt.Errorf("too many arguments for query")
+	}
+	return b.String(), nil
+}
+
+// sqlLiteral renders a value as a MySQL literal. Strings that are not valid
+// UTF-8 are written as hex literals so they replay byte for byte.
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return stringLiteral(string(v))
+	case string:
+		return stringLiteral(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Time:
+		return stringLiteral(v.Format("2006-01-02 15:04:05.999999"))
+	default:
+		return stringLiteral(fmt.Sprintf("%v", v))
+	}
+}
+
+func stringLiteral(s string) string {
+	if !utf8.ValidString(s) {
+		return "X'" + hex.EncodeToString([]byte(s)) + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\x1a':
+			b.WriteString(`\Z`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
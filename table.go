@@ -0,0 +1,1505 @@
+package mysqlreplace
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// processTable scans table through db and sends its updates to w.
+func processTable(ctx context.Context, db *sql.DB, w writer, table string, config Config) (result TableResult, err error) {
+	tlog := config.tableLogger(table)
+	// Work done only for debug logging is skipped at other levels.
+	verbose := tlog.Enabled(ctx, slog.LevelDebug)
+	config, rule := config.forTable(table)
+	if rule != nil {
+		tlog.Debug("following rule", "rule", rule.Name)
+		result.Rule = rule.Name
+	}
+	runPairs, _ := config.runPairs()
+	result.Columns = make(map[string]int)
+	result.Pairs = make([]int, len(runPairs))
+	if config.CountOnly {
+		result.Occurrences = make(map[string]int)
+	}
+	start := time.Now()
+	defer func() {
+		result.Elapsed = time.Since(start) - result.prompted - result.Slept
+	}()
+
+	schema, err := getColumns(ctx, db, table, config)
+	if err != nil {
+		return result, err
+	}
+	selection := selectColumns(table, schema, config)
+	if len(selection.Generated) > 0 {
+		tlog.Info("skipping generated columns; they derive from other columns and are updated by the server", "columns", selection.Generated)
+	}
+	if verbose {
+		tlog.Debug("found text columns", "columns", describeColumns(schema.Text, selection.Found))
+	}
+	if len(selection.Enum) > 0 {
+		tlog.Info("skipping ENUM/SET columns (use -include-enum to replace values that stay valid members)", "columns", selection.Enum)
+	}
+	columns := selection.Columns
+	if len(config.Columns) > 0 || len(config.ExcludeColumns) > 0 {
+		tlog.Debug("column selection", "selected", columnNames(columns), "filtered", selection.Filtered)
+	}
+	for _, column := range columns {
+		rules := config.matchingColumnRules(column.Name)
+		if len(rules) == 0 {
+			continue
+		}
+		if len(rules) > 1 {
+			tlog.Warn("column matches several rules; only the first applies", "column", column.Name, "rules", rules)
+		}
+		if result.ColumnRules == nil {
+			result.ColumnRules = make(map[string]string)
+		}
+		result.ColumnRules[column.Name] = rules[0].Name
+		tlog.Debug("column follows rule", "column", column.Name, "rule", rules[0].Name)
+	}
+
+	if len(selection.Excluded) > 0 {
+		tlog.Debug("skipping excluded columns; values in them that contain a search string are counted", "columns", columnNames(selection.Excluded))
+	}
+	if len(selection.NotNull) > 0 {
+		tlog.Warn("skipping NOT NULL columns, which -set-null cannot set to NULL", "columns", selection.NotNull)
+		result.NotNullColumns = selection.NotNull
+	}
+
+	if len(columns) == 0 {
+		if len(selection.Excluded) > 0 {
+			tlog.Info("every text column is excluded; the table is not scanned and matches in it are not counted")
+		}
+		result.NoTextColumns = true
+		return result, nil
+	}
+
+	where := config.tableWhere(table)
+	if where != "" {
+		if err := checkWhere(ctx, db, table, where); err != nil {
+			if mysqlErrorNumber(err) != errBadField || config.StrictWhere {
+				return result, fmt.Errorf("-where %s: %w", where, err)
+			}
+			tlog.Warn("skipping table, it lacks a column -where refers to (use -strict-where to fail instead)", "where", where, "err", err)
+			result.WhereSkipped = true
+			return result, nil
+		}
+		tlog.Debug("scanning only the rows matching -where", "where", where)
+	}
+
+	key, err := getRowKey(ctx, db, table)
+	if err != nil {
+		return result, err
+	}
+	// A unique index on NOT NULL columns serves every use of the primary
+	// key below: matching, keyset chunks, batches and the audit row key.
+	primaryKey := key.Columns
+	switch key.Index {
+	case "":
+		tlog.Warn("table has no primary key or unique index on NOT NULL columns, matching rows on all column values")
+	case "PRIMARY":
+		tlog.Debug("using primary key", "columns", primaryKey)
+	default:
+		tlog.Info("table has no primary key, identifying rows by unique index", "index", key.Index, "columns", primaryKey)
+	}
+
+	var filter string
+	var filterArgs []interface{}
+	if config.Prefilter && !config.ServerSide {
+		// Rows matching only in excluded columns are read too, to count them.
+		filter, filterArgs = buildPrefilter(append(append([]textColumn(nil), columns...), selection.Excluded...), config)
+		if filter == "" {
+			tlog.Debug("prefilter not usable for these columns, scanning all rows")
+		}
+	}
+	if where != "" {
+		if filter != "" {
+			filter = where + " AND " + filter
+		} else {
+			filter = where
+		}
+	}
+
+	var preserve []string
+	if len(schema.OnUpdate) > 0 {
+		if config.PreserveTimestamps {
+			preserve = schema.OnUpdate
+			tlog.Debug("preserving ON UPDATE timestamp columns", "columns", preserve)
+		} else {
+			tlog.Debug("updates will bump ON UPDATE timestamp columns (use -preserve-timestamps to keep them)", "columns", schema.OnUpdate)
+		}
+	}
+
+	lockRows := false
+	if config.LockRows {
+		if len(primaryKey) == 0 {
+			tlog.Warn("-lock-rows needs a primary key to lock the table chunk by chunk; scanning without row locks")
+		} else {
+			// Each chunk commits on its own instead.
+			lockRows = true
+			config.TxPerTable = false
+		}
+	}
+
+	job := &tableJob{
+		ctx:        ctx,
+		db:         db,
+		w:          w,
+		exec:       w,
+		table:      table,
+		config:     config,
+		log:        tlog,
+		verbose:    verbose,
+		columns:    columns,
+		excluded:   selection.Excluded,
+		primaryKey: primaryKey,
+		exact:      collatedColumns(schema.Text),
+		temporal:   schema.Temporal,
+		generated:  schema.Generated,
+		preserve:   preserve,
+		onUpdate:   schema.OnUpdate,
+		filter:     filter,
+		filterArgs: filterArgs,
+		where:      where,
+		result:     &result,
+		prog:       newProgress(table, config),
+		lockRows:   lockRows,
+		guard:      config.readDB != nil,
+	}
+	if config.TopValues > 0 {
+		job.values = newValueCounter()
+		defer func() {
+			result.TopValues, result.OtherValues = job.values.top(config.TopValues)
+		}()
+	}
+	defer job.prog.finish()
+	defer job.closeStatements()
+	defer func() {
+		if job.sqlBlock {
+			config.sqlOut.endTable(err == nil)
+		}
+	}()
+
+	defer func() {
+		if config.undo != nil {
+			config.undo.endTable(table, !config.TxPerTable || result.Committed)
+		}
+	}()
+	if config.ChangedKeys || config.keys != nil {
+		job.keys = newTableKeys(config.keys, config.ChangedKeys, table, primaryKey, &result)
+		defer func() {
+			job.keys.end(!config.TxPerTable || !config.WritesDatabase() || result.Committed)
+		}()
+	}
+
+	// The per-table transaction is opened by prepareWrite before the first
+	// update, after any backup table has been created.
+	defer func() {
+		tx := job.tx
+		if tx == nil {
+			return
+		}
+		if err != nil {
+			// database/sql has already rolled back a transaction
+			// whose context was canceled.
+			if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				err = fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+				return
+			}
+			err = fmt.Errorf("%w (rolled back, table left untouched)", err)
+			if job.audited {
+				config.audit.writeRollback(table)
+			}
+			return
+		}
+		committing := time.Now()
+		err = tx.Commit()
+		job.waited(committing)
+		if err != nil {
+			err = fmt.Errorf("commit failed: %v", err)
+			return
+		}
+		result.Committed = true
+	}()
+
+	if lockRows && config.BackupSuffix != "" {
+		// Creating the backup table would commit a chunk's transaction and
+		// release its locks, so it is made before the first chunk.
+		columnsList, _, err := queryRows(ctx, db, fmt.Sprintf("SELECT %s* FROM %s LIMIT 0", config.selectHint(), quoteTable(table)))
+		if err != nil {
+			return result, err
+		}
+		if err := job.prepareWrite(columnsList); err != nil {
+			return result, err
+		}
+	}
+
+	if config.BatchSize > 1 && config.WritesDatabase() && len(primaryKey) > 0 && !config.ServerSide {
+		job.batch = newUpdateBatch(job)
+	}
+
+	if config.ServerSide {
+		err = job.replaceServerSide()
+	} else if len(primaryKey) > 0 && config.ChunkSize > 0 {
+		tlog.Debug("scanning in chunks by primary key", "chunk_size", config.ChunkSize)
+		job.chunked = true
+		err = job.scanChunks()
+	} else if len(primaryKey) == 0 && !config.CountOnly {
+		if err = job.findDuplicates(); err == nil {
+			err = job.scanAll()
+		}
+	} else {
+		err = job.scanAll()
+	}
+	// Rows still queued are written even when the scan stopped early, as
+	// they would have been without batching.
+	if flushErr := job.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if verbose {
+		tlog.Debug("processed rows", "rows", result.RowsScanned)
+		if filter != "" {
+			var total int
+			if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteTable(table))).Scan(&total); err == nil {
+				tlog.Debug("prefilter excluded rows", "excluded", total-result.RowsScanned, "total", total)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// columnSelection is the outcome of choosing which of a table's text
+// columns to scan, with the names of the columns left out and why.
+type columnSelection struct {
+	Columns   []textColumn
+	Found     []string
+	Generated []string
+	Enum      []string
+	Filtered  []string
+	// Excluded are the columns left out by -exclude-columns, still checked
+	// for matches so the summary can report them.
+	Excluded []textColumn
+	// NotNull are the columns SetNull cannot set to NULL.
+	NotNull []string
+}
+
+// selectColumns picks the text columns of a table to scan: generated
+// columns are never written, ENUM/SET columns only with -include-enum,
+// NOT NULL columns not with -set-null, and -columns and -exclude-columns
+// narrow the rest.
+func selectColumns(table string, schema tableColumns, config Config) columnSelection {
+	var sel columnSelection
+	var replaceable []textColumn
+	for _, col := range schema.Text {
+		if col.Generated {
+			sel.Generated = append(sel.Generated, col.Name)
+		} else {
+			replaceable = append(replaceable, col)
+		}
+	}
+	sel.Found = columnNames(replaceable)
+
+	for _, col := range replaceable {
+		switch {
+		case col.Members != nil && !config.IncludeEnum:
+			sel.Enum = append(sel.Enum, col.Name)
+		case len(config.Columns) > 0 && !columnSelected(config.Columns, table, col.Name):
+			sel.Filtered = append(sel.Filtered, col.Name)
+		case columnExcluded(config.ExcludeColumns, table, col.Name):
+			sel.Filtered = append(sel.Filtered, col.Name)
+			sel.Excluded = append(sel.Excluded, col)
+		case config.SetNull && !col.Nullable:
+			sel.NotNull = append(sel.NotNull, col.Name)
+		default:
+			sel.Columns = append(sel.Columns, col)
+		}
+	}
+	return sel
+}
+
+// tableJob holds the state of a single table while it is being processed.
+type tableJob struct {
+	ctx        context.Context
+	db         *sql.DB
+	w          writer
+	exec       execer
+	tx         *sql.Tx
+	table      string
+	config     Config
+	log        *slog.Logger
+	verbose    bool
+	columns    []textColumn
+	excluded   []textColumn
+	primaryKey []string
+	// exact are the columns holding characters, compared byte for byte
+	// when rows are matched on all of their values.
+	exact []string
+	// temporal are the date and time columns, compared as text.
+	temporal  []string
+	generated []string
+	result    *TableResult
+	values    *valueCounter
+	keys      *tableKeys
+	prog      *progress
+	sqlBlock  bool
+	audited   bool
+	prepared  bool
+	batch     *updateBatch
+	stmts     map[string]*sql.Stmt
+
+	// lockRows reads each chunk with SELECT ... FOR UPDATE in a
+	// transaction of its own; chunkAudit holds the chunk's audit records
+	// until it commits.
+	lockRows   bool
+	chunkAudit []batchRow
+
+	// guard is set when rows are read from a replica: each update also
+	// requires the changed columns to still hold the values read.
+	guard bool
+
+	// chunked is set when the table is scanned with scanChunks.
+	chunked bool
+
+	// approveAll is set once the user approved the rest of the table.
+	approveAll bool
+
+	// duplicates holds the fingerprints of rows with an identical copy, in
+	// tables identified by full row.
+	duplicates map[[sha256.Size]byte]bool
+
+	// preserve lists ON UPDATE CURRENT_TIMESTAMP columns to set to their
+	// own value so updates do not bump them; onUpdate lists all of them.
+	preserve []string
+	onUpdate []string
+
+	// filter is an optional WHERE condition restricting the scan to
+	// candidate rows, with its arguments in filterArgs. It includes where,
+	// the condition from Config.Where and TableWhere.
+	filter     string
+	filterArgs []interface{}
+	where      string
+
+	// deferWrites is set while scanAll queues changed rows in pending, of
+	// pendingSize bytes, to write once its result set is closed.
+	deferWrites bool
+	pending     []*pendingRow
+	pendingSize int64
+}
+
+// scanAll processes the table with a single full-table SELECT. When the
+// rows are read from the server they are written to, the changed rows are
+// written after the result set is closed, so the scan neither holds it open
+// across updates nor reads its own writes; only more than PendingLimit
+// bytes of them are written while it is open.
+func (j *tableJob) scanAll() error {
+	j.deferWrites = j.config.WritesDatabase() && !j.guard
+	defer j.dropPending()
+
+	query := fmt.Sprintf("SELECT %s* FROM %s", j.config.selectHint(), quoteTable(j.table))
+	if j.filter != "" {
+		query += " WHERE " + j.filter
+	}
+	if j.config.Limit > 0 {
+		// One extra row tells us whether the limit truncated the table.
+		query += fmt.Sprintf(" LIMIT %d", j.config.Limit+1)
+	}
+	reading := time.Now()
+	rows, err := j.db.QueryContext(j.ctx, query, j.filterArgs...)
+	j.waited(reading)
+	if err != nil {
+		j.timedOut(err)
+		return err
+	}
+	defer rows.Close()
+
+	columnsList, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for {
+		// Reading the next row waits on the server for its data.
+		reading := time.Now()
+		more := rows.Next()
+		j.waited(reading)
+		if !more || j.limitReached() {
+			break
+		}
+		values, err := scanRow(rows, len(columnsList))
+		if err != nil {
+			return err
+		}
+		if err := j.processRow(columnsList, values); err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	j.timedOut(err)
+	if err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if len(j.pending) > 0 {
+		j.log.Debug("scan done, writing changed rows", "rows", len(j.pending))
+	}
+	return j.writePending()
+}
+
+// scanChunks processes the table in primary key order, ChunkSize rows at a
+// time, using keyset pagination. Each chunk is read completely before its
+// rows are updated, so no result set stays open across updates.
+func (j *tableJob) scanChunks() error {
+	keyColumns := make([]string, len(j.primaryKey))
+	placeholders := make([]string, len(j.primaryKey))
+	for i, key := range j.primaryKey {
+		keyColumns[i] = quoteIdent(key)
+		placeholders[i] = "?"
+	}
+	orderBy := strings.Join(keyColumns, ", ")
+	after := fmt.Sprintf("(%s) > (%s)", orderBy, strings.Join(placeholders, ", "))
+
+	var cursor []interface{}
+	if j.config.checkpoint != nil {
+		var err error
+		if cursor, err = j.config.checkpoint.position(j.table, j.primaryKey); err != nil {
+			return err
+		}
+		if cursor != nil {
+			values := make([]string, len(cursor))
+			for i, value := range cursor {
+				values[i] = convertToString(value)
+			}
+			j.log.Info("resuming after the checkpointed position", "key", j.primaryKey, "values", values)
+		}
+	}
+	// A position is only recorded once the chunk's changes are committed:
+	// with a per-table transaction the table restarts from the beginning.
+	checkpointed := j.config.checkpoint != nil && (j.lockRows || !j.config.TxPerTable)
+	for {
+		var conditions []string
+		var args []interface{}
+		if cursor != nil {
+			conditions = append(conditions, after)
+			args = append(args, cursor...)
+		}
+		if j.filter != "" {
+			conditions = append(conditions, j.filter)
+			args = append(args, j.filterArgs...)
+		}
+		query := fmt.Sprintf("SELECT %s* FROM %s", j.config.selectHint(), quoteTable(j.table))
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY %s LIMIT %d", orderBy, j.config.ChunkSize)
+
+		var columnsList []string
+		var chunk [][]interface{}
+		read := func(q querier) error {
+			defer j.waited(time.Now())
+			var err error
+			columnsList, chunk, err = queryRows(j.ctx, q, query, args...)
+			j.timedOut(err)
+			return err
+		}
+		limited := false
+		updated := j.result.RowsUpdated
+		process := func() error {
+			for _, values := range chunk {
+				if j.limitReached() {
+					limited = true
+					return nil
+				}
+				if err := j.processRow(columnsList, values); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		var err error
+		if j.lockRows {
+			query += " FOR UPDATE"
+			err = j.lockedChunk(func(q querier) error {
+				if err := read(q); err != nil {
+					return err
+				}
+				return process()
+			})
+		} else if err = j.readRetry(func() error { return read(j.db) }); err == nil {
+			err = process()
+		}
+		if err != nil || limited {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+		last := chunk[len(chunk)-1]
+		cursor = make([]interface{}, len(j.primaryKey))
+		for i, key := range j.primaryKey {
+			idx := indexOf(columnsList, key)
+			if idx < 0 {
+				return fmt.Errorf("primary key column %s not found in result set", key)
+			}
+			cursor[i] = last[idx]
+		}
+		if checkpointed {
+			if err := j.flush(); err != nil {
+				return err
+			}
+			if err := j.config.checkpoint.advance(j.table, j.primaryKey, cursor); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < j.config.ChunkSize {
+			return nil
+		}
+		if j.config.SleepBetweenChunks > 0 && j.result.RowsUpdated > updated {
+			if err := j.pause(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// limitReached reports whether -limit rows have been scanned, or the user
+// quit at the approval prompt. It is called when another row is available,
+// so reaching the limit marks the table as truncated.
+func (j *tableJob) limitReached() bool {
+	if j.result.Quit {
+		return true
+	}
+	if j.config.Limit <= 0 || j.result.RowsScanned < j.config.Limit {
+		return false
+	}
+	if !j.result.Limited {
+		j.result.Limited = true
+		j.log.Info("stopped at -limit", "rows", j.result.RowsScanned)
+	}
+	return true
+}
+
+// writeContext returns the context for UPDATE statements. Outside a
+// transaction an interrupted run lets the in-flight statement finish rather
+// than abandoning it half way; inside one, cancellation rolls back the table.
+func (j *tableJob) writeContext() context.Context {
+	if _, ok := j.exec.(*sql.Tx); ok {
+		return j.ctx
+	}
+	return context.WithoutCancel(j.ctx)
+}
+
+// processRow applies the replacements to one row and writes any changes.
+func (j *tableJob) processRow(columnsList []string, values []interface{}) error {
+	config, result, tlog, verbose := j.config, j.result, j.log, j.verbose
+
+	// Stop between rows once the run has been interrupted.
+	if err := j.ctx.Err(); err != nil {
+		return err
+	}
+	j.countBytes(columnsList, values)
+	j.countExcluded(columnsList, values)
+	if config.CountOnly {
+		j.countRow(columnsList, values)
+		return nil
+	}
+
+	var updates []string
+	var args []interface{}
+	var changes []auditChange
+	var guards []string
+	var guardArgs []interface{}
+	changed := make(map[string]interface{})
+	hasChanges := false
+	// Counted before the snapshot, as a row left alone still had them.
+	oversize := j.oversizeValues(columnsList, values)
+	// A row left alone after all, such as one changed since it was read
+	// from a replica, has its counts taken back to before, taken at its
+	// first replacement.
+	var before TableResult
+
+	for _, column := range j.columns {
+		col := column.Name
+		i := indexOf(columnsList, col)
+		if i < 0 || values[i] == nil || oversize[i] {
+			continue
+		}
+
+		replacing := time.Now()
+		strValue := convertToString(values[i])
+		colConfig := config.forColumn(column)
+		hits := make([]int, len(colConfig.Pairs))
+		newValue, replacements, encoding := replaceColumnValue(strValue, j.table, column, colConfig, hits)
+		j.processed(replacing)
+		if verbose && config.WholeWord {
+			for _, pair := range colConfig.Pairs {
+				for _, word := range pair.skippedWords(strValue) {
+					tlog.Debug(fmt.Sprintf("skipped '%s' inside '%s': not a whole word", pair.Search, logValue(word, config)), "column", col)
+				}
+			}
+		}
+		if replacements > 0 && column.Members != nil && !config.SetNull && !column.allows(newValue) {
+			tlog.Warn(fmt.Sprintf("not replacing '%s' with '%s', which is not an allowed member", strValue, newValue), "column", col)
+			replacements = 0
+		}
+		if replacements > 0 {
+			if !hasChanges {
+				before = result.snapshot()
+			}
+			occurrences := 0
+			for i, hit := range hits {
+				if hit > 0 {
+					result.Pairs[colConfig.pairOffset+i]++
+					occurrences += hit
+				}
+			}
+			if j.sampling() {
+				j.addSample(col, columnsList, values, sampleExcerpt(strValue, colConfig, encoding), false)
+			}
+			if j.values != nil {
+				j.values.add(topValue(strValue, colConfig, encoding))
+			}
+			if verbose {
+				for _, pair := range colConfig.Pairs {
+					for _, match := range pair.findAll(strValue) {
+						tlog.Debug(fmt.Sprintf("matched '%s'", logValue(match, config)), "column", col)
+					}
+				}
+				change := describeChange(strValue, newValue, config)
+				if config.SetNull {
+					change = highlight{{text: "'"}, {logValue(strValue, config), '-'}, {text: "' -> NULL"}}
+				}
+				if !config.WritesDatabase() {
+					tlog.Debug("would replace "+change.String(), "column", col, change.attr())
+				} else {
+					tlog.Debug("found match "+change.String(), "column", col, change.attr())
+				}
+			}
+			updates = append(updates, fmt.Sprintf("%s = ?", quoteIdent(col)))
+			switch {
+			case config.SetNull:
+				args = append(args, nil)
+			case column.Binary:
+				args = append(args, []byte(newValue))
+			default:
+				args = append(args, newValue)
+			}
+			changed[col] = args[len(args)-1]
+			if j.guard && len(j.primaryKey) > 0 {
+				guards = append(guards, guardCondition(column))
+				guardArgs = append(guardArgs, values[i])
+			}
+			if config.SetNull {
+				changes = append(changes, auditChange{Column: col, OldValue: strValue, Null: true, Values: replacements, Occurrences: occurrences})
+				result.NulledValues++
+			} else {
+				changes = append(changes, auditChange{Column: col, OldValue: strValue, NewValue: newValue, Values: replacements, Occurrences: occurrences})
+			}
+			hasChanges = true
+			result.Replacements += replacements
+			result.OccurrencesReplaced += occurrences
+			result.Columns[col] += replacements
+			switch encoding {
+			case "base64":
+				result.Base64Values++
+			case "gzip", "zlib":
+				result.CompressedValues++
+			}
+		} else if verbose && result.RowsScanned < config.LogNoMatch {
+			tlog.Debug(fmt.Sprintf("no match in '%s' (searching for: '%s')", logValue(strValue, config), config.searchTerms()), "column", col)
+		}
+	}
+
+	if hasChanges && j.skipDuplicate(values) {
+		tlog.Warn("row is one of several identical copies, not updated", "row", auditRowKey(columnsList, values, j.primaryKey))
+		result.restore(before)
+		result.DuplicatesSkipped++
+		hasChanges = false
+	}
+
+	// Rows the user declines at the approval prompt keep no counts either.
+	if hasChanges && config.approve != nil && !j.approveRow(columnsList, values, changes) {
+		result.restore(before)
+		result.RowsSkipped++
+		hasChanges = false
+	}
+
+	if hasChanges {
+		for _, col := range j.preserve {
+			updates = append(updates, fmt.Sprintf("%s = %s", quoteIdent(col), quoteIdent(col)))
+		}
+	}
+
+	if hasChanges {
+		row := &pendingRow{columnsList: columnsList, values: values, updates: updates, args: args, changed: changed,
+			changes: changes, guards: guards, guardArgs: guardArgs, before: before}
+		if err := j.reserveRow(row); err != nil {
+			result.restore(before)
+			return err
+		}
+		if j.deferWrites {
+			if err := j.deferRow(row); err != nil {
+				return err
+			}
+		} else if err := j.writeRow(row); err != nil {
+			return err
+		}
+	}
+	result.RowsScanned++
+	j.prog.update(result.RowsScanned, result.RowsUpdated)
+
+	return nil
+}
+
+// writeRow writes one changed row found by processRow: to OutputSQL, or to
+// the database along with its backup and undo records, queued in a batch or
+// with an UPDATE of its own. The row is then counted as updated and audited.
+// Its snapshot, if any, is written first, in dry runs too.
+func (j *tableJob) writeRow(row *pendingRow) error {
+	config, result, tlog := j.config, j.result, j.log
+
+	if config.snapshot != nil {
+		if err := config.snapshot.writeRow(j.table, row.columnsList, row.values, j.primaryKey); err != nil {
+			return fmt.Errorf("writing snapshot: %w", err)
+		}
+	}
+	hasChanges, queued := true, false
+	if config.sqlOut != nil {
+		query, queryArgs, err := buildUpdate(j.table, row.updates, row.args, row.columnsList, row.values, j.primaryKey, j.generated, j.exact, j.temporal, row.guards, row.guardArgs)
+		if err != nil {
+			return err
+		}
+		if !j.sqlBlock {
+			config.sqlOut.beginTable(j.table)
+			j.sqlBlock = true
+		}
+		if err := config.sqlOut.writeUpdate(query, queryArgs); err != nil {
+			return err
+		}
+	} else if config.WritesDatabase() {
+		if err := j.prepareWrite(row.columnsList); err != nil {
+			return err
+		}
+		if config.BackupSuffix != "" && config.BackupChangedOnly {
+			if err := j.backupRow(row.columnsList, row.values); err != nil {
+				return err
+			}
+		}
+		// The undo statement is written first so a crash cannot lose it; if
+		// the update does not happen it matches no row.
+		if config.undo != nil {
+			if err := j.writeUndo(row.columnsList, row.values, row.changed); err != nil {
+				return err
+			}
+		}
+		if j.batch != nil && !changesKey(row.changed, j.primaryKey) {
+			if err := j.queueUpdate(row.columnsList, row.values, row.updates, row.args, row.changed, row.changes); err != nil {
+				return err
+			}
+			queued = true
+		} else {
+			// Keep rows in scan order: queued rows are written first.
+			if err := j.flush(); err != nil {
+				return err
+			}
+			affected, err := j.updateRow(row.updates, row.args, row.columnsList, row.values, row.guards, row.guardArgs)
+			if isInvalidValue(err) {
+				// Only the statement failed, so the table carries on.
+				tlog.Warn("the server rejected a value of the row, not updated", "row", auditRowKey(row.columnsList, row.values, j.primaryKey), "err", err)
+				j.takeBack(row)
+				result.RejectedRows++
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch {
+			case j.guard && affected == 0:
+				tlog.Warn("row changed since it was read from the replica, not updated", "row", auditRowKey(row.columnsList, row.values, j.primaryKey))
+				j.takeBack(row)
+				result.ChangedSinceRead++
+				hasChanges = false
+			case affected != 1:
+				if err := j.unexpectedAffected(affected, 1, auditRowKey(row.columnsList, row.values, j.primaryKey)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if hasChanges {
+		result.RowsUpdated++
+		// Queued rows are audited when their batch is written.
+		if (config.audit != nil || j.keys != nil) && !queued {
+			action := "update"
+			if config.DryRun {
+				action = "dry-run"
+			} else if config.sqlOut != nil {
+				action = "sql-file"
+			}
+			if j.lockRows {
+				// Written once the chunk's transaction commits.
+				j.chunkAudit = append(j.chunkAudit, batchRow{columnsList: row.columnsList, values: row.values, changes: row.changes})
+			} else {
+				if config.audit != nil {
+					config.audit.writeRow(action, j.table, auditRowKey(row.columnsList, row.values, j.primaryKey), row.changes)
+					j.audited = true
+				}
+				j.recordKey(row.columnsList, row.values)
+			}
+		}
+	}
+	if hasChanges && config.SleepBetweenChunks > 0 && !j.chunked && result.RowsUpdated%config.SleepEvery == 0 {
+		if err := j.pause(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countRow counts the matches of every pair in one row for CountOnly.
+// result.Pairs counts the values each pair matched.
+func (j *tableJob) countRow(columnsList []string, values []interface{}) {
+	result := j.result
+	matched := false
+	oversize := j.oversizeValues(columnsList, values)
+	for _, column := range j.columns {
+		i := indexOf(columnsList, column.Name)
+		if i < 0 || values[i] == nil || oversize[i] {
+			continue
+		}
+		matching := time.Now()
+		strValue := convertToString(values[i])
+		occurrences := 0
+		colConfig := j.config.forColumn(column)
+		for p, pair := range colConfig.Pairs {
+			accepted, _ := pair.find(strValue)
+			if len(accepted) > 0 {
+				occurrences += len(accepted)
+				result.Pairs[colConfig.pairOffset+p]++
+			}
+		}
+		j.processed(matching)
+		if occurrences > 0 {
+			result.Occurrences[column.Name] += occurrences
+			matched = true
+			if j.sampling() {
+				j.addSample(column.Name, columnsList, values, sampleExcerpt(strValue, colConfig, ""), false)
+			}
+			if j.values != nil {
+				j.values.add(topValue(strValue, colConfig, ""))
+			}
+			if j.verbose {
+				j.log.Debug(fmt.Sprintf("%d occurrences in '%s'", occurrences, logValue(strValue, j.config)), "column", column.Name)
+			}
+		}
+	}
+	if matched {
+		result.MatchedRows++
+	}
+	result.RowsScanned++
+	j.prog.update(result.RowsScanned, result.MatchedRows)
+}
+
+// buildPrefilter returns a WHERE condition matching rows where any text
+// column contains any search string. It returns an empty condition when the
+// raw column text may not contain the search string literally.
+func buildPrefilter(columns []textColumn, config Config) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for _, col := range columns {
+		for _, pair := range config.forColumn(col).Pairs {
+			// JSON documents escape quotes, backslashes and control
+			// characters, so LIKE could miss such matches.
+			if col.JSON && strings.ContainsFunc(pair.Search, func(r rune) bool {
+				return r == '"' || r == '\\' || r < 0x20
+			}) {
+				return "", nil
+			}
+			clauses = append(clauses, fmt.Sprintf("%s LIKE CONCAT('%%', ?, '%%')", quoteIdent(col.Name)))
+			args = append(args, escapeLike(pair.Search))
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// escapeLike escapes the LIKE wildcards and the escape character itself.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func scanRow(rows *sql.Rows, n int) ([]interface{}, error) {
+	values := make([]interface{}, n)
+	valuePtrs := make([]interface{}, n)
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	if err := rows.Scan(valuePtrs...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// queryRows runs a query and reads the whole result set into memory.
+func queryRows(ctx context.Context, db querier, query string, args ...interface{}) ([]string, [][]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columnsList, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result [][]interface{}
+	for rows.Next() {
+		values, err := scanRow(rows, len(columnsList))
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, values)
+	}
+
+	return columnsList, result, rows.Err()
+}
+
+func indexOf(list []string, name string) int {
+	for i, item := range list {
+		if item == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func convertToString(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func replaceValue(value, table, column string, config Config, hits []int) string {
+	if !config.matches(value) {
+		return value
+	}
+	if config.Serialized && isSerialized(value) {
+		// Counted apart, as a parse error may come after some strings
+		// were replaced.
+		counts := make([]int, len(hits))
+		newValue, err := replaceSerialized(value, func(s string) string {
+			return config.replaceString(s, counts)
+		})
+		if err == nil {
+			addHits(hits, counts)
+			return newValue
+		}
+		config.log().Warn("could not parse PHP-serialized value, using plain replacement", "table", table, "column", column, "err", err)
+	}
+	return config.replaceString(value, hits)
+}
+
+func addHits(hits, counts []int) {
+	for i, n := range counts {
+		hits[i] += n
+	}
+}
+
+// oversizeValues returns the indexes of the row's values to scan that are
+// larger than MaxValueSize, logging and counting each so that it can be
+// handled by hand.
+func (j *tableJob) oversizeValues(columnsList []string, values []interface{}) map[int]bool {
+	if j.config.MaxValueSize == 0 {
+		return nil
+	}
+	var oversize map[int]bool
+	for _, column := range j.columns {
+		i := indexOf(columnsList, column.Name)
+		if i < 0 || values[i] == nil {
+			continue
+		}
+		if size := valueSize(values[i]); j.config.oversize(size) {
+			if oversize == nil {
+				oversize = make(map[int]bool)
+			}
+			oversize[i] = true
+			j.result.OversizeValues++
+			j.log.Warn("value larger than -max-value-size, left alone", "column", column.Name,
+				"row", auditRowKey(columnsList, values, j.primaryKey), "bytes", size)
+		}
+	}
+	return oversize
+}
+
+// oversize reports whether a value of size bytes is larger than
+// MaxValueSize.
+func (c Config) oversize(size int64) bool {
+	return c.MaxValueSize > 0 && size > c.MaxValueSize
+}
+
+// valueSize is the length in bytes of a value as fetched, before any
+// decoding.
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
+	default:
+		return int64(len(convertToString(v)))
+	}
+}
+
+// countBytes adds the size of the row's values to scan to BytesScanned.
+func (j *tableJob) countBytes(columnsList []string, values []interface{}) {
+	for _, column := range j.columns {
+		if i := indexOf(columnsList, column.Name); i >= 0 && values[i] != nil {
+			j.result.BytesScanned += valueSize(values[i])
+		}
+	}
+}
+
+// countExcluded counts the values of the row's excluded columns that contain
+// a search string, which the run leaves alone.
+func (j *tableJob) countExcluded(columnsList []string, values []interface{}) {
+	for _, column := range j.excluded {
+		i := indexOf(columnsList, column.Name)
+		if i < 0 || values[i] == nil || j.config.oversize(valueSize(values[i])) {
+			continue
+		}
+		if !j.config.forColumn(column).matches(convertToString(values[i])) {
+			continue
+		}
+		if j.result.ExcludedMatches == nil {
+			j.result.ExcludedMatches = make(map[string]int)
+		}
+		j.result.ExcludedMatches[column.Name]++
+		if j.sampling() {
+			j.addSample(column.Name, columnsList, values, "", true)
+		}
+	}
+}
+
+// sampling reports whether the table still collects example matches for
+// Samples.
+func (j *tableJob) sampling() bool {
+	return (j.config.DryRun || j.config.CountOnly) && len(j.result.Samples) < j.config.Samples
+}
+
+// addSample records an example match in a column of the row.
+func (j *tableJob) addSample(column string, columnsList []string, values []interface{}, excerpt string, redacted bool) {
+	j.result.Samples = append(j.result.Samples, Sample{
+		Column:   column,
+		Row:      auditRowKey(columnsList, values, j.primaryKey),
+		Excerpt:  excerpt,
+		Redacted: redacted,
+	})
+}
+
+// replaceColumnValue returns the new value for a column and the number of
+// replacements it represents: one for a plain text value, or the number of
+// modified string values for a JSON document. encoding names the encoding
+// the replacement was made inside of, "base64", "gzip" or "zlib", and is
+// empty for a plain value.
+func replaceColumnValue(value, table string, col textColumn, config Config, hits []int) (newValue string, replacements int, encoding string) {
+	if config.Decompress && col.Binary {
+		if algorithm := compression(value); algorithm != "" {
+			if newValue, ok := replaceCompressed(value, algorithm, table, col.Name, config, hits); ok {
+				return newValue, 1, algorithm
+			}
+			// Compressed bytes are never replaced in as they are.
+			return value, 0, ""
+		}
+	}
+	if config.DecodeBase64 && !col.JSON && !config.matches(value) {
+		if newValue, ok := replaceBase64(value, table, col.Name, config, hits); ok {
+			return newValue, 1, "base64"
+		}
+		return value, 0, ""
+	}
+	if !col.JSON || !config.matches(value) {
+		newValue := replaceValue(value, table, col.Name, config, hits)
+		if newValue == value {
+			return value, 0, ""
+		}
+		return newValue, 1, ""
+	}
+
+	counts := make([]int, len(hits))
+	newValue, modified, err := replaceJSON(value, func(s string) string {
+		return replaceValue(s, table, col.Name, config, counts)
+	}, config.JSONKeys)
+	if err == nil {
+		addHits(hits, counts)
+	} else {
+		config.log().Warn("could not process JSON value, using plain replacement", "table", table, "column", col.Name, "err", err)
+		newValue = replaceValue(value, table, col.Name, config, hits)
+		if newValue == value {
+			return value, 0, ""
+		}
+		return newValue, 1, ""
+	}
+	return newValue, modified, ""
+}
+
+// describeColumns lists the named columns with their collation, if any,
+// as "name (collation)".
+func describeColumns(columns []textColumn, names []string) []string {
+	described := make([]string, 0, len(names))
+	for _, col := range columns {
+		if indexOf(names, col.Name) < 0 {
+			continue
+		}
+		if col.Collation == "" {
+			described = append(described, col.Name)
+		} else {
+			described = append(described, fmt.Sprintf("%s (%s)", col.Name, col.Collation))
+		}
+	}
+	return described
+}
+
+// collatedColumns returns the names of the columns holding characters, which
+// whole-row matches compare byte for byte.
+func collatedColumns(columns []textColumn) []string {
+	var names []string
+	for _, col := range columns {
+		if col.Collation != "" {
+			names = append(names, col.Name)
+		}
+	}
+	return names
+}
+
+func columnNames(columns []textColumn) []string {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// tableColumns describes the columns of a table that matter for replacement.
+type tableColumns struct {
+	// Text lists the columns that may hold text. Binary string and BLOB
+	// columns are included when requested.
+	Text []textColumn
+	// Generated lists all generated columns, whatever their type.
+	Generated []string
+	// OnUpdate lists TIMESTAMP and DATETIME columns with ON UPDATE
+	// CURRENT_TIMESTAMP.
+	OnUpdate []string
+	// Temporal lists the DATE, DATETIME and TIMESTAMP columns.
+	Temporal []string
+}
+
+// getColumns describes the columns of table, from config's schemaColumns
+// when Run has read them, and otherwise with a query of its own.
+func getColumns(ctx context.Context, db *sql.DB, table string, config Config) (tableColumns, error) {
+	columns, ok := config.schemaColumns[table]
+	if !ok {
+		var err error
+		if columns, err = readTableColumns(ctx, db, table); err != nil {
+			return tableColumns{}, err
+		}
+		if len(columns) == 0 {
+			return tableColumns{}, fmt.Errorf("table %s does not exist", table)
+		}
+	}
+	return describeColumnTypes(columns, config.IncludeBinary), nil
+}
+
+// describeColumnTypes sorts out the columns of a table that matter for
+// replacement.
+func describeColumnTypes(columns []columnInfo, includeBinary bool) tableColumns {
+	var schema tableColumns
+	for _, info := range columns {
+		field, typ, extra := info.Name, info.ColumnType, info.Extra
+
+		// Extra is "VIRTUAL GENERATED" or "STORED GENERATED" (MariaDB also
+		// "PERSISTENT GENERATED"); "DEFAULT_GENERATED" marks an expression
+		// default on an ordinary column.
+		upperExtra := strings.ToUpper(extra)
+		isGenerated := info.Generation != "" || strings.Contains(upperExtra, "VIRTUAL") ||
+			strings.Contains(upperExtra, "STORED") || strings.Contains(upperExtra, "PERSISTENT")
+		if isGenerated {
+			schema.Generated = append(schema.Generated, field)
+		}
+		if strings.Contains(strings.ToLower(extra), "on update current_timestamp") {
+			schema.OnUpdate = append(schema.OnUpdate, field)
+		}
+		switch strings.ToLower(info.DataType) {
+		case "date", "datetime", "timestamp":
+			schema.Temporal = append(schema.Temporal, field)
+		}
+
+		lowerType := strings.ToLower(typ)
+		if strings.HasPrefix(lowerType, "enum(") || strings.HasPrefix(lowerType, "set(") {
+			schema.Text = append(schema.Text, textColumn{
+				Name:      field,
+				Set:       strings.HasPrefix(lowerType, "set("),
+				Members:   parseEnumMembers(typ),
+				Generated: isGenerated,
+				Collation: info.Collation,
+				Nullable:  info.Nullable,
+			})
+			continue
+		}
+
+		isText := strings.Contains(lowerType, "char") ||
+			strings.Contains(lowerType, "text") ||
+			strings.Contains(lowerType, "varchar")
+		isJSON := lowerType == "json"
+		isBinary := includeBinary && (strings.Contains(lowerType, "blob") ||
+			strings.Contains(lowerType, "binary"))
+		if isText || isJSON || isBinary {
+			column := textColumn{Name: field, JSON: isJSON, Binary: isBinary, Generated: isGenerated, Nullable: info.Nullable}
+			if isText {
+				column.Collation = info.Collation
+			}
+			schema.Text = append(schema.Text, column)
+		}
+	}
+	return schema
+}
+
+// zeroDate reports whether a date or time value read from the server has a
+// zero month or day, as in 0000-00-00 00:00:00.
+func zeroDate(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	s := convertToString(value)
+	return len(s) >= 10 && s[4] == '-' && (s[5:7] == "00" || s[8:10] == "00")
+}
+
+// parseEnumMembers returns the members of an enum(...) or set(...) column
+// type as given by COLUMN_TYPE, where quotes inside members are doubled.
+func parseEnumMembers(typ string) []string {
+	open := strings.IndexByte(typ, '(')
+	if open < 0 {
+		return []string{}
+	}
+	members := []string{}
+	var member strings.Builder
+	inQuote := false
+	for i := open + 1; i < len(typ); i++ {
+		c := typ[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(typ):
+			i++
+			member.WriteByte(typ[i])
+		case inQuote && c == '\'' && i+1 < len(typ) && typ[i+1] == '\'':
+			i++
+			member.WriteByte('\'')
+		case inQuote && c == '\'':
+			inQuote = false
+			members = append(members, member.String())
+			member.Reset()
+		case inQuote:
+			member.WriteByte(c)
+		case c == '\'':
+			inQuote = true
+		}
+	}
+	return members
+}
+
+// maxPreparedStatements caps the statements kept prepared per table. Rows
+// changing yet another set of columns use ad-hoc statements.
+const maxPreparedStatements = 16
+
+// updateRow runs the UPDATE for one row and returns the number of rows it
+// affected, which should be exactly one. With a primary key the statement
+// only depends on which columns changed, so it is prepared once per column
+// set and reused for the rest of the table.
+func (j *tableJob) updateRow(updates []string, args []interface{}, columnsList []string, values []interface{}, guards []string, guardArgs []interface{}) (int64, error) {
+	query, allArgs, err := buildUpdate(j.table, updates, args, columnsList, values, j.primaryKey, j.generated, j.exact, j.temporal, guards, guardArgs)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := j.throttle(1); err != nil {
+		return 0, err
+	}
+	res, err := j.execRetry(func() (sql.Result, error) {
+		// Prepared again on the new connection after a lost one.
+		stmt, err := j.statement(j.writeContext(), query)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := j.statementContext(j.writeContext())
+		defer cancel()
+		if stmt != nil {
+			return stmt.ExecContext(ctx, allArgs...)
+		}
+		return j.exec.ExecContext(ctx, query, allArgs...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// unexpectedAffected logs and counts an UPDATE that affected a number of
+// rows other than expected, identifying the row unless row is empty. With
+// Strict it is returned as an error, failing the table.
+func (j *tableJob) unexpectedAffected(affected, expected int64, row string) error {
+	j.result.UnexpectedAffected++
+	msg := fmt.Sprintf("update affected %d rows, expected %d", affected, expected)
+	if j.config.Strict {
+		if row != "" {
+			return fmt.Errorf("row %s: %s (-strict)", row, msg)
+		}
+		return fmt.Errorf("%s (-strict)", msg)
+	}
+	if row != "" {
+		j.log.Warn(msg, "row", row)
+	} else {
+		j.log.Warn(msg)
+	}
+	return nil
+}
+
+// statement returns the prepared statement for query, preparing it on first
+// use, or nil when the table's statements are not prepared.
+func (j *tableJob) statement(ctx context.Context, query string) (*sql.Stmt, error) {
+	if len(j.primaryKey) == 0 {
+		return nil, nil
+	}
+	if stmt, ok := j.stmts[query]; ok {
+		return stmt, nil
+	}
+	p, ok := j.exec.(preparer)
+	if !ok || len(j.stmts) >= maxPreparedStatements {
+		return nil, nil
+	}
+	stmt, err := p.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if j.stmts == nil {
+		j.stmts = make(map[string]*sql.Stmt)
+	}
+	j.stmts[query] = stmt
+	return stmt, nil
+}
+
+// closeStatements closes the statements prepared for the table.
+func (j *tableJob) closeStatements() {
+	for _, stmt := range j.stmts {
+		stmt.Close()
+	}
+	j.stmts = nil
+}
+
+// buildUpdate returns the UPDATE statement for one row. guards are extra
+// conditions the row must meet, with their arguments in guardArgs.
+func buildUpdate(table string, updates []string, args []interface{}, columnsList []string, values []interface{}, primaryKey, generated, exact, temporal, guards []string, guardArgs []interface{}) (string, []interface{}, error) {
+	where, whereArgs, err := buildRowMatch(columnsList, values, primaryKey, generated, exact, temporal)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(guards) > 0 {
+		where += " AND " + strings.Join(guards, " AND ")
+		whereArgs = append(whereArgs, guardArgs...)
+	}
+
+	allArgs := append(append([]interface{}{}, args...), whereArgs...)
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteTable(table), strings.Join(updates, ", "), where)
+	if len(primaryKey) == 0 {
+		// Fully identical rows are each scanned, so update them one at a
+		// time.
+		query += " LIMIT 1"
+	}
+
+	return query, allArgs, nil
+}
+
+// guardCondition returns a condition that a column still holds the value
+// given as its argument. Text is compared byte for byte after conversion
+// to utf8mb4, so changes the column's collation ignores, such as in letter
+// case, are seen too.
+func guardCondition(column textColumn) string {
+	col := quoteIdent(column.Name)
+	switch {
+	case column.Binary:
+		return col + " = ?"
+	case column.JSON:
+		return col + " = CAST(? AS JSON)"
+	}
+	return fmt.Sprintf("BINARY CONVERT(%s USING utf8mb4) = BINARY CONVERT(? USING utf8mb4)", col)
+}
+
+// buildRowMatch returns a WHERE condition identifying one row. Without a
+// primary key the row is matched on all of its columns except generated
+// ones, whose values depend on expressions that may not round-trip exactly.
+// The columns in exact are compared byte for byte, as guardCondition does,
+// so that neither letter case nor trailing spaces, which their collation
+// may ignore, match another row. Zero dates in the columns in temporal are
+// compared as text.
+func buildRowMatch(columnsList []string, values []interface{}, primaryKey, generated, exact, temporal []string) (string, []interface{}, error) {
+	var whereClauses []string
+	var whereArgs []interface{}
+
+	if len(primaryKey) > 0 {
+		for _, key := range primaryKey {
+			found := false
+			for i, colName := range columnsList {
+				if colName == key {
+					whereClauses = append(whereClauses, fmt.Sprintf("%s = ?", quoteIdent(colName)))
+					whereArgs = append(whereArgs, values[i])
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", nil, fmt.Errorf("primary key column %s not found in result set", key)
+			}
+		}
+	} else {
+		// Match on every column, NULLs included, so rows that differ only
+		// in a NULL column are told apart.
+		for i, colName := range columnsList {
+			if indexOf(generated, colName) >= 0 {
+				continue
+			}
+			switch {
+			case indexOf(exact, colName) >= 0:
+				whereClauses = append(whereClauses, fmt.Sprintf("BINARY CONVERT(%s USING utf8mb4) <=> BINARY CONVERT(? USING utf8mb4)", quoteIdent(colName)))
+			case indexOf(temporal, colName) >= 0 && zeroDate(values[i]):
+				// Strict SQL modes reject zero dates such as 0000-00-00
+				// given as a date, even in a WHERE clause, but not as text.
+				whereClauses = append(whereClauses, fmt.Sprintf("CAST(%s AS CHAR) <=> ?", quoteIdent(colName)))
+			default:
+				whereClauses = append(whereClauses, fmt.Sprintf("%s <=> ?", quoteIdent(colName)))
+			}
+			whereArgs = append(whereArgs, values[i])
+		}
+	}
+
+	if len(whereClauses) == 0 {
+		return "", nil, fmt.Errorf("no valid WHERE clauses found")
+	}
+
+	return strings.Join(whereClauses, " AND "), whereArgs, nil
+}
@@ -0,0 +1,361 @@
+package mysqlreplace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReplaceColumnValueCountsOccurrences(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		value  string
+		want   string
+	}{
+		{"plain", Config{Pairs: []Pair{{Search: "old.example.com", Replace: "new.example.com"}}},
+			"old.example.com, www.old.example.com and old.example.com/about",
+			"new.example.com, www.new.example.com and new.example.com/about"},
+		{"regex", Config{Regex: true, Pairs: []Pair{{Search: `old\.(example\.com)`, Replace: "new.$1"}}},
+			"old.example.com, www.old.example.com and old.example.com/about",
+			"new.example.com, www.new.example.com and new.example.com/about"},
+		{"serialized", Config{Serialized: true, Pairs: []Pair{{Search: "old.example.com", Replace: "new.example.org"}}},
+			`a:2:{i:0;s:15:"old.example.com";i:1;s:40:"see old.example.com and old.example.com!";}`,
+			`a:2:{i:0;s:15:"new.example.org";i:1;s:40:"see new.example.org and new.example.org!";}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Database = "db"
+			config := compiledConfig(t, tt.config)
+			hits := make([]int, len(config.Pairs))
+			got, replacements, _ := replaceColumnValue(tt.value, "t", textColumn{Name: "c"}, config, hits)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if replacements != 1 {
+				t.Errorf("%d values changed, want 1", replacements)
+			}
+			if hits[0] != 3 {
+				t.Errorf("%d occurrences replaced, want 3", hits[0])
+			}
+		})
+	}
+}
+
+func TestBuildUpdateQuotesIdentifiers(t *testing.T) {
+	tests := []struct {
+		name       string
+		table      string
+		column     string
+		primaryKey []string
+		want       string
+	}{
+		{"reserved and dashed", "order-items", "key", []string{"id"},
+			"UPDATE `order-items` SET `key` = ? WHERE `id` = ?"},
+		{"backtick", "we`ird", "co`l", []string{"i`d"},
+			"UPDATE `we``ird` SET `co``l` = ? WHERE `i``d` = ?"},
+		{"schema-qualified", "shop.order-items", "key", []string{"id"},
+			"UPDATE `shop`.`order-items` SET `key` = ? WHERE `id` = ?"},
+		{"no primary key", "order-items", "key", nil,
+			"UPDATE `order-items` SET `key` = ? WHERE `id` <=> ? AND `key` <=> ? LIMIT 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := "id"
+			if len(tt.primaryKey) > 0 {
+				id = tt.primaryKey[0]
+			}
+			columnsList := []string{id, tt.column}
+			values := []interface{}{7, "old"}
+			query, args, err := buildUpdate(tt.table, []string{quoteIdent(tt.column) + " = ?"}, []interface{}{"new"},
+				columnsList, values, tt.primaryKey, nil, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tt.want {
+				t.Errorf("got %s, want %s", query, tt.want)
+			}
+			wantArgs := 2
+			if tt.primaryKey == nil {
+				wantArgs = 3
+			}
+			if len(args) != wantArgs || args[0] != "new" {
+				t.Errorf("got arguments %v", args)
+			}
+		})
+	}
+}
+
+// TestScanOrderItems runs the whole cycle, column discovery, the prefilter,
+// the SELECTs and the UPDATEs, over a dashed table and a reserved column.
+func TestScanOrderItems(t *testing.T) {
+	db := testDB(t)
+	for _, mode := range []struct {
+		chunkSize int
+		prefilter bool
+	}{{0, false}, {0, true}, {2, false}, {2, true}} {
+		t.Run(fmt.Sprintf("chunk-size=%d,prefilter=%v", mode.chunkSize, mode.prefilter), func(t *testing.T) {
+			createTestTable(t, db, "order-items", "id INT PRIMARY KEY, `key` VARCHAR(50)",
+				"(1, 'old-1'), (2, 'kept'), (3, 'old-3'), (4, NULL), (5, 'old-5')")
+			result := processTestTable(t, db, "order-items", Config{
+				Pairs: []Pair{{Search: "old", Replace: "new"}}, ChunkSize: mode.chunkSize, Prefilter: mode.prefilter,
+			})
+			if result.RowsUpdated != 3 || result.Columns["key"] != 3 {
+				t.Errorf("%d rows updated and %d values changed in key, want 3 and 3", result.RowsUpdated, result.Columns["key"])
+			}
+			var got []string
+			for _, value := range columnValues(t, db, "order-items", "key", "id") {
+				got = append(got, value.String)
+			}
+			if want := []string{"new-1", "kept", "new-3", "", "new-5"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRowMatchWithNull(t *testing.T) {
+	where, args, err := buildRowMatch([]string{"name", "note"}, []interface{}{"old", nil}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "`name` <=> ? AND `note` <=> ?"; where != want {
+		t.Errorf("got %s, want %s", where, want)
+	}
+	if len(args) != 2 || args[1] != nil {
+		t.Errorf("got arguments %v, want NULL for note", args)
+	}
+
+	db := testDB(t)
+	createTestTable(t, db, "test_nopk_null", "name VARCHAR(50) NOT NULL, note VARCHAR(50) NULL",
+		"('old site', NULL), ('old site', 'kept'), ('other', NULL)")
+	result := processTestTable(t, db, "test_nopk_null", Config{Pairs: []Pair{{Search: "old", Replace: "new"}}})
+	if result.RowsUpdated != 2 || result.UnexpectedAffected != 0 {
+		t.Errorf("%d rows updated and %d unexpected affected counts, want 2 and 0", result.RowsUpdated, result.UnexpectedAffected)
+	}
+	for _, value := range columnValues(t, db, "test_nopk_null", "name", "name") {
+		if value.String == "old site" {
+			t.Errorf("a row was left unchanged")
+		}
+	}
+}
+
+func TestUnexpectedAffected(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			j := &tableJob{config: Config{Strict: strict}, result: &TableResult{}, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			err := j.unexpectedAffected(0, 1, "id=7")
+			if strict != (err != nil) {
+				t.Errorf("got error %v with strict %v", err, strict)
+			}
+			if err != nil && !strings.Contains(err.Error(), "row id=7: update affected 0 rows, expected 1") {
+				t.Errorf("got error %v", err)
+			}
+			if j.result.UnexpectedAffected != 1 {
+				t.Errorf("counted %d, want 1", j.result.UnexpectedAffected)
+			}
+		})
+	}
+}
+
+func TestRowMatchWithZeroDate(t *testing.T) {
+	zero := []byte("0000-00-00 00:00:00")
+	where, args, err := buildRowMatch([]string{"title", "published", "updated"},
+		[]interface{}{"old", zero, []byte("2024-05-01 10:00:00")}, nil, nil, nil, []string{"published", "updated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "`title` <=> ? AND CAST(`published` AS CHAR) <=> ? AND `updated` <=> ?"; where != want {
+		t.Errorf("got %s, want %s", where, want)
+	}
+	// The zero date is bound as the text read, never as a date.
+	if text, ok := args[1].([]byte); !ok || string(text) != string(zero) {
+		t.Errorf("zero date bound as %#v", args[1])
+	}
+
+	tests := []struct {
+		value interface{}
+		want  bool
+	}{
+		{[]byte("0000-00-00 00:00:00"), true},
+		{"0000-00-00", true},
+		{"2024-00-10", true},
+		{"2024-05-00 08:00:00", true},
+		{"2024-05-01 08:00:00", false},
+		{"10:00:00", false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := zeroDate(tt.value); got != tt.want {
+			t.Errorf("zeroDate(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreCaseInBinaryCollation(t *testing.T) {
+	config := compiledConfig(t, Config{Database: "db", IgnoreCase: true, Pairs: []Pair{{Search: "old", Replace: "new"}}})
+	tests := []struct {
+		collation string
+		want      string
+	}{
+		{"utf8mb4_bin", "Old OLD new"},
+		{"utf8mb4_unicode_ci", "new new new"},
+		{"", "new new new"},
+	}
+	for _, tt := range tests {
+		col := textColumn{Name: "c", Collation: tt.collation}
+		colConfig := config.forColumn(col)
+		got, _, _ := replaceColumnValue("Old OLD old", "t", col, colConfig, make([]int, len(colConfig.Pairs)))
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.collation, got, tt.want)
+		}
+	}
+
+	exact := collatedColumns([]textColumn{{Name: "code", Collation: "utf8mb4_bin"}, {Name: "data", Binary: true}})
+	where, _, err := buildRowMatch([]string{"code", "data"}, []interface{}{"Old", []byte{1}}, nil, nil, exact, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "BINARY CONVERT(`code` USING utf8mb4) <=> BINARY CONVERT(? USING utf8mb4) AND `data` <=> ?"; where != want {
+		t.Errorf("got %s, want %s", where, want)
+	}
+
+	db := testDB(t)
+	createTestTable(t, db, "test_bin_collation", "code VARCHAR(50) COLLATE utf8mb4_bin, note VARCHAR(50) COLLATE utf8mb4_unicode_ci",
+		"('Old OLD old', 'Old OLD old'), ('OLD', 'x')")
+	processTestTable(t, db, "test_bin_collation", Config{IgnoreCase: true, Pairs: []Pair{{Search: "old", Replace: "new"}}})
+	codes := columnValues(t, db, "test_bin_collation", "code", "note")
+	notes := columnValues(t, db, "test_bin_collation", "note", "note")
+	if len(codes) != 2 || codes[0].String != "Old OLD new" || codes[1].String != "OLD" {
+		t.Errorf("code column holds %v", codes)
+	}
+	if len(notes) != 2 || notes[0].String != "new new new" {
+		t.Errorf("note column holds %v", notes)
+	}
+}
+
+func TestDescribeColumnTypes(t *testing.T) {
+	const ci = "utf8mb4_unicode_ci"
+	columns := []columnInfo{
+		{Name: "id", DataType: "int", ColumnType: "int", Extra: "auto_increment"},
+		{Name: "title", DataType: "varchar", ColumnType: "varchar(200)", Collation: ci},
+		{Name: "slug", DataType: "varchar", ColumnType: "varchar(200)", Collation: ci, Extra: "VIRTUAL GENERATED", Generation: "lower(`title`)"},
+		{Name: "summary", DataType: "text", ColumnType: "text", Collation: ci, Extra: "STORED GENERATED", Generation: "left(`title`,20)"},
+		{Name: "status", DataType: "enum", ColumnType: "enum('draft','it''s')", Collation: ci},
+		{Name: "tags", DataType: "set", ColumnType: "set('a','b')", Collation: ci, Nullable: true},
+		{Name: "payload", DataType: "blob", ColumnType: "blob", Nullable: true},
+		{Name: "hash", DataType: "binary", ColumnType: "binary(16)"},
+		{Name: "doc", DataType: "json", ColumnType: "json", Nullable: true},
+		{Name: "updated_at", DataType: "timestamp", ColumnType: "timestamp", Extra: "DEFAULT_GENERATED on update CURRENT_TIMESTAMP"},
+		{Name: "published", DataType: "date", ColumnType: "date"},
+	}
+	enums := []textColumn{
+		{Name: "status", Members: []string{"draft", "it's"}, Collation: ci},
+		{Name: "tags", Set: true, Members: []string{"a", "b"}, Collation: ci, Nullable: true},
+	}
+	text := []textColumn{
+		{Name: "title", Collation: ci},
+		{Name: "slug", Generated: true, Collation: ci},
+		{Name: "summary", Generated: true, Collation: ci},
+	}
+	want := tableColumns{
+		Text:      append(append(append([]textColumn(nil), text...), enums...), textColumn{Name: "doc", JSON: true, Nullable: true}),
+		Generated: []string{"slug", "summary"},
+		OnUpdate:  []string{"updated_at"},
+		Temporal:  []string{"updated_at", "published"},
+	}
+	if got := describeColumnTypes(columns, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("without binary columns got\n%+v\nwant\n%+v", got, want)
+	}
+
+	want.Text = append(append(append([]textColumn(nil), text...), enums...),
+		textColumn{Name: "payload", Binary: true, Nullable: true},
+		textColumn{Name: "hash", Binary: true},
+		textColumn{Name: "doc", JSON: true, Nullable: true})
+	if got := describeColumnTypes(columns, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("with binary columns got\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestEmojiLeftAloneWithoutMatch(t *testing.T) {
+	const value = "launch 🚀 party 🎉"
+	config := compiledConfig(t, Config{Database: "db", Pairs: []Pair{{Search: "old.example.com", Replace: "new.example.com"}}})
+	col := textColumn{Name: "c", Collation: "utf8mb4_unicode_ci"}
+	if got, replacements, _ := replaceColumnValue(value, "t", col, config, make([]int, 1)); got != value || replacements != 0 {
+		t.Errorf("got %q with %d replacements, want it unchanged", got, replacements)
+	}
+
+	db := testDB(t)
+	createTestTable(t, db, "test_emoji_noop", "id INT PRIMARY KEY, body TEXT CHARACTER SET utf8mb4",
+		fmt.Sprintf("(1, '%s'), (2, 'see old.example.com')", value))
+	result := processTestTable(t, db, "test_emoji_noop", Config{Pairs: []Pair{{Search: "old.example.com", Replace: "new.example.com"}}})
+	if result.RowsUpdated != 1 {
+		t.Errorf("%d rows updated, want 1", result.RowsUpdated)
+	}
+	if got := columnValues(t, db, "test_emoji_noop", "body", "id"); got[0].String != value {
+		t.Errorf("the emoji row now holds %q, want %q", got[0].String, value)
+	}
+}
+
+func TestEmojiSurvivesReplacement(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		value  string
+		want   string
+	}{
+		{"plain", Config{Pairs: []Pair{{Search: "old.example.com", Replace: "new.example.com"}}},
+			"🚀 old.example.com 🎉", "🚀 new.example.com 🎉"},
+		{"adjacent", Config{Pairs: []Pair{{Search: "old", Replace: "new"}}},
+			"👍old👍", "👍new👍"},
+		{"ignore case", Config{IgnoreCase: true, Pairs: []Pair{{Search: "café", Replace: "bistro"}}},
+			"☕ CAFÉ 🥐", "☕ bistro 🥐"},
+		{"whole word", Config{WholeWord: true, Pairs: []Pair{{Search: "old", Replace: "new"}}},
+			"🔥old 🔥older", "🔥new 🔥older"},
+		{"serialized", Config{Serialized: true, Pairs: []Pair{{Search: "old", Replace: "newer"}}},
+			`s:13:"🎉 old 🎉";`, `s:15:"🎉 newer 🎉";`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Database = "db"
+			config := compiledConfig(t, tt.config)
+			if got := replaceValue(tt.value, "t", "c", config, make([]int, len(config.Pairs))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// execOnly hides the PrepareContext of an execer, so that updateRow sends
+// every UPDATE as an ad-hoc statement.
+type execOnly struct {
+	execer
+}
+
+func BenchmarkUpdateRow(b *testing.B) {
+	db := testDB(b)
+	createTestTable(b, db, "test_bench_update", "id INT PRIMARY KEY, body VARCHAR(100)", "(1, 'a')")
+	for _, bc := range []struct {
+		name string
+		exec execer
+	}{
+		{"prepared", db},
+		{"unprepared", execOnly{db}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			j := &tableJob{ctx: context.Background(), db: db, exec: bc.exec, table: "test_bench_update", result: &TableResult{},
+				log: slog.New(slog.NewTextHandler(io.Discard, nil)), primaryKey: []string{"id"}}
+			defer j.closeStatements()
+			for i := 0; i < b.N; i++ {
+				if _, err := j.updateRow([]string{"`body` = ?"}, []interface{}{strconv.Itoa(i)}, []string{"id", "body"}, []interface{}{1, "a"}, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// quoteIdent quotes a table or column name for interpolation into SQL,
+// doubling any embedded backticks.
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// splitTable splits a schema-qualified table name at its first dot. The
+// schema is empty for a table of the connected database.
+func splitTable(name string) (string, string) {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return schema, table
+	}
+	return "", name
+}
+
+// quoteTable quotes a table name, qualified by its schema if it has one.
+func quoteTable(name string) string {
+	schema, table := splitTable(name)
+	if schema == "" {
+		return quoteIdent(table)
+	}
+	return quoteIdent(schema) + "." + quoteIdent(table)
+}
+
+// tableCondition returns an information_schema condition on TABLE_SCHEMA and
+// TABLE_NAME matching table, and its arguments.
+func tableCondition(table string) (string, []interface{}) {
+	schema, name := splitTable(table)
+	if schema == "" {
+		return "TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", []interface{}{name}
+	}
+	return "TABLE_SCHEMA = ? AND TABLE_NAME = ?", []interface{}{schema, name}
+}
+
+// localTableName is the name a table of the connected database goes by: its
+// own, or qualified by database when it holds a dot, so that it is not
+// taken for a table of another schema.
+func localTableName(database, table string) string {
+	if strings.Contains(table, ".") {
+		return database + "." + table
+	}
+	return table
+}
+
+func isWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "%*?")
+}
+
+// matchWildcard matches name against a pattern where % and * match any
+// sequence of characters and ? matches a single character.
+func matchWildcard(pattern, name string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%', '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTables applies the -tables and -exclude-tables selections. It returns
+// the selected tables and how many of them were removed by exclusion.
+func filterTables(tables, include, exclude []string) ([]string, int, error) {
+	existing := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		existing[table] = true
+	}
+	for _, name := range include {
+		if !isWildcard(name) && !existing[name] {
+			return nil, 0, fmt.Errorf("table %s does not exist", name)
+		}
+	}
+
+	var selected []string
+	excluded := 0
+	for _, table := range tables {
+		if len(include) > 0 && !matchesAny(include, table) {
+			continue
+		}
+		if matchesAny(exclude, table) {
+			excluded++
+			continue
+		}
+		selected = append(selected, table)
+	}
+
+	return selected, excluded, nil
+}
+
+// splitTableSelection separates the -tables entries naming tables of other
+// schemas, as schema.table, from those matched against the tables of the
+// connected database in local. A dotted name of a local table stays local.
+func splitTableSelection(names, local []string) ([]string, []string) {
+	var include, qualified []string
+	for _, name := range names {
+		if strings.Contains(name, ".") && indexOf(local, name) < 0 {
+			qualified = append(qualified, name)
+		} else {
+			include = append(include, name)
+		}
+	}
+	return include, qualified
+}
+
+// resolveQualifiedTable checks that the schema.table named in -tables exists
+// and returns the name it goes by, bare when the schema is the connected
+// database.
+func resolveQualifiedTable(ctx context.Context, db *sql.DB, name, database string, includeViews bool) (string, error) {
+	if isWildcard(name) {
+		return "", fmt.Errorf("schema-qualified table %s cannot hold wildcards", name)
+	}
+	schema, table := splitTable(name)
+	var tableType string
+	err := db.QueryRowContext(ctx, "SELECT TABLE_TYPE FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", schema, table).Scan(&tableType)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("table %s does not exist", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if tableType == "VIEW" && !includeViews {
+		return "", fmt.Errorf("%s is a view, pass -include-views to process it", name)
+	}
+	if schema == database {
+		return localTableName(database, table), nil
+	}
+	return name, nil
+}
+
+// columnSelected reports whether column of table is named by -columns, either
+// bare or as table.column. Every column is selected when -columns is empty.
+func columnSelected(selection []string, table, column string) bool {
+	return len(selection) == 0 || columnNamed(selection, table, column)
+}
+
+// columnNamed reports whether column of table is in names, either bare or as
+// table.column.
+func columnNamed(names []string, table, column string) bool {
+	for _, name := range names {
+		if name == column || name == table+"."+column {
+			return true
+		}
+	}
+	return false
+}
+
+// columnExcluded reports whether column of table matches one of the
+// -exclude-columns patterns, either bare or as table.column. Patterns take
+// the wildcards of -tables and, like MySQL column names, ignore case.
+func columnExcluded(patterns []string, table, column string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if matchWildcard(pattern, strings.ToLower(column)) || matchWildcard(pattern, strings.ToLower(table+"."+column)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkColumns returns an error naming any -columns entry that matches no
+// column among columns, the tables of the database and the
+// schema-qualified ones, so typos do not silently select nothing.
+func checkColumns(selection []string, columns map[string][]columnInfo) error {
+	found := make(map[string]bool)
+	for table, infos := range columns {
+		for _, info := range infos {
+			found[info.Name] = true
+			found[table+"."+info.Name] = true
+		}
+	}
+
+	var missing []string
+	for _, name := range selection {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no such column: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// columnInfo is one column of a table as information_schema.COLUMNS
+// describes it.
+type columnInfo struct {
+	Name       string
+	DataType   string
+	ColumnType string
+	MaxLength  sql.NullInt64
+	Collation  string
+	Extra      string
+	Key        string
+	Generation string
+	Nullable   bool
+}
+
+// readColumns returns the columns of every table of the current database and
+// of the schema-qualified ones among tables, in one query, keyed by the name
+// each table goes by.
+func readColumns(ctx context.Context, db *sql.DB, tables []string) (map[string][]columnInfo, error) {
+	cond := "TABLE_SCHEMA = DATABASE()"
+	var args []interface{}
+	for _, table := range tables {
+		if schema, name := splitTable(table); schema != "" {
+			cond += " OR (TABLE_SCHEMA = ? AND TABLE_NAME = ?)"
+			args = append(args, schema, name)
+		}
+	}
+	return queryColumns(ctx, db, cond, args)
+}
+
+// readTableColumns returns the columns of a single table.
+func readTableColumns(ctx context.Context, db *sql.DB, table string) ([]columnInfo, error) {
+	cond, args := tableCondition(table)
+	columns, err := queryColumns(ctx, db, cond, args)
+	if err != nil {
+		return nil, err
+	}
+	// The server's spelling of the name may differ in letter case.
+	for _, infos := range columns {
+		return infos, nil
+	}
+	return nil, nil
+}
+
+// queryColumns reads the columns information_schema.COLUMNS lists under
+// cond, in table order.
+func queryColumns(ctx context.Context, db *sql.DB, cond string, args []interface{}) (map[string][]columnInfo, error) {
+	query := `SELECT TABLE_SCHEMA, TABLE_NAME, TABLE_SCHEMA = DATABASE(), COLUMN_NAME, DATA_TYPE, COLUMN_TYPE,
+		CHARACTER_MAXIMUM_LENGTH, COLLATION_NAME, EXTRA, COLUMN_KEY, IS_NULLABLE, %s
+		FROM information_schema.COLUMNS WHERE %s ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION`
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(query, "GENERATION_EXPRESSION", cond), args...)
+	if err != nil {
+		// Servers without GENERATION_EXPRESSION predate generated
+		// columns; EXTRA still marks them.
+		rows, err = db.QueryContext(ctx, fmt.Sprintf(query, "NULL", cond), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer rows.Close()
+
+	columns := make(map[string][]columnInfo)
+	for rows.Next() {
+		var schema, table string
+		var local bool
+		var info columnInfo
+		var collation, extra, key, nullable, generation sql.NullString
+		if err := rows.Scan(&schema, &table, &local, &info.Name, &info.DataType, &info.ColumnType,
+			&info.MaxLength, &collation, &extra, &key, &nullable, &generation); err != nil {
+			return nil, err
+		}
+		info.Collation, info.Extra, info.Key, info.Generation = collation.String, extra.String, key.String, generation.String
+		info.Nullable = strings.EqualFold(nullable.String, "YES")
+		if local {
+			table = localTableName(schema, table)
+		} else {
+			table = schema + "." + table
+		}
+		columns[table] = append(columns[table], info)
+	}
+	return columns, rows.Err()
+}
+
+// getTables returns the base tables and the views of the current database.
+func getTables(ctx context.Context, db *sql.DB) ([]string, []string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW FULL TABLES")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var tables, views []string
+	for rows.Next() {
+		var table, tableType string
+		if err := rows.Scan(&table, &tableType); err != nil {
+			return nil, nil, err
+		}
+		if tableType == "VIEW" {
+			views = append(views, table)
+		} else {
+			tables = append(tables, table)
+		}
+	}
+
+	return tables, views, rows.Err()
+}
+
+// systemSchemas are the server's own schemas, never processed by
+// ListDatabases callers.
+var systemSchemas = []string{"information_schema", "mysql", "performance_schema", "sys"}
+
+// ListDatabases returns the databases on the server db is connected to,
+// leaving out the system schemas.
+func ListDatabases(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW DATABASES")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if indexOf(systemSchemas, strings.ToLower(name)) < 0 {
+			databases = append(databases, name)
+		}
+	}
+	return databases, rows.Err()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,105 @@
+package mysqlreplace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// updateLimiter is a token bucket shared by every worker of a run, capping
+// the rows updated per second across all of them for MaxUpdatesPerSecond.
+// The bucket holds at most one token, so updates are spread out evenly; a
+// batch takes a token per row and leaves the bucket in debt until it is
+// paid back.
+type updateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// updates, first and done record the rows let through and when, for
+	// the average rate in the summary.
+	updates int64
+	firstN  int
+	first   time.Time
+	done    time.Time
+}
+
+func newUpdateLimiter(rate float64) *updateLimiter {
+	return &updateLimiter{rate: rate, tokens: 1, last: time.Now()}
+}
+
+// wait blocks until n rows may be updated, returning early with the
+// context's error if it is cancelled first.
+func (l *updateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > 1 {
+		l.tokens = 1
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	at := now.Add(delay)
+	if l.updates == 0 {
+		l.first, l.firstN = at, n
+	}
+	l.updates += int64(n)
+	if at.After(l.done) {
+		l.done = at
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// average returns the rows let through and their average rate per second
+// from the first update to the last, or 0 when there was only one.
+func (l *updateLimiter) average() (int64, float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	span := l.done.Sub(l.first).Seconds()
+	if span <= 0 {
+		return l.updates, 0
+	}
+	return l.updates, float64(l.updates-int64(l.firstN)) / span
+}
+
+// pause writes any queued batch and then sleeps for SleepBetweenChunks,
+// returning the context's error if the run is interrupted meanwhile.
+func (j *tableJob) pause() error {
+	if err := j.flush(); err != nil {
+		return err
+	}
+	j.log.Debug("sleeping between chunks", "duration", j.config.SleepBetweenChunks)
+	started := time.Now()
+	ok := j.wait(j.config.SleepBetweenChunks)
+	j.result.Slept += time.Since(started)
+	if !ok {
+		return j.ctx.Err()
+	}
+	return nil
+}
+
+// throttle waits for the shared limiter, if any, before n rows are updated.
+func (j *tableJob) throttle(n int) error {
+	if j.config.limiter == nil {
+		return nil
+	}
+	return j.config.limiter.wait(j.ctx, n)
+}
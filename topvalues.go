@@ -0,0 +1,90 @@
+package mysqlreplace
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// topValuesTracked caps the distinct values counted per table for
+// TopValues. Once it is reached, matches of values not yet seen are only
+// counted among the others.
+const topValuesTracked = 1000
+
+// topValueRunes is the longest value counted as it is. Longer values are
+// counted by the text around their first match, so that values differing
+// only elsewhere are counted together.
+const topValueRunes = 64
+
+// ValueCount is one of the most common matching values of a table, for
+// Config.TopValues.
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// valueCounter counts the matching values of a table.
+type valueCounter struct {
+	counts map[string]int
+	total  int
+}
+
+func newValueCounter() *valueCounter {
+	return &valueCounter{counts: make(map[string]int)}
+}
+
+func (vc *valueCounter) add(value string) {
+	vc.total++
+	if _, ok := vc.counts[value]; ok || len(vc.counts) < topValuesTracked {
+		vc.counts[value]++
+	}
+}
+
+// top returns the n most common values, most common first, and the number
+// of matching values that are not among them.
+func (vc *valueCounter) top(n int) ([]ValueCount, int) {
+	values := make([]ValueCount, 0, len(vc.counts))
+	for value, count := range vc.counts {
+		values = append(values, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+	others := vc.total
+	for _, value := range values {
+		others -= value.Count
+	}
+	return values, others
+}
+
+// topValue returns the form of a matching value that TopValues counts: the
+// value itself when short, or up to 16 characters before the first match
+// and 48 from its start, with the cuts marked. Values replaced inside an
+// encoding are counted together by it.
+func topValue(value string, config Config, encoding string) string {
+	if encoding != "" {
+		return fmt.Sprintf("(inside a %s value)", encoding)
+	}
+	if utf8.RuneCountInString(value) <= topValueRunes {
+		return value
+	}
+	start := -1
+	for _, pair := range config.Pairs {
+		accepted, _ := pair.find(value)
+		if len(accepted) > 0 && (start < 0 || accepted[0][0] < start) {
+			start = accepted[0][0]
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	from := backRunes(value, start, 16)
+	to := forwardRunes(value, start, 48)
+	return ellipsisIf(from > 0) + value[from:to] + ellipsisIf(to < len(value))
+}
@@ -0,0 +1,222 @@
+package mysqlreplace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// undoWriter records, for every row changed in the database, an UPDATE that
+// restores the row's original values. Statements are flushed to the file as
+// they are made so a crashed run still leaves usable undo for the rows
+// already changed. When the run finishes the file is rewritten with each
+// table's statements in reverse order inside a transaction, newest table
+// first, and tables that were rolled back are dropped.
+type undoWriter struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	err    error
+	header string
+	offset int64
+
+	// tables lists the tables with undo statements in the order they
+	// finished; spans locates each table's statements in the file.
+	tables []string
+	spans  map[string][]undoSpan
+	kept   map[string]bool
+
+	statements int
+}
+
+type undoSpan struct {
+	offset int64
+	length int
+}
+
+func createUndoWriter(path string, config Config) (*undoWriter, error) {
+	// Never overwrite an earlier run's undo file, which may be the only
+	// record of the values it changed.
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	uw := &undoWriter{path: path, file: file, w: bufio.NewWriter(file), spans: make(map[string][]undoSpan), kept: make(map[string]bool)}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- Undo file generated by mysqlreplace\n")
+	fmt.Fprintf(&b, "-- Started: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "-- Host: %s:%d\n", config.Host, config.Port)
+	fmt.Fprintf(&b, "-- Database: %s\n", config.Database)
+	for _, pair := range config.Pairs {
+		if config.SetNull {
+			fmt.Fprintf(&b, "-- Reverts search: %q set to NULL\n", pair.Search)
+		} else {
+			fmt.Fprintf(&b, "-- Reverts search: %q replace: %q\n", pair.Search, pair.Replace)
+		}
+	}
+	fmt.Fprintf(&b, "\nSET NAMES utf8mb4;\nUSE %s;\n", quoteIdent(config.Database))
+	apply, _ := sessionSettings(config)
+	for _, stmt := range apply {
+		fmt.Fprintf(&b, "%s;\n", stmt)
+	}
+	uw.header = b.String()
+
+	// Until the run finishes, the file holds one autocommit statement per
+	// row in the order the rows were changed.
+	fmt.Fprintf(uw.w, "%s\n-- Run in progress: statements are in the order applied\n", uw.header)
+	uw.offset = int64(uw.w.Buffered())
+	return uw, uw.w.Flush()
+}
+
+// writeRow appends the statement restoring one row of table.
+func (uw *undoWriter) writeRow(table, stmt string) {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	line := stmt + ";\n"
+	uw.w.WriteString(line)
+	if err := uw.w.Flush(); err != nil && uw.err == nil {
+		uw.err = err
+	}
+	uw.spans[table] = append(uw.spans[table], undoSpan{offset: uw.offset, length: len(line)})
+	uw.offset += int64(len(line))
+	uw.statements++
+}
+
+// endTable records whether the changes undone by table's statements were
+// kept. Statements of a rolled-back table are left out of the final file,
+// and forgotten so that a table processed again starts afresh.
+func (uw *undoWriter) endTable(table string, kept bool) {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	if len(uw.spans[table]) == 0 {
+		return
+	}
+	if !kept {
+		delete(uw.spans, table)
+		return
+	}
+	uw.tables = append(uw.tables, table)
+	uw.kept[table] = kept
+}
+
+// Close rewrites the file in replay order. On failure the incremental file
+// is left in place.
+func (uw *undoWriter) Close() error {
+	if uw.err != nil {
+		uw.file.Close()
+		return uw.err
+	}
+
+	tmpPath := uw.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		uw.file.Close()
+		return err
+	}
+	if err := uw.writeFinal(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		uw.file.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		uw.file.Close()
+		return err
+	}
+	uw.file.Close()
+	return os.Rename(tmpPath, uw.path)
+}
+
+func (uw *undoWriter) writeFinal(tmp *os.File) error {
+	w := bufio.NewWriter(tmp)
+	w.WriteString(uw.header)
+
+	statements := 0
+	for i := len(uw.tables) - 1; i >= 0; i-- {
+		table := uw.tables[i]
+		if !uw.kept[table] {
+			continue
+		}
+		spans := uw.spans[table]
+		fmt.Fprintf(w, "\n-- Table %s\nSTART TRANSACTION;\n", table)
+		for j := len(spans) - 1; j >= 0; j-- {
+			buf := make([]byte, spans[j].length)
+			if _, err := uw.file.ReadAt(buf, spans[j].offset); err != nil {
+				return err
+			}
+			w.Write(buf)
+			statements++
+		}
+		fmt.Fprintf(w, "COMMIT;\n")
+	}
+	uw.statements = statements
+
+	fmt.Fprintf(w, "\n-- Completed: %s (%d statements)\n", time.Now().Format(time.RFC3339), statements)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return tmp.Sync()
+}
+
+// writeUndo records the statement restoring a changed row. changed maps each
+// replaced column to the value written to it.
+func (j *tableJob) writeUndo(columnsList []string, values []interface{}, changed map[string]interface{}) error {
+	var sets []string
+	var args []interface{}
+	after := append([]interface{}{}, values...)
+	for i, col := range columnsList {
+		if newValue, ok := changed[col]; ok {
+			sets = append(sets, fmt.Sprintf("%s = ?", quoteIdent(col)))
+			args = append(args, values[i])
+			after[i] = newValue
+		}
+	}
+
+	// Timestamps bumped by the update are set back too. Their new value is
+	// unknown, so they cannot be used to find a row without a primary key.
+	skip := j.generated
+	if len(j.preserve) == 0 && len(j.onUpdate) > 0 {
+		skip = append(append([]string{}, j.generated...), j.onUpdate...)
+		for _, col := range j.onUpdate {
+			if i := indexOf(columnsList, col); i >= 0 {
+				sets = append(sets, fmt.Sprintf("%s = ?", quoteIdent(col)))
+				args = append(args, values[i])
+			}
+		}
+	}
+
+	where, whereArgs, err := buildRowMatch(columnsList, after, j.primaryKey, skip, j.exact, j.temporal)
+	if err != nil {
+		return err
+	}
+	if j.guard && len(j.primaryKey) > 0 {
+		// Like the update, the undo only applies to a row nothing else has
+		// changed since.
+		for _, column := range j.columns {
+			newValue, ok := changed[column.Name]
+			switch {
+			case ok && newValue == nil:
+				where += " AND " + quoteIdent(column.Name) + " IS NULL"
+			case ok:
+				where += " AND " + guardCondition(column)
+				whereArgs = append(whereArgs, newValue)
+			}
+		}
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", quoteTable(j.table), strings.Join(sets, ", "), where)
+	if len(j.primaryKey) == 0 {
+		query += " LIMIT 1"
+	}
+	stmt, err := interpolateQuery(query, append(args, whereArgs...))
+	if err != nil {
+		return err
+	}
+	j.config.undo.writeRow(j.table, stmt)
+	return nil
+}
@@ -0,0 +1,240 @@
+package mysqlreplace
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Labels of the pairs added by Config.URLEncoded and Config.HTMLEntities.
+// The labels of the Config.URLVariants pairs are in urlVariantForms.
+const (
+	variantURLEncoded   = "url-encoded"
+	variantHTMLEntities = "html-entities"
+)
+
+// urlVariantForms are the forms of a bare host added by Config.URLVariants,
+// longest prefix first so that "//" cannot match inside "https://" before
+// the https pair has replaced it. Escaped forms write every / as \/, as
+// JSON encoders such as PHP's json_encode do.
+var urlVariantForms = []struct {
+	variant string
+	prefix  string
+	escaped bool
+}{
+	{"https-escaped", "https://", true},
+	{"http-escaped", "http://", true},
+	{"https", "https://", false},
+	{"http", "http://", false},
+	{"protocol-relative-escaped", "//", true},
+	{"protocol-relative", "//", false},
+}
+
+// withURLVariants returns pairs with each pair whose search and replace
+// strings are both bare hosts, such as old.example.com, preceded by its
+// https, http and protocol-relative forms, plain and with escaped slashes.
+// Forms already searched for are not added again.
+func withURLVariants(pairs []Pair, config Config) []Pair {
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		seen[pair.Search] = true
+	}
+
+	var out []Pair
+	for _, pair := range pairs {
+		if !isBareHost(pair.Search) || !isBareHost(pair.Replace) {
+			config.log().Warn("not adding URL variants of a pair that is not a bare host", "pair", pair.String())
+			out = append(out, pair)
+			continue
+		}
+		for _, form := range urlVariantForms {
+			search, replace := form.prefix+pair.Search, form.prefix+pair.Replace
+			if form.escaped {
+				search, replace = escapeSlashes(search), escapeSlashes(replace)
+			}
+			if seen[search] {
+				continue
+			}
+			seen[search] = true
+			out = append(out, Pair{Search: search, Replace: replace, variant: form.variant})
+		}
+		out = append(out, pair)
+	}
+	return out
+}
+
+// isBareHost reports whether s names a host, optionally with a path,
+// without a scheme or leading slashes.
+func isBareHost(s string) bool {
+	return s != "" && !strings.Contains(s, "://") && !strings.Contains(s, `:\/\/`) &&
+		!strings.HasPrefix(s, "/") && !strings.HasPrefix(s, `\/`)
+}
+
+func escapeSlashes(s string) string {
+	return strings.ReplaceAll(s, "/", `\/`)
+}
+
+// withVariantPairs returns pairs with the enabled encoded forms of each pair
+// added after it. A form is only added when it differs from the pair and is
+// not already searched for.
+func withVariantPairs(pairs []Pair, urlEncoded, htmlEntities bool) []Pair {
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		seen[pair.Search] = true
+	}
+	add := func(out []Pair, variant Pair) []Pair {
+		if seen[variant.Search] {
+			return out
+		}
+		seen[variant.Search] = true
+		return append(out, variant)
+	}
+
+	var out []Pair
+	for _, pair := range pairs {
+		out = append(out, pair)
+		if urlEncoded {
+			search := percentEncode(pair.Search)
+			out = add(out, Pair{Search: search, Replace: percentEncode(pair.Replace),
+				variant: variantURLEncoded, variantExpr: percentPattern(search)})
+		}
+		if htmlEntities {
+			out = add(out, Pair{Search: entityEncode(pair.Search), Replace: htmlEscape(pair.Replace),
+				variant: variantHTMLEntities, variantExpr: entityPattern(pair.Search)})
+		}
+	}
+	return out
+}
+
+// percentEncode encodes every byte of s except the RFC 3986 unreserved
+// characters as %XX, as PHP's rawurlencode and JavaScript's
+// encodeURIComponent do for URLs.
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// percentPattern returns a regular expression matching the percent-encoded
+// string s with hex digits in either case.
+func percentPattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			b.WriteByte('%')
+			b.WriteString(hexPattern(s[i+1 : i+3]))
+			i += 2
+			continue
+		}
+		b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// hexPattern matches the hex digits of s in either case.
+func hexPattern(s string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(s) {
+		if c >= 'A' && c <= 'F' {
+			fmt.Fprintf(&b, "[%c%c]", c, c+'a'-'A')
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// htmlNamedEntities are the named forms of the characters htmlEscape encodes.
+var htmlNamedEntities = map[rune]string{
+	'&':  "&amp;",
+	'<':  "&lt;",
+	'>':  "&gt;",
+	'"':  "&quot;",
+	'\'': "&#039;",
+}
+
+// entityRef matches a character reference at the start of a string.
+var entityRef = regexp.MustCompile(`^&(?:[A-Za-z][A-Za-z0-9]*|#[0-9]+|#[xX][0-9A-Fa-f]+);`)
+
+// htmlEscape encodes & < > " and ' like PHP's htmlspecialchars with
+// ENT_QUOTES, leaving existing character references alone so nothing is
+// encoded twice.
+func htmlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if ref := entityRef.FindString(s[i:]); ref != "" {
+			b.WriteString(ref)
+			i += len(ref)
+			continue
+		}
+		if entity, ok := htmlNamedEntities[r]; ok {
+			b.WriteString(entity)
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// entityEncode is htmlEscape that also writes non-ASCII characters as
+// decimal references. It names the HTML entity variant of a search string.
+func entityEncode(s string) string {
+	var b strings.Builder
+	for _, r := range htmlEscape(s) {
+		if r >= utf8.RuneSelf {
+			fmt.Fprintf(&b, "&#%d;", r)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// entityPattern returns a regular expression matching s with any of
+// & < > " ', and any non-ASCII character, written literally, as its named
+// entity or as a decimal or hex character reference. Character references
+// already in s are matched as written.
+func entityPattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if ref := entityRef.FindString(s[i:]); ref != "" {
+			b.WriteString(regexp.QuoteMeta(ref))
+			i += len(ref)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		entity, named := htmlNamedEntities[r]
+		if !named && r < utf8.RuneSelf {
+			b.WriteString(regexp.QuoteMeta(s[i : i+size]))
+			i += size
+			continue
+		}
+		alternatives := []string{regexp.QuoteMeta(s[i : i+size])}
+		if named && r != '\'' {
+			alternatives = append(alternatives, regexp.QuoteMeta(entity))
+		}
+		if r == '\'' {
+			alternatives = append(alternatives, "&apos;")
+		}
+		alternatives = append(alternatives,
+			fmt.Sprintf("&#0*%d;", r),
+			fmt.Sprintf("&#[xX]0*%s;", hexPattern(fmt.Sprintf("%X", r))))
+		b.WriteString("(?:" + strings.Join(alternatives, "|") + ")")
+		i += size
+	}
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// VerifyReport is the outcome of Config.Verify: what a read-only scan of the
+// same tables and columns still finds once the run has finished. Remaining
+// is the number of matches: the occurrences in scanned columns, and the
+// values with a match in excluded columns. Tables that could not be scanned
+// again are counted in TablesFailed.
+type VerifyReport struct {
+	Remaining    int           `json:"remaining"`
+	TablesFailed int           `json:"tables_failed"`
+	Matches      []VerifyMatch `json:"matches"`
+}
+
+// VerifyMatch counts the matches left in one column. Reason says why they
+// were left, where known:
+//
+//   - "excluded_column": the column is in ExcludeColumns; Values counts the
+//     values with a match, rather than Occurrences
+//   - "enum_column": the column is an ENUM or SET column, skipped without
+//     IncludeEnum
+//   - "table_failed": the table failed or was interrupted during the run
+//   - "rows_skipped": the run left some of the table's rows alone, having
+//     been rejected by the server, declined, changed since they were read
+//     or identical copies
+//   - "limited": Limit stopped the run's scan of the table
+//   - "oversize_value": the run left values of the table over MaxValueSize
+//     alone, which the verification scans
+//
+// An empty Reason is a match the run should have replaced, such as one a
+// replacement brought back or one written since the row was scanned.
+type VerifyMatch struct {
+	Table       string `json:"table"`
+	Column      string `json:"column,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Occurrences int    `json:"occurrences,omitempty"`
+	Values      int    `json:"values,omitempty"`
+}
+
+// verify scans tables again as CountOnly would, through the primary rather
+// than any replica, and reports the matches left in them. ran holds the
+// run's report entries, which tell some of the reasons.
+func (r *Replacer) verify(ctx context.Context, tables []string, ran []TableReport, config Config) *VerifyReport {
+	vc := config
+	vc.CountOnly = true
+	vc.DryRun = false
+	vc.ServerSide = false
+	vc.IncludeEnum = true
+	vc.Limit = 0
+	vc.MaxValueSize = 0
+	vc.Samples = 0
+	vc.TopValues = 0
+	vc.SleepBetweenChunks = 0
+	vc.MaxUpdatesPerSecond = 0
+	vc.MaxTotalReplacements = 0
+	vc.LockRows = false
+	vc.BackupSuffix = ""
+	vc.OutputSQL, vc.sqlOut = "", nil
+	vc.AuditCSV, vc.audit = "", nil
+	vc.UndoFile, vc.undo = "", nil
+	vc.SnapshotDir, vc.snapshot = "", nil
+	vc.ChangedKeys, vc.ChangedKeysFile, vc.keys = false, "", nil
+	vc.Checkpoint, vc.checkpoint = "", nil
+	vc.readDB, vc.approve, vc.limiter = nil, nil, nil
+	vc.Logger = config.log().With("pass", "verify")
+
+	entries := make(map[string]TableReport, len(ran))
+	for _, entry := range ran {
+		entries[entry.Name] = entry
+	}
+
+	config.log().Info("verifying: scanning the tables again for remaining matches")
+	verify := &VerifyReport{Matches: []VerifyMatch{}}
+	for _, table := range tables {
+		if ctx.Err() != nil {
+			break
+		}
+		result, err := processTable(ctx, r.db, r.db, table, vc)
+		if err != nil {
+			vc.tableLogger(table).Error("could not verify table", "err", err)
+			verify.TablesFailed++
+			continue
+		}
+		enum, err := enumColumns(ctx, r.db, table, config)
+		if err != nil {
+			vc.tableLogger(table).Warn("could not list the ENUM/SET columns", "err", err)
+		}
+		reason := verifyReason(entries[table])
+		for _, column := range sortedKeys(result.Occurrences) {
+			match := VerifyMatch{Table: table, Column: column, Reason: reason, Occurrences: result.Occurrences[column]}
+			if indexOf(enum, column) >= 0 {
+				match.Reason = "enum_column"
+			}
+			verify.Matches = append(verify.Matches, match)
+			verify.Remaining += match.Occurrences
+		}
+		for _, column := range sortedKeys(result.ExcludedMatches) {
+			verify.Matches = append(verify.Matches, VerifyMatch{Table: table, Column: column, Reason: "excluded_column", Values: result.ExcludedMatches[column]})
+			verify.Remaining += result.ExcludedMatches[column]
+		}
+	}
+	sort.SliceStable(verify.Matches, func(i, j int) bool {
+		return verify.Matches[i].Table < verify.Matches[j].Table
+	})
+	return verify
+}
+
+// verifyReason tells, from the run's entry for a table, why matches may have
+// been left in it.
+func verifyReason(entry TableReport) string {
+	switch {
+	case entry.Status == "failed" || entry.Status == "interrupted":
+		return "table_failed"
+	case entry.RejectedRows > 0 || entry.RowsSkipped > 0 || entry.ChangedSinceRead > 0 || entry.DuplicatesSkipped > 0:
+		return "rows_skipped"
+	case entry.Limited:
+		return "limited"
+	case entry.OversizeValues > 0:
+		return "oversize_value"
+	}
+	return ""
+}
+
+// enumColumns returns the ENUM and SET columns of table that the run left
+// out for lacking IncludeEnum.
+func enumColumns(ctx context.Context, db *sql.DB, table string, config Config) ([]string, error) {
+	config, _ = config.forTable(table)
+	schema, err := getColumns(ctx, db, table, config)
+	if err != nil {
+		return nil, err
+	}
+	return selectColumns(table, schema, config).Enum, nil
+}
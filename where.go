@@ -0,0 +1,45 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// errBadField is MySQL's ER_BAD_FIELD_ERROR, for a column that does not
+// exist.
+const errBadField = 1054
+
+// tableWhere returns the condition restricting the rows of table: Where
+// and the TableWhere entries whose pattern matches it, in pattern order,
+// ANDed together. It is "" when no condition applies.
+func (c Config) tableWhere(table string) string {
+	var conditions []string
+	if c.Where != "" {
+		conditions = append(conditions, "("+c.Where+")")
+	}
+	patterns := make([]string, 0, len(c.TableWhere))
+	for pattern := range c.TableWhere {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if matchWildcard(pattern, table) {
+			conditions = append(conditions, "("+c.TableWhere[pattern]+")")
+		}
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// checkWhere runs where against table in a query that reads no rows, so
+// that a condition on a column the table lacks, or one the server cannot
+// parse, is found before the scan.
+func checkWhere(ctx context.Context, db *sql.DB, table, where string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT 1 FROM %s WHERE %s LIMIT 0", quoteTable(table), where))
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
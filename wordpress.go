@@ -0,0 +1,120 @@
+package mysqlreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WordPress describes the WordPress installation in a database.
+type WordPress struct {
+	// Prefix is the table prefix, such as "wp_".
+	Prefix  string
+	SiteURL string
+	Home    string
+	// PostsTables are the posts tables of the main site and, on multisite
+	// installs, of every sub-site.
+	PostsTables []string
+}
+
+// DetectWordPress finds the WordPress installation in the database db is
+// connected to. The table prefix is detected from the options table unless
+// prefix is given.
+func DetectWordPress(ctx context.Context, db *sql.DB, prefix string) (*WordPress, error) {
+	tables, _, err := getTables(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		existing[table] = true
+	}
+
+	if prefix == "" {
+		prefixes := wordPressPrefixes(tables, existing)
+		switch len(prefixes) {
+		case 0:
+			return nil, fmt.Errorf("no WordPress options and posts tables found")
+		case 1:
+			prefix = prefixes[0]
+		default:
+			return nil, fmt.Errorf("found several WordPress table prefixes (%s); choose one", strings.Join(prefixes, ", "))
+		}
+	} else if !existing[prefix+"options"] {
+		return nil, fmt.Errorf("table %soptions does not exist", prefix)
+	}
+
+	wp := &WordPress{Prefix: prefix}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT option_name, option_value FROM %s WHERE option_name IN ('siteurl', 'home')", quoteIdent(prefix+"options")))
+	if err != nil {
+		return nil, fmt.Errorf("reading %soptions: %w", prefix, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if name == "siteurl" {
+			wp.SiteURL = value
+		} else {
+			wp.Home = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, table := range tables {
+		if table == prefix+"posts" || isSubsiteTable(table, prefix, "posts") {
+			wp.PostsTables = append(wp.PostsTables, table)
+		}
+	}
+	return wp, nil
+}
+
+// wordPressPrefixes returns the prefixes with both an options and a posts
+// table. The prefixes of multisite sub-sites (wp_2_ beside wp_) are left out.
+func wordPressPrefixes(tables []string, existing map[string]bool) []string {
+	var candidates []string
+	for _, table := range tables {
+		if prefix, ok := strings.CutSuffix(table, "options"); ok && existing[prefix+"posts"] {
+			candidates = append(candidates, prefix)
+		}
+	}
+	var prefixes []string
+	for _, prefix := range candidates {
+		subsite := false
+		for _, other := range candidates {
+			if other != prefix && isSubsiteTable(prefix, other, "") {
+				subsite = true
+			}
+		}
+		if !subsite {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// isSubsiteTable reports whether name is prefix, a sub-site number, an
+// underscore and suffix, like wp_2_posts.
+func isSubsiteTable(name, prefix, suffix string) bool {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	rest, ok = strings.CutSuffix(rest, "_"+suffix)
+	if !ok || rest == "" {
+		return false
+	}
+	for _, c := range rest {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}